@@ -0,0 +1,45 @@
+package subtree
+
+//-------------------
+// Callbacks returning errors
+//-------------------
+
+// MatchE is like Match but the callback returns an error. A non-nil error stops the match and is returned.
+// Matches are visited in subject order.
+func (t *SubjectTree[T]) MatchE(filter []byte, cb func(subject []byte, val *T) error) error {
+	if t == nil || cb == nil {
+		return nil
+	}
+	var err error
+	t.recordMatch(filter)
+	t.matchOrdered(filter, nil, t.guardIter(func(subject []byte, val *T) bool {
+		err = cb(subject, val)
+		return err == nil
+	}))
+	return err
+}
+
+// IterOrderedE is like IterOrdered but the callback returns an error. A non-nil error stops the walk and
+// is returned.
+func (t *SubjectTree[T]) IterOrderedE(cb func(subject []byte, val *T) error) error {
+	return t.iterE(true, cb)
+}
+
+// IterFastE is like IterFast but the callback returns an error. A non-nil error stops the walk and
+// is returned.
+func (t *SubjectTree[T]) IterFastE(cb func(subject []byte, val *T) error) error {
+	return t.iterE(false, cb)
+}
+
+// Internal function to walk all entries until the callback returns an error.
+func (t *SubjectTree[T]) iterE(ordered bool, cb func(subject []byte, val *T) error) error {
+	if t == nil || cb == nil {
+		return nil
+	}
+	var err error
+	t.iterAll(ordered, t.guardIter(func(subject []byte, val *T) bool {
+		err = cb(subject, val)
+		return err == nil
+	}))
+	return err
+}
@@ -0,0 +1,117 @@
+package subtree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//-------------------
+// Applying several changes at once
+//-------------------
+
+// Mutation is a single change to apply with Apply. OpInsert and OpUpdate both insert the value, replacing
+// any existing one, OpDelete deletes the subject and OpEmpty removes everything. The value is ignored for
+// deletes and empties.
+type Mutation[T any] struct {
+	Op      Op
+	Subject []byte
+	Value   T
+}
+
+// Apply applies the mutations in order as a single modification of the tree. The version only advances once,
+// so retained versions, snapshots and read views either see none or all of the mutations, e.g. related
+// subjects like "stream.x.state" and "stream.x.meta" never appear half updated. All mutations are checked
+// before any is applied, and if one is invalid ErrInvalidOp is returned and the tree is left unchanged.
+// Op loggers still see every mutation that changed the tree.
+func (t *SubjectTree[T]) Apply(muts []Mutation[T]) error {
+	if t == nil {
+		return ErrInvalidOp
+	}
+	for i := range muts {
+		if err := muts[i].check(); err != nil {
+			return fmt.Errorf("%w at %d", err, i)
+		}
+	}
+	t.asOneVersion(len(muts), func(i int) {
+		switch m := &muts[i]; m.Op {
+		case OpInsert, OpUpdate:
+			t.Insert(m.Subject, m.Value)
+		case OpDelete:
+			t.Delete(m.Subject)
+		case OpEmpty:
+			t.Empty()
+		}
+	})
+	return nil
+}
+
+// asOneVersion calls apply with 0 to n-1, each making a change to the tree, as a single modification. The
+// first change retains the version before it, the rest is written to the nodes it copied.
+func (t *SubjectTree[T]) asOneVersion(n int, apply func(i int)) {
+	retain, start := t.retain, t.version
+	defer func() { t.retain = retain }()
+	for i := range n {
+		apply(i)
+		if t.version != start {
+			t.retain = 0
+		}
+	}
+	if t.version != start {
+		t.version = start + 1
+	}
+}
+
+// check returns an error if the mutation can not be applied.
+func (m *Mutation[T]) check() error {
+	switch m.Op {
+	case OpInsert, OpUpdate:
+		if len(m.Subject) == 0 || bytes.IndexByte(m.Subject, noPivot) >= 0 {
+			return fmt.Errorf("%w: %v requires a valid subject", ErrInvalidOp, m.Op)
+		}
+	case OpDelete:
+		if len(m.Subject) == 0 {
+			return fmt.Errorf("%w: %v requires a subject", ErrInvalidOp, m.Op)
+		}
+	case OpEmpty:
+	default:
+		return fmt.Errorf("%w: %v", ErrInvalidOp, m.Op)
+	}
+	return nil
+}
+
+// Apply applies the mutations in order while holding the write lock, so readers see none or all of them.
+// See SubjectTree.Apply. With striped locks the locks of all stripes are held.
+func (s *SafeSubjectTree[T]) Apply(muts []Mutation[T]) error {
+	if len(s.stripes) == 1 {
+		st := &s.stripes[0]
+		st.lock()
+		defer st.mu.Unlock()
+		return st.t.Apply(muts)
+	}
+	for i := range muts {
+		if err := muts[i].check(); err != nil {
+			return fmt.Errorf("%w at %d", err, i)
+		}
+	}
+	s.lockAll()
+	defer s.unlockAll()
+	// Every stripe applies its own mutations in order, and all of them the empties.
+	per := make(map[*safeStripe[T]][]Mutation[T])
+	for _, m := range muts {
+		if m.Op == OpEmpty {
+			for i := range s.stripes {
+				st := &s.stripes[i]
+				per[st] = append(per[st], m)
+			}
+		} else {
+			st := s.stripe(m.Subject)
+			per[st] = append(per[st], m)
+		}
+	}
+	for st, muts := range per {
+		if err := st.t.Apply(muts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,413 @@
+package subtree
+
+import (
+	"bytes"
+	"math"
+)
+
+//-------------------
+// Arena backed trees
+//-------------------
+
+// ArenaSubjectTree is a modifiable SubjectTree using the memory layout of FrozenSubjectTree: nodes, child
+// keys, leaves, values, prefixes and suffixes live in a few flat arrays and reference each other through
+// 32-bit offsets instead of 16 byte interface values. An internal node costs 16 bytes plus 5 bytes for each
+// child it has room for, where a node256 costs over 4KB, and the garbage collector has only a handful of
+// objects to scan, which matters most for trees of tens of millions of entries that are bound by memory.
+// Children are kept in blocks with room for 4, 8 and so on up to 256 of them, moved to a larger block when
+// full and to a smaller one when down to a quarter. Blocks, nodes and leaves freed by deletes are reused
+// by later inserts, and the bytes of prefixes and suffixes no longer used are compacted once they make up
+// more than half of all of them. None of the options of a SubjectTree apply.
+// The limits are 2^31 nodes and leaves and 4GB of prefixes and suffixes, past which an insert panics with
+// ErrTooLarge. An ArenaSubjectTree is not safe for concurrent use.
+type ArenaSubjectTree[T any] struct {
+	f          FrozenSubjectTree[T]   // The layout, with blocks of children that can have room to spare
+	classes    []uint8                // Size class of the block of each node
+	freeBlocks [arenaClasses][]uint32 // First indexes of unused blocks by size class
+	freeNodes  []uint32               // Unused nodes
+	freeLeaves []uint32               // Unused leaves and values
+	live       int                    // Bytes of data used by prefixes and suffixes
+	size       int                    // Number of entries
+}
+
+// Blocks of children have room for arenaMinBlock << class of them.
+const (
+	arenaMinBlock = 4
+	arenaClasses  = 7
+)
+
+// arenaMinCompact is the least amount of data that is compacted, below it the garbage costs nothing to keep.
+const arenaMinCompact = 4096
+
+// NewArenaSubjectTree creates a new, empty ArenaSubjectTree with values T.
+func NewArenaSubjectTree[T any]() *ArenaSubjectTree[T] {
+	return &ArenaSubjectTree[T]{f: FrozenSubjectTree[T]{root: noRef}}
+}
+
+// Size returns the number of elements stored.
+func (a *ArenaSubjectTree[T]) Size() int {
+	if a == nil {
+		return 0
+	}
+	return a.size
+}
+
+// Empty removes all entries and releases the arrays, returning the tree.
+func (a *ArenaSubjectTree[T]) Empty() *ArenaSubjectTree[T] {
+	if a == nil {
+		return NewArenaSubjectTree[T]()
+	}
+	*a = ArenaSubjectTree[T]{f: FrozenSubjectTree[T]{root: noRef}}
+	return a
+}
+
+// Insert a value into the tree. Will return if the value was updated and if so the old value.
+// The returned old value is a copy and no longer part of the tree.
+func (a *ArenaSubjectTree[T]) Insert(subject []byte, value T) (*T, bool) {
+	if a == nil || bytes.IndexByte(subject, noPivot) >= 0 {
+		return nil, false
+	}
+	root, old, updated := a.insert(a.f.root, subject, value, 0)
+	a.f.root = root
+	if !updated {
+		a.size++
+	}
+	a.compactIfNeeded()
+	return old, updated
+}
+
+// Find will find the value and return it or false if it was not found.
+// The returned pointer refers to the value stored in the tree, and is only valid until the next insert or
+// delete, which can move the values.
+func (a *ArenaSubjectTree[T]) Find(subject []byte) (*T, bool) {
+	if a == nil {
+		return nil, false
+	}
+	return a.f.Find(subject)
+}
+
+// Delete will delete the subject and return the value if it was deleted.
+func (a *ArenaSubjectTree[T]) Delete(subject []byte) (*T, bool) {
+	if a == nil || a.f.root == noRef {
+		return nil, false
+	}
+	root, old, deleted := a.delete(a.f.root, subject, 0)
+	a.f.root = root
+	if deleted {
+		a.size--
+		a.compactIfNeeded()
+	}
+	return old, deleted
+}
+
+// Match will match against a subject that can have wildcards and invoke the callback func for each matched value.
+// The callback must not modify the tree.
+func (a *ArenaSubjectTree[T]) Match(filter []byte, cb func(subject []byte, val *T)) {
+	if a == nil {
+		return
+	}
+	a.f.Match(filter, cb)
+}
+
+// IterOrdered will walk all entries lexographically. The callback can return false to terminate the walk.
+// The callback must not modify the tree.
+func (a *ArenaSubjectTree[T]) IterOrdered(cb func(subject []byte, val *T) bool) {
+	if a == nil {
+		return
+	}
+	a.f.IterOrdered(cb)
+}
+
+// IterFast will walk all entries with no guarantees of ordering. The callback can return false to terminate the walk.
+// For an arena tree this is the same as IterOrdered.
+func (a *ArenaSubjectTree[T]) IterFast(cb func(subject []byte, val *T) bool) {
+	a.IterOrdered(cb)
+}
+
+// Internal recursive function to insert the value below ref, returning the reference that replaces ref.
+func (a *ArenaSubjectTree[T]) insert(ref uint32, subject []byte, value T, si int) (uint32, *T, bool) {
+	f := &a.f
+	if ref == noRef {
+		return a.newLeaf(subject[si:], value), nil, false
+	}
+	if ref&frozenLeafBit != 0 {
+		li := ref &^ frozenLeafBit
+		suffix := f.frag(f.leaves[li])
+		if string(suffix) == string(subject[si:]) {
+			old := f.values[li]
+			f.values[li] = value
+			return ref, &old, true
+		}
+		// Split the leaf below a new node holding the part both have in common, which can not be all of
+		// both, so the two get different pivots.
+		cpi := commonPrefixLen(suffix, subject[si:])
+		span := f.leaves[li]
+		nn := a.newNode(frozenSpan{span.off, uint32(cpi)})
+		f.leaves[li] = frozenSpan{span.off + uint32(cpi), span.len - uint32(cpi)}
+		a.addChild(nn, pivot(suffix, cpi), ref)
+		a.addChild(nn, pivot(subject, si+cpi), a.newLeaf(subject[si+cpi:], value))
+		return nn, nil, false
+	}
+	span := f.nodes[ref].prefix
+	prefix := f.frag(span)
+	cpi := commonPrefixLen(prefix, subject[si:])
+	if cpi < len(prefix) {
+		// Split the prefix, putting a new node holding the part in common above this one.
+		nn := a.newNode(frozenSpan{span.off, uint32(cpi)})
+		f.nodes[ref].prefix = frozenSpan{span.off + uint32(cpi), span.len - uint32(cpi)}
+		a.addChild(nn, prefix[cpi], ref)
+		a.addChild(nn, pivot(subject, si+cpi), a.newLeaf(subject[si+cpi:], value))
+		return nn, nil, false
+	}
+	si += len(prefix)
+	p := pivot(subject, si)
+	ci := f.findChild(&f.nodes[ref], p)
+	if ci == noRef {
+		a.addChild(ref, p, a.newLeaf(subject[si:], value))
+		return ref, nil, false
+	}
+	// Our block stays where it is while the child is inserted into, so its slot can be written after.
+	slot := a.slot(ref, p)
+	cref, old, updated := a.insert(ci, subject, value, si)
+	f.refs[slot] = cref
+	return ref, old, updated
+}
+
+// Internal recursive function to delete the subject below ref, returning the reference that replaces ref.
+func (a *ArenaSubjectTree[T]) delete(ref uint32, subject []byte, si int) (uint32, *T, bool) {
+	f := &a.f
+	if ref&frozenLeafBit != 0 {
+		li := ref &^ frozenLeafBit
+		if string(f.frag(f.leaves[li])) != string(subject[si:]) {
+			return ref, nil, false
+		}
+		old := f.values[li]
+		a.freeLeaf(li)
+		return noRef, &old, true
+	}
+	prefix := f.frag(f.nodes[ref].prefix)
+	if end := si + len(prefix); end > len(subject) || string(subject[si:end]) != string(prefix) {
+		return ref, nil, false
+	}
+	si += len(prefix)
+	p := pivot(subject, si)
+	ci := f.findChild(&f.nodes[ref], p)
+	if ci == noRef {
+		return ref, nil, false
+	}
+	slot := a.slot(ref, p)
+	cref, old, deleted := a.delete(ci, subject, si)
+	if !deleted {
+		return ref, nil, false
+	}
+	if cref != noRef {
+		f.refs[slot] = cref
+		return ref, old, true
+	}
+	a.deleteChild(ref, p)
+	switch f.nodes[ref].count {
+	case 0:
+		a.freeNode(ref)
+		return noRef, old, true
+	case 1:
+		// Collapse into the only child left, which takes our prefix in front of its own path.
+		only := f.refs[f.nodes[ref].first]
+		a.setPath(only, a.concat(f.nodes[ref].prefix, a.pathSpan(only)))
+		f.nodes[ref].prefix = frozenSpan{}
+		a.freeNode(ref)
+		return only, old, true
+	}
+	return ref, old, true
+}
+
+// slot returns the index in keys and refs of the child of node ref for key c, which must exist.
+func (a *ArenaSubjectTree[T]) slot(ref uint32, c byte) int {
+	fn := &a.f.nodes[ref]
+	return int(fn.first) + bytes.IndexByte(a.f.keys[fn.first:fn.first+fn.count], c)
+}
+
+// pathSpan returns the span of the prefix or suffix of a reference.
+func (a *ArenaSubjectTree[T]) pathSpan(ref uint32) frozenSpan {
+	if ref&frozenLeafBit != 0 {
+		return a.f.leaves[ref&^frozenLeafBit]
+	}
+	return a.f.nodes[ref].prefix
+}
+
+// setPath sets the span of the prefix or suffix of a reference.
+func (a *ArenaSubjectTree[T]) setPath(ref uint32, span frozenSpan) {
+	if ref&frozenLeafBit != 0 {
+		a.f.leaves[ref&^frozenLeafBit] = span
+	} else {
+		a.f.nodes[ref].prefix = span
+	}
+}
+
+// span copies b into the data array and returns its range.
+func (a *ArenaSubjectTree[T]) span(b []byte) frozenSpan {
+	if len(a.f.data)+len(b) > math.MaxUint32 {
+		panic(ErrTooLarge)
+	}
+	span := frozenSpan{uint32(len(a.f.data)), uint32(len(b))}
+	a.f.data = append(a.f.data, b...)
+	a.live += len(b)
+	return span
+}
+
+// concat copies the bytes of two spans into a new one, which takes their place among the bytes in use.
+func (a *ArenaSubjectTree[T]) concat(x, y frozenSpan) frozenSpan {
+	if len(a.f.data)+int(x.len)+int(y.len) > math.MaxUint32 {
+		panic(ErrTooLarge)
+	}
+	span := frozenSpan{uint32(len(a.f.data)), x.len + y.len}
+	// Appending can move the data, so take the second span only once the first is in.
+	a.f.data = append(a.f.data, a.f.frag(x)...)
+	a.f.data = append(a.f.data, a.f.frag(y)...)
+	return span
+}
+
+// newLeaf returns the reference of a new leaf, reusing a freed one if there is any.
+func (a *ArenaSubjectTree[T]) newLeaf(suffix []byte, value T) uint32 {
+	f := &a.f
+	span := a.span(suffix)
+	if n := len(a.freeLeaves); n > 0 {
+		li := a.freeLeaves[n-1]
+		a.freeLeaves = a.freeLeaves[:n-1]
+		f.leaves[li], f.values[li] = span, value
+		return li | frozenLeafBit
+	}
+	if len(f.leaves) >= int(frozenLeafBit) {
+		panic(ErrTooLarge)
+	}
+	f.leaves, f.values = append(f.leaves, span), append(f.values, value)
+	return uint32(len(f.leaves)-1) | frozenLeafBit
+}
+
+// freeLeaf releases a leaf for reuse, dropping its value so it can be collected.
+func (a *ArenaSubjectTree[T]) freeLeaf(li uint32) {
+	var zero T
+	a.live -= int(a.f.leaves[li].len)
+	a.f.leaves[li], a.f.values[li] = frozenSpan{}, zero
+	a.freeLeaves = append(a.freeLeaves, li)
+}
+
+// newNode returns the reference of a new node without children, reusing a freed one if there is any.
+// The prefix is a span already in use, which the node takes over.
+func (a *ArenaSubjectTree[T]) newNode(prefix frozenSpan) uint32 {
+	f := &a.f
+	fn := frozenNode{prefix: prefix, first: a.block(0)}
+	if n := len(a.freeNodes); n > 0 {
+		ref := a.freeNodes[n-1]
+		a.freeNodes = a.freeNodes[:n-1]
+		f.nodes[ref], a.classes[ref] = fn, 0
+		return ref
+	}
+	if len(f.nodes) >= int(frozenLeafBit) {
+		panic(ErrTooLarge)
+	}
+	f.nodes, a.classes = append(f.nodes, fn), append(a.classes, 0)
+	return uint32(len(f.nodes) - 1)
+}
+
+// freeNode releases a node and its block for reuse. The children must have been moved or released.
+func (a *ArenaSubjectTree[T]) freeNode(ref uint32) {
+	fn := &a.f.nodes[ref]
+	a.live -= int(fn.prefix.len)
+	a.freeBlock(fn.first, a.classes[ref])
+	*fn = frozenNode{}
+	a.freeNodes = append(a.freeNodes, ref)
+}
+
+// block returns the first index of an unused block of the size class, reusing a freed one if there is any.
+func (a *ArenaSubjectTree[T]) block(class uint8) uint32 {
+	f := &a.f
+	if n := len(a.freeBlocks[class]); n > 0 {
+		first := a.freeBlocks[class][n-1]
+		a.freeBlocks[class] = a.freeBlocks[class][:n-1]
+		return first
+	}
+	first, size := len(f.keys), arenaMinBlock<<class
+	if first+size > math.MaxUint32 {
+		panic(ErrTooLarge)
+	}
+	f.keys = append(f.keys, make([]byte, size)...)
+	f.refs = append(f.refs, make([]uint32, size)...)
+	return uint32(first)
+}
+
+// freeBlock releases a block for reuse.
+func (a *ArenaSubjectTree[T]) freeBlock(first uint32, class uint8) {
+	a.freeBlocks[class] = append(a.freeBlocks[class], first)
+}
+
+// moveBlock moves the children of node ref into a new block of the size class.
+func (a *ArenaSubjectTree[T]) moveBlock(ref uint32, class uint8) {
+	first := a.block(class)
+	f := &a.f
+	fn := &f.nodes[ref]
+	copy(f.keys[first:], f.keys[fn.first:fn.first+fn.count])
+	copy(f.refs[first:], f.refs[fn.first:fn.first+fn.count])
+	a.freeBlock(fn.first, a.classes[ref])
+	fn.first, a.classes[ref] = first, class
+}
+
+// addChild adds a child to node ref, keeping the keys of its block sorted.
+func (a *ArenaSubjectTree[T]) addChild(ref uint32, c byte, cref uint32) {
+	if class := a.classes[ref]; a.f.nodes[ref].count == arenaMinBlock<<class {
+		a.moveBlock(ref, class+1)
+	}
+	f := &a.f
+	fn := &f.nodes[ref]
+	keys, refs := f.keys[fn.first:fn.first+fn.count+1], f.refs[fn.first:fn.first+fn.count+1]
+	i := int(fn.count)
+	for ; i > 0 && keys[i-1] > c; i-- {
+		keys[i], refs[i] = keys[i-1], refs[i-1]
+	}
+	keys[i], refs[i] = c, cref
+	fn.count++
+}
+
+// deleteChild removes the child for key c from node ref, moving its children to a smaller block once they
+// only take a quarter of it.
+func (a *ArenaSubjectTree[T]) deleteChild(ref uint32, c byte) {
+	f := &a.f
+	fn := &f.nodes[ref]
+	keys, refs := f.keys[fn.first:fn.first+fn.count], f.refs[fn.first:fn.first+fn.count]
+	i := bytes.IndexByte(keys, c)
+	copy(keys[i:], keys[i+1:])
+	copy(refs[i:], refs[i+1:])
+	fn.count--
+	if class := a.classes[ref]; class > 0 && fn.count <= arenaMinBlock<<class/4 {
+		a.moveBlock(ref, class-1)
+	}
+}
+
+// compactIfNeeded copies the prefixes and suffixes in use into new data once the bytes no longer used make
+// up more than half of it.
+func (a *ArenaSubjectTree[T]) compactIfNeeded() {
+	f := &a.f
+	if len(f.data) < arenaMinCompact || len(f.data)-a.live <= a.live {
+		return
+	}
+	old := f.data
+	f.data = make([]byte, 0, a.live)
+	if f.root != noRef {
+		a.compact(f.root, old)
+	}
+	a.live = len(f.data)
+}
+
+// Internal recursive function to copy the prefixes and suffixes below ref from old into the data.
+func (a *ArenaSubjectTree[T]) compact(ref uint32, old []byte) {
+	f := &a.f
+	span := a.pathSpan(ref)
+	a.setPath(ref, frozenSpan{uint32(len(f.data)), span.len})
+	f.data = append(f.data, old[span.off:span.off+span.len]...)
+	if ref&frozenLeafBit != 0 {
+		return
+	}
+	fn := f.nodes[ref]
+	for _, cref := range f.refs[fn.first : fn.first+fn.count] {
+		a.compact(cref, old)
+	}
+}
@@ -1,8 +1,21 @@
 package subtree
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand/v2"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 //-------------------
@@ -109,6 +122,1825 @@ func TestSubjectTreeNodeGrow(t *testing.T) {
 	require_True(t, ok)
 }
 
+//-------------------
+//  Test for Structural Insert Events
+//-------------------
+
+// Test that inserts report the splits and growth they caused.
+func TestSubjectTreeInsertEvents(t *testing.T) {
+	st := NewSubjectTree[int]()
+	_, _, ev := st.InsertWithEvents(b("foo.bar.A"), 1)
+	require_False(t, ev.Structural())
+	// Splitting the leaf.
+	_, _, ev = st.InsertWithEvents(b("foo.bar.B"), 2)
+	require_Equal(t, ev, InsertEvents{Splits: 1})
+	_, _, ev = st.InsertWithEvents(b("foo.bar.C"), 3)
+	require_False(t, ev.Structural())
+	_, _, ev = st.InsertWithEvents(b("foo.bar.D"), 4)
+	require_False(t, ev.Structural())
+	// The node4 is full and grows.
+	_, _, ev = st.InsertWithEvents(b("foo.bar.E"), 5)
+	require_Equal(t, ev, InsertEvents{Grows: 1})
+	// Splitting the node prefix.
+	_, _, ev = st.InsertWithEvents(b("foo.baz"), 6)
+	require_Equal(t, ev, InsertEvents{Splits: 1})
+	// Updates never change the structure.
+	_, updated, ev := st.InsertWithEvents(b("foo.bar.A"), 7)
+	require_True(t, updated)
+	require_False(t, ev.Structural())
+}
+
+//-------------------
+//  Test for Structural Statistics
+//-------------------
+
+// Test that the tree counts allocations, grows, shrinks, splits and copies.
+func TestSubjectTreeStats(t *testing.T) {
+	st := NewSubjectTree[int]()
+	require_Equal(t, st.Stats(), TreeStats{})
+	for i := 0; i < 5; i++ {
+		st.Insert(b(fmt.Sprintf("foo.bar.%d", i)), i)
+	}
+	stats := st.Stats()
+	require_Equal(t, stats.LeafAllocs, 5)
+	require_Equal(t, stats.Splits, 1)
+	require_Equal(t, stats.Grows, 1)
+	// The node4 from the split and the node10 it grew into.
+	require_Equal(t, stats.NodeAllocs, 2)
+	require_Equal(t, stats.Shrinks, 0)
+	require_True(t, stats.PrefixCopies >= 5)
+
+	// Deleting down to one child shrinks to a node4 and then collapses it.
+	for i := 0; i < 4; i++ {
+		st.Delete(b(fmt.Sprintf("foo.bar.%d", i)))
+	}
+	stats = st.Stats()
+	require_Equal(t, stats.Shrinks, 2)
+	require_Equal(t, stats.NodeAllocs, 3)
+
+	// Modifying shared nodes copies them.
+	st.Insert(b("foo.baz"), 1)
+	st.Snapshot()
+	stats = st.Stats()
+	st.Insert(b("foo.baz"), 2)
+	after := st.Stats()
+	require_Equal(t, after.Clones-stats.Clones, 2)
+	require_Equal(t, after.LeafAllocs+after.NodeAllocs, stats.LeafAllocs+stats.NodeAllocs+2)
+}
+
+// Test that modifications are counted in the interval they happen in, and old intervals drop out of the ring.
+func TestSubjectTreeChurnRates(t *testing.T) {
+	require_True(t, NewSubjectTree[int]().Stats().Churn == nil)
+
+	st := NewSubjectTree[int](WithChurnRates(time.Second, 3))
+	clock := time.Unix(1000, 0)
+	st.churn.now = func() time.Time { return clock }
+	format := func() string {
+		var parts []string
+		for _, ci := range st.Stats().Churn.Intervals {
+			parts = append(parts, fmt.Sprintf("%d:%d/%d/%d", ci.Start.Unix(), ci.Inserts, ci.Updates, ci.Deletes))
+		}
+		return strings.Join(parts, " ")
+	}
+	require_Equal(t, format(), "1000:0/0/0")
+
+	for i := 0; i < 10; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	clock = clock.Add(1500 * time.Millisecond)
+	st.Insert(b("foo.1"), 11)
+	st.Delete(b("foo.2"))
+	st.Delete(b("foo.nope"))
+	require_Equal(t, format(), "1001:0/1/1 1000:10/0/0")
+	churn := st.Stats().Churn
+	require_Equal(t, churn.Interval, time.Second)
+	require_Equal(t, churn.Intervals[0].Duration, 500*time.Millisecond)
+	require_Equal(t, churn.Intervals[0].DeleteRate(), 2.0)
+	require_Equal(t, churn.Intervals[1].InsertRate(), 10.0)
+
+	// Quiet intervals count as such, Empty counts its subjects as deletes and only keep intervals are kept.
+	clock = clock.Add(2 * time.Second)
+	require_Equal(t, format(), "1003:0/0/0 1002:0/0/0 1001:0/1/1")
+	st.Empty()
+	require_Equal(t, format(), "1003:0/0/9 1002:0/0/0 1001:0/1/1")
+	clock = clock.Add(time.Hour)
+	st.Insert(b("bar"), 1)
+	require_Equal(t, format(), "4603:1/0/0 4602:0/0/0 4601:0/0/0")
+}
+
+//-------------------
+//  Test for Structural Events
+//-------------------
+
+// eventRecorder is an event sink keeping all events.
+type eventRecorder struct {
+	events []Event
+}
+
+func (r *eventRecorder) Event(e Event) {
+	r.events = append(r.events, e)
+}
+
+// Test that structural changes are reported to the event sink.
+func TestSubjectTreeEventSink(t *testing.T) {
+	rec := &eventRecorder{}
+	st := NewSubjectTree[int](WithEventSink(rec))
+	st.Insert(b("foo.bar.0"), 0)
+	require_True(t, slices.Equal(rec.events, []Event{{EventRootSwap, "", "LEAF"}}))
+
+	rec.events = nil
+	for i := 1; i < 5; i++ {
+		st.Insert(b(fmt.Sprintf("foo.bar.%d", i)), i)
+	}
+	require_True(t, slices.Equal(rec.events, []Event{
+		{EventSplit, "LEAF", "NODE4"},
+		{EventRootSwap, "LEAF", "NODE4"},
+		{EventGrow, "NODE4", "NODE10"},
+		{EventRootSwap, "NODE4", "NODE10"},
+	}))
+
+	// Deleting down to one child shrinks to a node4 and then collapses it into the leaf.
+	rec.events = nil
+	for i := 0; i < 4; i++ {
+		st.Delete(b(fmt.Sprintf("foo.bar.%d", i)))
+	}
+	require_True(t, slices.Equal(rec.events, []Event{
+		{EventShrink, "NODE10", "NODE4"},
+		{EventRootSwap, "NODE10", "NODE4"},
+		{EventShrink, "NODE4", "LEAF"},
+		{EventRootSwap, "NODE4", "LEAF"},
+	}))
+	rec.events = nil
+	st.Delete(b("foo.bar.4"))
+	require_True(t, slices.Equal(rec.events, []Event{{EventRootSwap, "LEAF", ""}}))
+
+	// Compacting lazily deleted entries prunes the emptied nodes.
+	rec.events = nil
+	st = NewSubjectTree[int](WithEventSink(rec), WithLazyDelete())
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+	st.Insert(b("zoo"), 3)
+	st.Delete(b("foo.bar"))
+	st.Delete(b("foo.baz"))
+	rec.events = nil
+	st.Compact()
+	var prunes int
+	for _, e := range rec.events {
+		if e.Kind == EventPrune {
+			prunes++
+		}
+	}
+	require_True(t, prunes > 0)
+	require_Equal(t, st.Size(), 1)
+
+	require_Equal(t, EventRootSwap.String(), "ROOT_SWAP")
+	require_Equal(t, EventKind(0).String(), "EventKind(0)")
+
+	// No sink, no events.
+	st = NewSubjectTree[int]()
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+	st.Delete(b("foo.bar"))
+}
+
+//-------------------
+//  Test for Sampling Entries
+//-------------------
+
+// Test that sampling picks distinct live entries uniformly, however the tree is shaped.
+func TestSubjectTreeSample(t *testing.T) {
+	st := NewSubjectTree[int](WithLazyDelete())
+	require_Equal(t, len(st.Sample(5, nil)), 0)
+	// A skewed tree, with most entries below one deep prefix.
+	for i := 0; i < 900; i++ {
+		st.Insert(b(fmt.Sprintf("hot.a.b.c.%d", i)), i)
+	}
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("cold.%d", i)), 900+i)
+	}
+	// Dead entries are never sampled.
+	for i := 0; i < 100; i++ {
+		st.Delete(b(fmt.Sprintf("hot.a.b.c.%d", i)))
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	var hot int
+	for i := 0; i < 1000; i++ {
+		entries := st.Sample(10, rng)
+		require_Equal(t, len(entries), 10)
+		seen := make(map[string]bool)
+		for _, e := range entries {
+			require_False(t, seen[string(e.Subject)])
+			seen[string(e.Subject)] = true
+			v, found := st.Find(e.Subject)
+			require_True(t, found)
+			require_Equal(t, *v, e.Value)
+			if e.Value < 900 {
+				hot++
+			}
+		}
+	}
+	// 800 of the 900 live entries are hot.
+	require_True(t, hot > 8600 && hot < 9200)
+
+	// Asking for more than half, or all, of the entries.
+	require_Equal(t, len(st.Sample(600, rng)), 600)
+	all := st.Sample(5000, rng)
+	require_Equal(t, len(all), 900)
+	seen := make(map[string]bool)
+	for _, e := range all {
+		seen[string(e.Subject)] = true
+	}
+	require_Equal(t, len(seen), 900)
+
+	// The same source gives the same sample.
+	s1 := st.Sample(3, rand.New(rand.NewPCG(7, 7)))
+	s2 := st.Sample(3, rand.New(rand.NewPCG(7, 7)))
+	for i := range s1 {
+		require_Equal(t, string(s1[i].Subject), string(s2[i].Subject))
+	}
+}
+
+// Test that partitions hold about the same number of entries each and cover all subjects in order.
+func TestSubjectTreePartition(t *testing.T) {
+	st := NewSubjectTree[int](WithLazyDelete())
+	require_Equal(t, len(st.Partition(4)), 0)
+	for i := 0; i < 900; i++ {
+		st.Insert(b(fmt.Sprintf("hot.a.b.c.%d", i)), i)
+	}
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("cold.%d", i)), i)
+	}
+	st.Insert(b("hot"), 0)
+	st.Insert(b("hot.a"), 0)
+	// Dead entries are not counted.
+	for i := 0; i < 101; i++ {
+		st.Delete(b(fmt.Sprintf("hot.a.b.c.%d", i)))
+	}
+	subjects := st.Subjects()
+	require_Equal(t, len(subjects), 901)
+	for _, n := range []int{1, 3, 7, 64, 901} {
+		ranges := st.Partition(n)
+		require_Equal(t, len(ranges), n)
+		var next int
+		for _, r := range ranges {
+			require_Equal(t, string(r[0]), string(subjects[next]))
+			var count int
+			for next < len(subjects) && bytes.Compare(subjects[next], r[1]) <= 0 {
+				next++
+				count++
+			}
+			require_Equal(t, string(r[1]), string(subjects[next-1]))
+			require_True(t, count == 901/n || count == 901/n+1)
+		}
+		require_Equal(t, next, len(subjects))
+	}
+	require_Equal(t, len(st.Partition(2000)), 901)
+	require_Equal(t, len(st.Partition(0)), 0)
+}
+
+//-------------------
+//  Test for Profiling Subjects
+//-------------------
+
+// Test the distributions of tokens, token lengths and fanout of the stored subjects.
+func TestSubjectTreeProfile(t *testing.T) {
+	st := NewSubjectTree[int]()
+	require_Equal(t, st.Profile().Subjects, 0)
+	for _, subj := range []string{"a.x.1", "a.x.2", "a.y.1", "bb.z.1", "bb.z.2", "bb.z.3", "ccc"} {
+		st.Insert(b(subj), 0)
+	}
+	p := st.Profile()
+	require_Equal(t, p.Subjects, 7)
+	require_Equal(t, p.Tokens[3], 6)
+	require_Equal(t, p.Tokens[1], 1)
+	require_Equal(t, p.Tokens.Quantile(0.5), 3)
+	require_True(t, p.Tokens.Fraction(3) > 0.85)
+	require_Equal(t, p.TokenLengths.Total(), 19)
+	require_Equal(t, p.TokenLengths[2], 3)
+	require_Equal(t, p.TokenLengths[3], 1)
+	// Three first tokens at the root.
+	require_Equal(t, len(p.Fanout), 3)
+	require_Equal(t, p.Fanout[0][3], 1)
+	// a has x and y, bb only z.
+	require_Equal(t, p.Fanout[1][2], 1)
+	require_Equal(t, p.Fanout[1][1], 1)
+	// a.x has 2, a.y 1 and bb.z 3.
+	require_Equal(t, p.Fanout[2][1], 1)
+	require_Equal(t, p.Fanout[2][2], 1)
+	require_Equal(t, p.Fanout[2][3], 1)
+	require_Equal(t, p.Fanout[2].Total(), 3)
+}
+
+//-------------------
+//  Test for Most Populous Prefixes
+//-------------------
+
+// Test finding the prefixes with the most subjects at a token depth.
+func TestSubjectTreeTopPrefixes(t *testing.T) {
+	st := NewSubjectTree[int](WithLazyDelete())
+	for i := 0; i < 50; i++ {
+		st.Insert(b(fmt.Sprintf("acme.orders.%d", i)), i)
+		st.Insert(b(fmt.Sprintf("acme.billing.%d", i%10)), i)
+		st.Insert(b(fmt.Sprintf("globex.orders.%d", i%20)), i)
+	}
+	st.Insert(b("acme"), 0)
+	st.Insert(b("acme.orders"), 0)
+	st.Insert(b("acmex.orders.1"), 0)
+	// Dead entries are not counted.
+	st.Delete(b("globex.orders.0"))
+
+	format := func(top []PrefixCount) string {
+		var parts []string
+		for _, pc := range top {
+			parts = append(parts, fmt.Sprintf("%s=%d", pc.Prefix, pc.Leaves))
+		}
+		return strings.Join(parts, ",")
+	}
+	require_Equal(t, format(st.TopPrefixes(1, 10)), "acme=62,globex=19,acmex=1")
+	require_Equal(t, format(st.TopPrefixes(1, 2)), "acme=62,globex=19")
+	require_Equal(t, format(st.TopPrefixes(2, 3)), "acme.orders=51,globex.orders=19,acme.billing=10")
+	require_Equal(t, len(st.TopPrefixes(3, 1000)), 50+10+19+1)
+	require_Equal(t, len(st.TopPrefixes(4, 10)), 0)
+	require_Equal(t, len(st.TopPrefixes(0, 10)), 0)
+}
+
+//-------------------
+//  Test for Splitting and Grafting Subtrees
+//-------------------
+
+// Test detaching the subjects under a prefix into their own tree and grafting them back.
+func TestSubjectTreeSplitAtGraft(t *testing.T) {
+	contents := func(st *SubjectTree[int]) string {
+		var entries []string
+		st.IterOrdered(func(subject []byte, v *int) bool {
+			entries = append(entries, fmt.Sprintf("%s=%d", subject, *v))
+			return true
+		})
+		require_Equal(t, len(entries), st.Size())
+		return strings.Join(entries, ",")
+	}
+	build := func() *SubjectTree[int] {
+		st := NewSubjectTree[int]()
+		for i := 0; i < 300; i++ {
+			st.Insert(b(fmt.Sprintf("%s.%s.%d", []string{"acme", "acmex", "globex"}[i%3], []string{"orders", "billing"}[i%2], i)), i)
+		}
+		st.Insert(b("acme"), -1)
+		st.Insert(b("acme.orders"), -2)
+		return st
+	}
+	orig := contents(build())
+
+	for _, prefix := range []string{"acme.", "acme", "acme.orders", "acme.orders.", "acmex.billing.1", "globex.orders.3", "g", "acme.orders.0", ""} {
+		st := build()
+		// Nodes shared with a snapshot must stay intact.
+		snap := st.Snapshot()
+		var follower *SubjectTree[int]
+		if prefix == "acme." {
+			follower = build()
+			st.SetOpLogger(func(op Op, subject []byte, v *int) {
+				require_True(t, follower.ApplyOp(op, subject, v) == nil)
+			})
+		}
+		sub, ok := st.SplitAt(b(prefix))
+		require_True(t, ok)
+		// Everything left does not start with the prefix, and everything split off does without it.
+		st.IterFast(func(subject []byte, _ *int) bool {
+			require_False(t, strings.HasPrefix(string(subject), prefix))
+			return true
+		})
+		sub.IterFast(func(subject []byte, v *int) bool {
+			found, ok := snap.Find(append(b(prefix), subject...))
+			require_True(t, ok)
+			require_Equal(t, *found, *v)
+			return true
+		})
+		require_Equal(t, st.Size()+sub.Size(), 302)
+		if follower != nil {
+			require_Equal(t, contents(follower), contents(st))
+		}
+		// The split off tree is independent.
+		sub.Insert(b("new"), 1)
+		_, found := st.Find(b(prefix + "new"))
+		require_False(t, found)
+		sub.Delete(b("new"))
+
+		// Grafting back where it came from restores the tree.
+		require_True(t, st.Graft(b(prefix), sub) == nil)
+		require_Equal(t, sub.Size(), 0)
+		require_Equal(t, contents(st), orig)
+		if follower != nil {
+			require_Equal(t, contents(follower), orig)
+		}
+		// The snapshot did not see any of it.
+		var n int
+		snap.IterFast(func(_ []byte, _ *int) bool { n++; return true })
+		require_Equal(t, n, 302)
+	}
+
+	// Nothing to split.
+	st := build()
+	_, ok := st.SplitAt(b("initech"))
+	require_False(t, ok)
+	_, ok = st.SplitAt(b("acme.orders.0.x"))
+	require_False(t, ok)
+
+	// Grafting onto a prefix in use fails and leaves both trees alone.
+	sub, _ := st.SplitAt(b("acme.orders."))
+	require_True(t, st.Graft(b("acme."), sub) == ErrPrefixInUse)
+	require_True(t, st.Graft(b("globex.orders"), sub) == ErrPrefixInUse)
+	require_Equal(t, st.Size()+sub.Size(), 302)
+
+	// Grafting somewhere else moves the subjects.
+	require_True(t, st.Graft(b("initech.orders."), sub) == nil)
+	v, found := st.Find(b("initech.orders.0"))
+	require_True(t, found)
+	require_Equal(t, *v, 0)
+	_, found = st.Find(b("acme.orders.0"))
+	require_False(t, found)
+	require_Equal(t, st.Size(), 302)
+
+	// Dead leaves move along and are compacted away when grafting.
+	st = NewSubjectTree[int](WithLazyDelete())
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+		st.Insert(b(fmt.Sprintf("bar.%d", i)), i)
+	}
+	for i := 0; i < 100; i += 2 {
+		st.Delete(b(fmt.Sprintf("foo.%d", i)))
+	}
+	sub, ok = st.SplitAt(b("foo."))
+	require_True(t, ok)
+	require_Equal(t, sub.Size(), 50)
+	require_Equal(t, st.Size(), 100)
+	require_Equal(t, st.dead, 0)
+	require_Equal(t, sub.dead, 50)
+	require_True(t, st.Graft(b("baz."), sub) == nil)
+	require_Equal(t, st.Size(), 150)
+	require_Equal(t, st.dead+sub.dead, 50)
+	_, found = st.Find(b("baz.0"))
+	require_False(t, found)
+	_, found = st.Find(b("baz.1"))
+	require_True(t, found)
+}
+
+// Test moving subjects from one prefix to another, including overlapping ones.
+func TestSubjectTreeMovePrefix(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("orders.%d.new", i)), i)
+		st.Insert(b(fmt.Sprintf("billing.%d", i)), i)
+	}
+	st.Insert(b("orders"), -1)
+	check := func(format string, from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			v, found := st.Find(b(fmt.Sprintf(format, i)))
+			require_True(t, found)
+			require_Equal(t, *v, i)
+		}
+	}
+
+	moved, err := st.MovePrefix(b("orders."), b("archive.orders."))
+	require_True(t, err == nil)
+	require_Equal(t, moved, 100)
+	require_Equal(t, st.Size(), 201)
+	check("archive.orders.%d.new", 0, 100)
+	_, found := st.Find(b("orders.1.new"))
+	require_False(t, found)
+	_, found = st.Find(b("orders"))
+	require_True(t, found)
+
+	// Overlapping prefixes, both ways.
+	moved, err = st.MovePrefix(b("archive."), b("archive.old."))
+	require_True(t, err == nil)
+	require_Equal(t, moved, 100)
+	check("archive.old.orders.%d.new", 0, 100)
+	moved, err = st.MovePrefix(b("archive.old."), b("archive."))
+	require_True(t, err == nil)
+	require_Equal(t, moved, 100)
+	check("archive.orders.%d.new", 0, 100)
+
+	// Subjects in the way fail without changing anything.
+	_, err = st.MovePrefix(b("archive.orders."), b("billing."))
+	require_True(t, err == ErrPrefixInUse)
+	_, err = st.MovePrefix(b("archive.orders.1"), b("archive."))
+	require_True(t, err == ErrPrefixInUse)
+	check("archive.orders.%d.new", 0, 100)
+	check("billing.%d", 0, 100)
+	require_Equal(t, st.Size(), 201)
+
+	// Nothing to move, or nowhere to go.
+	moved, err = st.MovePrefix(b("shipping."), b("billing."))
+	require_True(t, err == nil)
+	require_Equal(t, moved, 0)
+	moved, err = st.MovePrefix(b("billing."), b("billing."))
+	require_True(t, err == nil)
+	require_Equal(t, moved, 100)
+	check("billing.%d", 0, 100)
+}
+
+// Test that the prefixes of splits, grafts, moves and views are folded like subjects.
+func TestSubjectTreeSplitCanon(t *testing.T) {
+	st := NewSubjectTree[int](WithUnicodeFold())
+	st.Insert(b("Foo.Caf\u00e9.1"), 1)
+	st.Insert(b("foo.bar.2"), 2)
+	st.Insert(b("bar.3"), 3)
+
+	require_Equal(t, st.View(b("FOO")).Size(), 2)
+	require_Equal(t, st.View(b("foo.CAFE\u0301")).Size(), 1)
+
+	nt, ok := st.SplitAt(b("FOO.CAF\u00c9."))
+	require_True(t, ok)
+	require_Equal(t, nt.Size(), 1)
+	require_Equal(t, st.Size(), 2)
+	require_True(t, st.Graft(b("Foo.cafe\u0301."), nt) == nil)
+	v, found := st.Find(b("foo.caf\u00e9.1"))
+	require_True(t, found)
+	require_Equal(t, *v, 1)
+
+	moved, err := st.MovePrefix(b("FOO.Bar."), b("Baz."))
+	require_True(t, err == nil)
+	require_Equal(t, moved, 1)
+	_, found = st.Find(b("baz.2"))
+	require_True(t, found)
+	moved, err = st.MovePrefix(b("FOO."), b("BAR."))
+	require_True(t, err == ErrPrefixInUse)
+	require_Equal(t, moved, 0)
+	require_Equal(t, st.Size(), 3)
+}
+
+// Test extracting the matching entries into a tree of their own.
+func TestSubjectTreeExtractMatching(t *testing.T) {
+	st := NewSubjectTree[*int](WithLazyDelete())
+	for i := 0; i < 100; i++ {
+		v := i
+		st.Insert(b(fmt.Sprintf("foo.%d.bar", i)), &v)
+		st.Insert(b(fmt.Sprintf("foo.%d.baz", i)), &v)
+	}
+	st.Delete(b("foo.0.bar"))
+
+	et := st.ExtractMatching(b("foo.*.bar"))
+	require_Equal(t, et.Size(), 99)
+	require_Equal(t, st.Size(), 199)
+	_, found := et.Find(b("foo.0.bar"))
+	require_False(t, found)
+	v, found := et.Find(b("foo.42.bar"))
+	require_True(t, found)
+	require_Equal(t, **v, 42)
+	// Values are shared, entries are not.
+	sv, _ := st.Find(b("foo.42.bar"))
+	require_True(t, *sv == *v)
+	et.Delete(b("foo.42.bar"))
+	_, found = st.Find(b("foo.42.bar"))
+	require_True(t, found)
+	require_True(t, et.opts.lazyDelete)
+
+	require_Equal(t, st.ExtractMatching(b("bar.>")).Size(), 0)
+	require_Equal(t, st.ExtractMatching(b(">")).Size(), 199)
+}
+
+// Test that trees split off or extracted have what their options ask for, like IDs and indexes.
+func TestSubjectTreeSplitExtractOptions(t *testing.T) {
+	st := NewSubjectTree[int](WithEntryIDs(), WithSuffixIndex(), WithTokenIndex(1),
+		WithValueDedup(func(v int) uint64 { return uint64(v) }, func(a, b int) bool { return a == b }))
+	for i := 0; i < 10; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar", i)), i)
+		st.Insert(b(fmt.Sprintf("baz.%d.bar", i)), i)
+	}
+	check := func(nt *SubjectTree[int], first string) {
+		t.Helper()
+		require_Equal(t, nt.Size(), 10)
+		require_True(t, nt.Config().EntryIDs)
+		id, ok := nt.IDOf(b(first + ".3.bar"))
+		require_True(t, ok)
+		subject, v, ok := nt.FindByID(id)
+		require_True(t, ok)
+		require_Equal(t, string(subject), first+".3.bar")
+		require_Equal(t, *v, 3)
+		require_True(t, nt.suffixes != nil && nt.tokens != nil && nt.dedup != nil)
+		require_Equal(t, nt.suffixes.Size(), 10)
+		var n int
+		nt.MatchSuffix(b("3.bar"), func(_ []byte, _ *int) { n++ })
+		require_Equal(t, n, 1)
+		n = 0
+		nt.MatchTokenAt(1, b("4"), func(_ []byte, _ *int) { n++ })
+		require_Equal(t, n, 1)
+		// New entries get IDs and are indexed too.
+		nt.Insert(b(first+".x.bar"), 3)
+		_, ok = nt.IDOf(b(first + ".x.bar"))
+		require_True(t, ok)
+		require_Equal(t, nt.suffixes.Size(), 11)
+	}
+
+	et := st.ExtractMatching(b("foo.>"))
+	check(et, "foo")
+	// Extracted entries are inserted again, so they get IDs of their own.
+	sid, _ := st.IDOf(b("foo.3.bar"))
+	eid, _ := et.IDOf(b("foo.3.bar"))
+	require_True(t, sid != eid)
+
+	nt, ok := st.SplitAt(b("baz."))
+	require_True(t, ok)
+	// Subjects moved by the split keep their IDs.
+	rid, _ := nt.IDOf(b("3.bar"))
+	require_True(t, rid != 0)
+	require_True(t, nt.dedup != nil)
+	require_Equal(t, nt.suffixes.Size(), 10)
+	var n int
+	nt.MatchTokenAt(1, b("bar"), func(_ []byte, _ *int) { n++ })
+	require_Equal(t, n, 10)
+	require_Equal(t, st.Size(), 10)
+	require_Equal(t, st.suffixes.Size(), 10)
+	require_True(t, st.Graft(b("qux."), nt) == nil)
+	gid, ok := st.IDOf(b("qux.3.bar"))
+	require_True(t, ok)
+	require_Equal(t, gid, rid)
+}
+
+//-------------------
+//  Test for Collecting Subjects and Values
+//-------------------
+
+// Test collecting all subjects and values, and collecting them page by page.
+func TestSubjectTreeSubjectsValues(t *testing.T) {
+	st := NewSubjectTree[int]()
+	require_Equal(t, len(st.Subjects()), 0)
+	require_Equal(t, len(st.Values()), 0)
+	for i := 0; i < 50; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%02d", 49-i)), 49-i)
+	}
+	st.Insert(b("foo"), -1)
+
+	subjects, vals := st.Subjects(), st.Values()
+	require_Equal(t, len(subjects), 51)
+	require_Equal(t, len(vals), 51)
+	require_Equal(t, string(subjects[0]), "foo")
+	require_Equal(t, vals[0], -1)
+	for i := 1; i < 51; i++ {
+		// Every subject has memory of its own.
+		require_Equal(t, string(subjects[i]), fmt.Sprintf("foo.%02d", i-1))
+		require_Equal(t, vals[i], i-1)
+	}
+
+	// Page through both.
+	var all [][]byte
+	for page := st.SubjectsPage(nil, 7); len(page) > 0; page = st.SubjectsPage(page[len(page)-1], 7) {
+		require_True(t, len(page) <= 7)
+		all = append(all, page...)
+	}
+	require_Equal(t, len(all), 51)
+	for i := range all {
+		require_True(t, bytes.Equal(all[i], subjects[i]))
+	}
+	var allVals []int
+	for page, last := st.ValuesPage(nil, 10); len(page) > 0; page, last = st.ValuesPage(last, 10) {
+		allVals = append(allVals, page...)
+	}
+	require_Equal(t, len(allVals), 51)
+	for i := range allVals {
+		require_Equal(t, allVals[i], vals[i])
+	}
+	require_Equal(t, len(st.SubjectsPage(b("foo.25"), 0)), 24)
+	require_Equal(t, len(st.SubjectsPage(b("zzz"), 0)), 0)
+}
+
+//-------------------
+//  Test for Entries
+//-------------------
+
+// Test inserting, collecting, matching and diffing entries.
+func TestSubjectTreeEntries(t *testing.T) {
+	st := NewSubjectTree[int]()
+	var entries []Entry[int]
+	for i := 0; i < 30; i++ {
+		entries = append(entries, Entry[int]{Subject: b(fmt.Sprintf("foo.%02d", i)), Value: i})
+	}
+	entries = append(entries, Entry[int]{Subject: b("foo.00"), Value: 100})
+	require_Equal(t, st.InsertEntries(entries), 30)
+	v, _ := st.Find(b("foo.00"))
+	require_Equal(t, *v, 100)
+
+	all := st.Entries()
+	require_Equal(t, len(all), 30)
+	for i, e := range all {
+		require_Equal(t, string(e.Subject), fmt.Sprintf("foo.%02d", i))
+	}
+	page := st.EntriesPage(all[9].Subject, 5)
+	require_Equal(t, len(page), 5)
+	require_Equal(t, string(page[0].Subject), "foo.10")
+	require_Equal(t, page[4].Value, 14)
+
+	dst := st.MatchAppend(nil, b("foo.1x"))
+	require_Equal(t, len(dst), 0)
+	dst = st.MatchAppend(dst, b("foo.*"))
+	dst = st.MatchAppend(dst, b("foo.29"))
+	require_Equal(t, len(dst), 31)
+	require_Equal(t, string(dst[30].Subject), "foo.29")
+	require_True(t, &dst[29].Subject[0] != &dst[30].Subject[0])
+
+	other := NewSubjectTree[int]()
+	other.InsertEntries(all[1:])
+	other.Insert(b("foo.01"), -1)
+	other.Insert(b("bar"), 1)
+	removed, added, changed := st.DiffEntries(other, func(a, b int) bool { return a == b })
+	require_Equal(t, len(removed), 1)
+	require_Equal(t, string(removed[0].Subject), "foo.00")
+	require_Equal(t, len(added), 1)
+	require_Equal(t, string(added[0].Subject), "bar")
+	require_Equal(t, len(changed), 1)
+	require_Equal(t, changed[0].Value, -1)
+}
+
+// Test that deleting an entry reports the entry, its stamp and the structural changes.
+func TestSubjectTreeDeleteEntry(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 5; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	e, deleted, events := st.DeleteEntry(b("foo.3"))
+	require_True(t, deleted)
+	require_Equal(t, string(e.Subject), "foo.3")
+	require_Equal(t, e.Value, 3)
+	// From a node10 down to a node4.
+	require_Equal(t, events.Shrinks, 1)
+	require_False(t, events.Stamped)
+	_, deleted, events = st.DeleteEntry(b("foo.3"))
+	require_False(t, deleted)
+	require_Equal(t, events, DeleteEvents{})
+	_, _, events = st.DeleteEntry(b("foo.2"))
+	require_Equal(t, events.Shrinks, 0)
+
+	// Stamps of the last write.
+	st = NewSubjectTree[int]()
+	st.EnableLWW(7, StampLamport)
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+	stamp, _ := st.StampOf(b("foo.baz"))
+	_, deleted, events = st.DeleteEntry(b("foo.baz"))
+	require_True(t, deleted)
+	require_True(t, events.Stamped)
+	require_Equal(t, events.Stamp, stamp)
+	require_Equal(t, events.Stamp.Replica, 7)
+	// The parent collapsed into the remaining leaf.
+	require_Equal(t, events.Shrinks, 1)
+
+	// Lazy deletes, the last one compacting.
+	st = NewSubjectTree[int](WithLazyDelete(), WithCompactThreshold(0.5))
+	for i := 0; i < 4; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	_, _, events = st.DeleteEntry(b("foo.0"))
+	require_True(t, events.Lazy)
+	require_False(t, events.Compacted)
+	require_Equal(t, events.Shrinks, 0)
+	st.DeleteEntry(b("foo.1"))
+	e, _, events = st.DeleteEntry(b("foo.2"))
+	require_Equal(t, e.Value, 2)
+	require_True(t, events.Compacted)
+	require_Equal(t, st.Size(), 1)
+}
+
+// Test deleting only when a predicate holds for the current value.
+func TestSubjectTreeDeleteIf(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+	even := func(v int) bool { return v%2 == 0 }
+	_, deleted := st.DeleteIf(b("foo.bar"), even)
+	require_False(t, deleted)
+	v, deleted := st.DeleteIf(b("foo.baz"), even)
+	require_True(t, deleted)
+	require_Equal(t, v, 2)
+	_, deleted = st.DeleteIf(b("foo.baz"), nil)
+	require_False(t, deleted)
+	_, deleted = st.DeleteIf(b("foo.bar"), nil)
+	require_True(t, deleted)
+	require_Equal(t, st.Size(), 0)
+
+	// Concurrent deleters of the same version, only one of them wins.
+	sst := NewSafeSubjectTree[int]()
+	sst.Insert(b("lock"), 1)
+	var wg sync.WaitGroup
+	var wins atomic.Int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, deleted := sst.DeleteIf(b("lock"), func(v int) bool { return v == 1 }); deleted {
+				wins.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	require_Equal(t, wins.Load(), 1)
+}
+
+// Test that exports stream entries in subject order, resume after a subject and import back.
+func TestSubjectTreeExportEntries(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 500; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%7, i)), i)
+	}
+	var exported []Entry[int]
+	require_True(t, st.ExportEntries(func(subject []byte, v int) error {
+		exported = append(exported, Entry[int]{Subject: copyBytes(subject), Value: v})
+		return nil
+	}) == nil)
+	require_Equal(t, len(exported), 500)
+	require_True(t, slices.IsSortedFunc(exported, func(a, b Entry[int]) int { return bytes.Compare(a.Subject, b.Subject) }))
+
+	// An export stopped by an error resumes after the last subject it got to.
+	stop := errors.New("stop")
+	var resumed []Entry[int]
+	err := st.ExportEntries(func(subject []byte, v int) error {
+		if len(resumed) == 200 {
+			return stop
+		}
+		resumed = append(resumed, Entry[int]{Subject: copyBytes(subject), Value: v})
+		return nil
+	})
+	require_True(t, err == stop)
+	require_True(t, st.ExportEntriesAfter(resumed[len(resumed)-1].Subject, func(subject []byte, v int) error {
+		resumed = append(resumed, Entry[int]{Subject: copyBytes(subject), Value: v})
+		return nil
+	}) == nil)
+	require_Equal(t, fmt.Sprint(resumed), fmt.Sprint(exported))
+
+	// Importing the stream rebuilds the tree, stopping at entries out of order.
+	source := func(entries []Entry[int]) func() ([]byte, int, error) {
+		return func() ([]byte, int, error) {
+			if len(entries) == 0 {
+				return nil, 0, io.EOF
+			}
+			e := entries[0]
+			entries = entries[1:]
+			return e.Subject, e.Value, nil
+		}
+	}
+	it := NewSubjectTree[int]()
+	n, err := it.ImportEntries(source(exported))
+	require_True(t, err == nil)
+	require_Equal(t, n, 500)
+	require_True(t, it.Equal(st, func(a, b int) bool { return a == b }))
+	it = NewSubjectTree[int]()
+	shuffled := slices.Concat(exported[:10], exported[20:21], exported[10:20])
+	n, err = it.ImportEntries(source(shuffled))
+	require_True(t, errors.Is(err, ErrOutOfOrder))
+	require_Equal(t, n, 11)
+	require_Equal(t, it.Size(), 11)
+}
+
+// Test that chunked exports cut the entries into disjoint ranges of about the requested size.
+func TestSubjectTreeExportChunks(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%7, i)), i)
+	}
+	var chunks []Chunk[int]
+	require_True(t, st.ExportChunks(1000, func(c Chunk[int]) error {
+		chunks = append(chunks, c)
+		return nil
+	}) == nil)
+	require_True(t, len(chunks) > 10)
+	var all []Entry[int]
+	for i, c := range chunks {
+		require_Equal(t, c.Index, i)
+		require_True(t, c.Bytes <= 1000)
+		if i < len(chunks)-1 {
+			require_True(t, c.Bytes > 900)
+			require_True(t, bytes.Compare(c.Last, chunks[i+1].First) < 0)
+		}
+		require_True(t, bytes.Equal(c.First, c.Entries[0].Subject))
+		require_True(t, bytes.Equal(c.Last, c.Entries[len(c.Entries)-1].Subject))
+		all = append(all, c.Entries...)
+	}
+	require_Equal(t, fmt.Sprint(all), fmt.Sprint(st.Entries()))
+
+	// Entries larger than a chunk get one of their own, and no limit means a single chunk.
+	var sizes []int
+	st.ExportChunks(1, func(c Chunk[int]) error {
+		sizes = append(sizes, len(c.Entries))
+		return nil
+	})
+	require_Equal(t, len(sizes), 1000)
+	require_Equal(t, slices.Max(sizes), 1)
+	sizes = nil
+	st.ExportChunks(0, func(c Chunk[int]) error {
+		sizes = append(sizes, len(c.Entries))
+		return nil
+	})
+	require_True(t, slices.Equal(sizes, []int{1000}))
+
+	// Errors stop the export.
+	stop := errors.New("stop")
+	var emitted int
+	err := st.ExportChunks(1000, func(c Chunk[int]) error {
+		emitted++
+		return stop
+	})
+	require_True(t, err == stop)
+	require_Equal(t, emitted, 1)
+	require_True(t, NewSubjectTree[int]().ExportChunks(1000, func(c Chunk[int]) error { return stop }) == nil)
+}
+
+// Test that chunks imported in parallel merge into the same tree as inserting their entries, including
+// subjects that are prefixes of each other across chunks and entries already in the tree.
+func TestSubjectTreeImportChunks(t *testing.T) {
+	rng := rand.New(rand.NewPCG(5, 6))
+	tokens := []string{"a", "ab", "b", "foo", "foobar", "*", ">"}
+	src := NewSubjectTree[int]()
+	for i := 0; i < 2000; i++ {
+		var subj []string
+		for n := 1 + rng.IntN(4); n > 0; n-- {
+			subj = append(subj, tokens[rng.IntN(len(tokens))])
+		}
+		src.Insert(b(strings.Join(subj, ".")), i)
+	}
+	export := func(st *SubjectTree[int], maxBytes int) <-chan Chunk[int] {
+		var chunks []Chunk[int]
+		st.ExportChunks(maxBytes, func(c Chunk[int]) error {
+			chunks = append(chunks, c)
+			return nil
+		})
+		// Hand them out in any order.
+		rng.Shuffle(len(chunks), func(i, j int) { chunks[i], chunks[j] = chunks[j], chunks[i] })
+		ch := make(chan Chunk[int], len(chunks))
+		for _, c := range chunks {
+			ch <- c
+		}
+		close(ch)
+		return ch
+	}
+	for _, maxBytes := range []int{1, 50, 500, 0} {
+		for _, opts := range [][]Option{nil, {WithMaxPrefix(2)}} {
+			st := NewSubjectTree[int](opts...)
+			n, err := st.ImportChunks(export(src, maxBytes), 4)
+			require_True(t, err == nil)
+			require_Equal(t, n, src.Size())
+			require_True(t, st.Validate() == nil)
+			require_Equal(t, fmt.Sprint(st.Entries()), fmt.Sprint(src.Entries()))
+		}
+	}
+
+	// Chunks are merged where they do not overlap the entries in the tree, and inserted where they do.
+	st := NewSubjectTree[int]()
+	more := NewSubjectTree[int]()
+	expected := NewSubjectTree[int]()
+	src.IterOrdered(func(subject []byte, v *int) bool {
+		if *v%5 == 0 || bytes.HasPrefix(subject, b("foo")) {
+			st.Insert(subject, -*v)
+			expected.Insert(subject, -*v)
+		} else {
+			more.Insert(subject, *v)
+			expected.Insert(subject, *v)
+		}
+		return true
+	})
+	more.Insert(b("foo.a"), 1)
+	expected.Insert(b("foo.a"), 1)
+	n, err := st.ImportChunks(export(more, 200), 3)
+	require_True(t, err == nil)
+	require_Equal(t, n, more.Size())
+	require_True(t, st.Validate() == nil)
+	require_Equal(t, st.Size(), expected.Size())
+	require_Equal(t, fmt.Sprint(st.Entries()), fmt.Sprint(expected.Entries()))
+
+	// Overlapping chunks and entries out of order import nothing, but the channel is still drained.
+	ch := make(chan Chunk[int], 3)
+	ch <- Chunk[int]{Entries: []Entry[int]{{b("a"), 1}, {b("c"), 2}}}
+	ch <- Chunk[int]{Entries: []Entry[int]{{b("b"), 3}}}
+	ch <- Chunk[int]{Entries: []Entry[int]{{b("d"), 4}}}
+	close(ch)
+	st = NewSubjectTree[int]()
+	n, err = st.ImportChunks(ch, 2)
+	require_True(t, errors.Is(err, ErrOutOfOrder))
+	require_Equal(t, n, 0)
+	require_Equal(t, st.Size(), 0)
+	require_Equal(t, len(ch), 0)
+	ch = make(chan Chunk[int], 1)
+	ch <- Chunk[int]{Entries: []Entry[int]{{b("b"), 1}, {b("a"), 2}}}
+	close(ch)
+	_, err = st.ImportChunks(ch, 0)
+	require_True(t, errors.Is(err, ErrOutOfOrder))
+	require_Equal(t, st.Size(), 0)
+}
+
+//-------------------
+//  Test for Prefix Scoped Views
+//-------------------
+
+// Test that views only reach the subjects below their prefix, with relative subjects in and out.
+func TestSubjectTreeView(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("tenant.a"), -1)
+	st.Insert(b("tenant.ab.orders"), -1)
+	st.Insert(b("tenant.b.orders.1"), -1)
+	a, ab := st.View(b("tenant.a")), st.View(b("tenant.ab."))
+	require_Equal(t, string(a.Prefix()), "tenant.a")
+	require_Equal(t, a.Size(), 0)
+	require_Equal(t, ab.Size(), 1)
+
+	for i := 0; i < 10; i++ {
+		_, updated := a.Insert(b(fmt.Sprintf("orders.%d", i)), i)
+		require_False(t, updated)
+	}
+	_, updated := a.Insert(nil, 1)
+	require_False(t, updated)
+	require_Equal(t, a.Size(), 10)
+	require_Equal(t, st.Size(), 13)
+	v, found := st.Find(b("tenant.a.orders.3"))
+	require_True(t, found)
+	require_Equal(t, *v, 3)
+	v, found = a.Find(b("orders.3"))
+	require_True(t, found)
+	require_Equal(t, *v, 3)
+	_, found = a.Find(nil)
+	require_False(t, found)
+
+	// Wildcards stay within the view.
+	for filter, expected := range map[string]int{">": 10, "*": 0, "orders.*": 10, "*.1": 1, "orders": 0, "*.*.*": 0} {
+		var n int
+		a.Match(b(filter), func(subject []byte, _ *int) {
+			require_True(t, strings.HasPrefix(string(subject), "orders."))
+			n++
+		})
+		require_Equal(t, n, expected)
+	}
+	var subjects []string
+	ab.IterOrdered(func(subject []byte, _ *int) bool {
+		subjects = append(subjects, string(subject))
+		return true
+	})
+	require_Equal(t, len(subjects), 1)
+	require_Equal(t, subjects[0], "orders")
+
+	_, deleted := a.Delete(b("orders.3"))
+	require_True(t, deleted)
+	_, deleted = ab.Delete(b("orders.4"))
+	require_False(t, deleted)
+	require_Equal(t, a.Size(), 9)
+
+	for _, prefix := range []string{"", "tenant.*", ">", "tenant..a", "a.>"} {
+		func() {
+			defer func() { require_True(t, recover() != nil) }()
+			st.View(b(prefix))
+		}()
+	}
+}
+
+// Test that a read only handle sees the current contents without being able to write through it.
+func TestSubjectTreeReadOnly(t *testing.T) {
+	var empty ROTree[int]
+	require_Equal(t, empty.Size(), 0)
+	_, found := empty.Find(b("foo"))
+	require_False(t, found)
+	empty.Match(b(">"), func(_ []byte, _ int) { t.Fatalf("Unexpected match") })
+
+	st := NewSubjectTree[int]()
+	ro := st.ReadOnly()
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+	require_Equal(t, ro.Size(), 2)
+	require_Equal(t, ro.Version(), st.Version())
+	require_Equal(t, ro.Stats(), st.Stats())
+	v, found := ro.Find(b("foo.baz"))
+	require_True(t, found)
+	require_Equal(t, v, 2)
+
+	var sum int
+	ro.Match(b("foo.*"), func(_ []byte, v int) { sum += v })
+	require_Equal(t, sum, 3)
+	var subjects []string
+	ro.IterOrdered(func(subject []byte, v int) bool {
+		subjects = append(subjects, string(subject))
+		return true
+	})
+	require_Equal(t, strings.Join(subjects, ","), "foo.bar,foo.baz")
+	var n int
+	ro.IterFast(func(_ []byte, _ int) bool { n++; return false })
+	require_Equal(t, n, 1)
+}
+
+//-------------------
+//  Test for Validating the Tree Structure
+//-------------------
+
+// Test that valid trees validate through all kinds of changes and that corruption is reported, not panicked on.
+func TestSubjectTreeValidate(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithLazyDelete()}, {WithShrinkHysteresis(3)}} {
+		st := NewSubjectTree[int](opts...)
+		require_True(t, st.Validate() == nil)
+		rng := rand.New(rand.NewPCG(1, 2))
+		for i := 0; i < 3000; i++ {
+			subj := b(fmt.Sprintf("foo.%d.%d", rng.IntN(50), rng.IntN(300)))
+			if rng.IntN(3) == 0 {
+				st.Delete(subj)
+			} else {
+				st.Insert(subj, i)
+			}
+			if i%500 == 0 {
+				st.Snapshot()
+			}
+			if i%100 == 0 {
+				require_True(t, st.Validate() == nil)
+			}
+		}
+		st.Compact()
+		require_True(t, st.Validate() == nil)
+	}
+
+	// Deleting subjects shorter than a prefix, with no capacity to spare behind them.
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.bar.baz"), 1)
+	st.Insert(b("foo.bar.bat"), 2)
+	_, deleted := st.Delete([]byte{'f', 'o', 'o'})
+	require_False(t, deleted)
+	require_True(t, st.Validate() == nil)
+
+	// Subjects that can not be stored.
+	_, _, err := st.InsertE([]byte{'f', noPivot}, 1)
+	require_True(t, errors.Is(err, ErrInvalidSubject))
+	_, updated, err := st.InsertE(b("foo.bar.baz"), 3)
+	require_True(t, err == nil)
+	require_True(t, updated)
+
+	// Counts out of line.
+	st.size++
+	require_True(t, errors.Is(st.Validate(), ErrInvalidTree))
+	st.size--
+	st.root.base().leaves++
+	require_True(t, errors.Is(st.Validate(), ErrInvalidTree))
+	st.root.base().leaves--
+	require_True(t, st.Validate() == nil)
+
+	// A node pointing past its children makes operations panic, which is turned into errors.
+	st = NewSubjectTree[int]()
+	for i := 0; i < 20; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%c", 'A'+i)), i)
+	}
+	nn, ok := st.root.(*node48)
+	require_True(t, ok)
+	nn.key['z'] = 200
+	require_True(t, errors.Is(st.Validate(), ErrInvalidTree))
+	_, _, err = st.InsertE(b("foo.z"), 1)
+	require_True(t, errors.Is(err, ErrInvalidTree))
+}
+
+// Test that panics from a corrupted tree are recovered from and reported, while callback panics are not.
+func TestSubjectTreeRecover(t *testing.T) {
+	var hooked []error
+	var dumped strings.Builder
+	corrupt := func(opts ...Option) (*SubjectTree[int], *node48) {
+		st := NewSubjectTree[int](opts...)
+		for i := 0; i < 20; i++ {
+			st.Insert(b(fmt.Sprintf("foo.%c", 'A'+i)), i)
+		}
+		nn := st.root.(*node48)
+		nn.key['z'] = 200
+		return st, nn
+	}
+	st, nn := corrupt(WithPanicHook(func(err error, dump func(w io.Writer)) {
+		hooked = append(hooked, err)
+		dump(&dumped)
+	}))
+	require_True(t, st.Err() == nil)
+	_, updated := st.Insert(b("foo.z"), 1)
+	require_False(t, updated)
+	require_True(t, errors.Is(st.Err(), ErrInvalidTree))
+	require_Equal(t, len(hooked), 1)
+	require_True(t, strings.Contains(dumped.String(), `Suffix: "A"`))
+	_, _, err := st.InsertE(b("foo.z"), 1)
+	require_True(t, errors.Is(err, ErrInvalidTree))
+	_, _, err = st.DeleteE(b("foo.z"))
+	require_True(t, errors.Is(err, ErrInvalidTree))
+	st.Match(b("foo.z"), func(_ []byte, _ *int) {})
+	require_Equal(t, len(hooked), 4)
+	// Everything else keeps working.
+	_, deleted, err := st.DeleteE(b("foo.A"))
+	require_True(t, deleted)
+	require_True(t, err == nil)
+
+	// The error stays until the tree validates again.
+	require_True(t, st.Validate() != nil)
+	require_True(t, st.Err() != nil)
+	nn.key['z'] = 0
+	require_True(t, st.Validate() == nil)
+	require_True(t, st.Err() == nil)
+
+	// Panics of callbacks are passed on.
+	st, _ = corrupt(WithRecover())
+	func() {
+		defer func() { require_Equal(t, recover(), "callback") }()
+		st.Match(b("foo.*"), func(_ []byte, _ *int) { panic("callback") })
+	}()
+	require_True(t, st.Err() == nil)
+
+	// Without recovering the panic is not caught.
+	st, _ = corrupt()
+	func() {
+		defer func() { require_True(t, recover() != nil) }()
+		st.Insert(b("foo.z"), 1)
+	}()
+}
+
+// Test that debug builds validate the tree after every modification. Run with -tags subtree_debug.
+func TestSubjectTreeDebugChecks(t *testing.T) {
+	if !debugChecks {
+		t.Skip()
+	}
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+	st.size++
+	func() {
+		defer func() { require_True(t, recover() != nil) }()
+		st.Insert(b("foo.bat"), 3)
+	}()
+
+	// With recovering the check is reported as the error of the tree, and not repeated.
+	st = NewSubjectTree[int](WithRecover())
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+	st.root.base().leaves++
+	st.Delete(b("foo.bat"))
+	require_True(t, errors.Is(st.Err(), ErrInvalidTree))
+	st.Insert(b("foo.bat"), 3)
+	require_Equal(t, st.Size(), 3)
+	st.root.base().leaves--
+	require_True(t, st.Validate() == nil)
+	require_True(t, st.Err() == nil)
+}
+
+//-------------------
+
+// Test that node prefixes stay within the cap through inserts, deletes and compactions, against a map.
+func TestSubjectTreeMaxPrefix(t *testing.T) {
+	for _, opts := range [][]Option{{WithMaxPrefix(4)}, {WithMaxPrefix(1), WithShrinkHysteresis(2)}, {WithMaxPrefix(6), WithLazyDelete(), WithCompactThreshold(0.3)}} {
+		st := NewSubjectTree[int](opts...)
+		limit := st.opts.maxPrefix
+		check := func(expected map[string]int) {
+			t.Helper()
+			if err := st.Validate(); err != nil {
+				t.Fatalf("Invalid tree: %v", err)
+			}
+			require_Equal(t, st.Size(), len(expected))
+			for subj, v := range expected {
+				found, ok := st.Find(b(subj))
+				require_True(t, ok)
+				require_Equal(t, *found, v)
+			}
+			st.WalkNodes(func(info NodeInfo) bool {
+				if len(info.Prefix) > limit {
+					t.Fatalf("Expected prefix of at most %d, got %q", limit, info.Prefix)
+				}
+				return true
+			})
+		}
+		expected := make(map[string]int)
+		rng := rand.New(rand.NewPCG(3, 4))
+		for i := 0; i < 2000; i++ {
+			subj := fmt.Sprintf("id.%s%d.%s", strings.Repeat("0123456789", 1+rng.IntN(3)), rng.IntN(20), strings.Repeat("x", rng.IntN(30)))
+			if rng.IntN(3) == 0 {
+				_, deleted := st.Delete(b(subj))
+				_, ok := expected[subj]
+				require_Equal(t, deleted, ok)
+				delete(expected, subj)
+			} else {
+				st.Insert(b(subj), i)
+				expected[subj] = i
+			}
+			if i%400 == 0 {
+				st.Snapshot()
+				check(expected)
+			}
+		}
+		check(expected)
+		require_True(t, st.Stats().PrefixChains > 0)
+		var n int
+		st.Match(b("id.*.>"), func(_ []byte, _ *int) { n++ })
+		require_Equal(t, n, len(expected))
+		for subj := range expected {
+			st.Delete(b(subj))
+		}
+		st.Compact()
+		require_Equal(t, st.Size(), 0)
+		require_True(t, st.root == nil)
+	}
+
+	// Moving a subtree somewhere with a longer prefix chains it as well.
+	st := NewSubjectTree[int](WithMaxPrefix(3))
+	st.Insert(b("a.1"), 1)
+	st.Insert(b("a.2"), 2)
+	sub, _ := st.SplitAt(b("a."))
+	require_True(t, st.Graft(b("very.long.prefix."), sub) == nil)
+	require_True(t, st.Validate() == nil)
+	st.WalkNodes(func(info NodeInfo) bool {
+		require_True(t, len(info.Prefix) <= 3)
+		return true
+	})
+	v, found := st.Find(b("very.long.prefix.2"))
+	require_True(t, found)
+	require_Equal(t, *v, 2)
+}
+
+//-------------------
+//  Test for Token Dictionary
+//-------------------
+
+// Test that a tree with a token dictionary behaves like a plain one while storing shorter subjects.
+func TestSubjectTreeTokenDictionary(t *testing.T) {
+	dt := NewDictSubjectTree[int](0)
+	st := NewSubjectTree[int]()
+	var raw, i int
+	for site := 0; site < 5; site++ {
+		for dev := 0; dev < 20; dev++ {
+			for _, metric := range []string{"temperature", "humidity", "pressure"} {
+				subj := fmt.Sprintf("datacenter-%d.rack-device-%d.%s", site, dev, metric)
+				dt.Insert(b(subj), i)
+				st.Insert(b(subj), i)
+				raw += len(subj)
+				i++
+			}
+		}
+	}
+	require_Equal(t, dt.Size(), st.Size())
+	require_Equal(t, dt.Stats().Tokens, 5+20+3)
+
+	// Stored subjects are a lot shorter.
+	var stored int
+	dt.t.IterFast(func(subject []byte, _ *int) bool {
+		stored += len(subject)
+		return true
+	})
+	require_True(t, stored*3 < raw)
+
+	st.IterFast(func(subject []byte, v *int) bool {
+		found, ok := dt.Find(subject)
+		require_True(t, ok)
+		require_Equal(t, *found, *v)
+		return true
+	})
+	_, found := dt.Find(b("datacenter-1.rack-device-1.voltage"))
+	require_False(t, found)
+
+	for _, filter := range []string{"datacenter-2.*.humidity", "*.rack-device-7.>", "datacenter-3.>", "*.*.pressure", "nope.>"} {
+		expected := make(map[string]int)
+		st.Match(b(filter), func(subject []byte, v *int) { expected[string(subject)] = *v })
+		got := make(map[string]int)
+		dt.Match(b(filter), func(subject []byte, v *int) { got[string(subject)] = *v })
+		require_Equal(t, len(got), len(expected))
+		for subj, v := range expected {
+			require_Equal(t, got[subj], v)
+		}
+	}
+	var n int
+	dt.IterFast(func(subject []byte, _ *int) bool {
+		_, ok := st.Find(subject)
+		require_True(t, ok)
+		n++
+		return true
+	})
+	require_Equal(t, n, st.Size())
+
+	v, deleted := dt.Delete(b("datacenter-0.rack-device-0.temperature"))
+	require_True(t, deleted)
+	require_Equal(t, *v, 0)
+	require_Equal(t, dt.Size(), st.Size()-1)
+
+	// Tokens starting with the marker byte, short tokens and tokens past the limit are stored as they are.
+	dt = NewDictSubjectTree[int](1)
+	for i, subj := range []string{"first.\x1e\x1ecode", "\x1e.a.first", "second.x", "first.second"} {
+		dt.Insert(b(subj), i)
+	}
+	require_Equal(t, dt.Stats(), TokenDictStats{Tokens: 1, Bytes: len("first")})
+	for i, subj := range []string{"first.\x1e\x1ecode", "\x1e.a.first", "second.x", "first.second"} {
+		found, ok := dt.Find(b(subj))
+		require_True(t, ok)
+		require_Equal(t, *found, i)
+	}
+	var subjects []string
+	dt.Match(b("*.>"), func(subject []byte, _ *int) { subjects = append(subjects, string(subject)) })
+	slices.Sort(subjects)
+	require_Equal(t, strings.Join(subjects, ","), "\x1e.a.first,first.\x1e\x1ecode,first.second,second.x")
+}
+
+//-------------------
+//  Test for Compressed Values
+//-------------------
+
+// Test that large compressible values are stored compressed and come back as inserted.
+func TestCompressedSubjectTree(t *testing.T) {
+	ct := NewCompressedSubjectTree(64)
+	doc := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"items":[%s]}`, i, strings.Repeat(`{"name":"item","price":42},`, 20)))
+	}
+	small := []byte(`{"id":1}`)
+	random := make([]byte, 256)
+	for i := range random {
+		random[i] = byte(rand.IntN(256))
+	}
+	for i := 0; i < 100; i++ {
+		ct.Insert(b(fmt.Sprintf("docs.%d", i)), doc(i))
+	}
+	ct.Insert(b("small"), small)
+	ct.Insert(b("random"), random)
+	ct.Insert(b("empty"), nil)
+
+	stats := ct.Stats()
+	require_Equal(t, stats.Values, 103)
+	require_Equal(t, stats.Compressed, 100)
+	require_True(t, stats.Ratio() < 0.5)
+	v, ok := ct.Find(b("docs.7"))
+	require_True(t, ok)
+	require_True(t, bytes.Equal(v, doc(7)))
+	v, _ = ct.Find(b("small"))
+	require_True(t, bytes.Equal(v, small))
+	v, _ = ct.Find(b("random"))
+	require_True(t, bytes.Equal(v, random))
+	v, ok = ct.Find(b("empty"))
+	require_True(t, ok && len(v) == 0)
+
+	var n int
+	ct.Match(b("docs.*"), func(subject, val []byte) {
+		var i int
+		fmt.Sscanf(string(subject), "docs.%d", &i)
+		require_True(t, bytes.Equal(val, doc(i)))
+		n++
+	})
+	require_Equal(t, n, 100)
+
+	// Updates and deletes keep the statistics current.
+	old, updated := ct.Insert(b("docs.7"), small)
+	require_True(t, updated && bytes.Equal(old, doc(7)))
+	old, ok = ct.Delete(b("docs.8"))
+	require_True(t, ok && bytes.Equal(old, doc(8)))
+	stats = ct.Stats()
+	require_Equal(t, stats.Values, 102)
+	require_Equal(t, stats.Compressed, 98)
+	var raw, stored uint64
+	ct.Tree().IterOrdered(func(_ []byte, v *[]byte) bool {
+		size, _ := valueSize(*v)
+		raw, stored = raw+uint64(size), stored+uint64(len(*v))
+		return true
+	})
+	require_Equal(t, stats.RawBytes, raw)
+	require_Equal(t, stats.StoredBytes, stored)
+}
+
+//-------------------
+//  Test for Weak Entries
+//-------------------
+
+// Test that entries are evicted once their values are reclaimed, and only then.
+func TestWeakSubjectTree(t *testing.T) {
+	type resource struct {
+		id  int
+		buf [64]byte
+	}
+	wt := NewWeakSubjectTree[resource]()
+	var kept []*resource
+	for i := 0; i < 100; i++ {
+		r := &resource{id: i}
+		if i%2 == 0 {
+			kept = append(kept, r)
+		}
+		wt.Insert(b(fmt.Sprintf("res.%d", i)), r)
+	}
+	// A subject given a new value stays, even when its old value is reclaimed.
+	renewed := &resource{id: -1}
+	wt.Insert(b("res.1"), renewed)
+	require_False(t, wt.Insert(b("res.nil"), nil))
+
+	deadline := time.Now().Add(10 * time.Second)
+	for wt.Size() > 51 && time.Now().Before(deadline) {
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+	require_Equal(t, wt.Size(), 51)
+	for _, r := range kept {
+		v, ok := wt.Find(b(fmt.Sprintf("res.%d", r.id)))
+		require_True(t, ok && v == r)
+	}
+	v, ok := wt.Find(b("res.1"))
+	require_True(t, ok && v == renewed)
+	_, ok = wt.Find(b("res.3"))
+	require_False(t, ok)
+	var n int
+	wt.Match(b("res.*"), func(_ []byte, _ *resource) { n++ })
+	require_Equal(t, n, 51)
+
+	v, ok = wt.Delete(b("res.0"))
+	require_True(t, ok && v == kept[0])
+	runtime.KeepAlive(kept)
+	runtime.KeepAlive(renewed)
+}
+
+//-------------------
+//  Test for Loading Values
+//-------------------
+
+// Test that values are loaded through the stored references, one at a time or in batches.
+func TestSubjectTreeValueLoader(t *testing.T) {
+	store := map[int]string{}
+	st := NewSubjectTree[int]()
+	for i := 0; i < 10; i++ {
+		store[i] = strings.Repeat("x", i)
+		st.Insert(b(fmt.Sprintf("blob.%d", i)), i)
+	}
+	errMissing := errors.New("missing")
+	var loads int
+	lt := WithValueLoader(st, func(ref int) (string, error) {
+		loads++
+		v, ok := store[ref]
+		if !ok {
+			return "", errMissing
+		}
+		return v, nil
+	})
+	require_True(t, lt.Tree() == st)
+
+	v, found, err := lt.Find(b("blob.3"))
+	require_True(t, found && err == nil)
+	require_Equal(t, v, "xxx")
+	_, found, err = lt.Find(b("blob.nope"))
+	require_False(t, found)
+	require_True(t, err == nil)
+
+	var subjects []string
+	require_True(t, lt.Match(b("blob.*"), func(subject []byte, val string) error {
+		require_Equal(t, val, store[len(subjects)])
+		subjects = append(subjects, string(subject))
+		return nil
+	}) == nil)
+	require_Equal(t, len(subjects), 10)
+	require_Equal(t, loads, 11)
+
+	// Batches of 4 take 3 calls for 10 matches.
+	var batches int
+	lt.WithBatch(4, func(refs []int) ([]string, error) {
+		batches++
+		vals := make([]string, 0, len(refs))
+		for _, ref := range refs {
+			v, ok := store[ref]
+			if !ok {
+				return nil, errMissing
+			}
+			vals = append(vals, v)
+		}
+		return vals, nil
+	})
+	subjects = subjects[:0]
+	require_True(t, lt.Match(b("blob.>"), func(subject []byte, val string) error {
+		require_Equal(t, string(subject), fmt.Sprintf("blob.%d", len(val)))
+		subjects = append(subjects, string(subject))
+		return nil
+	}) == nil)
+	require_Equal(t, len(subjects), 10)
+	require_Equal(t, batches, 3)
+
+	// Errors stop the match, from loading or from the callback.
+	delete(store, 6)
+	subjects = subjects[:0]
+	err = lt.Match(b("blob.*"), func(subject []byte, _ string) error {
+		subjects = append(subjects, string(subject))
+		return nil
+	})
+	require_True(t, errors.Is(err, errMissing))
+	require_Equal(t, len(subjects), 4)
+	errStop := errors.New("stop")
+	err = lt.Match(b("blob.*"), func(_ []byte, _ string) error { return errStop })
+	require_True(t, errors.Is(err, errStop))
+	_, found, err = lt.Find(b("blob.6"))
+	require_True(t, found && errors.Is(err, errMissing))
+
+	lt.WithBatch(4, func(refs []int) ([]string, error) { return nil, nil })
+	require_True(t, errors.Is(lt.Match(b("blob.*"), func(_ []byte, _ string) error { return nil }), ErrLoadBatch))
+}
+
+//-------------------
+//  Test for Entry IDs
+//-------------------
+
+// Test that entries keep their IDs through updates and moves, and get new ones when re-created.
+func TestSubjectTreeEntryIDs(t *testing.T) {
+	st := NewSubjectTree[int](WithEntryIDs())
+	st.Insert(b("foo.bar.A"), 1)
+	st.Insert(b("foo.bar.B"), 2)
+	st.Insert(b("foo.baz"), 3)
+	idA, ok := st.IDOf(b("foo.bar.A"))
+	require_True(t, ok)
+	idB, _ := st.IDOf(b("foo.bar.B"))
+	idC, _ := st.IDOf(b("foo.baz"))
+	require_True(t, idA < idB && idB < idC)
+	_, ok = st.IDOf(b("foo.nope"))
+	require_False(t, ok)
+
+	subject, v, ok := st.FindByID(idB)
+	require_True(t, ok)
+	require_Equal(t, string(subject), "foo.bar.B")
+	require_Equal(t, *v, 2)
+
+	// Updates keep the ID, a delete and insert gets a new one.
+	st.Insert(b("foo.bar.A"), 11)
+	id, _ := st.IDOf(b("foo.bar.A"))
+	require_Equal(t, id, idA)
+	st.Delete(b("foo.bar.A"))
+	_, _, ok = st.FindByID(idA)
+	require_False(t, ok)
+	require_Equal(t, len(st.ids), 2)
+	st.Insert(b("foo.bar.A"), 1)
+	id, _ = st.IDOf(b("foo.bar.A"))
+	require_True(t, id > idC)
+	idA = id
+
+	ids := make(map[string]uint64)
+	st.MatchIDs(b("foo.>"), func(subject []byte, id uint64, _ *int) { ids[string(subject)] = id })
+	require_Equal(t, len(ids), 3)
+	require_Equal(t, ids["foo.bar.A"], idA)
+	require_Equal(t, ids["foo.baz"], idC)
+
+	// Moved entries keep their IDs and can be found by them in the tree they are in.
+	sub, _ := st.SplitAt(b("foo.bar."))
+	_, _, ok = st.FindByID(idB)
+	require_False(t, ok)
+	subject, _, ok = sub.FindByID(idB)
+	require_True(t, ok)
+	require_Equal(t, string(subject), "B")
+	require_True(t, st.Graft(b("moved."), sub) == nil)
+	subject, v, ok = st.FindByID(idB)
+	require_True(t, ok)
+	require_Equal(t, string(subject), "moved.B")
+	require_Equal(t, *v, 2)
+	require_Equal(t, len(st.ids), 3)
+
+	// Lazy deletes and snapshots.
+	st = NewSubjectTree[int](WithEntryIDs(), WithLazyDelete())
+	st.Insert(b("foo.bar"), 1)
+	id, _ = st.IDOf(b("foo.bar"))
+	st.Snapshot()
+	st.Delete(b("foo.bar"))
+	_, _, ok = st.FindByID(id)
+	require_False(t, ok)
+	st.Insert(b("foo.bar"), 1)
+	nid, ok := st.IDOf(b("foo.bar"))
+	require_True(t, ok && nid != id)
+
+	// Not enabled.
+	st = NewSubjectTree[int]()
+	st.Insert(b("foo.bar"), 1)
+	_, ok = st.IDOf(b("foo.bar"))
+	require_False(t, ok)
+	_, _, ok = st.FindByID(1)
+	require_False(t, ok)
+}
+
+//-------------------
+//  Test for Latency Hooks
+//-------------------
+
+// Test that the latency hook sees every timed call with its number of results.
+func TestSubjectTreeLatencyHook(t *testing.T) {
+	type call struct {
+		call    Call
+		results int
+	}
+	var calls []call
+	st := NewSubjectTree[int](WithLatencyHook(func(c Call, d time.Duration, results int) {
+		require_True(t, d >= 0)
+		calls = append(calls, call{c, results})
+	}))
+	st.Insert(b("foo.bar.A"), 1)
+	st.Insert(b("foo.bar.B"), 2)
+	st.Insert(b("foo.bar.A"), 3)
+	st.Find(b("foo.bar.A"))
+	st.Find(b("foo.bar.C"))
+	st.Match(b("foo.*.*"), func(_ []byte, _ *int) {})
+	st.MatchE(b("foo.bar.B"), func(_ []byte, _ *int) error { return nil })
+	st.MatchAllowed(b(">"), nil, func(_ []byte, _ *int) {})
+	st.Delete(b("foo.bar.A"))
+	st.Delete(b("foo.bar.A"))
+	require_Equal(t, fmt.Sprint(calls), fmt.Sprint([]call{
+		{CallInsert, 1}, {CallInsert, 1}, {CallInsert, 0},
+		{CallFind, 1}, {CallFind, 0},
+		{CallMatch, 2}, {CallMatch, 1}, {CallMatch, 2},
+		{CallDelete, 1}, {CallDelete, 0},
+	}))
+	require_Equal(t, CallMatch.String(), "MATCH")
+	require_Equal(t, Call(9).String(), "Call(9)")
+}
+
+//-------------------
+//  Test for Pluggable Clocks
+//-------------------
+
+// Test that the time based features of a tree follow its clock.
+func TestSubjectTreeClock(t *testing.T) {
+	clock := NewManualClock(time.Unix(1000, 0))
+	var durations []time.Duration
+	st := NewSubjectTree[int](WithClock(clock), WithHotPrefixes(1, time.Minute), WithChurnRates(time.Second, 2),
+		WithLatencyHook(func(_ Call, d time.Duration, _ int) { durations = append(durations, d) }))
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%02d", i)), i)
+	}
+	require_Equal(t, st.Stats().Churn.Intervals[0].Start, time.Unix(1000, 0))
+
+	// Hot prefixes decay with the clock, and latencies are measured with it.
+	st.Match(b("foo.*"), func(_ []byte, _ *int) { clock.Advance(time.Second) })
+	require_Equal(t, durations[len(durations)-1], 100*time.Second)
+	clock.Advance(time.Minute)
+	// The match was counted when it started, 160 seconds ago.
+	require_Equal(t, fmt.Sprintf("%.3f", st.HotSubtrees(1)[0].Matches), fmt.Sprintf("%.3f", math.Exp2(-160.0/60)))
+	require_Equal(t, clock.Now(), time.Unix(1160, 0))
+
+	// Deadlines run out on the clock only.
+	var n int
+	complete := st.MatchDeadline(b("foo.*"), 10*time.Second, func(_ []byte, _ *int) {
+		n++
+		clock.Advance(time.Second)
+	})
+	require_False(t, complete)
+	require_True(t, n >= 10 && n < 100)
+	require_True(t, st.MatchDeadline(b("foo.*"), time.Nanosecond, func(_ []byte, _ *int) {}))
+
+	// Wall clock stamps come from the clock.
+	clock.Set(time.Unix(5000, 0))
+	st.EnableLWW(1, StampWallClock)
+	st.Insert(b("bar"), 1)
+	stamp, _ := st.StampOf(b("bar"))
+	require_Equal(t, stamp.Time, uint64(time.Unix(5000, 0).UnixNano()))
+}
+
+//-------------------
+//  Test for Options and Config
+//-------------------
+
+// Test that invalid options are rejected when the tree is created, and Config reports the settings in effect.
+func TestSubjectTreeOptionsConfig(t *testing.T) {
+	valid := []Option{WithLazyDelete(), WithCompactThreshold(0.5), WithMaxPrefix(8), WithHotPrefixes(2, time.Minute),
+		WithTokenIndex(1, 3, 1), WithTokenRewrites(map[string]string{"Old": "New"}), WithUnicodeFold(), WithChurnRates(time.Second, 4)}
+	require_True(t, ValidateOptions(valid...) == nil)
+	require_True(t, ValidateOptions() == nil)
+	for _, opt := range []Option{
+		WithCompactThreshold(0.5), WithCompactThreshold(1.5), WithMaxPrefix(-1), WithShrinkHysteresis(-2),
+		WithHotPrefixes(0, time.Minute), WithHotPrefixes(2, 0), WithChurnRates(0, 4), WithChurnRates(time.Second, 0),
+		WithTokenIndex(-1), WithStripedLocks(-1), WithWriteBatching(-1), WithReaderGrace(-time.Second),
+		WithValueDedup[int](nil, nil),
+	} {
+		require_True(t, errors.Is(ValidateOptions(opt), ErrInvalidOption))
+	}
+	// All invalid settings are reported at once.
+	err := ValidateOptions(WithMaxPrefix(-1), WithTokenIndex(-1))
+	require_True(t, strings.Contains(err.Error(), "WithMaxPrefix") && strings.Contains(err.Error(), "WithTokenIndex"))
+
+	c := NewSubjectTree[int](valid...).Config()
+	require_True(t, c.LazyDelete && c.UnicodeFold && !c.EntryIDs && !c.ValueEquals)
+	require_Equal(t, c.CompactThreshold, 0.5)
+	require_Equal(t, c.MaxPrefix, 8)
+	require_Equal(t, c.HotPrefixDepth, 2)
+	require_Equal(t, c.HotHalfLife, time.Minute)
+	require_Equal(t, fmt.Sprint(c.TokenIndex), "[1 3]")
+	require_Equal(t, fmt.Sprint(c.TokenRewrites), "map[old:new]")
+	require_Equal(t, c.ChurnIntervals, 4)
+	require_Equal(t, c.Stripes, 1)
+	require_True(t, c.Clock == nil)
+
+	sc := NewSafeSubjectTree[int](WithStripedLocks(4), WithReaderGrace(time.Millisecond)).Config()
+	require_Equal(t, sc.Stripes, 4)
+	require_Equal(t, sc.ReaderGrace, time.Millisecond)
+	require_Equal(t, NewSafeSubjectTree[int](WithStripedLocks(4), WithEntryIDs()).Config().Stripes, 1)
+	var nt *SubjectTree[int]
+	require_Equal(t, nt.Config().MaxPrefix, 0)
+
+	// The constructors returning errors report the same settings, including those for another value type.
+	et, err := NewSubjectTreeE[string](WithValueEquals(func(a, b int) bool { return a == b }), WithMaxPrefix(-1))
+	require_True(t, et == nil && errors.Is(err, ErrInvalidOption))
+	require_True(t, strings.Contains(err.Error(), "WithValueEquals") && strings.Contains(err.Error(), "WithMaxPrefix"))
+	et, err = NewSubjectTreeE[string](valid...)
+	require_True(t, et != nil && err == nil)
+	require_True(t, et.Config().LazyDelete)
+	es, err := NewSafeSubjectTreeE[int](WithStripedLocks(-1))
+	require_True(t, es == nil && errors.Is(err, ErrInvalidOption))
+	es, err = NewSafeSubjectTreeE[int](WithStripedLocks(2))
+	require_True(t, es != nil && err == nil)
+	require_Equal(t, es.Config().Stripes, 2)
+
+	// Functions for another value type are reported with the rest.
+	func() {
+		defer func() {
+			err, _ := recover().(error)
+			require_True(t, errors.Is(err, ErrInvalidOption))
+			require_True(t, strings.Contains(err.Error(), "WithValueEquals") && strings.Contains(err.Error(), "WithMaxPrefix"))
+		}()
+		NewSubjectTree[string](WithValueEquals(func(a, b int) bool { return a == b }), WithMaxPrefix(-1))
+	}()
+
+	defer func() {
+		err, _ := recover().(error)
+		require_True(t, errors.Is(err, ErrInvalidOption))
+	}()
+	NewSubjectTree[int](WithCompactThreshold(0.5))
+}
+
 //-------------------
 //  Test for Node Deletion in SubjectTree
 //-------------------
@@ -172,6 +2004,223 @@ func TestSubjectTreeNodeDelete(t *testing.T) {
 	require_Equal(t, *v, 22)
 }
 
+//-------------------
+//  Test for Shrink Hysteresis
+//-------------------
+
+// Test that nodes only shrink once well below the smaller kind when hysteresis is configured.
+func TestSubjectTreeShrinkHysteresis(t *testing.T) {
+	st := NewSubjectTree[int](WithShrinkHysteresis(4))
+	for i := 0; i < 11; i++ {
+		st.Insert(b(fmt.Sprintf("foo.bar.%c", 'A'+i)), i)
+	}
+	_, ok := st.root.(*node16)
+	require_True(t, ok)
+	// A node10 holds 10, so we need to drop to 6 children before shrinking.
+	for i := 0; i < 4; i++ {
+		st.Delete(b(fmt.Sprintf("foo.bar.%c", 'A'+i)))
+		_, ok = st.root.(*node16)
+		require_True(t, ok)
+	}
+	// Oscillating around the old boundary does not change the kind.
+	for i := 0; i < 10; i++ {
+		st.Insert(b("foo.bar.A"), 0)
+		st.Delete(b("foo.bar.A"))
+		_, ok = st.root.(*node16)
+		require_True(t, ok)
+	}
+	st.Delete(b("foo.bar.E"))
+	_, ok = st.root.(*node10)
+	require_True(t, ok)
+	require_Equal(t, st.Size(), 6)
+
+	// Down to a single child the node is still collapsed into its parent.
+	st = NewSubjectTree[int](WithShrinkHysteresis(100))
+	for i := 0; i < 20; i++ {
+		st.Insert(b(fmt.Sprintf("foo.bar.%c", 'A'+i)), i)
+	}
+	for i := 1; i < 20; i++ {
+		st.Delete(b(fmt.Sprintf("foo.bar.%c", 'A'+i)))
+		_, found := st.Find(b("foo.bar.A"))
+		require_True(t, found)
+	}
+	require_True(t, st.root.isLeaf())
+	require_Equal(t, string(st.root.path()), "foo.bar.A")
+}
+
+// Benchmark a workload oscillating around a node kind boundary, with and without hysteresis.
+func BenchmarkSubjectTreeShrinkHysteresis(b *testing.B) {
+	for _, slack := range []int{0, 4} {
+		b.Run(fmt.Sprintf("slack=%d", slack), func(b *testing.B) {
+			st := NewSubjectTree[int](WithShrinkHysteresis(slack))
+			subjects := make([][]byte, 100)
+			for i := range subjects {
+				// Each node sits right at the node16/node10 boundary.
+				for c := 0; c < 10; c++ {
+					st.Insert([]byte(fmt.Sprintf("foo.%d.%c", i, 'A'+c)), c)
+				}
+				subjects[i] = []byte(fmt.Sprintf("foo.%d.Z", i))
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				subj := subjects[i%len(subjects)]
+				st.Insert(subj, i)
+				st.Delete(subj)
+			}
+		})
+	}
+}
+
+//-------------------
+//  Test for Lazy Deletes and Compaction
+//-------------------
+
+// Test that lazily deleted entries are invisible, can be revived, and are removed by Compact.
+func TestSubjectTreeLazyDelete(t *testing.T) {
+	st := NewSubjectTree[int](WithLazyDelete())
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%5, i)), i)
+	}
+	snap := st.Snapshot()
+	for i := 0; i < 40; i++ {
+		v, found := st.Delete(b(fmt.Sprintf("foo.%d.bar.%d", i%5, i)))
+		require_True(t, found)
+		require_Equal(t, *v, i)
+	}
+	require_Equal(t, st.Size(), 60)
+	require_Equal(t, st.Dead(), 40)
+	_, found := st.Delete(b("foo.0.bar.0"))
+	require_False(t, found)
+	_, found = st.Find(b("foo.0.bar.0"))
+	require_False(t, found)
+	match(t, st, ">", 60)
+	match(t, st, "foo.0.bar.*", 12)
+	count := 0
+	st.IterOrdered(func(_ []byte, _ *int) bool { count++; return true })
+	require_Equal(t, count, 60)
+	st.WalkNodes(func(info NodeInfo) bool {
+		if info.Depth == 0 {
+			require_Equal(t, info.Leaves, 60)
+		}
+		return true
+	})
+
+	// Inserting a deleted subject again revives it as a new entry.
+	old, updated := st.Insert(b("foo.1.bar.1"), 1001)
+	require_False(t, updated)
+	require_True(t, old == nil)
+	require_Equal(t, st.Size(), 61)
+	require_Equal(t, st.Dead(), 39)
+	v, found := st.Find(b("foo.1.bar.1"))
+	require_True(t, found)
+	require_Equal(t, *v, 1001)
+
+	// Compact removes the dead leaves and leaves no node with a single child.
+	require_Equal(t, st.Compact().Removed, 39)
+	require_Equal(t, st.Dead(), 0)
+	require_Equal(t, st.Compact().Removed, 0)
+	require_Equal(t, st.Size(), 61)
+	match(t, st, ">", 61)
+	st.WalkNodes(func(info NodeInfo) bool {
+		require_True(t, info.Children > 1)
+		return true
+	})
+	// The snapshot taken before the deletes is untouched.
+	require_Equal(t, snap.Size(), 100)
+	v, found = snap.Find(b("foo.0.bar.0"))
+	require_True(t, found)
+	require_Equal(t, *v, 0)
+
+	// Deleting everything leaves only dead leaves, which are dropped without visiting them.
+	for i := 40; i < 100; i++ {
+		st.Delete(b(fmt.Sprintf("foo.%d.bar.%d", i%5, i)))
+	}
+	st.Delete(b("foo.1.bar.1"))
+	require_Equal(t, st.Size(), 0)
+	require_Equal(t, st.Compact().Removed, 61)
+	require_Equal(t, st.root, nil)
+
+	// With a threshold the tree sweeps by itself.
+	st = NewSubjectTree[int](WithLazyDelete(), WithCompactThreshold(0.5))
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%5, i)), i)
+	}
+	for i := 0; i < 90; i++ {
+		st.Delete(b(fmt.Sprintf("foo.%d.bar.%d", i%5, i)))
+		require_True(t, st.Dead() <= st.Size()+1)
+	}
+	match(t, st, ">", 10)
+}
+
+// Test that Compact collapses chains of single child nodes and reports the node counts.
+func TestSubjectTreeCompactChains(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.bar.A"), 1)
+	st.Insert(b("foo.bar.B"), 2)
+	st.Insert(b("foo.baz"), 3)
+	stats := st.Compact()
+	require_Equal(t, stats.NodesBefore, 2)
+	require_Equal(t, stats.NodesAfter, 2)
+	require_Equal(t, stats.Collapsed, 0)
+
+	// Build a chain of single child nodes above the root by hand.
+	bn := st.root.base()
+	require_Equal(t, string(bn.prefix), "foo.ba")
+	bn.prefix = b("o.ba")
+	mid := &node10{}
+	mid.setPrefix(b("o"))
+	mid.addChild('o', st.root)
+	mid.leaves = 3
+	top := &node4{}
+	top.setPrefix(b("f"))
+	top.addChild('o', mid)
+	top.leaves = 3
+	st.root = top
+	v, found := st.Find(b("foo.bar.B"))
+	require_True(t, found)
+	require_Equal(t, *v, 2)
+
+	stats = st.Compact()
+	require_Equal(t, stats.Removed, 0)
+	require_Equal(t, stats.Collapsed, 2)
+	require_Equal(t, stats.NodesBefore, 4)
+	require_Equal(t, stats.NodesAfter, 2)
+	require_Equal(t, string(st.root.path()), "foo.ba")
+	match(t, st, "foo.>", 3)
+	v, found = st.Find(b("foo.baz"))
+	require_True(t, found)
+	require_Equal(t, *v, 3)
+}
+
+// Benchmark purging a large number of subjects with eager and lazy deletes.
+func BenchmarkSubjectTreeBulkPurge(b *testing.B) {
+	subjects := make([][]byte, 100_000)
+	for i := range subjects {
+		subjects[i] = []byte(fmt.Sprintf("foo.%d.bar.%d", i%100, i))
+	}
+	for _, lazy := range []bool{false, true} {
+		b.Run(fmt.Sprintf("lazy=%v", lazy), func(b *testing.B) {
+			var opts []Option
+			if lazy {
+				opts = append(opts, WithLazyDelete())
+			}
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				st := NewSubjectTree[int](opts...)
+				for j, subj := range subjects {
+					st.Insert(subj, j)
+				}
+				b.StartTimer()
+				for _, subj := range subjects {
+					st.Delete(subj)
+				}
+				st.Compact()
+			}
+		})
+	}
+}
+
 //-------------------
 //  Test for Node48 Operations
 //-------------------
@@ -200,6 +2249,12 @@ func TestSubjectTreeNode48(t *testing.T) {
 	require_Equal(t, n.child[1].(*leaf[int]), &b)
 	require_Equal(t, len(n.children()), 2)
 
+	n.addChild('C', &c)
+	require_Equal(t, n.key['C'], 3)
+	require_True(t, n.child[2] != nil)
+	require_Equal(t, n.child[2].(*leaf[int]), &c)
+	require_Equal(t, len(n.children()), 3)
+
 	// Delete child 'A' and verify the node shrinks correctly.
 	n.deleteChild('A')
 	require_Equal(t, len(n.children()), 2)
@@ -214,6 +2269,79 @@ func TestSubjectTreeNode48(t *testing.T) {
 	require_Equal(t, n.child[0].(*leaf[int]), &c)
 }
 
+//-------------------
+//  Test for Node256 Occupancy Bitmap
+//-------------------
+
+// Test that the node256 bitmap tracks children and iteration visits them in order.
+func TestSubjectTreeNode256Bitmap(t *testing.T) {
+	var n node256
+	var l leaf[int]
+	keys := []byte{0, 63, 64, 'A', noPivot, 200, 255}
+	for _, c := range keys {
+		n.addChild(c, &l)
+	}
+	var got []int
+	n.iter(func(cn node) bool {
+		got = append(got, int(cn.numChildren()))
+		return true
+	})
+	require_Equal(t, len(got), len(keys))
+	for i, c := 0, n.next(0); c < 256; i, c = i+1, n.next(c+1) {
+		require_Equal(t, c, int(keys[i]))
+	}
+	// Removing children clears their bits.
+	n.deleteChild(63)
+	n.deleteChild(255)
+	require_Equal(t, n.next(1), 64)
+	require_Equal(t, n.next(65), int('A'))
+	require_Equal(t, n.next(201), 256)
+
+	// Ordered iteration and shrinking through a tree agree with the slots.
+	st := NewSubjectTree[int]()
+	for i := 0; i < 60; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%c", 'A'+i)), i)
+	}
+	st.Insert(b("foo."), -1)
+	_, ok := st.root.(*node256)
+	require_True(t, ok)
+	prev, count := "", 0
+	st.IterOrdered(func(subject []byte, _ *int) bool {
+		require_True(t, count == 0 || string(subject) > prev)
+		prev, count = string(subject), count+1
+		return true
+	})
+	require_Equal(t, count, 61)
+	for i := 0; i < 40; i++ {
+		st.Delete(b(fmt.Sprintf("foo.%c", 'A'+i)))
+	}
+	_, ok = st.root.(*node48)
+	require_True(t, ok)
+	require_Equal(t, st.Size(), 21)
+}
+
+// Benchmark ordered iteration over sparse node256s.
+func BenchmarkSubjectTreeIterOrderedSparse256(b *testing.B) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		for _, c := range []byte{'0', 'a', 'z', '~'} {
+			st.Insert([]byte(fmt.Sprintf("foo.%d.%c", i, c)), i)
+		}
+		// Enough keys to grow into a node256, then delete most of them.
+		for c := 0; c < 60; c++ {
+			st.Insert([]byte(fmt.Sprintf("foo.%d.%c", i, 'A'+c)), i)
+		}
+		for c := 0; c < 5; c++ {
+			st.Delete([]byte(fmt.Sprintf("foo.%d.%c", i, 'A'+c)))
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		st.IterOrdered(func(_ []byte, _ *int) bool { return true })
+	}
+}
+
 //-------------------
 //  Test for Insert with Longer Leaf Suffix and Trailing Nulls
 //-------------------
@@ -258,3 +2386,542 @@ func TestSubjectTreeInsertWithNoPivot(t *testing.T) {
 	require_False(t, updated)
 	require_Equal(t, st.Size(), 0)
 }
+
+//-------------------
+//  Test for Find Fast Path
+//-------------------
+
+// Test that literal lookups never allocate, regardless of hit or miss.
+func TestSubjectTreeFindNoAllocs(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.bar.%d.baz", i)), i)
+	}
+	hit, miss, short := b("foo.bar.522.baz"), b("foo.bar.522.bax"), b("foo.ba")
+	allocs := testing.AllocsPerRun(100, func() {
+		st.Find(hit)
+		st.Find(miss)
+		st.Find(short)
+	})
+	require_Equal(t, allocs, 0)
+	v, found := st.Find(hit)
+	require_True(t, found)
+	require_Equal(t, *v, 522)
+	_, found = st.Find(miss)
+	require_False(t, found)
+	_, found = st.Find(short)
+	require_False(t, found)
+}
+
+// Test that replacing a value only allocates the copy of the old value it returns, so the value passed in
+// stays off the heap unless the insert is logged.
+func TestSubjectTreeInsertAllocs(t *testing.T) {
+	st := NewSubjectTree[[4]int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.bar.%d.baz", i)), [4]int{i})
+	}
+	subj := b("foo.bar.522.baz")
+	allocs := testing.AllocsPerRun(100, func() {
+		st.Insert(subj, [4]int{1, 2, 3, 4})
+	})
+	// Debug builds check the whole tree after every insert.
+	if !debugChecks {
+		require_Equal(t, allocs, 1)
+	}
+	v, found := st.Find(subj)
+	require_True(t, found)
+	require_Equal(t, *v, [4]int{1, 2, 3, 4})
+}
+
+// Benchmark literal lookups on a warm tree.
+func BenchmarkSubjectTreeFind(b *testing.B) {
+	st := NewSubjectTree[int]()
+	subjects := make([][]byte, 0, 100_000)
+	for i := 0; i < 100_000; i++ {
+		subj := []byte(fmt.Sprintf("stream.%d.events.%d", i%256, i))
+		subjects = append(subjects, subj)
+		st.Insert(subj, i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, found := st.Find(subjects[i%len(subjects)]); !found {
+			b.Fatalf("subject not found")
+		}
+	}
+}
+
+//-------------------
+//  Test for Op Logging and Replay
+//-------------------
+
+// Test that a follower replaying the op log stays in sync with the leader.
+func TestSubjectTreeOpLogReplay(t *testing.T) {
+	leader, follower := NewSubjectTree[int](), NewSubjectTree[int]()
+	var ops []Op
+	leader.SetOpLogger(func(op Op, subject []byte, v *int) {
+		ops = append(ops, op)
+		require_True(t, follower.ApplyOp(op, subject, v) == nil)
+	})
+	leader.Insert(b("foo.bar.A"), 1)
+	leader.Insert(b("foo.bar.B"), 2)
+	leader.Insert(b("foo.bar.A"), 11)
+	leader.Delete(b("foo.bar.B"))
+	leader.Delete(b("foo.bar.C"))
+	require_Equal(t, len(ops), 4)
+	require_Equal(t, ops[0], OpInsert)
+	require_Equal(t, ops[2], OpUpdate)
+	require_Equal(t, ops[3], OpDelete)
+	require_Equal(t, follower.Size(), 1)
+	v, found := follower.Find(b("foo.bar.A"))
+	require_True(t, found)
+	require_Equal(t, *v, 11)
+
+	leader.Empty()
+	require_Equal(t, ops[len(ops)-1], OpEmpty)
+	require_Equal(t, follower.Size(), 0)
+
+	// Invalid ops are rejected.
+	require_True(t, follower.ApplyOp(OpInsert, b("foo"), nil) != nil)
+	require_True(t, follower.ApplyOp(Op(99), b("foo"), nil) != nil)
+	require_Equal(t, Op(99).String(), "Op(99)")
+}
+
+//-------------------
+//  Test for Matching As Of a Time
+//-------------------
+
+// Test that the history reconstructs the tree at earlier times from snapshots and replayed ops.
+func TestSubjectTreeMatchAsOf(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.0"), 0)
+	var logged int
+	st.SetOpLogger(func(_ Op, _ []byte, _ *int) { logged++ })
+
+	start := time.Unix(1000, 0)
+	clock := start
+	h := st.RecordHistory(4)
+	h.now = func() time.Time { return clock }
+	h.snaps[0].at = start
+	// Every op is a second apart, the state at second i is kept in expected[i].
+	var expected []map[string]int
+	state := map[string]int{"foo.0": 0}
+	for i := 1; i <= 30; i++ {
+		clock = start.Add(time.Duration(i) * time.Second)
+		subj := fmt.Sprintf("foo.%d", i%7)
+		if i%3 == 0 {
+			st.Delete(b(subj))
+			delete(state, subj)
+		} else {
+			st.Insert(b(subj), i)
+			state[subj] = i
+		}
+		if i == 20 {
+			st.Empty()
+			clear(state)
+		}
+		expected = append(expected, maps.Clone(state))
+	}
+	require_Equal(t, logged, len(h.ops))
+	require_True(t, len(h.snaps) > 5)
+
+	for i, exp := range expected {
+		at := start.Add(time.Duration(i+1)*time.Second + time.Millisecond)
+		got := make(map[string]int)
+		require_True(t, h.MatchAsOf(b("foo.*"), at, func(subject []byte, v *int) { got[string(subject)] = *v }) == nil)
+		require_True(t, maps.Equal(got, exp))
+	}
+	// The current tree is not affected by the replays.
+	require_Equal(t, st.Size(), len(state))
+	got := make(map[string]int)
+	st.Match(b(">"), func(subject []byte, v *int) { got[string(subject)] = *v })
+	require_True(t, maps.Equal(got, state))
+
+	// Before the history starts, and after trimming.
+	require_True(t, errors.Is(h.MatchAsOf(b(">"), start.Add(-time.Second), func(_ []byte, _ *int) {}), ErrVersionNotRetained))
+	h.Trim(start.Add(15 * time.Second))
+	require_True(t, h.Since().After(start))
+	require_False(t, h.Since().After(start.Add(15*time.Second)))
+	_, err := h.AsOf(start.Add(5 * time.Second))
+	require_True(t, errors.Is(err, ErrVersionNotRetained))
+	for i := 15; i < len(expected); i++ {
+		v, err := h.AsOf(start.Add(time.Duration(i+1) * time.Second))
+		require_True(t, err == nil)
+		require_Equal(t, v.Size(), len(expected[i]))
+	}
+}
+
+//-------------------
+//  Test for No-op Updates with Value Equality
+//-------------------
+
+// Test that inserting an equal value does not modify the tree or log an update.
+func TestSubjectTreeValueEquals(t *testing.T) {
+	st := NewSubjectTree[[]int](WithValueEquals(func(a, b []int) bool {
+		return len(a) == len(b) && (len(a) == 0 || a[0] == b[0])
+	}))
+	var ops []Op
+	st.SetOpLogger(func(op Op, _ []byte, _ *[]int) { ops = append(ops, op) })
+	st.Insert(b("foo.bar"), []int{1})
+	version := st.Version()
+
+	old, updated, changed := st.InsertChanged(b("foo.bar"), []int{1})
+	require_True(t, updated)
+	require_False(t, changed)
+	require_Equal(t, (*old)[0], 1)
+	require_Equal(t, st.Version(), version)
+	require_Equal(t, len(ops), 1)
+
+	// Insert still reports the entry as updated.
+	_, updated = st.Insert(b("foo.bar"), []int{1})
+	require_True(t, updated)
+	require_Equal(t, len(ops), 1)
+
+	_, updated, changed = st.InsertChanged(b("foo.bar"), []int{2})
+	require_True(t, updated && changed)
+	require_Equal(t, st.Version(), version+1)
+	require_Equal(t, ops[1], OpUpdate)
+	_, updated, changed = st.InsertChanged(b("foo.baz"), []int{2})
+	require_True(t, !updated && changed)
+	require_Equal(t, st.Size(), 2)
+
+	// Without the option every insert changes the tree.
+	plain := NewSubjectTree[int]()
+	plain.Insert(b("foo"), 1)
+	_, _, changed = plain.InsertChanged(b("foo"), 1)
+	require_True(t, changed)
+
+	// An equality function for another value type is an invalid option.
+	defer func() {
+		err, _ := recover().(error)
+		require_True(t, errors.Is(err, ErrInvalidOption))
+	}()
+	NewSubjectTree[string](WithValueEquals(func(a, b int) bool { return a == b }))
+}
+
+//-------------------
+//  Test for Value Deduplication
+//-------------------
+
+// Test that equal values share the memory of one instance, and that instances of values gone are dropped.
+func TestSubjectTreeValueDedup(t *testing.T) {
+	type config struct {
+		name string
+		tags []string
+	}
+	st := NewSubjectTree[config](WithValueDedup(func(v config) uint64 {
+		return uint64(len(v.name))
+	}, func(a, b config) bool {
+		return a.name == b.name && slices.Equal(a.tags, b.tags)
+	}))
+	for i := 0; i < 3000; i++ {
+		name := fmt.Sprintf("cfg-%d", i%3)
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), config{name: name, tags: []string{name, "x"}})
+	}
+	shared := make(map[*string]string)
+	st.IterFast(func(_ []byte, v *config) bool {
+		shared[&v.tags[0]] = v.name
+		return true
+	})
+	require_Equal(t, len(shared), 3)
+
+	// Distinct values coming and going do not pile up in the table.
+	for i := 0; i < 10000; i++ {
+		subject := b(fmt.Sprintf("bar.%d", i))
+		st.Insert(subject, config{name: fmt.Sprintf("tmp-%d", i)})
+		st.Delete(subject)
+	}
+	require_True(t, st.dedup.n <= 2*dedupMinSweep)
+	st.Empty()
+	require_Equal(t, st.dedup.n, 0)
+
+	// Functions for another value type are an invalid option.
+	defer func() {
+		err, _ := recover().(error)
+		require_True(t, errors.Is(err, ErrInvalidOption))
+	}()
+	NewSubjectTree[string](WithValueDedup(func(v int) uint64 { return uint64(v) }, func(a, b int) bool { return a == b }))
+}
+
+//-------------------
+//  Test for Recording and Replaying Workloads
+//-------------------
+
+// Test that replaying a recording reproduces the same operations and the same subjects.
+func TestSubjectTreeRecordReplay(t *testing.T) {
+	var rec bytes.Buffer
+	r := NewRecorder(&rec)
+	st := NewSubjectTree[int]()
+	st.SetRecorder(r)
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+	st.Insert(b("foo.\"quoted\" with spaces\n"), 3)
+	st.Find(b("foo.bar"))
+	st.Match(b("foo.*"), func(_ []byte, _ *int) {})
+	st.Delete(b("foo.baz"))
+	st.Empty()
+	st.Insert(b("bar"), 4)
+	st.SetRecorder(nil)
+	st.Insert(b("not.recorded"), 5)
+	require_True(t, r.Flush() == nil)
+	require_Equal(t, r.Ops(), 8)
+
+	// Replaying while recording again gives the same recording.
+	var again bytes.Buffer
+	r2 := NewRecorder(&again)
+	st2 := NewSubjectTree[int]()
+	st2.SetRecorder(r2)
+	require_True(t, Replay(bytes.NewReader(rec.Bytes()), st2) == nil)
+	require_True(t, r2.Flush() == nil)
+	require_Equal(t, again.String(), rec.String())
+	require_Equal(t, st2.Size(), 1)
+	_, found := st2.Find(b("bar"))
+	require_True(t, found)
+
+	err := Replay(strings.NewReader("insert \"foo\"\nfrobnicate \"foo\"\n"), NewSubjectTree[int]())
+	require_True(t, errors.Is(err, ErrInvalidRecord))
+	err = Replay(strings.NewReader("insert foo\n"), NewSubjectTree[int]())
+	require_True(t, errors.Is(err, ErrInvalidRecord))
+
+	// Only modifications that succeeded are recorded, and walks made for other calls are not matches.
+	rec.Reset()
+	r = NewRecorder(&rec)
+	st.SetRecorder(r)
+	st.Insert([]byte{'a', noPivot}, 1)
+	st.Delete(b("missing"))
+	st.DumpFiltered(io.Discard, b(">"))
+	Reduce(st, b(">"), 0, func(acc int, _ []byte, v *int) int { return acc + *v })
+	st.MatchOne(b(">"), SelectRandom)
+	require_True(t, r.Flush() == nil)
+	require_Equal(t, r.Ops(), 0)
+
+	// Recorded values are inserted again by ReplayValues.
+	rec.Reset()
+	r = NewValueRecorder(&rec, func(dst []byte, v int) ([]byte, error) { return strconv.AppendInt(dst, int64(v), 10), nil })
+	st.SetRecorder(r)
+	st.Insert(b("foo.bar"), 42)
+	st.Insert(b("foo \"baz\""), -7)
+	st.Delete(b("foo.bar"))
+	st.Insert(b("foo.bar"), 43)
+	require_True(t, r.Flush() == nil)
+	require_Equal(t, rec.String(), "insert \"foo.bar\" \"42\"\ninsert \"foo \\\"baz\\\"\" \"-7\"\ndelete \"foo.bar\"\ninsert \"foo.bar\" \"43\"\n")
+	decode := func(b []byte) (int, error) { return strconv.Atoi(string(b)) }
+	st3 := NewSubjectTree[int]()
+	require_True(t, ReplayValues(bytes.NewReader(rec.Bytes()), st3, decode) == nil)
+	require_Equal(t, st3.Size(), 2)
+	v, _ := st3.Find(b("foo \"baz\""))
+	require_Equal(t, *v, -7)
+	v, _ = st3.Find(b("foo.bar"))
+	require_Equal(t, *v, 43)
+	// Replay ignores the values, ReplayValues needs them.
+	st3 = NewSubjectTree[int]()
+	require_True(t, Replay(bytes.NewReader(rec.Bytes()), st3) == nil)
+	v, _ = st3.Find(b("foo.bar"))
+	require_Equal(t, *v, 0)
+	err = ReplayValues(strings.NewReader("insert \"foo\"\n"), NewSubjectTree[int](), decode)
+	require_True(t, errors.Is(err, ErrInvalidRecord))
+	err = ReplayValues(strings.NewReader("insert \"foo\" \"x\"\n"), NewSubjectTree[int](), decode)
+	require_True(t, errors.Is(err, ErrInvalidRecord))
+
+	// A value recorder only records trees of its value type.
+	other := NewSubjectTree[string]()
+	other.SetRecorder(r)
+	other.Insert(b("foo"), "bar")
+	require_True(t, r.Flush() != nil)
+}
+
+//-------------------
+//  Test for String Keyed API
+//-------------------
+
+// Test the string variants, and that they do not allocate for lookups.
+func TestSubjectTreeStrings(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		subj := fmt.Sprintf("foo.%d.bar", i)
+		old, updated := st.InsertString(subj, i)
+		require_True(t, old == nil)
+		require_False(t, updated)
+	}
+	// The tree must not retain the memory of the strings we pass in.
+	buf := []byte("foo.100.bar")
+	st.InsertString(string(buf), 100)
+	copy(buf, "xxxxxxxxxxx")
+	v, found := st.FindString("foo.100.bar")
+	require_True(t, found)
+	require_Equal(t, *v, 100)
+
+	count := 0
+	st.MatchString("foo.*.bar", func(_ []byte, _ *int) { count++ })
+	require_Equal(t, count, 101)
+
+	v, found = st.DeleteString("foo.7.bar")
+	require_True(t, found)
+	require_Equal(t, *v, 7)
+	_, found = st.FindString("foo.7.bar")
+	require_False(t, found)
+
+	subj := "foo.42.bar"
+	allocs := testing.AllocsPerRun(100, func() { st.FindString(subj) })
+	require_Equal(t, allocs, 0)
+}
+
+//-------------------
+//  Test for Value Returning Variants
+//-------------------
+
+// Test that FindVal and MatchVals return copies that do not alias the stored values.
+func TestSubjectTreeFindValMatchVals(t *testing.T) {
+	type big struct{ a, b int }
+	st := NewSubjectTree[big]()
+	st.Insert(b("foo.bar"), big{1, 2})
+	st.Insert(b("foo.baz"), big{3, 4})
+
+	v, found := st.FindVal(b("foo.bar"))
+	require_True(t, found)
+	require_Equal(t, v, big{1, 2})
+	v.a = 100
+	p, _ := st.Find(b("foo.bar"))
+	require_Equal(t, p.a, 1)
+	_, found = st.FindVal(b("foo.nope"))
+	require_False(t, found)
+
+	sum := 0
+	st.MatchVals(b("foo.*"), func(_ []byte, v big) {
+		sum += v.a + v.b
+		v.a = 0
+	})
+	require_Equal(t, sum, 10)
+	p, _ = st.Find(b("foo.baz"))
+	require_Equal(t, p.a, 3)
+}
+
+//-------------------
+//  Test for Hierarchical Defaults
+//-------------------
+
+// Test that FindWithDefaults returns the values of the subject and its ancestors, most specific first.
+func TestSubjectTreeFindWithDefaults(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("a"), 1)
+	st.Insert(b("a.b.c"), 3)
+	st.Insert(b("a.bb"), 4)
+	st.Insert(b("ab"), 5)
+
+	vals := func(subject string) []int {
+		var got []int
+		for _, v := range st.FindWithDefaults(b(subject)) {
+			got = append(got, *v)
+		}
+		return got
+	}
+	require_Equal(t, fmt.Sprint(vals("a.b.c")), "[3 1]")
+	st.Insert(b("a.b"), 2)
+	require_Equal(t, fmt.Sprint(vals("a.b.c")), "[3 2 1]")
+	require_Equal(t, fmt.Sprint(vals("a.b.c.d")), "[3 2 1]")
+	require_Equal(t, fmt.Sprint(vals("a.bb")), "[4 1]")
+	require_Equal(t, fmt.Sprint(vals("ab.c")), "[5]")
+	require_Equal(t, len(vals("x.y")), 0)
+
+	// The pointers refer to the stored values like for Find.
+	*st.FindWithDefaults(b("a.b.x"))[0] = 20
+	v, _ := st.Find(b("a.b"))
+	require_Equal(t, *v, 20)
+}
+
+//-------------------
+//  Test for Prefix Annotations
+//-------------------
+
+// Test that prefix annotations are kept apart from entries and apply to the subjects below them.
+func TestSubjectTreePrefixMeta(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("tenant.a.orders"), 1)
+	st.Insert(b("tenant.a.users.x"), 2)
+	st.Insert(b("tenant.b.orders"), 3)
+	st.SetPrefixMeta(b("tenant.a"), "policy-a")
+	st.SetPrefixMeta(b("tenant.a.users."), "policy-users")
+	st.SetPrefixMeta(b("other"), "unused")
+
+	require_Equal(t, st.Size(), 3)
+	_, found := st.Find(b("tenant.a"))
+	require_False(t, found)
+	meta, found := st.PrefixMeta(b("tenant.a.users"))
+	require_True(t, found)
+	require_Equal(t, meta, any("policy-users"))
+	_, found = st.PrefixMeta(b("tenant"))
+	require_False(t, found)
+
+	require_Equal(t, st.MetaFor(b("tenant.a.orders")), any("policy-a"))
+	require_Equal(t, st.MetaFor(b("tenant.a.users.x")), any("policy-users"))
+	require_Equal(t, st.MetaFor(b("tenant.a")), any("policy-a"))
+	require_Equal(t, st.MetaFor(b("tenant.ab")), nil)
+	require_Equal(t, st.MetaFor(b("tenant.b.orders")), nil)
+
+	got := make(map[string]any)
+	st.MatchWithMeta(b("tenant.>"), func(subject []byte, _ *int, meta any) { got[string(subject)] = meta })
+	require_Equal(t, len(got), 3)
+	require_Equal(t, got["tenant.a.orders"], any("policy-a"))
+	require_Equal(t, got["tenant.a.users.x"], any("policy-users"))
+	require_Equal(t, got["tenant.b.orders"], nil)
+
+	// Annotations survive emptying the tree, and are removed with a nil meta.
+	st.Empty()
+	_, found = st.PrefixMeta(b("tenant.a"))
+	require_True(t, found)
+	st.SetPrefixMeta(b("tenant.a"), nil)
+	_, found = st.PrefixMeta(b("tenant.a"))
+	require_False(t, found)
+
+	for _, prefix := range []string{"", "a..b", "a.*", ">"} {
+		var panicked bool
+		func() {
+			defer func() { panicked = recover() != nil }()
+			st.SetPrefixMeta(b(prefix), 1)
+		}()
+		require_True(t, panicked)
+	}
+}
+
+//-------------------
+//  Test for Sealed Values and Write Checks
+//-------------------
+
+// Test that a sealed tree only hands out copies, and that the write check catches modifications.
+func TestSubjectTreeSealedAndCheckWrites(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.bar"), 1)
+	st.Insert(b("foo.baz"), 2)
+
+	st.SetSealed(true)
+	v, _ := st.Find(b("foo.bar"))
+	*v = 100
+	st.Match(b("foo.*"), func(_ []byte, v *int) { *v = 100 })
+	st.IterFast(func(_ []byte, v *int) bool {
+		*v = 100
+		return true
+	})
+	st.SetSealed(false)
+	v, _ = st.Find(b("foo.bar"))
+	require_Equal(t, *v, 1)
+	v, _ = st.Find(b("foo.baz"))
+	require_Equal(t, *v, 2)
+
+	// Reading is fine with checks enabled.
+	st.SetCheckValueWrites(true)
+	sum := 0
+	st.MatchValues(b(">"), func(v *int) { sum += *v })
+	require_Equal(t, sum, 3)
+
+	// But writing is not.
+	defer func() {
+		r := recover()
+		require_True(t, r != nil)
+		require_True(t, strings.Contains(fmt.Sprint(r), "foo.ba"))
+	}()
+	st.IterOrdered(func(_ []byte, v *int) bool {
+		*v++
+		return true
+	})
+	t.Fatalf("Expected a panic")
+}
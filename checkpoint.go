@@ -0,0 +1,142 @@
+package subtree
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+//-------------------
+// Checkpoint sinks
+//-------------------
+
+// ErrNoCheckpoint is returned by RestoreLatest when the sink holds no checkpoint with the prefix.
+var ErrNoCheckpoint = errors.New("subtree: no checkpoint")
+
+// CheckpointSink stores checkpoints by name, e.g. in an object store, so Save and Restore can write and read
+// them without this package depending on any client for it. Names may contain slashes.
+type CheckpointSink interface {
+	// Put stores the data read from r under the name, replacing any checkpoint of that name. A checkpoint
+	// must only become visible to Get once all of r was read without an error.
+	Put(ctx context.Context, name string, r io.Reader) error
+	// Get returns a reader for the checkpoint of the name, which the caller closes.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+	// List returns the names of the checkpoints starting with the prefix, in any order.
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Save encodes the tree as with Encode and stores it in the sink under the name. The encoding is streamed to
+// the sink from a snapshot of the tree, as with EncodeAsync, so the tree can be modified as soon as the call
+// to Save is made, with the same synchronization needed for Insert.
+func (t *SubjectTree[T]) Save(ctx context.Context, sink CheckpointSink, name string, encodeValue func(dst []byte, v T) ([]byte, error)) error {
+	pr, pw := io.Pipe()
+	job, err := t.EncodeAsync(pw, EncodeOptions[T]{EncodeValue: encodeValue, Context: ctx})
+	if err != nil {
+		return err
+	}
+	go func() { pw.CloseWithError(job.Wait()) }()
+	err = sink.Put(ctx, name, pr)
+	// Unblock the encoding if the sink stopped reading early.
+	pr.CloseWithError(io.ErrClosedPipe)
+	job.Cancel()
+	if jerr := job.Wait(); err == nil {
+		err = jerr
+	}
+	return err
+}
+
+// Restore reads the checkpoint of the name from the sink, as written by Save.
+func Restore[T any](ctx context.Context, sink CheckpointSink, name string, decodeValue func(b []byte) (T, error)) (*SubjectTree[T], error) {
+	r, err := sink.Get(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return Decode(r, decodeValue)
+}
+
+// RestoreLatest reads the checkpoint with the largest name starting with the prefix from the sink, e.g. the
+// most recent one for names ending in a timestamp that sorts in time order, and returns it with its name.
+// Returns ErrNoCheckpoint if there is none.
+func RestoreLatest[T any](ctx context.Context, sink CheckpointSink, prefix string, decodeValue func(b []byte) (T, error)) (*SubjectTree[T], string, error) {
+	names, err := sink.List(ctx, prefix)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(names) == 0 {
+		return nil, "", ErrNoCheckpoint
+	}
+	name := slices.Max(names)
+	t, err := Restore(ctx, sink, name, decodeValue)
+	return t, name, err
+}
+
+// DirSink returns a CheckpointSink storing checkpoints as files in the directory, e.g. for local disks or
+// tests. Slashes in names are directories below it.
+func DirSink(dir string) CheckpointSink {
+	return dirSink(dir)
+}
+
+// dirSink is a CheckpointSink storing files in a directory.
+type dirSink string
+
+func (d dirSink) path(name string) string {
+	return filepath.Join(string(d), filepath.FromSlash(name))
+}
+
+// Put writes the checkpoint to a temporary file and renames it into place once complete.
+func (d dirSink) Put(_ context.Context, name string, r io.Reader) error {
+	path := d.path(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func (d dirSink) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	return os.Open(d.path(name))
+}
+
+// List walks the directory for files with names starting with the prefix, skipping the hidden temporary files.
+func (d dirSink) List(_ context.Context, prefix string) ([]string, error) {
+	var names []string
+	err := filepath.WalkDir(string(d), func(path string, e os.DirEntry, err error) error {
+		if err != nil || e.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(string(d), path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		if strings.HasPrefix(name, prefix) && !strings.HasPrefix(e.Name(), ".") {
+			names = append(names, name)
+		}
+		return nil
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return names, err
+}
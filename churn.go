@@ -0,0 +1,124 @@
+package subtree
+
+import "time"
+
+//-------------------
+// Churn rates
+//-------------------
+
+// WithChurnRates counts the inserts, updates and deletes in intervals of the given length, and Stats reports
+// them for the current interval and up to keep-1 intervals before it, so scaling decisions can follow the
+// churn of subjects without wrapping every call. Intervals are aligned to multiples of the length. Counting
+// reads the clock on every modification.
+func WithChurnRates(interval time.Duration, keep int) Option {
+	return func(o *options) {
+		if interval <= 0 || keep <= 0 {
+			o.invalid("WithChurnRates needs a positive interval and number to keep, got %v and %d", interval, keep)
+		}
+		o.churnInterval, o.churnKeep = max(interval, 0), max(keep, 1)
+	}
+}
+
+// ChurnStats holds the modifications of a tree in its recent intervals.
+type ChurnStats struct {
+	Interval  time.Duration   // Length of the intervals
+	Intervals []ChurnInterval // The current interval first, then the ones before it as far as they were tracked
+}
+
+// ChurnInterval counts the modifications of a tree during an interval.
+type ChurnInterval struct {
+	Start    time.Time     // Start of the interval
+	Duration time.Duration // Length of the interval, up to now for the current one
+	Inserts  uint64        // Subjects inserted
+	Updates  uint64        // Values of subjects replaced
+	Deletes  uint64        // Subjects deleted, including those removed by Empty
+}
+
+// InsertRate returns the inserts per second during the interval.
+func (c ChurnInterval) InsertRate() float64 {
+	return c.rate(c.Inserts)
+}
+
+// UpdateRate returns the updates per second during the interval.
+func (c ChurnInterval) UpdateRate() float64 {
+	return c.rate(c.Updates)
+}
+
+// DeleteRate returns the deletes per second during the interval.
+func (c ChurnInterval) DeleteRate() float64 {
+	return c.rate(c.Deletes)
+}
+
+// rate returns n per second of the interval.
+func (c ChurnInterval) rate(n uint64) float64 {
+	if c.Duration <= 0 {
+		return 0
+	}
+	return float64(n) / c.Duration.Seconds()
+}
+
+// churnTracker keeps the counts of the recent intervals in a ring.
+type churnTracker struct {
+	interval time.Duration
+	now      func() time.Time
+	ring     []ChurnInterval
+	cur      int // Index of the current interval in the ring
+}
+
+// newChurnTracker returns a tracker for the options, or nil if tracking is not enabled.
+func newChurnTracker(o *options) *churnTracker {
+	if o.churnInterval <= 0 {
+		return nil
+	}
+	return &churnTracker{interval: o.churnInterval, now: o.nowFunc(), ring: make([]ChurnInterval, o.churnKeep)}
+}
+
+// advance moves the current interval forward to the one holding now, clearing those passed over.
+func (c *churnTracker) advance(now time.Time) {
+	cur := &c.ring[c.cur]
+	if cur.Start.IsZero() {
+		cur.Start = now.Truncate(c.interval)
+		return
+	}
+	steps := int(now.Sub(cur.Start) / c.interval)
+	if steps <= 0 {
+		return
+	}
+	start := cur.Start.Add(time.Duration(steps) * c.interval)
+	for i := min(steps, len(c.ring)) - 1; i >= 0; i-- {
+		c.cur = (c.cur + 1) % len(c.ring)
+		c.ring[c.cur] = ChurnInterval{Start: start.Add(-time.Duration(i) * c.interval)}
+	}
+}
+
+// record counts n modifications of the kind op.
+func (c *churnTracker) record(op Op, n int) {
+	c.advance(c.now())
+	cur := &c.ring[c.cur]
+	switch op {
+	case OpInsert:
+		cur.Inserts += uint64(n)
+	case OpUpdate:
+		cur.Updates += uint64(n)
+	case OpDelete:
+		cur.Deletes += uint64(n)
+	}
+}
+
+// stats returns the counts of the recent intervals. The tracker is not modified, so this can run next to
+// other readers.
+func (c *churnTracker) stats() *ChurnStats {
+	now := c.now()
+	ring := churnTracker{interval: c.interval, ring: append([]ChurnInterval(nil), c.ring...), cur: c.cur}
+	ring.advance(now)
+	cs := &ChurnStats{Interval: c.interval, Intervals: make([]ChurnInterval, 0, len(ring.ring))}
+	for i := range ring.ring {
+		ci := ring.ring[(ring.cur-i+len(ring.ring))%len(ring.ring)]
+		if ci.Start.IsZero() {
+			break
+		}
+		ci.Duration = min(now.Sub(ci.Start), c.interval)
+		cs.Intervals = append(cs.Intervals, ci)
+	}
+	return cs
+}
@@ -0,0 +1,79 @@
+package subtree
+
+import (
+	"sync"
+	"time"
+)
+
+//-------------------
+// Clocks
+//-------------------
+
+// Clock tells the time. Trees read the time only through their clock, for the decay of hot prefixes, churn
+// intervals, history and wall clock stamps, deadlines and the durations handed to latency hooks.
+type Clock interface {
+	Now() time.Time
+}
+
+// WithClock makes the tree read the time from c instead of the system clock, e.g. a ManualClock so tests can
+// advance time deterministically, or a monotonic source on systems whose wall clock jumps. Clocks of trees
+// used from several goroutines have to be safe for concurrent use.
+func WithClock(c Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+// now returns the time of the clock of the options.
+func (o *options) now() time.Time {
+	if o.clock != nil {
+		return o.clock.Now()
+	}
+	return time.Now()
+}
+
+// since returns the time passed since start on the clock of the options.
+func (o *options) since(start time.Time) time.Duration {
+	return o.now().Sub(start)
+}
+
+// nowFunc returns the function telling the time of the clock of the options.
+func (o *options) nowFunc() func() time.Time {
+	if o.clock != nil {
+		return o.clock.Now
+	}
+	return time.Now
+}
+
+// ManualClock is a Clock that only moves when told to. It is safe for concurrent use.
+type ManualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewManualClock returns a ManualClock set to the given time.
+func NewManualClock(now time.Time) *ManualClock {
+	return &ManualClock{now: now}
+}
+
+// Now returns the time the clock is set to.
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Set sets the clock to the given time.
+func (c *ManualClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = now
+}
+
+// Advance moves the clock forward by d, and returns the new time.
+func (c *ManualClock) Advance(d time.Duration) time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	return c.now
+}
@@ -0,0 +1,154 @@
+// Command subtree inspects subject trees encoded with SubjectTree.Encode, e.g. checkpoints,
+// outside of the service that wrote them. Values are treated as opaque bytes.
+//
+// Usage:
+//
+//	subtree stats <file>            Print entry and node statistics
+//	subtree dump <file> [filter]    Dump the tree structure, optionally only for a filter
+//	subtree match <file> <filter>   Print subjects matching the filter
+//	subtree diff <file> <other>     Print subjects that differ between two trees
+//	subtree export <file>           Print all entries as subject and quoted value, one per line
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/rskv-p/subtree"
+)
+
+const usage = `usage: subtree <command> <file> [args]
+
+commands:
+  stats <file>            print entry and node statistics
+  dump <file> [filter]    dump the tree structure, optionally only for a filter
+  match <file> <filter>   print subjects matching the filter
+  diff <file> <other>     print subjects that differ between two trees
+  export <file>           print all entries as subject and quoted value
+`
+
+var errUsage = errors.New("invalid usage")
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprint(os.Stderr, usage)
+		} else {
+			fmt.Fprintf(os.Stderr, "subtree: %v\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run executes the command given by args, writing its output to w.
+func run(args []string, w io.Writer) error {
+	if len(args) < 2 {
+		return errUsage
+	}
+	cmd, file, rest := args[0], args[1], args[2:]
+	st, err := load(file)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cmd == "stats" && len(rest) == 0:
+		stats(w, st)
+	case cmd == "dump" && len(rest) == 0:
+		st.DumpWith(w, nil, formatValue)
+	case cmd == "dump" && len(rest) == 1:
+		st.DumpWith(w, []byte(rest[0]), formatValue)
+	case cmd == "match" && len(rest) == 1:
+		var subjects []string
+		st.Match([]byte(rest[0]), func(subject []byte, _ *[]byte) {
+			subjects = append(subjects, string(subject))
+		})
+		// Match does not guarantee any order, so sort for stable output.
+		sort.Strings(subjects)
+		for _, subject := range subjects {
+			fmt.Fprintln(w, subject)
+		}
+	case cmd == "diff" && len(rest) == 1:
+		other, err := load(rest[0])
+		if err != nil {
+			return err
+		}
+		st.Diff(other, bytes.Equal, func(subject []byte, a, b *[]byte) bool {
+			switch {
+			case b == nil:
+				fmt.Fprintf(w, "- %s\n", subject)
+			case a == nil:
+				fmt.Fprintf(w, "+ %s\n", subject)
+			default:
+				fmt.Fprintf(w, "~ %s\n", subject)
+			}
+			return true
+		})
+	case cmd == "export" && len(rest) == 0:
+		st.IterOrdered(func(subject []byte, v *[]byte) bool {
+			fmt.Fprintf(w, "%s\t%q\n", subject, *v)
+			return true
+		})
+	default:
+		return errUsage
+	}
+	return nil
+}
+
+// load decodes the tree stored in file with raw byte values.
+func load(file string) (*subtree.SubjectTree[[]byte], error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	st, err := subtree.Decode(f, func(b []byte) ([]byte, error) { return bytes.Clone(b), nil })
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file, err)
+	}
+	return st, nil
+}
+
+// formatValue formats raw values for dumps.
+func formatValue(v []byte) string { return fmt.Sprintf("%q", v) }
+
+// stats prints entry and node statistics for the tree.
+func stats(w io.Writer, st *subtree.SubjectTree[[]byte]) {
+	kinds := make(map[string]int)
+	var nodes, maxDepth, children, prefixBytes int
+	st.WalkNodes(func(info subtree.NodeInfo) bool {
+		nodes++
+		kinds[info.Kind]++
+		maxDepth = max(maxDepth, info.Depth)
+		children += info.Children
+		prefixBytes += len(info.Prefix)
+		return true
+	})
+	var subjectBytes, valueBytes int
+	st.IterFast(func(subject []byte, v *[]byte) bool {
+		subjectBytes += len(subject)
+		valueBytes += len(*v)
+		return true
+	})
+
+	fmt.Fprintf(w, "entries:       %d\n", st.Size())
+	fmt.Fprintf(w, "subject bytes: %d\n", subjectBytes)
+	fmt.Fprintf(w, "value bytes:   %d\n", valueBytes)
+	fmt.Fprintf(w, "nodes:         %d\n", nodes)
+	names := make([]string, 0, len(kinds))
+	for kind := range kinds {
+		names = append(names, kind)
+	}
+	sort.Strings(names)
+	for _, kind := range names {
+		fmt.Fprintf(w, "  %-11s  %d\n", kind+":", kinds[kind])
+	}
+	fmt.Fprintf(w, "max depth:     %d\n", maxDepth)
+	fmt.Fprintf(w, "prefix bytes:  %d\n", prefixBytes)
+	if nodes > 0 {
+		fmt.Fprintf(w, "avg fanout:    %.2f\n", float64(children)/float64(nodes))
+	}
+}
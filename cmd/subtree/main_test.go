@@ -0,0 +1,67 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rskv-p/subtree"
+)
+
+// writeTree encodes a tree with the given entries to a file in dir.
+func writeTree(t *testing.T, dir, name string, entries map[string]string) string {
+	t.Helper()
+	st := subtree.NewSubjectTree[[]byte]()
+	for subject, v := range entries {
+		st.Insert([]byte(subject), []byte(v))
+	}
+	path := filepath.Join(dir, name)
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("Error creating file: %v", err)
+	}
+	defer f.Close()
+	if err := st.Encode(f, func(dst []byte, v []byte) ([]byte, error) { return append(dst, v...), nil }); err != nil {
+		t.Fatalf("Error encoding tree: %v", err)
+	}
+	return path
+}
+
+// Test the subcommands against encoded files.
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTree(t, dir, "a", map[string]string{"foo.bar.A": "1", "foo.bar.B": "2", "foo.baz": "3"})
+	b := writeTree(t, dir, "b", map[string]string{"foo.bar.A": "1", "foo.bar.B": "22", "foo.new": "4"})
+
+	for _, tc := range []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"stats", a}, []string{"entries:       3", "NODE4:"}},
+		{[]string{"dump", a}, []string{`LEAF: Suffix: "z" Value: "3"`}},
+		{[]string{"dump", a, "foo.baz"}, []string{`Value: "3"`}},
+		{[]string{"match", a, "foo.bar.*"}, []string{"foo.bar.A\nfoo.bar.B\n"}},
+		{[]string{"diff", a, b}, []string{"~ foo.bar.B\n- foo.baz\n+ foo.new\n"}},
+		{[]string{"export", a}, []string{"foo.bar.A\t\"1\"\nfoo.bar.B\t\"2\"\nfoo.baz\t\"3\"\n"}},
+	} {
+		var out strings.Builder
+		if err := run(tc.args, &out); err != nil {
+			t.Fatalf("Unexpected error for %v: %v", tc.args, err)
+		}
+		for _, e := range tc.expected {
+			if !strings.Contains(out.String(), e) {
+				t.Fatalf("Expected output of %v to contain %q, got:\n%s", tc.args, e, out.String())
+			}
+		}
+	}
+
+	// Bad usage and bad files are errors.
+	var out strings.Builder
+	if err := run([]string{"match", a}, &out); err != errUsage {
+		t.Fatalf("Expected usage error, got %v", err)
+	}
+	if err := run([]string{"stats", filepath.Join(dir, "missing")}, &out); err == nil {
+		t.Fatalf("Expected error for missing file")
+	}
+}
@@ -0,0 +1,63 @@
+package subtree
+
+//-------------------
+// Collecting subjects and values
+//-------------------
+
+// Subjects returns copies of all subjects in the tree in subject order.
+// Meant for small trees and tests, every subject is copied into a slice of its own.
+func (t *SubjectTree[T]) Subjects() [][]byte {
+	return t.SubjectsPage(nil, 0)
+}
+
+// Values returns copies of all values in the tree in subject order.
+// Meant for small trees and tests, use IterOrdered to walk large trees.
+func (t *SubjectTree[T]) Values() []T {
+	vals, _ := t.ValuesPage(nil, 0)
+	return vals
+}
+
+// SubjectsPage returns copies of at most limit subjects sorting after the given subject, in subject order.
+// A nil after starts at the first subject and a limit of 0 or less returns all of them. Pass the last
+// subject returned to get the next page, an empty result means there are no more.
+func (t *SubjectTree[T]) SubjectsPage(after []byte, limit int) [][]byte {
+	var subjects [][]byte
+	t.collect(after, limit, func(subject []byte, _ *T) {
+		subjects = append(subjects, copyBytes(subject))
+	})
+	return subjects
+}
+
+// ValuesPage returns copies of at most limit values of the subjects sorting after the given subject, in
+// subject order, and a copy of the subject of the last value returned to pass in for the next page.
+// A nil after starts at the first subject and a limit of 0 or less returns all of them.
+// An empty result means there are no more.
+func (t *SubjectTree[T]) ValuesPage(after []byte, limit int) ([]T, []byte) {
+	var vals []T
+	var last []byte
+	t.collect(after, limit, func(subject []byte, val *T) {
+		vals = append(vals, *val)
+		last = append(last[:0], subject...)
+	})
+	return vals, last
+}
+
+// Internal function handing the callback at most limit entries sorting after the given subject in subject order.
+func (t *SubjectTree[T]) collect(after []byte, limit int, cb func(subject []byte, val *T)) {
+	if t == nil || t.size == 0 {
+		return
+	}
+	walk := func(subject []byte, val *T) bool {
+		cb(subject, val)
+		limit--
+		return limit != 0
+	}
+	if after == nil {
+		t.iterAll(true, walk)
+		return
+	}
+	t.matchOrdered(fwcFilter, after, walk)
+}
+
+// fwcFilter matches every subject.
+var fwcFilter = []byte{fwc}
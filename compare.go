@@ -0,0 +1,92 @@
+package subtree
+
+import (
+	"encoding/binary"
+	"hash"
+)
+
+//-------------------
+// Comparing trees
+//-------------------
+
+// Equal returns true if both trees hold the same subjects with values that are equal according to eq.
+func (t *SubjectTree[T]) Equal(other *SubjectTree[T], eq func(a, b T) bool) bool {
+	if t.Size() != other.Size() {
+		return false
+	}
+	if t.Size() == 0 {
+		return true
+	}
+	// With equal sizes, every entry of ours being in other means they hold the same subjects.
+	equal := true
+	t.IterFast(func(subject []byte, v *T) bool {
+		ov, found := other.Find(subject)
+		equal = found && eq(*v, *ov)
+		return equal
+	})
+	return equal
+}
+
+// Diff calls cb for every subject that differs between the trees. For subjects only in this tree b is nil,
+// for subjects only in other a is nil, and for subjects in both whose values are not equal according to eq,
+// both are set. The callback can return false to stop. Subjects are passed in order for each of the trees,
+// first all the differences found walking this tree, then the subjects only present in other.
+func (t *SubjectTree[T]) Diff(other *SubjectTree[T], eq func(a, b T) bool, cb func(subject []byte, a, b *T) bool) {
+	if cb == nil {
+		return
+	}
+	stopped := false
+	t.IterOrdered(func(subject []byte, v *T) bool {
+		ov, found := other.Find(subject)
+		if !found {
+			stopped = !cb(subject, v, nil)
+		} else if !eq(*v, *ov) {
+			stopped = !cb(subject, v, ov)
+		}
+		return !stopped
+	})
+	if stopped {
+		return
+	}
+	other.IterOrdered(func(subject []byte, ov *T) bool {
+		if _, found := t.Find(subject); !found {
+			return cb(subject, nil, ov)
+		}
+		return true
+	})
+}
+
+// DiffEntries returns the differences between the trees as entries, taking other as the newer tree: the
+// entries only in this tree were removed, the entries only in other were added, and entries in both whose
+// values are not equal according to eq were changed to the value in other.
+func (t *SubjectTree[T]) DiffEntries(other *SubjectTree[T], eq func(a, b T) bool) (removed, added, changed []Entry[T]) {
+	t.Diff(other, eq, func(subject []byte, a, b *T) bool {
+		switch {
+		case b == nil:
+			removed = append(removed, entryOf(subject, a))
+		case a == nil:
+			added = append(added, entryOf(subject, b))
+		default:
+			changed = append(changed, entryOf(subject, b))
+		}
+		return true
+	})
+	return removed, added, changed
+}
+
+// Hash writes the contents of the tree to h, calling hashValue to write each value.
+// Entries are written in subject order so the result only depends on the contents, not on the insertion order
+// or the shape of the tree. If hashValue is nil only the subjects are hashed.
+func (t *SubjectTree[T]) Hash(h hash.Hash, hashValue func(hash.Hash, T)) {
+	var hdr [binary.MaxVarintLen64]byte
+	h.Write(hdr[:binary.PutUvarint(hdr[:], uint64(t.Size()))])
+	t.IterOrdered(func(subject []byte, v *T) bool {
+		// Length prefix the subject so the boundary with the value is unambiguous.
+		h.Write(hdr[:binary.PutUvarint(hdr[:], uint64(len(subject)))])
+		h.Write(subject)
+		if hashValue != nil {
+			hashValue(h, *v)
+		}
+		return true
+	})
+}
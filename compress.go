@@ -0,0 +1,196 @@
+package subtree
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+//-------------------
+// Compressed values
+//-------------------
+
+// CompressedSubjectTree is a SubjectTree with byte slice values that are compressed with DEFLATE when they
+// are at least a threshold in size, and decompressed again when they are found or matched. Payloads like
+// JSON documents often shrink to a fraction of their size. Values that do not get smaller are stored as
+// they are, as are values below the threshold, which are too small to be worth the time.
+// A CompressedSubjectTree is not safe for concurrent use.
+type CompressedSubjectTree struct {
+	t         *SubjectTree[[]byte]
+	threshold int
+	stats     CompressionStats
+}
+
+// CompressionStats reports how much a CompressedSubjectTree saves on the values it holds.
+type CompressionStats struct {
+	Values      int    // Number of values held
+	Compressed  int    // Number of those values stored compressed
+	RawBytes    uint64 // Total size of the values as inserted
+	StoredBytes uint64 // Total size of the values as stored, including a small header each
+}
+
+// Ratio returns the stored size of the values divided by their size as inserted, or 1 without values.
+func (s CompressionStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.StoredBytes) / float64(s.RawBytes)
+}
+
+// Stored values start with a byte telling how the rest is encoded. Compressed values follow it with their
+// size as inserted, as a uvarint.
+const (
+	valueRaw      = 0
+	valueDeflated = 1
+)
+
+// NewCompressedSubjectTree creates a new CompressedSubjectTree compressing values of at least threshold
+// bytes. The options configure the underlying tree.
+func NewCompressedSubjectTree(threshold int, opts ...Option) *CompressedSubjectTree {
+	return &CompressedSubjectTree{t: NewSubjectTree[[]byte](opts...), threshold: max(threshold, 0)}
+}
+
+// Tree returns the underlying tree holding the values as stored, which must only be modified through c.
+func (c *CompressedSubjectTree) Tree() *SubjectTree[[]byte] {
+	return c.t
+}
+
+// Size returns the number of elements stored.
+func (c *CompressedSubjectTree) Size() int {
+	return c.t.Size()
+}
+
+// Stats returns the sizes of the values held.
+func (c *CompressedSubjectTree) Stats() CompressionStats {
+	return c.stats
+}
+
+// Insert a value into the tree. Will return if the value was updated and if so the old value.
+// The value is copied, so the caller is free to reuse it.
+func (c *CompressedSubjectTree) Insert(subject, value []byte) ([]byte, bool) {
+	stored := c.encode(value)
+	old, updated, changed := c.t.InsertChanged(subject, stored)
+	if changed {
+		c.account(stored, 1)
+	}
+	if !updated {
+		return nil, false
+	}
+	if changed {
+		c.account(*old, -1)
+	}
+	return decodeValue(*old), true
+}
+
+// Find will find a value and return it, or false if it was not found. The value must not be modified.
+func (c *CompressedSubjectTree) Find(subject []byte) ([]byte, bool) {
+	stored, ok := c.t.Find(subject)
+	if !ok {
+		return nil, false
+	}
+	return decodeValue(*stored), true
+}
+
+// Delete will delete the item and return its value, or not found if it did not exist.
+func (c *CompressedSubjectTree) Delete(subject []byte) ([]byte, bool) {
+	stored, ok := c.t.Delete(subject)
+	if !ok {
+		return nil, false
+	}
+	c.account(*stored, -1)
+	return decodeValue(*stored), true
+}
+
+// Match will match against a subject that can have wildcards and invoke the callback func for each matched value.
+// The subject passed to the callback is only valid for the duration of the callback, and the value must not
+// be modified.
+func (c *CompressedSubjectTree) Match(filter []byte, cb func(subject, val []byte)) {
+	if cb == nil {
+		return
+	}
+	c.t.Match(filter, func(subject []byte, stored *[]byte) {
+		cb(subject, decodeValue(*stored))
+	})
+}
+
+// IterOrdered will walk all entries in the tree in subject order, stopping when the callback returns false.
+// The subject passed to the callback is only valid for the duration of the callback, and the value must not
+// be modified.
+func (c *CompressedSubjectTree) IterOrdered(cb func(subject, val []byte) bool) {
+	if cb == nil {
+		return
+	}
+	c.t.IterOrdered(func(subject []byte, stored *[]byte) bool {
+		return cb(subject, decodeValue(*stored))
+	})
+}
+
+// account adds a stored value to the statistics if sign is 1, or removes it if sign is -1.
+func (c *CompressedSubjectTree) account(stored []byte, sign int) {
+	raw, deflated := valueSize(stored)
+	c.stats.Values += sign
+	if deflated {
+		c.stats.Compressed += sign
+	}
+	if sign > 0 {
+		c.stats.RawBytes += uint64(raw)
+		c.stats.StoredBytes += uint64(len(stored))
+	} else {
+		c.stats.RawBytes -= uint64(raw)
+		c.stats.StoredBytes -= uint64(len(stored))
+	}
+}
+
+// flateWriters are reused, as each holds large buffers.
+var flateWriters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+	return w
+}}
+
+// encode returns the value as it is to be stored, compressed if that is worth it.
+func (c *CompressedSubjectTree) encode(value []byte) []byte {
+	if len(value) >= c.threshold && len(value) > 0 {
+		var buf bytes.Buffer
+		buf.Grow(len(value) / 2)
+		buf.WriteByte(valueDeflated)
+		buf.Write(binary.AppendUvarint(nil, uint64(len(value))))
+		w := flateWriters.Get().(*flate.Writer)
+		w.Reset(&buf)
+		// Writing to a buffer does not fail.
+		w.Write(value)
+		w.Close()
+		flateWriters.Put(w)
+		if buf.Len() < len(value)+1 {
+			return bytes.Clone(buf.Bytes())
+		}
+	}
+	return append([]byte{valueRaw}, value...)
+}
+
+// valueSize returns the size of a stored value as it was inserted, and if it is compressed.
+func valueSize(stored []byte) (int, bool) {
+	if stored[0] != valueDeflated {
+		return len(stored) - 1, false
+	}
+	n, _ := binary.Uvarint(stored[1:])
+	return int(n), true
+}
+
+// decodeValue returns the value as it was inserted. Raw values are returned without copying.
+func decodeValue(stored []byte) []byte {
+	if stored[0] != valueDeflated {
+		return stored[1:]
+	}
+	n, k := binary.Uvarint(stored[1:])
+	value := make([]byte, n)
+	r := flate.NewReader(bytes.NewReader(stored[1+k:]))
+	defer r.Close()
+	if _, err := io.ReadFull(r, value); err != nil {
+		// Only this tree writes compressed values, so they can only be broken by a bug.
+		panic(fmt.Sprintf("subtree: corrupted compressed value: %v", err))
+	}
+	return value
+}
@@ -0,0 +1,48 @@
+package subtree
+
+import "sync/atomic"
+
+//-------------------
+// Copy-on-write generations
+//-------------------
+
+// Every tree that shares nodes with another tree gets a unique, non-zero generation. Internal nodes record
+// the generation that created them and may only be modified in place by a tree with the same generation.
+// Leaves do not carry a generation, so a shared tree always copies a leaf before modifying it.
+// A generation of 0 means the tree has never shared its nodes and everything can be modified in place.
+var lastGen atomic.Uint64
+
+// nextGen returns a new unique copy-on-write generation.
+func nextGen() uint64 { return lastGen.Add(1) }
+
+// cow returns n if it can be modified in place by this tree, otherwise a private copy owned by this tree.
+func (t *SubjectTree[T]) cow(n node) node {
+	if t.gen == 0 {
+		return n
+	}
+	if bn := n.base(); bn != nil && bn.gen == t.gen {
+		return n
+	}
+	nn := n.clone()
+	if bn := nn.base(); bn != nil {
+		bn.gen = t.gen
+		t.counts.NodeAllocs++
+	} else {
+		t.counts.LeafAllocs++
+	}
+	t.counts.Clones++
+	return nn
+}
+
+// writable makes sure the node referenced by np can be modified in place, copying it if needed.
+func (t *SubjectTree[T]) writable(np *node) node {
+	n := t.cow(*np)
+	*np = n
+	return n
+}
+
+// share marks all current nodes as shared and moves this tree to a new generation so that any
+// future modification will copy nodes instead of changing them in place.
+func (t *SubjectTree[T]) share() {
+	t.gen = nextGen()
+}
@@ -0,0 +1,82 @@
+//go:build subtree_debug
+
+package subtree
+
+import "fmt"
+
+//-------------------
+// Invariant checks for debug builds
+//-------------------
+
+// debugChecks is set when built with the subtree_debug tag, which validates the tree after every modification.
+// This visits every node each time, so it is only meant to run tests with, e.g. go test -tags subtree_debug.
+const debugChecks = true
+
+// debugCheck validates the tree after op and panics if it does not hold up, so corruption is caught at the
+// modification that caused it. With WithRecover the panic is recovered like any other. Trees already known
+// to be broken are not checked again.
+func (t *SubjectTree[T]) debugCheck(op string) {
+	if t == nil || t.broken != nil {
+		return
+	}
+	if err := t.Validate(); err != nil {
+		panic(fmt.Sprintf("subtree: %s left an invalid tree: %v", op, err))
+	}
+}
+
+// matchOnce returns a function to call with every value a match hands out, which panics when one comes up
+// twice. Every leaf has a single path from the root and wildcards only choose which children to descend
+// into, so this can only happen in a corrupt tree.
+func matchOnce[T any](filter []byte) func(val *T) {
+	return recordOnce(filter, make(map[*T]struct{}))
+}
+
+// recordOnce returns a function adding values to seen, which panics when one is in it already.
+func recordOnce[T any](filter []byte, seen map[*T]struct{}) func(val *T) {
+	return func(val *T) {
+		if _, ok := seen[val]; ok {
+			panic(fmt.Sprintf("subtree: match of %q visited an entry twice", filter))
+		}
+		seen[val] = struct{}{}
+	}
+}
+
+// debugMatchLimit is the largest tree whose matches matchConsistent compares with every entry.
+const debugMatchLimit = 4096
+
+// matchConsistent returns a function to call with every value a match of the filter hands out, checking it
+// like matchOnce, and one to call once the match ran to its end. The latter panics unless the match handed
+// out exactly the entries whose subjects the filter matches by MatchesSubject, as the walk of the nodes has
+// to agree with comparing tokens. Only valid filters and subjects without empty tokens are compared, in
+// trees of up to debugMatchLimit entries the callback did not modify.
+func (t *SubjectTree[T]) matchConsistent(filter []byte) (visit func(val *T), done func()) {
+	seen := make(map[*T]struct{})
+	version := t.version
+	done = func() {
+		if t.version != version || t.size > debugMatchLimit || !validFilter(filter) {
+			return
+		}
+		t.iterAll(true, func(subject []byte, val *T) bool {
+			if emptyToken(subject) {
+				return true
+			}
+			if _, ok := seen[val]; ok != MatchesSubject(filter, subject) {
+				panic(fmt.Sprintf("subtree: match of %q disagrees with MatchesSubject on %q (matched: %v)", filter, subject, ok))
+			}
+			return true
+		})
+	}
+	return recordOnce(filter, seen), done
+}
+
+// emptyToken returns true if the subject has an empty token, which no subject should.
+func emptyToken(subject []byte) bool {
+	for start := 0; start <= len(subject); {
+		end := tokenEnd(subject, start)
+		if end == start {
+			return true
+		}
+		start = end + 1
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+package subtree
+
+//-------------------
+// Value deduplication
+//-------------------
+
+// WithValueDedup makes inserts store the instance of a value already held by the tree when an equal one is
+// inserted, as told by eq among the values with the same hash. Values like a small configuration struct
+// repeated for millions of subjects then share the strings, slices, maps and pointers they hold instead of
+// each keeping its own copies, which become garbage right away. The value itself is still stored in every
+// leaf, so values without any such references gain nothing. The instances are kept in a table next to the
+// tree that is rebuilt from the stored values once it has doubled in size, so it does not keep values no
+// longer in the tree for long. The functions must be for the value type of the tree, or the option is invalid.
+func WithValueDedup[T any](hash func(v T) uint64, eq func(a, b T) bool) Option {
+	return func(o *options) {
+		if hash == nil || eq == nil {
+			o.invalid("WithValueDedup needs a hash and an equality function")
+		}
+		o.dedup = valueDedup[T]{hash: hash, eq: eq}
+	}
+}
+
+// valueDedup holds the instances of the values in the tree by their hashes.
+type valueDedup[T any] struct {
+	hash    func(v T) uint64
+	eq      func(a, b T) bool
+	values  map[uint64][]T
+	n       int // Number of instances held
+	sweepAt int // Number of instances at which to rebuild the table
+}
+
+// dedupMinSweep is the smallest number of instances at which the table is rebuilt.
+const dedupMinSweep = 1024
+
+// newValueDedup returns a table for the options, or nil if deduplication is not enabled.
+func newValueDedup[T any](o *options) *valueDedup[T] {
+	if o.dedup == nil {
+		return nil
+	}
+	proto := o.dedup.(valueDedup[T])
+	return &valueDedup[T]{hash: proto.hash, eq: proto.eq, values: make(map[uint64][]T), sweepAt: dedupMinSweep}
+}
+
+// instance returns the instance held for a value equal to v, after adding v as one if there is none.
+func (d *valueDedup[T]) instance(v T) T {
+	h := d.hash(v)
+	for _, iv := range d.values[h] {
+		if d.eq(iv, v) {
+			return iv
+		}
+	}
+	d.values[h] = append(d.values[h], v)
+	d.n++
+	return v
+}
+
+// emptied drops all instances, as the tree holds no values anymore.
+func (d *valueDedup[T]) emptied() {
+	clear(d.values)
+	d.n, d.sweepAt = 0, dedupMinSweep
+}
+
+// dedupInserted rebuilds the table from the values in the tree once it has doubled in size since the last
+// time, dropping instances of values that are gone.
+func (t *SubjectTree[T]) dedupInserted() {
+	if t.dedup.n >= t.dedup.sweepAt {
+		t.dedupRebuild()
+	}
+}
+
+// dedupRebuild rebuilds the table from the values in the tree.
+func (t *SubjectTree[T]) dedupRebuild() {
+	d := t.dedup
+	d.emptied()
+	if t.root != nil {
+		var _pre [256]byte
+		t.iter(t.root, _pre[:0], false, func(_ []byte, v *T) bool {
+			d.instance(*v)
+			return true
+		})
+	}
+	d.sweepAt = max(2*d.n, dedupMinSweep)
+}
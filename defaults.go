@@ -0,0 +1,26 @@
+package subtree
+
+import "bytes"
+
+//-------------------
+// Hierarchical defaults
+//-------------------
+
+// FindWithDefaults returns the values stored at the subject and at each of its ancestors, the subject cut
+// after fewer and fewer tokens, most specific first: for "a.b.c" the values of "a.b.c", "a.b" and "a", as far
+// as they are stored. This suits configuration trees where settings for a subject override the defaults
+// for its prefixes. The pointers have the same semantics as the one returned from Find.
+func (t *SubjectTree[T]) FindWithDefaults(subject []byte) []*T {
+	if t == nil {
+		return nil
+	}
+	subject = t.canon(subject)
+	var vals []*T
+	for end := len(subject); end > 0; {
+		if v, found := t.find(subject[:end]); found {
+			vals = append(vals, v)
+		}
+		end = max(bytes.LastIndexByte(subject[:end], tsep), 0)
+	}
+	return vals
+}
@@ -0,0 +1,198 @@
+package subtree
+
+//-------------------
+// Token dictionary
+//-------------------
+
+// DictSubjectTree is a SubjectTree that stores tokens through a dictionary of short codes. Subject sets with
+// few distinct tokens per position, e.g. telemetry subjects like "<site>.<device>.<metric>", repeat the same
+// long tokens in many prefixes and suffixes, and replacing them by codes of two or three bytes can cut the
+// memory held by the tree two to three times. Subjects are expanded again before they reach a callback.
+// Tokens are given a code the first time they are inserted, as long as the dictionary has room and the code
+// is shorter than the token. Codes are never released, so the dictionary is bounded to a number of tokens,
+// after which new tokens are stored as they are.
+// A DictSubjectTree is not safe for concurrent use.
+type DictSubjectTree[T any] struct {
+	t      *SubjectTree[T]
+	codes  map[string]string // Token to its code
+	tokens []string          // Tokens by the number their code encodes
+	max    int               // Maximum number of tokens, 0 for no limit
+	bytes  int               // Total bytes of tokens held
+}
+
+// TokenDictStats reports the state of the dictionary of a DictSubjectTree.
+type TokenDictStats struct {
+	Tokens int // Number of tokens with a code
+	Bytes  int // Total bytes of those tokens
+}
+
+// NewDictSubjectTree creates a new DictSubjectTree with values T, coding at most maxTokens distinct tokens.
+// Zero means no limit. The options configure the underlying tree.
+func NewDictSubjectTree[T any](maxTokens int, opts ...Option) *DictSubjectTree[T] {
+	return &DictSubjectTree[T]{t: NewSubjectTree[T](opts...), codes: make(map[string]string), max: max(maxTokens, 0)}
+}
+
+// Codes are a marker byte followed by digits. Tokens of the subject starting with the marker byte are
+// escaped by doubling it, so they can't be mistaken for a code. No digit is a separator or wildcard, so
+// coded subjects have the same tokens as the original and filters can be coded the same way.
+const dictMark = 0x1e
+
+// dictDigits are the digits of codes, all printable characters other than separators and wildcards.
+var dictDigits = func() []byte {
+	var digits []byte
+	for c := byte('!'); c <= '~'; c++ {
+		if c != tsep && c != pwc && c != fwc {
+			digits = append(digits, c)
+		}
+	}
+	return digits
+}()
+
+// dictValues maps a digit back to its value, or -1 if the byte is not a digit.
+var dictValues = func() (v [256]int) {
+	for i := range v {
+		v[i] = -1
+	}
+	for i, c := range dictDigits {
+		v[c] = i
+	}
+	return v
+}()
+
+// Size returns the number of elements stored.
+func (d *DictSubjectTree[T]) Size() int {
+	return d.t.Size()
+}
+
+// Stats returns the state of the token dictionary.
+func (d *DictSubjectTree[T]) Stats() TokenDictStats {
+	return TokenDictStats{Tokens: len(d.tokens), Bytes: d.bytes}
+}
+
+// Insert a value into the tree. Will return if the value was updated and if so the old value.
+func (d *DictSubjectTree[T]) Insert(subject []byte, value T) (*T, bool) {
+	var _buf [256]byte
+	return d.t.Insert(d.encode(_buf[:0], subject, true), value)
+}
+
+// Find will find a value and return it or false if it was not found.
+func (d *DictSubjectTree[T]) Find(subject []byte) (*T, bool) {
+	var _buf [256]byte
+	return d.t.Find(d.encode(_buf[:0], subject, false))
+}
+
+// Delete will delete the item and return its value, or not found if it did not exist.
+func (d *DictSubjectTree[T]) Delete(subject []byte) (*T, bool) {
+	var _buf [256]byte
+	return d.t.Delete(d.encode(_buf[:0], subject, false))
+}
+
+// Match will match against a subject that can have wildcards and invoke the callback func for each matched value.
+// The subject passed to the callback is only valid for the duration of the callback.
+func (d *DictSubjectTree[T]) Match(filter []byte, cb func(subject []byte, val *T)) {
+	if cb == nil {
+		return
+	}
+	var _buf, _subj [256]byte
+	d.t.Match(d.encode(_buf[:0], filter, false), func(subject []byte, val *T) {
+		cb(d.decode(_subj[:0], subject), val)
+	})
+}
+
+// IterFast will walk all entries in the tree in no particular order, stopping when the callback returns false.
+// The subject passed to the callback is only valid for the duration of the callback.
+func (d *DictSubjectTree[T]) IterFast(cb func(subject []byte, val *T) bool) {
+	if cb == nil {
+		return
+	}
+	var _subj [256]byte
+	d.t.IterFast(func(subject []byte, val *T) bool {
+		return cb(d.decode(_subj[:0], subject), val)
+	})
+}
+
+// encode appends the coded form of subject to dst and returns the result. If learn is true tokens without
+// a code are given one while the dictionary has room.
+func (d *DictSubjectTree[T]) encode(dst, subject []byte, learn bool) []byte {
+	for start := 0; start <= len(subject); {
+		end := tokenEnd(subject, start)
+		tok := subject[start:end]
+		if code, ok := d.codes[string(tok)]; ok {
+			dst = append(dst, code...)
+		} else if code := d.learn(tok, learn); code != "" {
+			dst = append(dst, code...)
+		} else {
+			if len(tok) > 0 && tok[0] == dictMark {
+				dst = append(dst, dictMark)
+			}
+			dst = append(dst, tok...)
+		}
+		if end < len(subject) {
+			dst = append(dst, tsep)
+		}
+		start = end + 1
+	}
+	return dst
+}
+
+// learn gives tok a code and returns it, if allowed and worth it. Wildcards are single bytes, so
+// they are never coded.
+func (d *DictSubjectTree[T]) learn(tok []byte, learn bool) string {
+	if !learn || (d.max > 0 && len(d.tokens) >= d.max) {
+		return ""
+	}
+	code := dictCode(len(d.tokens))
+	if len(tok) <= len(code) {
+		return ""
+	}
+	d.codes[string(tok)] = code
+	d.tokens = append(d.tokens, string(tok))
+	d.bytes += len(tok)
+	return code
+}
+
+// dictCode returns the code for the token numbered i.
+func dictCode(i int) string {
+	var _code [8]byte
+	code := append(_code[:0], dictMark)
+	for {
+		code = append(code, dictDigits[i%len(dictDigits)])
+		if i /= len(dictDigits); i == 0 {
+			return string(code)
+		}
+	}
+}
+
+// decode appends the original form of the coded subject to dst and returns the result.
+func (d *DictSubjectTree[T]) decode(dst, subject []byte) []byte {
+	for start := 0; start <= len(subject); {
+		end := tokenEnd(subject, start)
+		tok := subject[start:end]
+		switch {
+		case len(tok) < 2 || tok[0] != dictMark:
+			dst = append(dst, tok...)
+		case tok[1] == dictMark:
+			dst = append(dst, tok[1:]...) // Escaped
+		default:
+			dst = append(dst, d.token(tok[1:])...)
+		}
+		if end < len(subject) {
+			dst = append(dst, tsep)
+		}
+		start = end + 1
+	}
+	return dst
+}
+
+// token returns the token for the digits of a code, least significant first.
+func (d *DictSubjectTree[T]) token(digits []byte) string {
+	var i int
+	for k := len(digits) - 1; k >= 0; k-- {
+		i = i*len(dictDigits) + dictValues[digits[k]]
+	}
+	if i < 0 || i >= len(d.tokens) {
+		// Not one of ours, can only come from a corrupt tree.
+		return string(digits)
+	}
+	return d.tokens[i]
+}
@@ -13,7 +13,30 @@ import (
 // Dump outputs a text representation of the entire tree to the given writer.
 // It starts by calling the private 'dump' method with the root node.
 func (t *SubjectTree[T]) Dump(w io.Writer) {
-	t.dump(w, t.root, 0)
+	t.DumpWith(w, nil, nil)
+}
+
+// DumpFiltered outputs a text representation of only the parts of the tree that lead to subjects
+// matching the filter, which can have wildcards.
+func (t *SubjectTree[T]) DumpFiltered(w io.Writer, filter []byte) {
+	t.DumpWith(w, filter, nil)
+}
+
+// DumpWith outputs a text representation of the tree restricted to subjects matching filter, if not nil,
+// and using format to print the values, if not nil. Values are printed with %+v by default.
+func (t *SubjectTree[T]) DumpWith(w io.Writer, filter []byte, format func(T) string) {
+	d := dumper[T]{w: w, format: format}
+	if filter != nil {
+		// Collect the matching leaves first, then the nodes leading to them are kept as well.
+		d.keep = make(map[*T]struct{})
+		t.matchInternal(filter, false, func(_ []byte, v *T) { d.keep[v] = struct{}{} })
+		if len(d.keep) == 0 {
+			fmt.Fprintf(w, "EMPTY\n")
+			fmt.Fprintln(w)
+			return
+		}
+	}
+	d.dump(t.root, 0)
 	fmt.Fprintln(w) // Add a newline after dumping the tree
 }
 
@@ -21,34 +44,66 @@ func (t *SubjectTree[T]) Dump(w io.Writer) {
 // Recursive node dumping
 //-------------------
 
+// dumper holds the state for dumping a tree.
+type dumper[T any] struct {
+	w      io.Writer       // Where to write the output
+	format func(T) string  // Optional value formatter
+	keep   map[*T]struct{} // Optional set of leaves to dump, by value address
+}
+
 // dump is a recursive function that traverses and prints the nodes of the tree.
 // It prints a detailed representation of the current node, whether it's a leaf or another node type.
-func (t *SubjectTree[T]) dump(w io.Writer, n node, depth int) {
+func (d *dumper[T]) dump(n node, depth int) {
 	if n == nil {
 		// If the node is nil, print "EMPTY"
-		fmt.Fprintf(w, "EMPTY\n")
+		fmt.Fprintf(d.w, "EMPTY\n")
 		return
 	}
 
 	// If the node is a leaf, print its details and stop recursion for this branch.
 	if n.isLeaf() {
 		leaf := n.(*leaf[T]) // Type assertion to a leaf type
-		fmt.Fprintf(w, "%s LEAF: Suffix: %q Value: %+v\n", dumpPre(depth), leaf.suffix, leaf.value)
+		if leaf.dead() {
+			fmt.Fprintf(d.w, "%s LEAF: Suffix: %q DELETED\n", dumpPre(depth), leaf.suffix)
+		} else if d.format != nil {
+			fmt.Fprintf(d.w, "%s LEAF: Suffix: %q Value: %s\n", dumpPre(depth), leaf.suffix, d.format(leaf.value))
+		} else {
+			fmt.Fprintf(d.w, "%s LEAF: Suffix: %q Value: %+v\n", dumpPre(depth), leaf.suffix, leaf.value)
+		}
 		n = nil // No further traversal for leaf nodes
 	} else {
 		// If it's not a leaf, it's a node, so print the prefix of the base node.
 		bn := n.base() // Get the base node information
-		fmt.Fprintf(w, "%s %s Prefix: %q\n", dumpPre(depth), n.kind(), bn.prefix)
+		fmt.Fprintf(d.w, "%s %s Prefix: %q\n", dumpPre(depth), n.kind(), bn.prefix)
 		depth++ // Increase depth for child nodes
 
-		// Iterate through child nodes and recursively call dump for each.
+		// Iterate through child nodes and recursively call dump for each we want to keep.
 		n.iter(func(n node) bool {
-			t.dump(w, n, depth)
+			if d.kept(n) {
+				d.dump(n, depth)
+			}
 			return true
 		})
 	}
 }
 
+// kept returns true if the node should be dumped, meaning it is or leads to a leaf we want to keep.
+func (d *dumper[T]) kept(n node) bool {
+	if d.keep == nil {
+		return true
+	}
+	if n.isLeaf() {
+		_, ok := d.keep[&n.(*leaf[T]).value]
+		return ok
+	}
+	kept := false
+	n.iter(func(cn node) bool {
+		kept = d.kept(cn)
+		return !kept
+	})
+	return kept
+}
+
 //-------------------
 // Node type definitions
 //-------------------
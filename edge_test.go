@@ -1,9 +1,15 @@
 package subtree
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 //-------------------
@@ -241,6 +247,50 @@ func TestSubjectTreeIterOrdered(t *testing.T) {
 	require_Equal(t, received, 4)
 }
 
+//-------------------
+//  Test for Iteration Ordered Without Allocations
+//-------------------
+
+// Test that ordered walks over all node kinds do not allocate, and stay ordered.
+func TestSubjectTreeIterOrderedNoAllocs(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i, fanout := range []int{3, 7, 13, 40, 90} {
+		// Insert in reverse to make sure packed nodes do not hold their children in order.
+		for j := fanout - 1; j >= 0; j-- {
+			st.Insert(b(fmt.Sprintf("foo.%d.%c", i, 33+j)), j)
+		}
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), -1)
+	}
+	var prev []byte
+	allocs := testing.AllocsPerRun(10, func() {
+		prev = prev[:0]
+		st.IterOrdered(func(subject []byte, _ *int) bool {
+			if len(prev) > 0 && bytes.Compare(subject, prev) <= 0 {
+				t.Fatalf("Expected %q after %q", subject, prev)
+			}
+			prev = append(prev[:0], subject...)
+			return true
+		})
+	})
+	require_Equal(t, allocs, 0)
+}
+
+// Benchmark ordered iteration over all node kinds, reporting allocations per entry.
+func BenchmarkSubjectTreeIterOrdered(b *testing.B) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100_000; i++ {
+		st.Insert([]byte(fmt.Sprintf("foo.%d.%d.bar", i%300, i)), i)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		st.IterOrdered(func(_ []byte, _ *int) bool { return true })
+	}
+	b.ReportMetric(float64(testing.AllocsPerRun(1, func() {
+		st.IterOrdered(func(_ []byte, _ *int) bool { return true })
+	}))/float64(st.Size()), "allocs/entry")
+}
+
 //-------------------
 //  Test for Iteration Fast
 //-------------------
@@ -286,3 +336,356 @@ func TestSubjectTreeIterFast(t *testing.T) {
 	})
 	require_Equal(t, received, 4)
 }
+
+//-------------------
+//  Test for Iteration Fast Visiting Each Entry Once
+//-------------------
+
+// Test that IterFast visits every entry once across all node kinds, also when the callback deletes.
+func TestSubjectTreeIterFastExactlyOnce(t *testing.T) {
+	// Fanouts that end up in each of the node kinds.
+	fill := func(opts ...Option) (*SubjectTree[int], int) {
+		st := NewSubjectTree[int](opts...)
+		var count int
+		for i, fanout := range []int{1, 3, 7, 13, 40, 90} {
+			for j := 0; j < fanout; j++ {
+				st.Insert(b(fmt.Sprintf("foo.%d.%c", i, 33+j)), count)
+				count++
+			}
+			// Delete a few to have moved children in the packed kinds.
+			if fanout > 1 {
+				st.Delete(b(fmt.Sprintf("foo.%d.%c", i, 33)))
+				count--
+			}
+		}
+		return st, count
+	}
+	check := func(st *SubjectTree[int], count int, del func(subject []byte, n int) bool) {
+		t.Helper()
+		seen := make(map[string]int)
+		var n int
+		st.IterFast(func(subject []byte, _ *int) bool {
+			seen[string(subject)]++
+			if del != nil && del(subject, n) {
+				_, found := st.Delete(subject)
+				require_True(t, found)
+			}
+			n++
+			return true
+		})
+		require_Equal(t, len(seen), count)
+		for subj, times := range seen {
+			if times != 1 {
+				t.Fatalf("Expected %q to be visited once, got %d", subj, times)
+			}
+		}
+	}
+
+	st, count := fill()
+	check(st, count, nil)
+	// Deleting the current entry every time.
+	check(st, count, func(_ []byte, _ int) bool { return true })
+	require_Equal(t, st.Size(), 0)
+	// Deleting every other entry, leaving the rest intact.
+	st, count = fill()
+	check(st, count, func(_ []byte, n int) bool { return n%2 == 0 })
+	require_Equal(t, st.Size(), count/2)
+	check(st, count/2, nil)
+	// And the same for trees sharing nodes and with lazy deletes.
+	st, count = fill()
+	st.Snapshot()
+	check(st, count, func(_ []byte, n int) bool { return n%3 == 0 })
+	st, count = fill(WithLazyDelete(), WithCompactThreshold(0.1))
+	check(st, count, func(_ []byte, _ int) bool { return true })
+	require_Equal(t, st.Size(), 0)
+
+	// Ordered walks stay in order and complete while deleting.
+	st, count = fill()
+	var prev string
+	var n int
+	st.IterOrdered(func(subject []byte, _ *int) bool {
+		require_True(t, n == 0 || string(subject) > prev)
+		prev = string(subject)
+		if n%2 == 0 {
+			_, found := st.Delete(subject)
+			require_True(t, found)
+		}
+		n++
+		return true
+	})
+	require_Equal(t, n, count)
+}
+
+//-------------------
+//  Test for Walking Internal Nodes
+//-------------------
+
+// Test that WalkNodes reports every internal node with correct leaf counts through inserts and deletes.
+func TestSubjectTreeWalkNodes(t *testing.T) {
+	st := NewSubjectTree[int]()
+	check := func() {
+		t.Helper()
+		var nodes, maxDepth int
+		st.WalkNodes(func(info NodeInfo) bool {
+			nodes++
+			maxDepth = max(maxDepth, info.Depth)
+			// Count the leaves below this node by matching everything under its path.
+			count := 0
+			st.IterFast(func(subject []byte, _ *int) bool {
+				if bytes.HasPrefix(subject, info.Path) {
+					count++
+				}
+				return true
+			})
+			if info.Depth == 0 {
+				require_Equal(t, info.Leaves, st.Size())
+			}
+			require_Equal(t, info.Leaves, count)
+			require_True(t, info.Children > 1 || info.Leaves == 1)
+			return true
+		})
+		require_True(t, st.Size() < 2 || nodes > 0)
+	}
+	for i := 0; i < 200; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%7, i)), i)
+		check()
+	}
+	st.Insert(b("foo.1.bar.1"), 0)
+	check()
+	st.Insert(b("foo"), 0)
+	check()
+	for i := 0; i < 200; i += 3 {
+		st.Delete(b(fmt.Sprintf("foo.%d.bar.%d", i%7, i)))
+		check()
+	}
+
+	// Early termination and a simple shape.
+	st = NewSubjectTree[int]()
+	st.Insert(b("foo.bar.A"), 1)
+	st.Insert(b("foo.bar.B"), 2)
+	st.Insert(b("foo.baz.A"), 3)
+	var infos []NodeInfo
+	st.WalkNodes(func(info NodeInfo) bool {
+		infos = append(infos, info)
+		return true
+	})
+	require_Equal(t, len(infos), 2)
+	require_Equal(t, infos[0].Kind, "NODE4")
+	require_Equal(t, string(infos[0].Prefix), "foo.ba")
+	require_Equal(t, infos[0].Leaves, 3)
+	require_Equal(t, infos[1].Depth, 1)
+	require_Equal(t, string(infos[1].Path), "foo.bar.")
+	require_Equal(t, infos[1].Leaves, 2)
+	count := 0
+	st.WalkNodes(func(info NodeInfo) bool {
+		count++
+		return false
+	})
+	require_Equal(t, count, 1)
+}
+
+// Test that handles from WalkNodes iterate the leaves below their node, until the tree is modified.
+func TestSubjectTreeIterNode(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 50; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%5, i)), i)
+	}
+	st.Insert(b("zzz"), 50)
+
+	// Find the big subtrees first, then walk their contents.
+	var handles []NodeHandle
+	var paths []string
+	var leaves []int
+	st.WalkNodes(func(info NodeInfo) bool {
+		if info.Depth > 0 && info.Leaves >= 10 {
+			handles = append(handles, info.Handle())
+			paths = append(paths, string(info.Path))
+			leaves = append(leaves, info.Leaves)
+		}
+		return true
+	})
+	require_True(t, len(handles) > 0)
+	for i, h := range handles {
+		var subjects []string
+		require_True(t, st.IterNode(h, func(subject []byte, _ *int) bool {
+			require_True(t, strings.HasPrefix(string(subject), paths[i]))
+			subjects = append(subjects, string(subject))
+			return true
+		}) == nil)
+		require_Equal(t, len(subjects), leaves[i])
+		require_True(t, slices.IsSorted(subjects))
+	}
+
+	// Stopping early.
+	var count int
+	require_True(t, st.IterNode(handles[0], func(_ []byte, _ *int) bool {
+		count++
+		return false
+	}) == nil)
+	require_Equal(t, count, 1)
+
+	// Handles go stale when the tree is modified, and do not work on other trees.
+	require_True(t, st.IterNode(handles[0], nil) == nil)
+	require_True(t, errors.Is(NewSubjectTree[int]().IterNode(handles[0], nil), ErrStaleHandle))
+	require_True(t, errors.Is(st.IterNode(NodeHandle{}, nil), ErrStaleHandle))
+	st.Insert(b("foo.9"), 9)
+	require_True(t, errors.Is(st.IterNode(handles[0], func(_ []byte, _ *int) bool { return true }), ErrStaleHandle))
+}
+
+// Test that Compact makes handles stale, since it rebuilds nodes without a new version.
+func TestSubjectTreeIterNodeCompact(t *testing.T) {
+	st := NewSubjectTree[int](WithLazyDelete())
+	st.Insert(b("foo.bar.a"), 1)
+	st.Insert(b("foo.bar.b"), 2)
+	st.Insert(b("foo.baz.c"), 3)
+	st.Delete(b("foo.baz.c"))
+
+	var handles []NodeHandle
+	st.WalkNodes(func(info NodeInfo) bool {
+		handles = append(handles, info.Handle())
+		return true
+	})
+	require_True(t, len(handles) > 1)
+	stats := st.Compact()
+	require_Equal(t, stats.Removed, 1)
+	require_Equal(t, stats.Collapsed, 1)
+	for _, h := range handles {
+		require_True(t, errors.Is(st.IterNode(h, func(_ []byte, _ *int) bool { return true }), ErrStaleHandle))
+	}
+
+	// Handles stay valid when there was nothing to compact.
+	h := handles[0]
+	st.WalkNodes(func(info NodeInfo) bool {
+		h = info.Handle()
+		return false
+	})
+	st.Compact()
+	var subjects []string
+	require_True(t, st.IterNode(h, func(subject []byte, _ *int) bool {
+		subjects = append(subjects, string(subject))
+		return true
+	}) == nil)
+	require_Equal(t, strings.Join(subjects, " "), "foo.bar.a foo.bar.b")
+
+	// Compacting from a callback does not lose or repeat entries of the walk.
+	for _, s := range []string{"foo.baz.c", "foo.baz.d", "foo.qux.e"} {
+		st.Insert(b(s), 4)
+	}
+	st.Delete(b("foo.baz.c"))
+	st.Delete(b("foo.baz.d"))
+	subjects = subjects[:0]
+	st.IterOrdered(func(subject []byte, _ *int) bool {
+		subjects = append(subjects, string(subject))
+		st.Compact()
+		return true
+	})
+	require_Equal(t, strings.Join(subjects, " "), "foo.bar.a foo.bar.b foo.qux.e")
+}
+
+//-------------------
+//  Test for Filtered and Formatted Dumps
+//-------------------
+
+// Test that filtered dumps only include the paths to matching leaves and use the value formatter.
+func TestSubjectTreeDumpWith(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.bar.A"), 1)
+	st.Insert(b("foo.bar.B"), 2)
+	st.Insert(b("foo.baz.A"), 3)
+	st.Insert(b("zzz"), 4)
+
+	var full strings.Builder
+	st.Dump(&full)
+	require_True(t, strings.Contains(full.String(), `"zzz" Value: 4`))
+	require_Equal(t, strings.Count(full.String(), "LEAF"), 4)
+
+	var filtered strings.Builder
+	st.DumpWith(&filtered, b("foo.*.A"), func(v int) string { return fmt.Sprintf("<%d>", v) })
+	out := filtered.String()
+	require_Equal(t, strings.Count(out, "LEAF"), 2)
+	require_True(t, strings.Contains(out, `Value: <1>`))
+	require_True(t, strings.Contains(out, `Value: <3>`))
+	require_False(t, strings.Contains(out, "zzz"))
+
+	var none strings.Builder
+	st.DumpFiltered(&none, b("bar.>"))
+	require_True(t, strings.HasPrefix(none.String(), "EMPTY"))
+
+	// Dumps are not matches to the hooks watching the tree.
+	var calls int
+	st = NewSubjectTree[int](WithHotPrefixes(2, time.Minute), WithLatencyHook(func(_ Call, _ time.Duration, _ int) { calls++ }))
+	st.Insert(b("foo.bar.A"), 1)
+	var rec bytes.Buffer
+	r := NewRecorder(&rec)
+	st.SetRecorder(r)
+	calls = 0
+	st.DumpFiltered(io.Discard, b("foo.>"))
+	require_Equal(t, calls, 0)
+	require_Equal(t, r.Ops(), 0)
+	require_Equal(t, len(st.HotSubtrees(1)), 0)
+}
+
+//-------------------
+//  Test for Interning Prefixes and Suffixes
+//-------------------
+
+// Test that identical suffixes share memory through an interner, across trees and within limits.
+func TestSubjectTreeInterner(t *testing.T) {
+	in := NewInterner(0, 0)
+	st1, st2 := NewSubjectTree[int](), NewSubjectTree[int]()
+	st1.SetInterner(in)
+	st2.SetInterner(in)
+	for i := 0; i < 100; i++ {
+		st1.Insert(b(fmt.Sprintf("device.%03d.temperature", i)), i)
+		st2.Insert(b(fmt.Sprintf("device.%03d.temperature", i)), i)
+	}
+	// Leaves with identical suffixes hold the same memory.
+	shared := make(map[string]*byte)
+	var leaves int
+	var walk func(n node)
+	walk = func(n node) {
+		if ln, ok := n.(*leaf[int]); ok {
+			leaves++
+			if p, ok := shared[string(ln.suffix)]; ok {
+				require_True(t, p == &ln.suffix[0])
+			} else {
+				shared[string(ln.suffix)] = &ln.suffix[0]
+			}
+			return
+		}
+		for _, cn := range n.children() {
+			if cn != nil {
+				walk(cn)
+			}
+		}
+	}
+	walk(st1.root)
+	walk(st2.root)
+	require_Equal(t, leaves, 200)
+	require_True(t, len(shared) < 20)
+	stats := in.Stats()
+	require_True(t, stats.Hits > 100)
+
+	// Deletes keep working with interned fragments.
+	for i := 0; i < 100; i += 2 {
+		_, found := st1.Delete(b(fmt.Sprintf("device.%03d.temperature", i)))
+		require_True(t, found)
+	}
+	for i := 1; i < 100; i += 2 {
+		v, found := st1.Find(b(fmt.Sprintf("device.%03d.temperature", i)))
+		require_True(t, found)
+		require_Equal(t, *v, i)
+	}
+
+	// Limits are respected.
+	small := NewInterner(2, 4)
+	st := NewSubjectTree[int]()
+	st.SetInterner(small)
+	for i := 0; i < 10; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar", i*100)), i)
+	}
+	stats = small.Stats()
+	require_True(t, stats.Entries <= 2)
+	require_True(t, stats.Skipped > 0)
+	require_Equal(t, st.Size(), 10)
+}
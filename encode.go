@@ -0,0 +1,434 @@
+package subtree
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sort"
+)
+
+//-------------------
+// Encoding and decoding trees
+//-------------------
+
+// The encoded form of a tree is a header followed by all entries in subject order, an index of the entries
+// and a checksum.
+//
+//	magic "STREE" | version byte | uvarint entry count
+//	per entry: uvarint bytes shared with the previous subject | uvarint suffix length | suffix
+//	           uvarint value length | value
+//	index: uvarint block count
+//	       per block: uvarint offset | uvarint first subject length | first subject | crc32 of the block
+//	uint64 offset of the index | crc32 of the index
+//	crc32 (Castagnoli) of everything before it, little endian
+//
+// Sharing the leading bytes with the previous subject keeps checkpoints of hierarchical subjects small.
+// The entries are cut into blocks of about encodingBlockSize bytes, where the first entry shares nothing, so
+// DecodePrefix can find the blocks holding a prefix through the index and decode them on their own.
+// Version 1 has no index and footer, Decode still reads it.
+const (
+	encodingMagic     = "STREE"
+	encodingVersion   = 2
+	encodingBlockSize = 4096
+	encodingFooterLen = 8 + 4 + 4
+)
+
+// ErrCorrupt is returned when decoding data that is not a valid encoded tree.
+var ErrCorrupt = errors.New("subtree: corrupt encoding")
+
+// ErrNoIndex is returned by DecodePrefix for encodings written before they had an index.
+var ErrNoIndex = errors.New("subtree: encoding has no index")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Encode writes all entries of the tree to w in subject order, followed by an index for DecodePrefix.
+// The encodeValue function appends the serialized form of a value to dst and returns the result.
+func (t *SubjectTree[T]) Encode(w io.Writer, encodeValue func(dst []byte, v T) ([]byte, error)) error {
+	return t.encode(w, encodeValue, nil)
+}
+
+// encode is Encode calling progress with the number of entries written so far after every entry, stopping
+// with the error it returns, if any.
+func (t *SubjectTree[T]) encode(w io.Writer, encodeValue func(dst []byte, v T) ([]byte, error), progress func(entries int) error) error {
+	crc := crc32.New(crcTable)
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	buf := append([]byte(encodingMagic), encodingVersion)
+	buf = binary.AppendUvarint(buf, uint64(t.Size()))
+	if _, err := bw.Write(buf); err != nil {
+		return err
+	}
+	off := uint64(len(buf))
+	// The index entries, with the checksum of each block appended when the next one starts.
+	var index, prev, vbuf []byte
+	var blocks, entries int
+	var blockStart uint64
+	var blockSum uint32
+	var err error
+	t.IterOrdered(func(subject []byte, v *T) bool {
+		if blocks == 0 || off-blockStart >= encodingBlockSize {
+			if blocks > 0 {
+				index = binary.LittleEndian.AppendUint32(index, blockSum)
+			}
+			index = binary.AppendUvarint(index, off)
+			index = binary.AppendUvarint(index, uint64(len(subject)))
+			index = append(index, subject...)
+			blocks, blockStart, blockSum, prev = blocks+1, off, 0, prev[:0]
+		}
+		shared := commonPrefixLen(prev, subject)
+		buf = binary.AppendUvarint(buf[:0], uint64(shared))
+		buf = binary.AppendUvarint(buf, uint64(len(subject)-shared))
+		buf = append(buf, subject[shared:]...)
+		if vbuf, err = encodeValue(vbuf[:0], *v); err != nil {
+			return false
+		}
+		buf = binary.AppendUvarint(buf, uint64(len(vbuf)))
+		buf = append(buf, vbuf...)
+		if _, err = bw.Write(buf); err != nil {
+			return false
+		}
+		off += uint64(len(buf))
+		blockSum = crc32.Update(blockSum, crcTable, buf)
+		prev = append(prev[:0], subject...)
+		if entries++; progress != nil {
+			err = progress(entries)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return err
+	}
+	if blocks > 0 {
+		index = binary.LittleEndian.AppendUint32(index, blockSum)
+	}
+	index = append(binary.AppendUvarint(nil, uint64(blocks)), index...)
+	index = binary.LittleEndian.AppendUint64(index, off)
+	index = binary.LittleEndian.AppendUint32(index, crc32.Checksum(index[:len(index)-8], crcTable))
+	if _, err := bw.Write(index); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	// The checksum itself is written past the crc writer.
+	_, err = w.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// Decode reads a tree written by Encode. The decodeValue function is handed the serialized form of each value,
+// which is only valid for the duration of the call.
+func Decode[T any](r io.Reader, decodeValue func(b []byte) (T, error)) (*SubjectTree[T], error) {
+	crc := crc32.New(crcTable)
+	br := bufio.NewReader(r)
+	cr := &crcReader{r: br, crc: crc}
+
+	hdr := make([]byte, len(encodingMagic)+1)
+	if _, err := io.ReadFull(cr, hdr); err != nil {
+		return nil, corrupt(err)
+	}
+	if string(hdr[:len(encodingMagic)]) != encodingMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	version := hdr[len(encodingMagic)]
+	if version != 1 && version != encodingVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCorrupt, version)
+	}
+	count, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+
+	t := NewSubjectTree[T]()
+	var subject, vbuf []byte
+	for i := uint64(0); i < count; i++ {
+		shared, err := binary.ReadUvarint(cr)
+		if err != nil {
+			return nil, corrupt(err)
+		}
+		if shared > uint64(len(subject)) {
+			return nil, fmt.Errorf("%w: bad shared prefix", ErrCorrupt)
+		}
+		if subject, err = readChunk(cr, subject[:shared]); err != nil {
+			return nil, err
+		}
+		if vbuf, err = readChunk(cr, vbuf[:0]); err != nil {
+			return nil, err
+		}
+		v, err := decodeValue(vbuf)
+		if err != nil {
+			return nil, err
+		}
+		if _, updated := t.Insert(subject, v); updated {
+			return nil, fmt.Errorf("%w: duplicate subject %q", ErrCorrupt, subject)
+		}
+	}
+	if version > 1 {
+		if err := skipIndex(cr); err != nil {
+			return nil, err
+		}
+	}
+
+	expected := crc.Sum32()
+	var sum [4]byte
+	if _, err := io.ReadFull(br, sum[:]); err != nil {
+		return nil, corrupt(err)
+	}
+	if binary.LittleEndian.Uint32(sum[:]) != expected {
+		return nil, fmt.Errorf("%w: checksum mismatch", ErrCorrupt)
+	}
+	return t, nil
+}
+
+// DecodePrefix reads only the entries starting with the literal prefix from a tree written by Encode, which is
+// size bytes long. Through the index it reads just the blocks of entries that can hold the prefix, so loading
+// a part of a very large checkpoint does not depend on its size. The subjects are kept whole. Only the blocks
+// read are checked against their checksums. Returns ErrNoIndex for encodings without an index.
+func DecodePrefix[T any](r io.ReaderAt, size int64, prefix []byte, decodeValue func(b []byte) (T, error)) (*SubjectTree[T], error) {
+	hdrLen := int64(len(encodingMagic) + 1)
+	if size < hdrLen {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, io.ErrUnexpectedEOF)
+	}
+	hdr, err := readAt(r, 0, hdrLen)
+	if err != nil {
+		return nil, err
+	}
+	if string(hdr[:len(encodingMagic)]) != encodingMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorrupt)
+	}
+	if version := hdr[len(encodingMagic)]; version != encodingVersion {
+		if version == 1 {
+			return nil, ErrNoIndex
+		}
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrCorrupt, version)
+	}
+	if size < hdrLen+1+encodingFooterLen {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupt, io.ErrUnexpectedEOF)
+	}
+	footer, err := readAt(r, size-encodingFooterLen, encodingFooterLen)
+	if err != nil {
+		return nil, err
+	}
+	indexOff, indexEnd := binary.LittleEndian.Uint64(footer), uint64(size-encodingFooterLen)
+	if indexOff <= uint64(hdrLen) || indexOff >= indexEnd {
+		return nil, fmt.Errorf("%w: bad index offset", ErrCorrupt)
+	}
+	index, err := readAt(r, int64(indexOff), int64(indexEnd-indexOff))
+	if err != nil {
+		return nil, err
+	}
+	if crc32.Checksum(index, crcTable) != binary.LittleEndian.Uint32(footer[8:]) {
+		return nil, fmt.Errorf("%w: index checksum mismatch", ErrCorrupt)
+	}
+	blocks, err := parseIndex(index, uint64(hdrLen), indexOff)
+	if err != nil {
+		return nil, err
+	}
+
+	t := NewSubjectTree[T]()
+	// The last block starting at or before the prefix, up to the first block starting past all its subjects.
+	first := sort.Search(len(blocks), func(i int) bool { return bytes.Compare(blocks[i].first, prefix) > 0 }) - 1
+	first = max(first, 0)
+	last := first + 1
+	for last < len(blocks) && bytes.HasPrefix(blocks[last].first, prefix) {
+		last++
+	}
+	if first >= len(blocks) {
+		return t, nil
+	}
+	end := indexOff
+	if last < len(blocks) {
+		end = blocks[last].off
+	}
+	data, err := readAt(r, int64(blocks[first].off), int64(end-blocks[first].off))
+	if err != nil {
+		return nil, err
+	}
+blocks:
+	for i := first; i < last; i++ {
+		b := blocks[i]
+		bend := end
+		if i+1 < len(blocks) {
+			bend = blocks[i+1].off
+		}
+		block := data[b.off-blocks[first].off : bend-blocks[first].off]
+		if crc32.Checksum(block, crcTable) != b.crc {
+			return nil, fmt.Errorf("%w: block checksum mismatch", ErrCorrupt)
+		}
+		var subject []byte
+		for len(block) > 0 {
+			shared, n := binary.Uvarint(block)
+			if n <= 0 || shared > uint64(len(subject)) {
+				return nil, fmt.Errorf("%w: bad shared prefix", ErrCorrupt)
+			}
+			suffix, rest, ok := sliceChunk(block[n:])
+			if !ok {
+				return nil, fmt.Errorf("%w: bad entry", ErrCorrupt)
+			}
+			vb, rest, ok := sliceChunk(rest)
+			if !ok {
+				return nil, fmt.Errorf("%w: bad entry", ErrCorrupt)
+			}
+			block, subject = rest, append(subject[:shared], suffix...)
+			if !bytes.HasPrefix(subject, prefix) {
+				// Entries are in order, so once past the prefix there is nothing more to find.
+				if bytes.Compare(subject, prefix) > 0 {
+					break blocks
+				}
+				continue
+			}
+			v, err := decodeValue(vb)
+			if err != nil {
+				return nil, err
+			}
+			if _, updated := t.Insert(subject, v); updated {
+				return nil, fmt.Errorf("%w: duplicate subject %q", ErrCorrupt, subject)
+			}
+		}
+	}
+	return t, nil
+}
+
+// indexBlock is a block of entries listed in the index.
+type indexBlock struct {
+	off   uint64 // Offset of the block
+	first []byte // First subject in the block
+	crc   uint32 // Checksum of the block
+}
+
+// parseIndex parses the index of an encoding, checking that the blocks lie in order between start and end.
+func parseIndex(index []byte, start, end uint64) ([]indexBlock, error) {
+	count, n := binary.Uvarint(index)
+	// Every block takes at least 6 bytes of the index, which bounds the count of a corrupt one.
+	if n <= 0 || count > uint64(len(index))/6 {
+		return nil, fmt.Errorf("%w: bad index", ErrCorrupt)
+	}
+	index = index[n:]
+	blocks := make([]indexBlock, 0, count)
+	for i := uint64(0); i < count; i++ {
+		off, n := binary.Uvarint(index)
+		if n <= 0 || off < start || off >= end || (i > 0 && off <= blocks[i-1].off) {
+			return nil, fmt.Errorf("%w: bad index", ErrCorrupt)
+		}
+		first, rest, ok := sliceChunk(index[n:])
+		if !ok || len(rest) < 4 || (i > 0 && bytes.Compare(first, blocks[i-1].first) <= 0) {
+			return nil, fmt.Errorf("%w: bad index", ErrCorrupt)
+		}
+		blocks = append(blocks, indexBlock{off: off, first: first, crc: binary.LittleEndian.Uint32(rest)})
+		index = rest[4:]
+	}
+	if len(index) != 0 {
+		return nil, fmt.Errorf("%w: bad index", ErrCorrupt)
+	}
+	return blocks, nil
+}
+
+// sliceChunk splits a uvarint length and that many bytes off the front of b.
+func sliceChunk(b []byte) (chunk, rest []byte, ok bool) {
+	l, n := binary.Uvarint(b)
+	if n <= 0 || l > uint64(len(b)-n) {
+		return nil, nil, false
+	}
+	return b[n : n+int(l)], b[n+int(l):], true
+}
+
+// readAt reads n bytes at off from r.
+func readAt(r io.ReaderAt, off, n int64) ([]byte, error) {
+	buf := make([]byte, n)
+	if m, err := r.ReadAt(buf, off); int64(m) < n {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, corrupt(err)
+	}
+	return buf, nil
+}
+
+// skipIndex reads past the index following the entries, checking that it is where the footer says it is.
+// DecodePrefix checks the index itself.
+func skipIndex(cr *crcReader) error {
+	off := cr.n
+	blocks, err := binary.ReadUvarint(cr)
+	if err != nil {
+		return corrupt(err)
+	}
+	var first []byte
+	var fixed [8]byte
+	for i := uint64(0); i < blocks; i++ {
+		if _, err := binary.ReadUvarint(cr); err != nil {
+			return corrupt(err)
+		}
+		if first, err = readChunk(cr, first[:0]); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(cr, fixed[:4]); err != nil {
+			return corrupt(err)
+		}
+	}
+	if _, err := io.ReadFull(cr, fixed[:]); err != nil {
+		return corrupt(err)
+	}
+	if binary.LittleEndian.Uint64(fixed[:]) != uint64(off) {
+		return fmt.Errorf("%w: bad index offset", ErrCorrupt)
+	}
+	if _, err := io.ReadFull(cr, fixed[:4]); err != nil {
+		return corrupt(err)
+	}
+	return nil
+}
+
+// crcReader feeds everything read through it into a checksum, counting the bytes read.
+type crcReader struct {
+	r   *bufio.Reader
+	crc io.Writer
+	n   int64
+	b   [1]byte
+}
+
+// Read implements io.Reader.
+func (c *crcReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.crc.Write(p[:n])
+	c.n += int64(n)
+	return n, err
+}
+
+// ReadByte implements io.ByteReader for reading uvarints.
+func (c *crcReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.b[0] = b
+		c.crc.Write(c.b[:])
+		c.n++
+	}
+	return b, err
+}
+
+// readChunk reads a uvarint length followed by that many bytes, appending them to dst.
+func readChunk(r *crcReader, dst []byte) ([]byte, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, corrupt(err)
+	}
+	// Grow in steps so a corrupt length can not make us allocate huge buffers up front.
+	for l > 0 {
+		chunk := min(l, 64*1024)
+		start := len(dst)
+		dst = append(dst, make([]byte, chunk)...)
+		if _, err := io.ReadFull(r, dst[start:]); err != nil {
+			return nil, corrupt(err)
+		}
+		l -= chunk
+	}
+	return dst, nil
+}
+
+// corrupt wraps unexpected end of data as corruption.
+func corrupt(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: %v", ErrCorrupt, io.ErrUnexpectedEOF)
+	}
+	return err
+}
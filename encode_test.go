@@ -0,0 +1,377 @@
+package subtree
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//-------------------
+//  Encoding Helper Functions
+//-------------------
+
+// encodeInt appends an int value as a varint.
+func encodeInt(dst []byte, v int) ([]byte, error) {
+	return binary.AppendVarint(dst, int64(v)), nil
+}
+
+// decodeInt decodes an int value written by encodeInt.
+func decodeInt(b []byte) (int, error) {
+	v, n := binary.Varint(b)
+	if n <= 0 {
+		return 0, errors.New("bad varint")
+	}
+	return int(v), nil
+}
+
+//-------------------
+//  Test for Encoding and Decoding
+//-------------------
+
+// Test that a tree survives an encode and decode round trip.
+func TestSubjectTreeEncodeDecode(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%13, i)), i)
+	}
+	st.Insert(b("foo"), -1)
+
+	var buf bytes.Buffer
+	require_True(t, st.Encode(&buf, encodeInt) == nil)
+	dt, err := Decode(bytes.NewReader(buf.Bytes()), decodeInt)
+	require_True(t, err == nil)
+	require_True(t, st.Equal(dt, func(a, b int) bool { return a == b }))
+
+	// Empty trees round trip as well.
+	var ebuf bytes.Buffer
+	require_True(t, NewSubjectTree[int]().Encode(&ebuf, encodeInt) == nil)
+	dt, err = Decode(&ebuf, decodeInt)
+	require_True(t, err == nil)
+	require_Equal(t, dt.Size(), 0)
+}
+
+// Test that truncated or modified data is detected.
+func TestSubjectTreeDecodeCorrupt(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	var buf bytes.Buffer
+	require_True(t, st.Encode(&buf, encodeInt) == nil)
+	data := buf.Bytes()
+
+	for _, l := range []int{0, 3, 6, 20, len(data) - 1} {
+		_, err := Decode(bytes.NewReader(data[:l]), decodeInt)
+		require_True(t, errors.Is(err, ErrCorrupt))
+	}
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)/2] ^= 0x01
+	_, err := Decode(bytes.NewReader(flipped), decodeInt)
+	require_True(t, err != nil)
+
+	// Value decode errors are passed through.
+	vErr := errors.New("nope")
+	_, err = Decode(bytes.NewReader(data), func(_ []byte) (int, error) { return 0, vErr })
+	require_True(t, err == vErr)
+}
+
+// Test that DecodePrefix loads just the entries under a prefix, reading only the blocks holding them.
+func TestSubjectTreeDecodePrefix(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 5000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%13, i)), i)
+	}
+	st.Insert(b("foo"), -1)
+	st.Insert(b("zoo"), -2)
+	var buf bytes.Buffer
+	require_True(t, st.Encode(&buf, encodeInt) == nil)
+	data := buf.Bytes()
+
+	for _, prefix := range []string{"", "foo", "foo.", "foo.1", "foo.12.", "foo.7.bar.4", "foo.3.bar.4998", "zoo", "a", "zzz"} {
+		r := &countingReaderAt{r: bytes.NewReader(data)}
+		dt, err := DecodePrefix(r, int64(len(data)), b(prefix), decodeInt)
+		require_True(t, err == nil)
+		expected := NewSubjectTree[int]()
+		st.IterFast(func(subject []byte, v *int) bool {
+			if strings.HasPrefix(string(subject), prefix) {
+				expected.Insert(subject, *v)
+			}
+			return true
+		})
+		require_True(t, dt.Equal(expected, func(a, b int) bool { return a == b }))
+		if expected.Size() < 10 {
+			require_True(t, r.n < int64(len(data))/4)
+		}
+	}
+
+	// Damage outside the blocks read goes unnoticed, inside it does not.
+	damaged := bytes.Clone(data)
+	damaged[10] ^= 0x01
+	dt, err := DecodePrefix(bytes.NewReader(damaged), int64(len(damaged)), b("zoo"), decodeInt)
+	require_True(t, err == nil)
+	require_Equal(t, dt.Size(), 1)
+	_, err = DecodePrefix(bytes.NewReader(damaged), int64(len(damaged)), b("foo.0."), decodeInt)
+	require_True(t, errors.Is(err, ErrCorrupt))
+	for _, l := range []int{0, 6, 20, len(data) - 1} {
+		_, err = DecodePrefix(bytes.NewReader(data[:l]), int64(l), b("foo"), decodeInt)
+		require_True(t, errors.Is(err, ErrCorrupt))
+	}
+
+	// Empty trees have an empty index.
+	var ebuf bytes.Buffer
+	require_True(t, NewSubjectTree[int]().Encode(&ebuf, encodeInt) == nil)
+	dt, err = DecodePrefix(bytes.NewReader(ebuf.Bytes()), int64(ebuf.Len()), b("foo"), decodeInt)
+	require_True(t, err == nil)
+	require_Equal(t, dt.Size(), 0)
+
+	// Encodings of the first version have no index, but still decode in full.
+	v1 := append([]byte(encodingMagic), 1)
+	v1 = binary.AppendUvarint(v1, 2)
+	v1 = append(v1, 0, 3, 'f', 'o', 'o', 1, 2)
+	v1 = append(v1, 3, 4, '.', 'b', 'a', 'r', 1, 4)
+	v1 = binary.LittleEndian.AppendUint32(v1, crc32.Checksum(v1, crcTable))
+	_, err = DecodePrefix(bytes.NewReader(v1), int64(len(v1)), b("foo"), decodeInt)
+	require_True(t, err == ErrNoIndex)
+	dt, err = Decode(bytes.NewReader(v1), decodeInt)
+	require_True(t, err == nil)
+	v, ok := dt.FindVal(b("foo.bar"))
+	require_True(t, ok)
+	require_Equal(t, v, 2)
+}
+
+// Test that EncodeAsync encodes the tree as of its start while the tree is modified, and can be canceled.
+func TestSubjectTreeEncodeAsync(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 10_000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%13, i)), i)
+	}
+	expected := NewSubjectTree[int]()
+	st.IterFast(func(subject []byte, v *int) bool {
+		expected.Insert(subject, *v)
+		return true
+	})
+
+	var buf bytes.Buffer
+	job, err := st.EncodeAsync(&buf, EncodeOptions[int]{EncodeValue: encodeInt})
+	require_True(t, err == nil)
+	for i := 0; i < 10_000; i += 3 {
+		st.Delete(b(fmt.Sprintf("foo.%d.bar.%d", i%13, i)))
+		st.Insert(b(fmt.Sprintf("bar.%d", i)), i)
+	}
+	require_True(t, job.Wait() == nil)
+	<-job.Done()
+	done, total := job.Progress()
+	require_Equal(t, done, 10_000)
+	require_Equal(t, total, 10_000)
+	dt, err := Decode(&buf, decodeInt)
+	require_True(t, err == nil)
+	require_True(t, dt.Equal(expected, func(a, b int) bool { return a == b }))
+
+	// Canceling stops the job, with what was written so far incomplete.
+	pr, pw := io.Pipe()
+	job, err = st.EncodeAsync(pw, EncodeOptions[int]{EncodeValue: encodeInt})
+	require_True(t, err == nil)
+	_, err = io.ReadFull(pr, make([]byte, 1000))
+	require_True(t, err == nil)
+	job.Cancel()
+	go io.Copy(io.Discard, pr)
+	require_True(t, errors.Is(job.Wait(), context.Canceled))
+	pw.Close()
+	done, total = job.Progress()
+	require_True(t, done < total)
+
+	// As does the context.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	job, err = st.EncodeAsync(io.Discard, EncodeOptions[int]{EncodeValue: encodeInt, Context: ctx})
+	require_True(t, err == nil)
+	require_True(t, errors.Is(job.Wait(), context.Canceled))
+
+	_, err = st.EncodeAsync(io.Discard, EncodeOptions[int]{})
+	require_True(t, err == ErrNoEncoder)
+}
+
+// Test that trees are saved to and restored from checkpoint sinks.
+func TestSubjectTreeCheckpointSink(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%13, i)), i)
+	}
+	ctx := context.Background()
+	sink := DirSink(t.TempDir())
+	_, _, err := RestoreLatest(ctx, sink, "cp/", decodeInt)
+	require_True(t, err == ErrNoCheckpoint)
+
+	require_True(t, st.Save(ctx, sink, "cp/0001", encodeInt) == nil)
+	st.Insert(b("foo"), -1)
+	require_True(t, st.Save(ctx, sink, "cp/0002", encodeInt) == nil)
+	require_True(t, st.Save(ctx, sink, "other", encodeInt) == nil)
+	names, err := sink.List(ctx, "cp/")
+	require_True(t, err == nil)
+	sort.Strings(names)
+	require_Equal(t, strings.Join(names, " "), "cp/0001 cp/0002")
+
+	dt, err := Restore(ctx, sink, "cp/0001", decodeInt)
+	require_True(t, err == nil)
+	require_Equal(t, dt.Size(), 1000)
+	dt, name, err := RestoreLatest(ctx, sink, "cp/", decodeInt)
+	require_True(t, err == nil)
+	require_Equal(t, name, "cp/0002")
+	require_True(t, dt.Equal(st, func(a, b int) bool { return a == b }))
+	_, err = Restore(ctx, sink, "missing", decodeInt)
+	require_True(t, errors.Is(err, os.ErrNotExist))
+
+	// Sinks failing part way leave no checkpoint behind and stop the encoding.
+	sErr := errors.New("upload failed")
+	failing := &failingSink{CheckpointSink: sink, after: 100, err: sErr}
+	require_True(t, st.Save(ctx, failing, "cp/0003", encodeInt) == sErr)
+	_, err = Restore(ctx, sink, "cp/0003", decodeInt)
+	require_True(t, errors.Is(err, os.ErrNotExist))
+	require_True(t, st.Save(ctx, sink, "cp/0003", nil) == ErrNoEncoder)
+}
+
+// failingSink fails a Put after reading some bytes.
+type failingSink struct {
+	CheckpointSink
+	after int64
+	err   error
+}
+
+func (f *failingSink) Put(_ context.Context, _ string, r io.Reader) error {
+	io.CopyN(io.Discard, r, f.after)
+	return f.err
+}
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n += int64(n)
+	return n, err
+}
+
+//-------------------
+//  Test for JSON
+//-------------------
+
+// Test that trees marshal to JSON objects in subject order and unmarshal back.
+func TestSubjectTreeJSON(t *testing.T) {
+	type doc struct {
+		Routes *SubjectTree[[]string] `json:"routes"`
+	}
+	st := NewSubjectTree[[]string]()
+	st.Insert(b("foo.bar"), []string{"a", "b"})
+	st.Insert(b("foo"), nil)
+	st.Insert(b("baz.\"quoted\""), []string{"c"})
+	data, err := json.Marshal(doc{Routes: st})
+	require_True(t, err == nil)
+	require_Equal(t, string(data), `{"routes":{"baz.\"quoted\"":["c"],"foo":null,"foo.bar":["a","b"]}}`)
+
+	var d doc
+	require_True(t, json.Unmarshal(data, &d) == nil)
+	require_True(t, d.Routes.Equal(st, func(a, b []string) bool { return slices.Equal(a, b) }))
+
+	// Unmarshaling replaces the entries, but keeps the options.
+	lt := NewSubjectTree[int](WithLazyDelete())
+	lt.Insert(b("old"), 1)
+	require_True(t, json.Unmarshal([]byte(`{"new.1": 1, "new.2": 2}`), lt) == nil)
+	require_Equal(t, lt.Size(), 2)
+	_, ok := lt.Find(b("old"))
+	require_False(t, ok)
+	require_True(t, lt.opts.lazyDelete)
+	require_True(t, json.Unmarshal([]byte(`null`), lt) == nil)
+	require_Equal(t, lt.Size(), 2)
+
+	// Errors leave the tree as it is.
+	require_True(t, json.Unmarshal([]byte(`{"a": "x"}`), lt) != nil)
+	require_True(t, errors.Is(json.Unmarshal([]byte(`{"": 1}`), lt), ErrInvalidSubject))
+	require_Equal(t, lt.Size(), 2)
+	lt.Insert([]byte{'a', 0xff}, 1)
+	_, err = json.Marshal(lt)
+	require_True(t, err != nil)
+
+	var nt *SubjectTree[int]
+	data, err = json.Marshal(nt)
+	require_True(t, err == nil)
+	require_Equal(t, string(data), "null")
+	data, err = json.Marshal(NewSubjectTree[int]())
+	require_True(t, err == nil)
+	require_Equal(t, string(data), "{}")
+}
+
+//-------------------
+//  Test for Generating a Static Matcher
+//-------------------
+
+// Test that the generated matcher compiles and agrees with Find for hits and misses.
+func TestSubjectTreeGenerate(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+	st := NewSubjectTree[int]()
+	subjects := []string{"foo", "foo.bar", "foo.bar.A", "foo.bar.B", "foo.baz", "a'b\\c", "x.\x7e\x80"}
+	for i := 0; i < 60; i++ {
+		subjects = append(subjects, fmt.Sprintf("wide.%c.%d", 'A'+i, i))
+	}
+	for i, subject := range subjects {
+		st.Insert(b(subject), i*10)
+	}
+
+	var src bytes.Buffer
+	err := GenerateWith(&src, st, GenerateConfig[int]{
+		Func:        "Match",
+		ValueType:   "int",
+		FormatValue: func(v int) string { return strconv.Itoa(v) },
+	})
+	require_True(t, err == nil)
+
+	// Probe with every subject and a few misses, printing what the generated code finds.
+	probes := append([]string{"", "f", "fo", "foo.", "foo.bar.C", "foo.bar.AA", "wide.Z", "zzz"}, subjects...)
+	var main bytes.Buffer
+	main.WriteString("package main\n\nimport \"fmt\"\n\nfunc main() {\n")
+	for _, p := range probes {
+		fmt.Fprintf(&main, "if i, ok := Match([]byte(%q)); ok {\nfmt.Println(MatchSubjects[i], MatchValues[i])\n} else {\nfmt.Println(\"-\")\n}\n", p)
+	}
+	main.WriteString("}\n")
+
+	dir := t.TempDir()
+	require_True(t, os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module gen\n\ngo 1.24\n"), 0o644) == nil)
+	require_True(t, os.WriteFile(filepath.Join(dir, "match.go"), src.Bytes(), 0o644) == nil)
+	require_True(t, os.WriteFile(filepath.Join(dir, "main.go"), main.Bytes(), 0o644) == nil)
+	cmd := exec.Command("go", "run", ".")
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Generated code failed: %v\n%s\n%s", err, out, src.String())
+	}
+
+	var expected strings.Builder
+	for _, p := range probes {
+		if v, found := st.Find(b(p)); found {
+			fmt.Fprintln(&expected, p, *v)
+		} else {
+			fmt.Fprintln(&expected, "-")
+		}
+	}
+	require_Equal(t, string(out), expected.String())
+
+	// A value type without a formatter is an error.
+	require_True(t, GenerateWith(&src, st, GenerateConfig[int]{ValueType: "int"}) != nil)
+}
@@ -0,0 +1,88 @@
+package subtree
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+//-------------------
+// Encoding in the background
+//-------------------
+
+// ErrNoEncoder is returned by EncodeAsync without a function to encode values with.
+var ErrNoEncoder = errors.New("subtree: no value encoder")
+
+// EncodeOptions configures EncodeAsync.
+type EncodeOptions[T any] struct {
+	// EncodeValue appends the serialized form of a value to dst and returns the result, as for Encode.
+	// It runs on the encoding goroutine.
+	EncodeValue func(dst []byte, v T) ([]byte, error)
+	// Context cancels the encoding when done, if set.
+	Context context.Context
+}
+
+// EncodeJob is an encoding running in the background, started by EncodeAsync.
+type EncodeJob struct {
+	total  int
+	done   atomic.Int64
+	cancel context.CancelFunc
+	finish chan struct{}
+	err    error
+}
+
+// encodeCheckEvery is the number of entries between checks for cancellation.
+const encodeCheckEvery = 256
+
+// EncodeAsync encodes the tree as of now to w like Encode, but on a goroutine of its own. The tree is
+// snapshotted first, so it can be modified right away while the encoding runs, which copies the nodes
+// modified as with any snapshot. Starting the job is a modification itself, so it needs the same
+// synchronization as Insert. The writer is only used by the job until it is done.
+// Returns ErrNoEncoder if the options have no EncodeValue function.
+func (t *SubjectTree[T]) EncodeAsync(w io.Writer, opts EncodeOptions[T]) (*EncodeJob, error) {
+	if opts.EncodeValue == nil {
+		return nil, ErrNoEncoder
+	}
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	v := t.Snapshot()
+	job := &EncodeJob{total: v.Size(), cancel: cancel, finish: make(chan struct{})}
+	go func() {
+		defer close(job.finish)
+		defer cancel()
+		job.err = v.t.encode(w, opts.EncodeValue, func(entries int) error {
+			job.done.Store(int64(entries))
+			if entries%encodeCheckEvery == 0 {
+				return ctx.Err()
+			}
+			return nil
+		})
+	}()
+	return job, nil
+}
+
+// Progress returns the number of entries written so far and the number of entries to write in total.
+func (j *EncodeJob) Progress() (done, total int) {
+	return int(j.done.Load()), j.total
+}
+
+// Cancel stops the job. The data written so far is incomplete, and Wait returns context.Canceled unless the
+// job was about done already.
+func (j *EncodeJob) Cancel() {
+	j.cancel()
+}
+
+// Done returns a channel closed when the job is done.
+func (j *EncodeJob) Done() <-chan struct{} {
+	return j.finish
+}
+
+// Wait waits for the job to be done and returns its error, if any.
+func (j *EncodeJob) Wait() error {
+	<-j.finish
+	return j.err
+}
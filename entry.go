@@ -0,0 +1,60 @@
+package subtree
+
+//-------------------
+// Entries
+//-------------------
+
+// Entry is a subject and its value as stored in the tree. Entries handed out by the tree hold copies of the
+// subject owned by the caller, and a copy of the value.
+type Entry[T any] struct {
+	Subject []byte
+	Value   T
+}
+
+// entryOf returns an entry holding copies of the subject and value.
+func entryOf[T any](subject []byte, val *T) Entry[T] {
+	return Entry[T]{Subject: copyBytes(subject), Value: *val}
+}
+
+// InsertEntries inserts all entries in order, so a later entry for the same subject wins.
+// Returns the number of entries that were new to the tree.
+func (t *SubjectTree[T]) InsertEntries(entries []Entry[T]) int {
+	if t == nil {
+		return 0
+	}
+	var inserted int
+	for i := range entries {
+		if _, updated := t.Insert(entries[i].Subject, entries[i].Value); !updated {
+			inserted++
+		}
+	}
+	return inserted
+}
+
+// Entries returns all entries in subject order. Meant for small trees and tests.
+func (t *SubjectTree[T]) Entries() []Entry[T] {
+	return t.EntriesPage(nil, 0)
+}
+
+// EntriesPage returns at most limit entries with subjects sorting after the given subject, in subject order.
+// A nil after starts at the first subject and a limit of 0 or less returns all of them. Pass the subject of
+// the last entry returned to get the next page, an empty result means there are no more.
+func (t *SubjectTree[T]) EntriesPage(after []byte, limit int) []Entry[T] {
+	var entries []Entry[T]
+	t.collect(after, limit, func(subject []byte, val *T) {
+		entries = append(entries, entryOf(subject, val))
+	})
+	return entries
+}
+
+// MatchAppend appends the entries matching the filter to dst in subject order and returns the result.
+func (t *SubjectTree[T]) MatchAppend(dst []Entry[T], filter []byte) []Entry[T] {
+	if t == nil {
+		return dst
+	}
+	t.matchOrdered(filter, nil, func(subject []byte, val *T) bool {
+		dst = append(dst, entryOf(subject, val))
+		return true
+	})
+	return dst
+}
@@ -0,0 +1,99 @@
+package subtree
+
+import "fmt"
+
+//-------------------
+// Structural events
+//-------------------
+
+// EventKind identifies a structural change of the tree reported to an event sink.
+type EventKind uint8
+
+const (
+	EventGrow     EventKind = iota + 1 // A node grew into a larger kind
+	EventShrink                        // A node shrunk into a smaller kind or collapsed into its only child
+	EventSplit                         // A leaf or node prefix was split by a new node
+	EventPrune                         // A node was removed because nothing was left below it
+	EventRootSwap                      // The root of the tree was replaced
+)
+
+// String returns the name of the event kind.
+func (k EventKind) String() string {
+	switch k {
+	case EventGrow:
+		return "GROW"
+	case EventShrink:
+		return "SHRINK"
+	case EventSplit:
+		return "SPLIT"
+	case EventPrune:
+		return "PRUNE"
+	case EventRootSwap:
+		return "ROOT_SWAP"
+	}
+	return fmt.Sprintf("EventKind(%d)", uint8(k))
+}
+
+// Event describes a structural change of the tree.
+type Event struct {
+	Kind EventKind
+	From string // Kind of the node changed, e.g. NODE4 or LEAF, empty if there was none
+	To   string // Kind of the node that took its place, empty if there is none
+}
+
+// EventSink receives the structural events of a tree, e.g. to correlate latency spikes with restructuring.
+// Events are delivered synchronously in the middle of a modification, so the sink must not use the tree.
+type EventSink interface {
+	Event(e Event)
+}
+
+// WithEventSink reports node growth, shrinking, splits, pruning and root swaps to sink as they happen.
+// Without a sink no events are created.
+func WithEventSink(sink EventSink) Option {
+	return func(o *options) {
+		o.sink = sink
+	}
+}
+
+// emit reports a change from one node to another to the sink, if set. Either node can be nil.
+func (t *SubjectTree[T]) emit(kind EventKind, from, to node) {
+	if t.opts.sink == nil {
+		return
+	}
+	e := Event{Kind: kind}
+	if from != nil {
+		e.From = from.kind()
+	}
+	if to != nil {
+		e.To = to.kind()
+	}
+	t.opts.sink.Event(e)
+}
+
+// grew counts and reports growing from into to, and returns to.
+func (t *SubjectTree[T]) grew(from, to node) node {
+	t.counts.grew()
+	t.emit(EventGrow, from, to)
+	return to
+}
+
+// shrunk counts and reports shrinking n into sn, if not nil, and returns sn.
+func (t *SubjectTree[T]) shrunk(n, sn node) node {
+	if t.counts.shrunk(n, sn) != nil {
+		t.emit(EventShrink, n, sn)
+	}
+	return sn
+}
+
+// split counts and reports splitting n, a leaf or a node's prefix, by the new node nn.
+func (t *SubjectTree[T]) split(n, nn node) {
+	t.counts.Splits++
+	t.emit(EventSplit, n, nn)
+}
+
+// rootSwapped reports a new root if it is no longer root.
+func (t *SubjectTree[T]) rootSwapped(root node) {
+	if t.opts.sink != nil && t.root != root {
+		t.emit(EventRootSwap, root, t.root)
+	}
+}
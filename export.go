@@ -0,0 +1,281 @@
+package subtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"unsafe"
+)
+
+//-------------------
+// Exporting and importing entries
+//-------------------
+
+// ErrOutOfOrder is returned by ImportEntries for entries not in strictly increasing subject order.
+var ErrOutOfOrder = errors.New("subtree: entries out of order")
+
+// ExportEntries calls the callback for every entry in subject order, e.g. to stream them into protobuf
+// messages. The order only depends on the subjects, so exporting the same entries always produces the same
+// stream. A non-nil error stops the export and is returned. The subject is only valid for the duration of
+// the callback, the value is a copy.
+func (t *SubjectTree[T]) ExportEntries(cb func(subject []byte, value T) error) error {
+	return t.ExportEntriesAfter(nil, cb)
+}
+
+// ExportEntriesAfter is like ExportEntries but only exports the entries with subjects sorting after the given
+// one, so an export that was interrupted can resume after the last subject it got to. A nil after starts at
+// the first subject.
+func (t *SubjectTree[T]) ExportEntriesAfter(after []byte, cb func(subject []byte, value T) error) error {
+	if t == nil || cb == nil {
+		return nil
+	}
+	var err error
+	walk := t.guardIter(func(subject []byte, val *T) bool {
+		err = cb(subject, *val)
+		return err == nil
+	})
+	if after == nil {
+		t.iterAll(true, walk)
+	} else {
+		t.matchOrdered(fwcFilter, after, walk)
+	}
+	return err
+}
+
+// ImportEntries inserts the entries returned by next until it returns io.EOF, the counterpart of
+// ExportEntries. The entries have to come in strictly increasing subject order, as exported, which is checked
+// so a stream that was cut and resumed at the wrong place is noticed. Returns the number of entries inserted
+// and the first error other than io.EOF, from next or ErrOutOfOrder. The entries before the error are in the
+// tree, so the import can resume after the last of them.
+func (t *SubjectTree[T]) ImportEntries(next func() (subject []byte, value T, err error)) (int, error) {
+	if t == nil {
+		return 0, nil
+	}
+	var prev []byte
+	for n := 0; ; n++ {
+		subject, value, err := next()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if n > 0 && bytes.Compare(subject, prev) <= 0 {
+			return n, fmt.Errorf("%w: %q after %q", ErrOutOfOrder, subject, prev)
+		}
+		t.Insert(subject, value)
+		prev = append(prev[:0], subject...)
+	}
+}
+
+// Chunk is a run of consecutive entries in subject order, as handed out by ExportChunks.
+type Chunk[T any] struct {
+	Index   int        // Position of the chunk in the export, starting at 0
+	First   []byte     // Subject of the first entry
+	Last    []byte     // Subject of the last entry
+	Bytes   int        // Approximate size of the entries
+	Entries []Entry[T] // The entries, in subject order
+}
+
+// ExportChunks cuts the entries, in subject order, into chunks of about maxBytes each and calls emit with
+// every chunk in turn, e.g. to import them in parallel or transfer a part of a tree. Every chunk holds a range
+// of subjects no other chunk overlaps. The size of an entry is the length of its subject plus the in-memory
+// size of its value, not counting anything the value references, so chunks are only about equal in size.
+// A chunk holds at least one entry, and a maxBytes of 0 or less puts all entries in a single chunk.
+// The chunks and their entries are owned by emit. A non-nil error stops the export and is returned.
+func (t *SubjectTree[T]) ExportChunks(maxBytes int, emit func(c Chunk[T]) error) error {
+	if t == nil || emit == nil {
+		return nil
+	}
+	var c Chunk[T]
+	valueSize := int(unsafe.Sizeof(*new(T)))
+	flush := func() error {
+		c.First, c.Last = c.Entries[0].Subject, c.Entries[len(c.Entries)-1].Subject
+		err := emit(c)
+		c = Chunk[T]{Index: c.Index + 1}
+		return err
+	}
+	err := t.ExportEntries(func(subject []byte, v T) error {
+		size := len(subject) + valueSize
+		if len(c.Entries) > 0 && maxBytes > 0 && c.Bytes+size > maxBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		c.Entries = append(c.Entries, Entry[T]{Subject: copyBytes(subject), Value: v})
+		c.Bytes += size
+		return nil
+	})
+	if err == nil && len(c.Entries) > 0 {
+		err = flush()
+	}
+	return err
+}
+
+// ImportChunks inserts the entries of chunks as handed out by ExportChunks, the counterpart of ExportChunks
+// for importing in parallel. The given number of workers read the chunks from the channel until it is closed,
+// each building a tree of its own for every chunk, and the trees are then merged into this one. As the chunks
+// hold disjoint ranges of subjects the merge only restructures the nodes along their boundaries, so its cost
+// does not depend on the number of entries. Chunks overlapping entries already in the tree are inserted entry
+// by entry instead, as are all of them for trees that stamp or number their entries.
+// The entries of every chunk have to be in strictly increasing subject order and the chunks may not overlap,
+// in any order they come in, or ErrOutOfOrder is returned and nothing is imported. The channel is read until
+// it is closed in any case. Returns the number of entries imported.
+func (t *SubjectTree[T]) ImportChunks(chunks <-chan Chunk[T], workers int) (int, error) {
+	type part struct {
+		first, last []byte
+		st          *SubjectTree[T]
+	}
+	var (
+		mu    sync.Mutex
+		parts []part
+		err   error
+		wg    sync.WaitGroup
+	)
+	for range max(workers, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				if len(c.Entries) == 0 || t == nil {
+					continue
+				}
+				// Only the prefix limit shapes the nodes, other options are for this tree alone.
+				st := &SubjectTree[T]{opts: options{maxPrefix: t.opts.maxPrefix}}
+				var cerr error
+				for i, e := range c.Entries {
+					if i > 0 && bytes.Compare(e.Subject, c.Entries[i-1].Subject) <= 0 {
+						cerr = fmt.Errorf("%w: %q after %q", ErrOutOfOrder, e.Subject, c.Entries[i-1].Subject)
+						break
+					}
+					st.Insert(e.Subject, e.Value)
+				}
+				mu.Lock()
+				if cerr != nil && err == nil {
+					err = cerr
+				}
+				parts = append(parts, part{c.Entries[0].Subject, c.Entries[len(c.Entries)-1].Subject, st})
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if err != nil || t == nil {
+		return 0, err
+	}
+	slices.SortFunc(parts, func(a, b part) int { return bytes.Compare(a.first, b.first) })
+	for i := 1; i < len(parts); i++ {
+		if bytes.Compare(parts[i].first, parts[i-1].last) <= 0 {
+			return 0, fmt.Errorf("%w: chunk from %q overlaps chunk to %q", ErrOutOfOrder, parts[i].first, parts[i-1].last)
+		}
+	}
+	var n int
+	for _, p := range parts {
+		n += p.st.size
+		t.mergeTree(p.st, p.first, p.last)
+	}
+	return n, nil
+}
+
+// mergeTree moves the entries of other, with subjects from first to last, into the tree.
+func (t *SubjectTree[T]) mergeTree(other *SubjectTree[T], first, last []byte) {
+	if other.root == nil {
+		return
+	}
+	if t.dead > 0 {
+		// Lazily deleted paths could overlap with the merged ones.
+		t.Compact()
+	}
+	if t.lww != nil || t.ids != nil || t.holdsRange(first, last) {
+		other.iterAll(true, func(subject []byte, val *T) bool {
+			t.Insert(subject, *val)
+			return true
+		})
+		return
+	}
+	var entries []Entry[T]
+	if t.logging() {
+		other.iterAll(true, func(subject []byte, val *T) bool {
+			entries = append(entries, entryOf(subject, val))
+			return true
+		})
+	}
+	t.beforeModify()
+	root := t.root
+	t.merge(&t.root, copyBytes(other.root.path()), 0, other.root)
+	t.rootSwapped(root)
+	t.size += other.size
+	t.version++
+	for _, e := range entries {
+		t.logOp(OpInsert, e.Subject, &e.Value)
+	}
+	if debugChecks {
+		t.debugCheck("import")
+	}
+}
+
+// holdsRange returns true if the tree holds a subject from first to last, inclusive.
+func (t *SubjectTree[T]) holdsRange(first, last []byte) bool {
+	if t.size == 0 {
+		return false
+	}
+	if t.findLeaf(first) != nil {
+		return true
+	}
+	var found bool
+	t.matchOrdered(fwcFilter, first, func(subject []byte, _ *T) bool {
+		found = bytes.Compare(subject, last) <= 0
+		return false
+	})
+	return found
+}
+
+// Internal recursive function to merge r, with key as its full path, into the tree. Unlike for graft, the
+// subjects below r may start with those in the tree and the other way around, as long as none is in both.
+func (t *SubjectTree[T]) merge(np *node, key []byte, si int, r node) {
+	n := *np
+	if n == nil {
+		*np = r
+		t.rebase(np, key[si:])
+		return
+	}
+	path := n.path()
+	cpi := commonPrefixLen(path, key[si:])
+	if si+cpi == len(key) && (cpi < len(path) || n.isLeaf()) {
+		// The path of r ends within the one of n, so n goes below r instead.
+		nkey := append(key[:si:si], path...)
+		*np = r
+		t.rebase(np, key[si:])
+		t.merge(np, nkey, si, n)
+		return
+	}
+	if n.isLeaf() || cpi < len(path) {
+		// The paths branch off, or the leaf ends before the key, which graft handles.
+		t.graft(np, key, si, r)
+		return
+	}
+	if si+cpi == len(key) && !r.isLeaf() {
+		// Both nodes have the same path, so merge the children of r one by one.
+		r.iter(func(cn node) bool {
+			t.merge(np, append(key[:len(key):len(key)], cn.path()...), si, cn)
+			return true
+		})
+		return
+	}
+	n = t.writable(np)
+	si += cpi
+	n.base().leaves += leafCount(r)
+	c := pivot(key, si)
+	if cn := n.findChild(c); cn != nil {
+		t.merge(cn, key, si, r)
+		return
+	}
+	if n.isFull() {
+		n = t.grew(n, n.grow())
+		*np = n
+	}
+	n.addChild(c, t.rebased(r, key[si:]))
+}
@@ -0,0 +1,152 @@
+package subtree
+
+import (
+	"sync"
+	"time"
+)
+
+//-------------------
+// Fairness between readers and writers
+//-------------------
+
+// WithWriteBatching makes writers of a SafeSubjectTree coalesce: Insert and Delete calls waiting for the write
+// lock are queued, and whichever writer holds the lock applies up to n of them at once, as a single version of
+// the tree as with Apply. Under a match heavy load every writer otherwise waits for the running matches on
+// its own, and every write blocks new matches once more. Each call still returns once its own write is in
+// the tree, with the same results. The option has no effect on a SubjectTree.
+func WithWriteBatching(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			o.invalid("WithWriteBatching of negative size %d", n)
+		}
+		o.writeBatch = max(n, 1)
+	}
+}
+
+// WithReaderGrace bounds how long Match on a SafeSubjectTree keeps waiting writers out. Once a writer waits
+// and the match has held the read lock for longer than d, it lets go of the lock and carries on after the
+// writer from the last subject it visited. Matches then walk the tree in subject order and may see writes
+// made in between, but never visit an entry twice. By default a match holds the read lock until it is done,
+// and long matches starve writers. The option has no effect on a SubjectTree.
+func WithReaderGrace(d time.Duration) Option {
+	return func(o *options) {
+		if d < 0 {
+			o.invalid("WithReaderGrace of negative duration %v", d)
+		}
+		o.readerGrace = max(d, 0)
+	}
+}
+
+// lock takes the write lock of the stripe, counting the writer as waiting until it has it.
+func (st *safeStripe[T]) lock() {
+	st.waiting.Add(1)
+	st.mu.Lock()
+	st.waiting.Add(-1)
+}
+
+// writeQueue holds the writes of a stripe waiting to be applied by the writer holding the lock.
+type writeQueue[T any] struct {
+	mu      sync.Mutex
+	pending []*queuedWrite[T]
+	active  bool // A writer is applying the queued writes
+}
+
+// queuedWrite is an insert or delete waiting in a writeQueue, with its results once applied.
+type queuedWrite[T any] struct {
+	op      Op
+	subject []byte
+	value   T
+	old     T
+	found   bool
+	wake    chan bool // Receives true once applied, false when this writer has to apply the queue
+}
+
+// write inserts the value for the subject, or deletes the subject for OpDelete, in the tree of the stripe,
+// together with the writes queued by others when batching. Returns the old value, and if there was one.
+func (s *SafeSubjectTree[T]) write(st *safeStripe[T], op Op, subject []byte, value T) (T, bool) {
+	if s.batch <= 1 {
+		st.lock()
+		defer st.mu.Unlock()
+		var w queuedWrite[T]
+		w.op, w.subject, w.value = op, subject, value
+		w.apply(st.t)
+		return w.old, w.found
+	}
+	w := &queuedWrite[T]{op: op, subject: subject, value: value, wake: make(chan bool, 1)}
+	q := &st.queue
+	q.mu.Lock()
+	q.pending = append(q.pending, w)
+	lead := !q.active
+	q.active = true
+	q.mu.Unlock()
+	if !lead && <-w.wake {
+		return w.old, w.found
+	}
+	// Apply batches from the front of the queue until our own write is in, then hand over to the next writer.
+	for done := false; !done; {
+		q.mu.Lock()
+		batch := make([]*queuedWrite[T], min(len(q.pending), s.batch))
+		q.pending = q.pending[copy(batch, q.pending):]
+		q.mu.Unlock()
+		st.lock()
+		st.t.asOneVersion(len(batch), func(i int) { batch[i].apply(st.t) })
+		st.mu.Unlock()
+		for _, bw := range batch {
+			if bw == w {
+				done = true
+			} else {
+				bw.wake <- true
+			}
+		}
+	}
+	q.mu.Lock()
+	if len(q.pending) > 0 {
+		next := q.pending[0]
+		q.mu.Unlock()
+		next.wake <- false
+	} else {
+		q.active = false
+		q.mu.Unlock()
+	}
+	return w.old, w.found
+}
+
+// apply makes the write to the tree and records its results.
+func (w *queuedWrite[T]) apply(t *SubjectTree[T]) {
+	var old *T
+	if w.op == OpDelete {
+		old, w.found = t.Delete(w.subject)
+	} else {
+		old, w.found = t.Insert(w.subject, w.value)
+	}
+	if w.found {
+		w.old = *old
+	}
+}
+
+// match matches the filter against the tree of the stripe while holding its read lock, letting go of it for
+// waiting writers after the grace period.
+func (s *SafeSubjectTree[T]) match(st *safeStripe[T], filter []byte, cb func(subject []byte, val T)) {
+	if s.grace <= 0 {
+		st.mu.RLock()
+		defer st.mu.RUnlock()
+		st.t.MatchVals(filter, cb)
+		return
+	}
+	var after []byte
+	for yielded := true; yielded; {
+		yielded = false
+		st.mu.RLock()
+		start, n := st.t.opts.now(), 0
+		st.t.matchOrdered(filter, after, st.t.guardIter(func(subject []byte, val *T) bool {
+			cb(subject, *val)
+			// Checking the time is not free, so only do it now and then.
+			if n++; n%64 == 0 && st.waiting.Load() > 0 && st.t.opts.since(start) > s.grace {
+				after, yielded = copyBytes(subject), true
+				return false
+			}
+			return true
+		}))
+		st.mu.RUnlock()
+	}
+}
@@ -0,0 +1,467 @@
+// Package filetree persists a subject tree in a directory, as a checkpoint written with Encode and a
+// write-ahead log of the modifications made since. Every modification is appended to the log before it
+// returns, and synced to disk according to the sync policy. Checkpoints are written next to the old one and
+// renamed over it, after which the log starts over. Opening the directory again loads the checkpoint and
+// replays the log, dropping a record torn by a crash at its end, so the tree comes back as of the last
+// modification that made it to disk. Records damaged anywhere else are reported as ErrCorruptLog.
+package filetree
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/rskv-p/subtree"
+)
+
+// Names of the files in the directory of a store.
+const (
+	checkpointFile = "checkpoint"
+	checkpointTemp = "checkpoint.tmp"
+	logFile        = "wal"
+)
+
+// ErrClosed is returned when using a store after it was closed.
+var ErrClosed = errors.New("filetree: store closed")
+
+// ErrNoCodec is returned by Open without functions to encode and decode values.
+var ErrNoCodec = errors.New("filetree: no value codec")
+
+// ErrCorruptLog is returned by Open when a record of the log that is followed by others does not match its
+// checksum, which a crash can not cause.
+var ErrCorruptLog = errors.New("filetree: corrupt log")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+//-------------------
+// Options
+//-------------------
+
+// Codec encodes and decodes the values of a store.
+type Codec[T any] struct {
+	Encode func(dst []byte, v T) ([]byte, error) // Appends the serialized form of v to dst
+	Decode func(b []byte) (T, error)             // Decodes a value, b is only valid for the duration of the call
+}
+
+// SyncPolicy decides when the log is synced to disk.
+type SyncPolicy uint8
+
+const (
+	SyncAlways   SyncPolicy = iota // Sync after every modification, so nothing returned is ever lost
+	SyncInterval                   // Sync with the first modification after the sync interval has passed
+	SyncNever                      // Leave syncing to the operating system, a crash of the machine can lose recent modifications
+)
+
+// Option configures a store.
+type Option func(*options)
+
+type options struct {
+	sync            SyncPolicy
+	syncInterval    time.Duration
+	checkpointEvery int
+	clock           subtree.Clock
+}
+
+// WithSyncPolicy sets when the log is synced to disk. The default is SyncAlways.
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(o *options) {
+		o.sync = p
+	}
+}
+
+// WithSyncInterval syncs the log with the first modification after d has passed since the last sync, so at
+// most the modifications of about d are lost when the machine crashes. Modifications are still written to the
+// log right away, so a crash of the process alone loses nothing.
+func WithSyncInterval(d time.Duration) Option {
+	return func(o *options) {
+		o.sync, o.syncInterval = SyncInterval, d
+	}
+}
+
+// WithCheckpointEvery writes a checkpoint once the log holds n records, keeping the time to open the store
+// bounded. Zero or less only checkpoints when Checkpoint is called. The default is 65536.
+func WithCheckpointEvery(n int) Option {
+	return func(o *options) {
+		o.checkpointEvery = n
+	}
+}
+
+// WithClock makes the store read the time for the sync interval from c instead of the system clock.
+func WithClock(c subtree.Clock) Option {
+	return func(o *options) {
+		o.clock = c
+	}
+}
+
+//-------------------
+// Persistent stores
+//-------------------
+
+// PersistentStore is a subject tree persisted in a directory. It is safe for concurrent use, with writes
+// serialized and reads running in parallel.
+type PersistentStore[T any] struct {
+	mu       sync.RWMutex
+	dir      string
+	opts     options
+	codec    Codec[T]
+	t        *subtree.SubjectTree[T]
+	log      *os.File
+	w        *bufio.Writer
+	buf      []byte
+	records  int       // Records in the log
+	lastSync time.Time // Time the log was last synced
+	err      error     // First error writing the log, after which the store refuses modifications
+	closed   bool
+}
+
+// Open opens the store in the directory, creating the directory if needed. The tree is recovered from the
+// checkpoint and the log found there, if any.
+func Open[T any](dir string, codec Codec[T], opts ...Option) (*PersistentStore[T], error) {
+	if codec.Encode == nil || codec.Decode == nil {
+		return nil, ErrNoCodec
+	}
+	s := &PersistentStore[T]{dir: dir, opts: options{checkpointEvery: 1 << 16}, codec: codec}
+	for _, opt := range opts {
+		opt(&s.opts)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// A checkpoint that was not renamed into place was never complete.
+	if err := os.Remove(filepath.Join(dir, checkpointTemp)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err := s.loadCheckpoint(); err != nil {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, logFile), os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.replay(log); err != nil {
+		log.Close()
+		return nil, err
+	}
+	s.log, s.w, s.lastSync = log, bufio.NewWriter(log), s.now()
+	s.t.SetOpLogger(s.logOp)
+	return s, nil
+}
+
+// loadCheckpoint loads the checkpoint, or starts with an empty tree if there is none.
+func (s *PersistentStore[T]) loadCheckpoint() error {
+	f, err := os.Open(filepath.Join(s.dir, checkpointFile))
+	if errors.Is(err, os.ErrNotExist) {
+		s.t = subtree.NewSubjectTree[T]()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if s.t, err = subtree.Decode(f, s.codec.Decode); err != nil {
+		return fmt.Errorf("filetree: loading checkpoint: %w", err)
+	}
+	return nil
+}
+
+// The log is a sequence of records, each of them
+//
+//	uint32 length of the payload | crc32 (Castagnoli) of the payload, both little endian
+//	payload: op byte | uvarint subject length | subject | value
+//
+// Inserts and updates carry the new value, deletes and empties none. Replaying the log from the start onto
+// the checkpoint written after it leaves the tree as it is, since the last op for a subject decides its state.
+// So the log only has to start over after the checkpoint is in place, and a crash in between does no harm.
+const recordHeaderLen = 8
+
+// replay applies the records in the log to the tree. A record cut short by the end of the log, or the last
+// record not matching its checksum, was torn by a crash while writing it, so the log is truncated before it.
+// Any other record not matching its checksum is corruption, and reported as ErrCorruptLog.
+func (s *PersistentStore[T]) replay(log *os.File) error {
+	info, err := log.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	r := bufio.NewReader(log)
+	var off int64
+	var hdr [recordHeaderLen]byte
+	var payload []byte
+	for {
+		if _, err := io.ReadFull(r, hdr[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		l := binary.LittleEndian.Uint32(hdr[:])
+		end := off + recordHeaderLen + int64(l)
+		if end > size {
+			break
+		}
+		payload = append(payload[:0], make([]byte, l)...)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			return err
+		}
+		if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(hdr[4:]) {
+			if end < size {
+				return fmt.Errorf("filetree: replaying log at offset %d: %w", off, ErrCorruptLog)
+			}
+			break
+		}
+		if err := s.apply(payload); err != nil {
+			return fmt.Errorf("filetree: replaying log at offset %d: %w", off, err)
+		}
+		off = end
+		s.records++
+	}
+	if err := log.Truncate(off); err != nil {
+		return err
+	}
+	_, err = log.Seek(off, io.SeekStart)
+	return err
+}
+
+// apply applies the payload of a log record to the tree.
+func (s *PersistentStore[T]) apply(payload []byte) error {
+	if len(payload) == 0 {
+		return subtree.ErrInvalidOp
+	}
+	op := subtree.Op(payload[0])
+	l, n := binary.Uvarint(payload[1:])
+	if n <= 0 || l > uint64(len(payload)-1-n) {
+		return subtree.ErrInvalidOp
+	}
+	subject, value := payload[1+n:1+n+int(l)], payload[1+n+int(l):]
+	if op != subtree.OpInsert && op != subtree.OpUpdate {
+		return s.t.ApplyOp(op, subject, nil)
+	}
+	v, err := s.codec.Decode(value)
+	if err != nil {
+		return err
+	}
+	return s.t.ApplyOp(op, subject, &v)
+}
+
+// logOp is the op logger of the tree, appending a record for every modification to the log.
+func (s *PersistentStore[T]) logOp(op subtree.Op, subject []byte, v *T) {
+	if s.err != nil {
+		return
+	}
+	s.buf = append(s.buf[:0], make([]byte, recordHeaderLen)...)
+	s.buf = append(s.buf, byte(op))
+	s.buf = binary.AppendUvarint(s.buf, uint64(len(subject)))
+	s.buf = append(s.buf, subject...)
+	if v != nil && (op == subtree.OpInsert || op == subtree.OpUpdate) {
+		if s.buf, s.err = s.codec.Encode(s.buf, *v); s.err != nil {
+			return
+		}
+	}
+	payload := s.buf[recordHeaderLen:]
+	binary.LittleEndian.PutUint32(s.buf, uint32(len(payload)))
+	binary.LittleEndian.PutUint32(s.buf[4:], crc32.Checksum(payload, crcTable))
+	if _, s.err = s.w.Write(s.buf); s.err == nil {
+		s.records++
+	}
+}
+
+// commit writes out the records of a modification, syncs them according to the policy and checkpoints if it
+// is time to. Must be called holding the write lock.
+func (s *PersistentStore[T]) commit() error {
+	if s.err == nil {
+		s.err = s.w.Flush()
+	}
+	if s.err != nil {
+		return s.err
+	}
+	switch s.opts.sync {
+	case SyncAlways:
+		s.err = s.log.Sync()
+	case SyncInterval:
+		if now := s.now(); now.Sub(s.lastSync) >= s.opts.syncInterval {
+			s.err, s.lastSync = s.log.Sync(), now
+		}
+	}
+	if s.err == nil && s.opts.checkpointEvery > 0 && s.records >= s.opts.checkpointEvery {
+		return s.checkpoint()
+	}
+	return s.err
+}
+
+// writable returns an error if the store can not be modified.
+func (s *PersistentStore[T]) writable() error {
+	if s.closed {
+		return ErrClosed
+	}
+	return s.err
+}
+
+// Insert a value into the store. Returns the old value if the subject was already present.
+func (s *PersistentStore[T]) Insert(subject []byte, value T) (old T, updated bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writable(); err != nil {
+		return old, false, err
+	}
+	if o, ok := s.t.Insert(subject, value); ok {
+		old, updated = *o, true
+	}
+	return old, updated, s.commit()
+}
+
+// Delete deletes the subject and returns its value, or false if it was not present.
+func (s *PersistentStore[T]) Delete(subject []byte) (val T, deleted bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writable(); err != nil {
+		return val, false, err
+	}
+	if v, ok := s.t.Delete(subject); ok {
+		val, deleted = *v, true
+	}
+	return val, deleted, s.commit()
+}
+
+// Update calls fn with the tree while holding the write lock, for modifications not covered by the methods
+// above, all of which are logged. The tree and any pointers into it must not be used once fn returns, and
+// fn must not change the op logger of the tree.
+func (s *PersistentStore[T]) Update(fn func(t *subtree.SubjectTree[T])) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writable(); err != nil {
+		return err
+	}
+	fn(s.t)
+	return s.commit()
+}
+
+// Size returns the number of entries in the store.
+func (s *PersistentStore[T]) Size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.Size()
+}
+
+// Find returns a copy of the value for the subject, or false if it is not present.
+func (s *PersistentStore[T]) Find(subject []byte) (T, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.t.FindVal(subject)
+}
+
+// Match calls the callback for every entry matching the filter. The callback runs while holding the read
+// lock, so it must not modify the store.
+func (s *PersistentStore[T]) Match(filter []byte, cb func(subject []byte, val T)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	s.t.MatchVals(filter, cb)
+}
+
+// Sync syncs the log to disk, regardless of the sync policy.
+func (s *PersistentStore[T]) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writable(); err != nil {
+		return err
+	}
+	s.err, s.lastSync = s.log.Sync(), s.now()
+	return s.err
+}
+
+// Checkpoint writes the tree to a new checkpoint and starts the log over, so opening the store does not have
+// to replay what came before.
+func (s *PersistentStore[T]) Checkpoint() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writable(); err != nil {
+		return err
+	}
+	return s.checkpoint()
+}
+
+// checkpoint writes the checkpoint and truncates the log. Must be called holding the write lock.
+func (s *PersistentStore[T]) checkpoint() error {
+	tmp := filepath.Join(s.dir, checkpointTemp)
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	err = s.t.Encode(w, s.codec.Encode)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(s.dir, checkpointFile))
+	}
+	if err == nil {
+		err = syncDir(s.dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// The checkpoint is in place, so the log can start over. Failing that leaves the store unusable, as
+	// records appended to the old log could no longer be told apart from the ones before the checkpoint.
+	if s.err = s.log.Truncate(0); s.err == nil {
+		_, s.err = s.log.Seek(0, io.SeekStart)
+	}
+	if s.err == nil {
+		s.err = s.log.Sync()
+	}
+	s.records, s.lastSync = 0, s.now()
+	return s.err
+}
+
+// Close writes out and syncs the log and closes the store.
+func (s *PersistentStore[T]) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return ErrClosed
+	}
+	s.closed = true
+	err := s.err
+	if err == nil {
+		if err = s.w.Flush(); err == nil {
+			err = s.log.Sync()
+		}
+	}
+	if cerr := s.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// now returns the time of the clock of the store.
+func (s *PersistentStore[T]) now() time.Time {
+	if s.opts.clock != nil {
+		return s.opts.clock.Now()
+	}
+	return time.Now()
+}
+
+// syncDir syncs the directory, making a rename in it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
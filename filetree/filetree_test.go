@@ -0,0 +1,235 @@
+package filetree
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/rskv-p/subtree"
+)
+
+// intCodec stores int values as decimal text.
+var intCodec = Codec[int]{
+	Encode: func(dst []byte, v int) ([]byte, error) { return fmt.Appendf(dst, "%d", v), nil },
+	Decode: func(b []byte) (int, error) {
+		var v int
+		_, err := fmt.Sscanf(string(b), "%d", &v)
+		return v, err
+	},
+}
+
+// contents returns the entries of the store as subject=value pairs in subject order.
+func contents(s *PersistentStore[int]) string {
+	var buf bytes.Buffer
+	s.Update(func(t *subtree.SubjectTree[int]) {
+		t.IterOrdered(func(subject []byte, v *int) bool {
+			fmt.Fprintf(&buf, "%s=%d ", subject, *v)
+			return true
+		})
+	})
+	return buf.String()
+}
+
+// mustOpen opens the store in dir, failing the test on errors.
+func mustOpen(t *testing.T, dir string, opts ...Option) *PersistentStore[int] {
+	t.Helper()
+	s, err := Open(dir, intCodec, opts...)
+	if err != nil {
+		t.Fatalf("Error opening store: %v", err)
+	}
+	return s
+}
+
+// Test that modifications survive closing and opening the store, with and without checkpoints.
+func TestStoreReopen(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir, WithCheckpointEvery(50))
+	for i := 0; i < 120; i++ {
+		if _, _, err := s.Insert([]byte(fmt.Sprintf("foo.%d", i%40)), i); err != nil {
+			t.Fatalf("Error inserting: %v", err)
+		}
+	}
+	if _, deleted, err := s.Delete([]byte("foo.7")); !deleted || err != nil {
+		t.Fatalf("Expected delete, got %v, %v", deleted, err)
+	}
+	if err := s.Update(func(t *subtree.SubjectTree[int]) { t.Insert([]byte("bar"), -1) }); err != nil {
+		t.Fatalf("Error updating: %v", err)
+	}
+	old, updated, err := s.Insert([]byte("bar"), -2)
+	if !updated || old != -1 || err != nil {
+		t.Fatalf("Expected update of -1, got %d, %v, %v", old, updated, err)
+	}
+	expected := contents(s)
+	if err := s.Close(); err != nil {
+		t.Fatalf("Error closing: %v", err)
+	}
+	if _, _, err := s.Insert([]byte("foo"), 1); err != ErrClosed {
+		t.Fatalf("Expected ErrClosed, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, checkpointFile)); err != nil {
+		t.Fatalf("Expected a checkpoint: %v", err)
+	}
+
+	s = mustOpen(t, dir)
+	if got := contents(s); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+	if v, ok := s.Find([]byte("foo.39")); !ok || v != 119 {
+		t.Fatalf("Expected 119, got %d, %v", v, ok)
+	}
+	var n int
+	s.Match([]byte("foo.*"), func(_ []byte, _ int) { n++ })
+	if n != 39 || s.Size() != 40 {
+		t.Fatalf("Expected 39 matches of 40 entries, got %d of %d", n, s.Size())
+	}
+
+	// Emptying is logged as well, and a checkpoint starts the log over.
+	s.Update(func(t *subtree.SubjectTree[int]) { t.Empty() })
+	s.Insert([]byte("baz"), 3)
+	s.Close()
+	s = mustOpen(t, dir)
+	if got := contents(s); got != "baz=3 " {
+		t.Fatalf("Expected only baz, got %q", got)
+	}
+	if err := s.Checkpoint(); err != nil {
+		t.Fatalf("Error checkpointing: %v", err)
+	}
+	if fi, err := os.Stat(filepath.Join(dir, logFile)); err != nil || fi.Size() != 0 {
+		t.Fatalf("Expected an empty log, got %v", err)
+	}
+	s.Close()
+	s = mustOpen(t, dir)
+	if got := contents(s); got != "baz=3 " {
+		t.Fatalf("Expected only baz, got %q", got)
+	}
+	s.Close()
+}
+
+// Test that opening recovers from crashes: records torn while writing, checkpoints not renamed into place and
+// logs not started over after a checkpoint.
+func TestStoreRecover(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir, WithSyncPolicy(SyncNever), WithCheckpointEvery(0))
+	for i := 0; i < 20; i++ {
+		s.Insert([]byte(fmt.Sprintf("foo.%d", i)), i)
+	}
+	s.Delete([]byte("foo.3"))
+	expected := contents(s)
+	// Crash without closing, tearing a record at the end of the log.
+	s.Insert([]byte("foo.torn"), 99)
+	logPath := filepath.Join(dir, logFile)
+	log, _ := os.ReadFile(logPath)
+	os.WriteFile(logPath, log[:len(log)-3], 0o644)
+	os.WriteFile(filepath.Join(dir, checkpointTemp), []byte("partial"), 0o644)
+
+	s = mustOpen(t, dir)
+	if got := contents(s); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, checkpointTemp)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the partial checkpoint to be removed, got %v", err)
+	}
+	// The torn record is gone, so new records follow the last good one.
+	s.Insert([]byte("foo.new"), 100)
+	expected = contents(s)
+	log, _ = os.ReadFile(logPath)
+
+	// Crash after a checkpoint was renamed into place, but before the log started over.
+	s.Checkpoint()
+	s.Close()
+	os.WriteFile(logPath, log, 0o644)
+	s = mustOpen(t, dir)
+	if got := contents(s); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+	s.Close()
+
+	// A corrupt checkpoint is an error.
+	os.WriteFile(filepath.Join(dir, checkpointFile), []byte("garbage"), 0o644)
+	if _, err := Open(dir, intCodec); !errors.Is(err, subtree.ErrCorrupt) {
+		t.Fatalf("Expected ErrCorrupt, got %v", err)
+	}
+	if _, err := Open(dir, Codec[int]{}); err != ErrNoCodec {
+		t.Fatalf("Expected ErrNoCodec, got %v", err)
+	}
+}
+
+// Test that a record not matching its checksum is only dropped when it is the last one of the log, and is
+// an error anywhere else, as it would take the records after it along.
+func TestStoreCorruptLog(t *testing.T) {
+	dir := t.TempDir()
+	s := mustOpen(t, dir, WithSyncPolicy(SyncNever), WithCheckpointEvery(0))
+	for i := 0; i < 5; i++ {
+		s.Insert([]byte(fmt.Sprintf("foo.%d", i)), i)
+	}
+	expected := contents(s)
+	s.Insert([]byte("foo.last"), 99)
+	s.Close()
+	logPath := filepath.Join(dir, logFile)
+	log, _ := os.ReadFile(logPath)
+
+	// Damage the payload of the second record.
+	damaged := bytes.Clone(log)
+	second := recordHeaderLen + int(binary.LittleEndian.Uint32(log))
+	damaged[second+recordHeaderLen+1] ^= 0xff
+	os.WriteFile(logPath, damaged, 0o644)
+	if _, err := Open(dir, intCodec); !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("Expected ErrCorruptLog, got %v", err)
+	}
+	// Nothing was truncated, so the log can still be repaired.
+	if got, _ := os.ReadFile(logPath); !bytes.Equal(got, damaged) {
+		t.Fatalf("Expected the log to be left as it was")
+	}
+
+	// The last record is torn, complete in length but not in content.
+	damaged = bytes.Clone(log)
+	damaged[len(damaged)-1] ^= 0xff
+	os.WriteFile(logPath, damaged, 0o644)
+	s = mustOpen(t, dir)
+	if got := contents(s); got != expected {
+		t.Fatalf("Expected %q, got %q", expected, got)
+	}
+	s.Close()
+}
+
+// Test that the log is synced according to the policy.
+func TestStoreSync(t *testing.T) {
+	s := mustOpen(t, t.TempDir(), WithSyncInterval(time.Hour))
+	start := s.lastSync
+	s.Insert([]byte("foo"), 1)
+	if s.lastSync != start {
+		t.Fatalf("Expected no sync within the interval")
+	}
+	s.opts.syncInterval = 0
+	s.Insert([]byte("foo"), 2)
+	if !s.lastSync.After(start) {
+		t.Fatalf("Expected a sync after the interval")
+	}
+	if err := s.Sync(); err != nil {
+		t.Fatalf("Error syncing: %v", err)
+	}
+	s.Close()
+}
+
+// Test that the sync interval follows the clock of the store.
+func TestStoreSyncClock(t *testing.T) {
+	clock := subtree.NewManualClock(time.Unix(1000, 0))
+	s := mustOpen(t, t.TempDir(), WithSyncInterval(time.Minute), WithClock(clock))
+	defer s.Close()
+	s.Insert([]byte("foo"), 1)
+	clock.Advance(59 * time.Second)
+	s.Insert([]byte("foo"), 2)
+	if !s.lastSync.Equal(time.Unix(1000, 0)) {
+		t.Fatalf("Expected no sync within the interval, last sync at %v", s.lastSync)
+	}
+	now := clock.Advance(time.Second)
+	s.Insert([]byte("foo"), 3)
+	if !s.lastSync.Equal(now) {
+		t.Fatalf("Expected a sync at %v, got %v", now, s.lastSync)
+	}
+}
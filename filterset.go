@@ -0,0 +1,151 @@
+package subtree
+
+import (
+	"fmt"
+	"io"
+)
+
+//-------------------
+// Compiled filter sets
+//-------------------
+
+// FilterSet is a set of filters compiled once into a tree, so their shared prefixes are only matched once.
+// Checking a subject against the set, or matching a tree against all of the filters, does not depend on
+// the number of filters, e.g. for gateways evaluating tens of thousands of filters per message.
+// A FilterSet can be written out with WriteTo and read back with ReadFilterSet.
+// FilterSets are immutable once created and safe for concurrent use.
+type FilterSet struct {
+	t *SubjectTree[struct{}]
+}
+
+// NewFilterSet compiles the filters into a FilterSet. Duplicate filters are only kept once.
+// Returns ErrInvalidFilter if any of the filters is not valid.
+func NewFilterSet(filters []string) (*FilterSet, error) {
+	st := NewSubjectTree[struct{}]()
+	for _, f := range filters {
+		if !validFilter(stringBytes(f)) {
+			return nil, fmt.Errorf("%w: %q", ErrInvalidFilter, f)
+		}
+		st.Insert(stringBytes(f), struct{}{})
+	}
+	return &FilterSet{t: st}, nil
+}
+
+// Len returns the number of distinct filters in the set.
+func (fs *FilterSet) Len() int {
+	if fs == nil {
+		return 0
+	}
+	return fs.t.Size()
+}
+
+// Filters returns the filters in the set in lexicographical order.
+func (fs *FilterSet) Filters() []string {
+	if fs == nil {
+		return nil
+	}
+	filters := make([]string, 0, fs.t.Size())
+	fs.t.IterOrdered(func(filter []byte, _ *struct{}) bool {
+		filters = append(filters, string(filter))
+		return true
+	})
+	return filters
+}
+
+// MatchesSubject returns true if any filter in the set matches the literal subject.
+func (fs *FilterSet) MatchesSubject(subject []byte) bool {
+	return fs != nil && fs.t.HasInterestMatching(subject)
+}
+
+// MatchingFilters calls the callback for every filter in the set matching the literal subject.
+// The filter passed to the callback is only valid for the duration of the callback.
+func (fs *FilterSet) MatchingFilters(subject []byte, cb func(filter []byte)) {
+	if fs == nil || cb == nil {
+		return
+	}
+	fs.t.ReverseMatch(subject, func(filter []byte, _ *struct{}) { cb(filter) })
+}
+
+// WriteTo writes the filter set to w, in the encoding of Encode. Returns the number of bytes written.
+func (fs *FilterSet) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := fs.t.Encode(cw, func(dst []byte, _ struct{}) ([]byte, error) { return dst, nil })
+	return cw.n, err
+}
+
+// ReadFilterSet reads a filter set written by WriteTo. Returns ErrCorrupt if the data is not a valid
+// encoding, or ErrInvalidFilter if it holds a filter that is not valid.
+func ReadFilterSet(r io.Reader) (*FilterSet, error) {
+	st, err := Decode(r, func(b []byte) (struct{}, error) {
+		if len(b) > 0 {
+			return struct{}{}, ErrCorrupt
+		}
+		return struct{}{}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	fs := &FilterSet{t: st}
+	st.IterFast(func(filter []byte, _ *struct{}) bool {
+		if !validFilter(filter) {
+			err = fmt.Errorf("%w: %q", ErrInvalidFilter, filter)
+		}
+		return err == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// MatchSet will match all entries against the filters of the set and call the callback once for every
+// entry matching any of them. Subtrees no filter could match are not walked at all.
+// Matches are visited in subject order.
+func (t *SubjectTree[T]) MatchSet(fs *FilterSet, cb func(subject []byte, val *T)) {
+	if fs == nil || fs.t.Size() == 0 || cb == nil {
+		return
+	}
+	t.MatchWithPruner(fwcFilter, func(_ int, prefix []byte) bool {
+		return !fs.t.interestUnder(prefix)
+	}, func(subject []byte, val *T) {
+		if fs.MatchesSubject(subject) {
+			cb(subject, val)
+		}
+	})
+}
+
+// Uncovered calls the callback for every entry no filter of the set matches, e.g. to find orphaned subjects
+// no consumer will ever receive. Subtrees a filter ending in a full wildcard covers completely are not walked
+// at all. Entries are visited in subject order.
+func (t *SubjectTree[T]) Uncovered(fs *FilterSet, cb func(subject []byte, val *T)) {
+	if cb == nil {
+		return
+	}
+	if fs == nil || fs.t.Size() == 0 {
+		t.IterOrdered(func(subject []byte, val *T) bool {
+			cb(subject, val)
+			return true
+		})
+		return
+	}
+	t.MatchWithPruner(fwcFilter, func(_ int, prefix []byte) bool {
+		return fs.t.coversPrefix(prefix)
+	}, func(subject []byte, val *T) {
+		if !fs.MatchesSubject(subject) {
+			cb(subject, val)
+		}
+	})
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write writes p to the underlying writer.
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,59 @@
+package subtree
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+//-------------------
+// Unicode case folding
+//-------------------
+
+// WithUnicodeFold makes the tree compare subjects as Unicode text instead of bytes: subjects and filters are
+// case folded and brought into the composed normal form (NFC) before they are inserted, looked up, deleted
+// or matched, so "Café", "café" and "café" are the same subject. The tree holds the folded subjects,
+// and those are what callbacks get. Subjects that are lower case ASCII are used as they are and cost
+// nothing extra, others are copied. Bytes that are not valid UTF-8 are kept as they are.
+// Folding is the full Unicode case folding, so e.g. "STRASSE" and "straße" are the same subject as well.
+func WithUnicodeFold() Option {
+	return func(o *options) {
+		o.fold = true
+	}
+}
+
+// foldSubject returns the subject case folded and in NFC, or the subject itself if it already is.
+func foldSubject(subject []byte) []byte {
+	var upper bool
+	for _, c := range subject {
+		if c >= utf8.RuneSelf {
+			return foldUnicode(subject)
+		}
+		upper = upper || 'A' <= c && c <= 'Z'
+	}
+	if !upper {
+		return subject
+	}
+	return bytes.ToLower(subject)
+}
+
+// foldUnicode folds a subject with runes beyond ASCII. The subject is folded decomposed and composed again
+// after, so composed characters fold the same as their decomposed forms. A caser keeps state, so every
+// call gets its own.
+func foldUnicode(subject []byte) []byte {
+	folded := norm.NFC.Bytes(cases.Fold().Bytes(norm.NFD.Bytes(subject)))
+	// The caser turns Cherokee letters into the other case, instead of into the capital letters as Unicode
+	// folds them, so they would change again every time they are folded.
+	for i := 0; i < len(folded); {
+		r, size := utf8.DecodeRune(folded[i:])
+		if 0x13a0 <= r && r <= 0x13ff || 0xab70 <= r && r <= 0xabbf {
+			// Both cases are three bytes long, and the folded bytes are ours.
+			utf8.EncodeRune(folded[i:], unicode.ToUpper(r))
+		}
+		i += size
+	}
+	return folded
+}
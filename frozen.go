@@ -0,0 +1,325 @@
+package subtree
+
+import (
+	"bytes"
+	"errors"
+	"math"
+)
+
+//-------------------
+// Frozen arena backed trees
+//-------------------
+
+// ErrTooLarge is returned when a tree does not fit the 32-bit offsets of a FrozenSubjectTree.
+var ErrTooLarge = errors.New("subtree: tree too large")
+
+// FrozenSubjectTree is a read only copy of a SubjectTree using a compact memory layout.
+// Instead of individually allocated nodes referencing their children through 16 byte interface values,
+// all nodes, child keys, leaves, values, prefixes and suffixes live in a few flat arrays and reference each
+// other through 32-bit offsets. An internal node costs 16 bytes plus 5 bytes per child regardless of its
+// fanout, where a node256 costs over 4KB, and the garbage collector has only a handful of objects to scan.
+// Use ArenaSubjectTree for a tree with this layout that can still be modified.
+// A FrozenSubjectTree is safe for concurrent use. Use Thaw to get a modifiable tree back.
+type FrozenSubjectTree[T any] struct {
+	nodes  []frozenNode // Internal nodes
+	keys   []byte       // Child keys, each node owns a range sorted by key
+	refs   []uint32     // Child references, parallel to keys
+	leaves []frozenSpan // Suffixes of the leaves, in subject order
+	values []T          // Values of the leaves, in subject order
+	data   []byte       // Storage for all prefixes and suffixes
+	root   uint32       // Reference to the root, noRef if empty
+}
+
+// A reference to a leaf has the high bit set and indexes leaves and values, otherwise it indexes nodes.
+const (
+	frozenLeafBit = uint32(1) << 31
+	noRef         = math.MaxUint32
+)
+
+// frozenSpan is a range of the data array.
+type frozenSpan struct {
+	off uint32
+	len uint32
+}
+
+// frozenNode is an internal node of a frozen tree.
+type frozenNode struct {
+	prefix frozenSpan // Prefix of the node
+	first  uint32     // First index of our children in keys and refs
+	count  uint32     // Number of children
+}
+
+// Freeze returns a FrozenSubjectTree with the current contents of the tree.
+// The limits are 2^31 nodes and leaves and 4GB of prefixes and suffixes.
+func (t *SubjectTree[T]) Freeze() (*FrozenSubjectTree[T], error) {
+	f := &FrozenSubjectTree[T]{root: noRef}
+	if t == nil || t.root == nil {
+		return f, nil
+	}
+	f.leaves = make([]frozenSpan, 0, t.size)
+	f.values = make([]T, 0, t.size)
+	ref, err := f.add(t.root)
+	if err != nil {
+		return nil, err
+	}
+	f.root = ref
+	return f, nil
+}
+
+// add copies node n and its subtree into the frozen tree in subject order and returns its reference.
+func (f *FrozenSubjectTree[T]) add(n node) (uint32, error) {
+	if n.isLeaf() {
+		ln := n.(*leaf[T])
+		if ln.dead() {
+			return noRef, nil
+		}
+		if len(f.leaves) >= int(frozenLeafBit) {
+			return 0, ErrTooLarge
+		}
+		span, err := f.span(ln.suffix)
+		if err != nil {
+			return 0, err
+		}
+		f.leaves = append(f.leaves, span)
+		f.values = append(f.values, ln.value)
+		return uint32(len(f.leaves)-1) | frozenLeafBit, nil
+	}
+	if len(f.nodes) >= int(frozenLeafBit) {
+		return 0, ErrTooLarge
+	}
+	span, err := f.span(n.base().prefix)
+	if err != nil {
+		return 0, err
+	}
+	idx := len(f.nodes)
+	f.nodes = append(f.nodes, frozenNode{prefix: span})
+
+	// Children are added in subject order so leaves end up ordered, and their references are then
+	// stored sorted by key for lookups. The two orders only differ for the child without a pivot.
+	var _nodes [256]node
+	children := sortedChildren(n, _nodes[:0])
+	var _keys [256]byte
+	var _refs [256]uint32
+	keys, refs := _keys[:0], _refs[:0]
+	for _, cn := range children {
+		ref, err := f.add(cn)
+		if err != nil {
+			return 0, err
+		}
+		if ref == noRef {
+			continue
+		}
+		keys, refs = append(keys, pivot(cn.path(), 0)), append(refs, ref)
+	}
+	for i := 1; i < len(keys); i++ {
+		for j := i; j > 0 && keys[j] < keys[j-1]; j-- {
+			keys[j], keys[j-1] = keys[j-1], keys[j]
+			refs[j], refs[j-1] = refs[j-1], refs[j]
+		}
+	}
+	// Our children are stored after those of our descendants, which were added above.
+	first := len(f.keys)
+	f.keys, f.refs = append(f.keys, keys...), append(f.refs, refs...)
+	f.nodes[idx].first, f.nodes[idx].count = uint32(first), uint32(len(keys))
+	return uint32(idx), nil
+}
+
+// span copies b into the data array and returns its range.
+func (f *FrozenSubjectTree[T]) span(b []byte) (frozenSpan, error) {
+	if len(f.data)+len(b) > math.MaxUint32 {
+		return frozenSpan{}, ErrTooLarge
+	}
+	span := frozenSpan{uint32(len(f.data)), uint32(len(b))}
+	f.data = append(f.data, b...)
+	return span, nil
+}
+
+// Thaw returns a new modifiable SubjectTree with the contents of the frozen tree.
+func (f *FrozenSubjectTree[T]) Thaw() *SubjectTree[T] {
+	t := NewSubjectTree[T]()
+	f.IterOrdered(func(subject []byte, v *T) bool {
+		t.Insert(subject, *v)
+		return true
+	})
+	return t
+}
+
+// Size returns the number of elements stored.
+func (f *FrozenSubjectTree[T]) Size() int { return len(f.values) }
+
+// Find will find the value and return it or false if it was not found.
+// The returned value must not be modified.
+func (f *FrozenSubjectTree[T]) Find(subject []byte) (*T, bool) {
+	var si int
+	for ref := f.root; ref != noRef; {
+		if ref&frozenLeafBit != 0 {
+			li := ref &^ frozenLeafBit
+			if string(subject[si:]) == string(f.frag(f.leaves[li])) {
+				return &f.values[li], true
+			}
+			return nil, false
+		}
+		fn := &f.nodes[ref]
+		if prefix := f.frag(fn.prefix); len(prefix) > 0 {
+			end := si + len(prefix)
+			if end > len(subject) || string(subject[si:end]) != string(prefix) {
+				return nil, false
+			}
+			si = end
+		}
+		ref = f.findChild(fn, pivot(subject, si))
+	}
+	return nil, false
+}
+
+// Match will match against a subject that can have wildcards and invoke the callback func for each matched value.
+// The values must not be modified.
+func (f *FrozenSubjectTree[T]) Match(filter []byte, cb func(subject []byte, val *T)) {
+	if f.root == noRef || len(filter) == 0 || cb == nil {
+		return
+	}
+	var raw [16][]byte
+	parts := genParts(filter, raw[:0])
+	var _pre [256]byte
+	f.match(f.root, parts, _pre[:0], cb)
+}
+
+// IterOrdered will walk all entries lexographically. The callback can return false to terminate the walk.
+func (f *FrozenSubjectTree[T]) IterOrdered(cb func(subject []byte, val *T) bool) {
+	if f.root == noRef {
+		return
+	}
+	var _pre [256]byte
+	f.iter(f.root, _pre[:0], cb)
+}
+
+// IterFast will walk all entries with no guarantees of ordering. The callback can return false to terminate the walk.
+// For a frozen tree this is the same as IterOrdered.
+func (f *FrozenSubjectTree[T]) IterFast(cb func(subject []byte, val *T) bool) {
+	f.IterOrdered(cb)
+}
+
+// frag returns the bytes of a span.
+func (f *FrozenSubjectTree[T]) frag(s frozenSpan) []byte {
+	return f.data[s.off : s.off+s.len : s.off+s.len]
+}
+
+// path returns the prefix or suffix of a reference.
+func (f *FrozenSubjectTree[T]) path(ref uint32) []byte {
+	if ref&frozenLeafBit != 0 {
+		return f.frag(f.leaves[ref&^frozenLeafBit])
+	}
+	return f.frag(f.nodes[ref].prefix)
+}
+
+// findChild returns the reference of the child of fn for key c, or noRef.
+func (f *FrozenSubjectTree[T]) findChild(fn *frozenNode, c byte) uint32 {
+	keys := f.keys[fn.first : fn.first+fn.count]
+	// Keys are sorted, so use a binary search for larger nodes.
+	lo, hi := 0, len(keys)
+	for hi-lo > 8 {
+		mid := int(uint(lo+hi) >> 1)
+		if keys[mid] < c {
+			lo = mid + 1
+		} else {
+			// Keep the middle key in range, it may be c.
+			hi = mid + 1
+		}
+	}
+	for i := lo; i < hi; i++ {
+		if keys[i] == c {
+			return f.refs[int(fn.first)+i]
+		}
+	}
+	return noRef
+}
+
+// children returns the child references of fn, sorted by key.
+func (f *FrozenSubjectTree[T]) children(fn *frozenNode) []uint32 {
+	return f.refs[fn.first : fn.first+fn.count]
+}
+
+// Internal iter function, children are visited in subject order.
+func (f *FrozenSubjectTree[T]) iter(ref uint32, pre []byte, cb func(subject []byte, val *T) bool) bool {
+	if ref&frozenLeafBit != 0 {
+		li := ref &^ frozenLeafBit
+		return cb(append(pre, f.frag(f.leaves[li])...), &f.values[li])
+	}
+	fn := &f.nodes[ref]
+	pre = append(pre, f.frag(fn.prefix)...)
+	// The child without a pivot, if any, is the first in subject order.
+	np := f.findChild(fn, noPivot)
+	if np != noRef && !f.iter(np, pre, cb) {
+		return false
+	}
+	for _, cref := range f.children(fn) {
+		if cref != np && !f.iter(cref, pre, cb) {
+			return false
+		}
+	}
+	return true
+}
+
+// Internal match function, mirroring SubjectTree.match on the frozen layout.
+func (f *FrozenSubjectTree[T]) match(ref uint32, parts [][]byte, pre []byte, cb func(subject []byte, val *T)) {
+	// Capture if we are sitting on a terminal fwc.
+	var hasFWC bool
+	if lp := len(parts); lp > 0 && isFWC(parts[lp-1]) {
+		hasFWC = true
+	}
+
+	for ref != noRef {
+		nparts, matched := matchParts(parts, f.path(ref))
+		if !matched {
+			return
+		}
+		// If we are a leaf and have exhausted all parts or have a FWC fire callback.
+		if ref&frozenLeafBit != 0 {
+			if len(nparts) == 0 || (hasFWC && len(nparts) == 1) {
+				li := ref &^ frozenLeafBit
+				cb(append(pre, f.frag(f.leaves[li])...), &f.values[li])
+			}
+			return
+		}
+		fn := &f.nodes[ref]
+		pre = append(pre, f.frag(fn.prefix)...)
+
+		// Check our remaining parts.
+		if len(nparts) == 0 && !hasFWC {
+			// We could have a leaf with no suffix which would be a match, or a terminal pwc.
+			var hasTermPWC bool
+			if lp := len(parts); lp > 0 && isPWC(parts[lp-1]) {
+				nparts = parts[len(parts)-1:]
+				hasTermPWC = true
+			}
+			for _, cref := range f.children(fn) {
+				if cref&frozenLeafBit != 0 {
+					li := cref &^ frozenLeafBit
+					suffix := f.frag(f.leaves[li])
+					if len(suffix) == 0 || (hasTermPWC && bytes.IndexByte(suffix, tsep) < 0) {
+						cb(append(pre, suffix...), &f.values[li])
+					}
+				} else if hasTermPWC {
+					f.match(cref, nparts, pre, cb)
+				}
+			}
+			return
+		}
+		// If we are sitting on a terminal fwc, put back and continue.
+		if hasFWC && len(nparts) == 0 {
+			nparts = parts[len(parts)-1:]
+		}
+
+		// Check if the first part is a wildcard, which means we need to look at all children.
+		fp := nparts[0]
+		p := pivot(fp, 0)
+		if isPWC(fp) || isFWC(fp) {
+			for _, cref := range f.children(fn) {
+				f.match(cref, nparts, pre, cb)
+			}
+			return
+		}
+		// Here we have normal traversal, so find the next child.
+		ref, parts = f.findChild(fn, p), nparts
+	}
+}
@@ -0,0 +1,130 @@
+package subtree
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io"
+	"strconv"
+)
+
+//-------------------
+// Generating a static matcher
+//-------------------
+
+// GenerateConfig controls the Go source emitted by GenerateWith.
+type GenerateConfig[T any] struct {
+	Package     string         // Package of the generated file, defaults to "main"
+	Func        string         // Name of the lookup function, defaults to "Lookup"
+	ValueType   string         // Go type of the values, e.g. "int". If empty no values are emitted
+	FormatValue func(T) string // Returns a Go expression for a value, required with ValueType
+}
+
+// Generate writes Go source for a matcher of the subjects currently in the tree, see GenerateWith.
+func Generate[T any](w io.Writer, t *SubjectTree[T]) error {
+	return GenerateWith(w, t, GenerateConfig[T]{})
+}
+
+// GenerateWith writes Go source for a matcher of the subjects currently in the tree. The generated code
+// mirrors the structure of the tree with nested prefix checks and switch statements, and does not allocate.
+// It contains the following, with names derived from the configured function name:
+//
+//	func Lookup(subject []byte) (int, bool) // Index of a literal subject in LookupSubjects
+//	var LookupSubjects = [...]string{...}   // All subjects in order
+//	var LookupValues = [...]T{...}          // Values for each subject, only if ValueType is set
+func GenerateWith[T any](w io.Writer, t *SubjectTree[T], cfg GenerateConfig[T]) error {
+	if cfg.Package == "" {
+		cfg.Package = "main"
+	}
+	if cfg.Func == "" {
+		cfg.Func = "Lookup"
+	}
+	if cfg.ValueType != "" && cfg.FormatValue == nil {
+		return fmt.Errorf("subtree: generate with value type %q requires a value formatter", cfg.ValueType)
+	}
+
+	// Index all leaves by the address of their value in subject order.
+	index := make(map[*T]int, t.Size())
+	var subjects []string
+	var values []T
+	t.iterAll(true, func(subject []byte, v *T) bool {
+		index[v] = len(subjects)
+		subjects = append(subjects, string(subject))
+		values = append(values, *v)
+		return true
+	})
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by subtree.Generate. DO NOT EDIT.\n\npackage %s\n\n", cfg.Package)
+	fmt.Fprintf(&buf, "// %s returns the index of subject in %sSubjects, or false if it is not one of them.\n", cfg.Func, cfg.Func)
+	fmt.Fprintf(&buf, "func %s(subject []byte) (int, bool) {\n", cfg.Func)
+	if t.root != nil {
+		g := generator[T]{buf: &buf, index: index}
+		g.node(t.root, 0)
+	}
+	fmt.Fprintf(&buf, "return -1, false\n}\n\n")
+
+	fmt.Fprintf(&buf, "// %sSubjects holds all subjects known to %s in order.\n", cfg.Func, cfg.Func)
+	fmt.Fprintf(&buf, "var %sSubjects = [...]string{\n", cfg.Func)
+	for _, subject := range subjects {
+		fmt.Fprintf(&buf, "%s,\n", strconv.Quote(subject))
+	}
+	fmt.Fprintf(&buf, "}\n")
+
+	if cfg.ValueType != "" {
+		fmt.Fprintf(&buf, "\n// %sValues holds the value for each subject in %sSubjects.\n", cfg.Func, cfg.Func)
+		fmt.Fprintf(&buf, "var %sValues = [...]%s{\n", cfg.Func, cfg.ValueType)
+		for _, v := range values {
+			fmt.Fprintf(&buf, "%s,\n", cfg.FormatValue(v))
+		}
+		fmt.Fprintf(&buf, "}\n")
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("subtree: generated invalid source: %w", err)
+	}
+	_, err = w.Write(src)
+	return err
+}
+
+// generator emits the lookup code for the nodes of a tree.
+type generator[T any] struct {
+	buf   *bytes.Buffer
+	index map[*T]int
+}
+
+// node emits the code matching node n, which starts at offset off of the subject.
+// At this point we know the subject is at least off bytes long.
+func (g *generator[T]) node(n node, off int) {
+	if n.isLeaf() {
+		ln := n.(*leaf[T])
+		if ln.dead() {
+			return
+		}
+		fmt.Fprintf(g.buf, "if string(subject[%d:]) == %s {\nreturn %d, true\n}\n", off, strconv.Quote(string(ln.suffix)), g.index[&ln.value])
+		return
+	}
+	bn := n.base()
+	if l := len(bn.prefix); l > 0 {
+		fmt.Fprintf(g.buf, "if len(subject) < %d || string(subject[%d:%d]) != %s {\nreturn -1, false\n}\n", off+l, off, off+l, strconv.Quote(string(bn.prefix)))
+		off += l
+	}
+	// The pivot is the next byte of the subject, or noPivot when we are at the end.
+	fmt.Fprintf(g.buf, "c := byte(%d)\nif len(subject) > %d {\nc = subject[%d]\n}\nswitch c {\n", noPivot, off, off)
+	var _nodes [256]node
+	for _, cn := range sortedChildren(n, _nodes[:0]) {
+		fmt.Fprintf(g.buf, "case %s:\n", byteLiteral(pivot(cn.path(), 0)))
+		// Leaves are matched on their full suffix, nodes will check their own prefix.
+		g.node(cn, off)
+	}
+	fmt.Fprintf(g.buf, "}\n")
+}
+
+// byteLiteral returns a Go literal for a byte, as a character when printable.
+func byteLiteral(c byte) string {
+	if c >= 0x20 && c < 0x7f && c != '\'' && c != '\\' {
+		return fmt.Sprintf("'%c'", c)
+	}
+	return fmt.Sprintf("0x%02x", c)
+}
@@ -1,3 +1,5 @@
 module github.com/rskv-p/subtree
 
 go 1.24.2
+
+require golang.org/x/text v0.21.0
@@ -0,0 +1,139 @@
+package subtree
+
+import (
+	"sort"
+	"time"
+)
+
+//-------------------
+// Time travel through the op log
+//-------------------
+
+// History keeps the modifications of a tree with the time they were made, together with a snapshot every
+// so many ops, so the state of the tree at an earlier time can be reconstructed, e.g. to find out what
+// interest existed when a message was dropped. Reconstructing starts from the nearest snapshot before that
+// time and replays the ops made since. Values are copied into the history, so they should not reference
+// memory that is modified later on.
+// Every snapshot makes the tree copy nodes on their next modification, so fewer snapshots trade memory
+// and writes for longer replays. A History is not safe for concurrent use, just like the tree.
+type History[T any] struct {
+	t     *SubjectTree[T]
+	every int                  // Ops between snapshots
+	snaps []historySnapshot[T] // Snapshots, oldest first
+	ops   []historyOp[T]       // Ops since the first snapshot, oldest first
+	now   func() time.Time     // Clock for the times of ops
+}
+
+// historySnapshot is the tree at a point in time, with the ops that followed it.
+type historySnapshot[T any] struct {
+	at   time.Time
+	view *ReadView[T]
+	ops  int // Position of the first op after this snapshot, counted from the start of the history
+}
+
+// historyOp is a modification of the tree.
+type historyOp[T any] struct {
+	at      time.Time
+	op      Op
+	subject string
+	v       T
+}
+
+// RecordHistory starts keeping the history of the tree, with a snapshot taken now and every given number of
+// ops. This installs an op logger which calls the op logger already set, if any. Setting another op logger
+// later on stops the history.
+func (t *SubjectTree[T]) RecordHistory(every int) *History[T] {
+	h := &History[T]{t: t, every: max(every, 1), now: t.opts.nowFunc()}
+	h.snapshot()
+	prev := t.oplog
+	t.SetOpLogger(func(op Op, subject []byte, v *T) {
+		h.record(op, subject, v)
+		if prev != nil {
+			prev(op, subject, v)
+		}
+	})
+	return h
+}
+
+// record appends an op to the history, followed by a snapshot if it is time for one.
+func (h *History[T]) record(op Op, subject []byte, v *T) {
+	hop := historyOp[T]{at: h.now(), op: op, subject: string(subject)}
+	if v != nil {
+		hop.v = *v
+	}
+	h.ops = append(h.ops, hop)
+	if last := h.snaps[len(h.snaps)-1]; h.offset()+len(h.ops)-last.ops >= h.every {
+		h.snapshot()
+	}
+}
+
+// snapshot takes a snapshot of the tree as of now.
+func (h *History[T]) snapshot() {
+	ops := len(h.ops)
+	if len(h.snaps) > 0 {
+		ops += h.offset()
+	}
+	h.snaps = append(h.snaps, historySnapshot[T]{at: h.now(), view: h.t.Snapshot(), ops: ops})
+}
+
+// offset returns the position of the first op kept, counted from the start of the history.
+func (h *History[T]) offset() int {
+	return h.snaps[0].ops
+}
+
+// Since returns the time of the oldest snapshot, the earliest time the history can reconstruct.
+func (h *History[T]) Since() time.Time {
+	return h.snaps[0].at
+}
+
+// AsOf returns a read view of the tree as it was at the given time, or ErrVersionNotRetained if that is
+// before the history starts.
+func (h *History[T]) AsOf(at time.Time) (*ReadView[T], error) {
+	// The last snapshot taken at or before the time.
+	i := sort.Search(len(h.snaps), func(i int) bool { return h.snaps[i].at.After(at) }) - 1
+	if i < 0 {
+		return nil, ErrVersionNotRetained
+	}
+	snap := h.snaps[i]
+	ops := h.ops[snap.ops-h.offset():]
+	if len(ops) == 0 || ops[0].at.After(at) {
+		return snap.view, nil
+	}
+	// Replay onto a copy of the snapshot. Its nodes are shared, so it copies them on write.
+	nt := &SubjectTree[T]{root: snap.view.t.root, size: snap.view.t.size, version: snap.view.version, opts: snap.view.t.opts}
+	nt.share()
+	for _, op := range ops {
+		if op.at.After(at) {
+			break
+		}
+		nt.ApplyOp(op.op, []byte(op.subject), &op.v)
+	}
+	return newReadView[T](treeVersion{nt.root, nt.size, nt.version}, &nt.opts), nil
+}
+
+// MatchAsOf is like Match against the tree as it was at the given time. Returns ErrVersionNotRetained if
+// that is before the history starts.
+func (h *History[T]) MatchAsOf(filter []byte, at time.Time, cb func(subject []byte, val *T)) error {
+	v, err := h.AsOf(at)
+	if err != nil {
+		return err
+	}
+	v.Match(filter, cb)
+	return nil
+}
+
+// Trim drops the snapshots and ops only needed to reconstruct the tree before the given time.
+func (h *History[T]) Trim(before time.Time) {
+	i := sort.Search(len(h.snaps), func(i int) bool { return h.snaps[i].at.After(before) }) - 1
+	if i <= 0 {
+		return
+	}
+	drop := h.snaps[i].ops - h.offset()
+	// Clear what is dropped so the values and views can be collected.
+	n := copy(h.ops, h.ops[drop:])
+	clear(h.ops[n:])
+	h.ops = h.ops[:n]
+	n = copy(h.snaps, h.snaps[i:])
+	clear(h.snaps[n:])
+	h.snaps = h.snaps[:n]
+}
@@ -0,0 +1,161 @@
+package subtree
+
+import (
+	"bytes"
+	"cmp"
+	"math"
+	"slices"
+	"sync"
+	"time"
+)
+
+//-------------------
+// Hot prefixes
+//-------------------
+
+// WithHotPrefixes tracks how often matches go to the subtrees below prefixes of up to depth tokens, with the
+// counts decaying by half every halfLife, so HotSubtrees reports the prefixes dominating recent match traffic
+// rather than since the tree was created. A filter whose first depth tokens are literal only goes to the
+// subtree below them, and is counted for those, e.g. "orders.eu" for "orders.eu.*" with a depth of 2.
+// A filter with a wildcard among them is counted once for every prefix of depth tokens it found entries
+// below, e.g. "orders.eu" and "orders.us" for "*.*.created", so wildcard traffic lands where it went.
+// Tracking takes a lock on every match, and wildcard filters have the matched subjects built.
+func WithHotPrefixes(depth int, halfLife time.Duration) Option {
+	return func(o *options) {
+		if depth <= 0 || halfLife <= 0 {
+			o.invalid("WithHotPrefixes needs a positive depth and half life, got %d and %v", depth, halfLife)
+		}
+		o.hotDepth, o.hotHalfLife = max(depth, 0), halfLife
+	}
+}
+
+// HotPrefix is a prefix of subjects and its decayed number of matches.
+type HotPrefix struct {
+	Prefix  []byte  // The literal tokens of the filters, without a trailing separator
+	Matches float64 // Number of matches, each decayed by its age
+}
+
+// hotTracker keeps the decayed match counts per prefix.
+type hotTracker struct {
+	mu       sync.Mutex
+	depth    int
+	halfLife time.Duration
+	now      func() time.Time
+	scores   map[string]hotScore
+	records  int // Matches recorded since the last sweep of cold prefixes
+}
+
+// hotScore is a decayed count as of a point in time.
+type hotScore struct {
+	n  float64
+	at time.Time
+}
+
+// hotSweep is the number of matches between sweeps of prefixes that have gone cold.
+const hotSweep = 1024
+
+// newHotTracker returns a tracker for the options, or nil if tracking is not enabled.
+func newHotTracker(o *options) *hotTracker {
+	if o.hotDepth <= 0 || o.hotHalfLife <= 0 {
+		return nil
+	}
+	return &hotTracker{depth: o.hotDepth, halfLife: o.hotHalfLife, now: o.nowFunc(), scores: make(map[string]hotScore)}
+}
+
+// decayed returns the count of s as of now.
+func (h *hotTracker) decayed(s hotScore, now time.Time) float64 {
+	return s.n * math.Exp2(-float64(now.Sub(s.at))/float64(h.halfLife))
+}
+
+// prefix returns the literal tokens of the filter before the first wildcard, up to depth of them, and
+// whether it only goes to the subtree below those.
+func (h *hotTracker) prefix(filter []byte) ([]byte, bool) {
+	end := 0
+	for tokens := 0; end < len(filter) && tokens < h.depth; tokens++ {
+		te := tokenEnd(filter, end)
+		if te-end == 1 && (filter[end] == pwc || filter[end] == fwc) {
+			return filter[:max(end-1, 0)], false
+		}
+		end = te + 1
+	}
+	return filter[:max(end-1, 0)], true
+}
+
+// start counts a match for the filter if it only goes to a single prefix. Otherwise it returns a function
+// to call with the subject of every entry the match hands out, and one to call when it ends, to count
+// the prefixes of those.
+func (h *hotTracker) start(filter []byte) (visit func(subject []byte), done func()) {
+	prefix, literal := h.prefix(filter)
+	if literal {
+		h.record(string(prefix))
+		return nil, nil
+	}
+	var prefixes []string
+	seen := make(map[string]struct{})
+	visit = func(subject []byte) {
+		prefix, _ := h.prefix(subject)
+		if _, ok := seen[string(prefix)]; !ok {
+			seen[string(prefix)] = struct{}{}
+			prefixes = append(prefixes, string(prefix))
+		}
+	}
+	done = func() {
+		h.record(prefixes...)
+	}
+	return visit, done
+}
+
+// record counts a match for each of the prefixes.
+func (h *hotTracker) record(prefixes ...string) {
+	if len(prefixes) == 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.now()
+	for _, prefix := range prefixes {
+		s := h.scores[prefix]
+		h.scores[prefix] = hotScore{n: h.decayed(s, now) + 1, at: now}
+	}
+	if h.records++; h.records >= hotSweep {
+		h.records = 0
+		for p, s := range h.scores {
+			if h.decayed(s, now) < 0.01 {
+				delete(h.scores, p)
+			}
+		}
+	}
+}
+
+// observeMatch records a match for the filter with the hot prefix tracker, if set.
+// Unless nil, visit has to be called with the subject of every entry the match hands out and done once
+// the match ends, for the tracker to count the prefixes the match went to.
+func (t *SubjectTree[T]) observeMatch(filter []byte) (visit func(subject []byte), done func()) {
+	if t == nil || t.hot == nil {
+		return nil, nil
+	}
+	return t.hot.start(filter)
+}
+
+// HotSubtrees returns the k prefixes with the most matches recently, hottest first and ties in subject order.
+// Returns nil unless the tree was created WithHotPrefixes.
+func (t *SubjectTree[T]) HotSubtrees(k int) []HotPrefix {
+	if t == nil || t.hot == nil || k <= 0 {
+		return nil
+	}
+	h := t.hot
+	h.mu.Lock()
+	now := h.now()
+	top := make([]HotPrefix, 0, len(h.scores))
+	for p, s := range h.scores {
+		top = append(top, HotPrefix{Prefix: []byte(p), Matches: h.decayed(s, now)})
+	}
+	h.mu.Unlock()
+	slices.SortFunc(top, func(a, b HotPrefix) int {
+		if a.Matches != b.Matches {
+			return cmp.Compare(b.Matches, a.Matches)
+		}
+		return bytes.Compare(a.Prefix, b.Prefix)
+	})
+	return top[:min(k, len(top))]
+}
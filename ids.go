@@ -0,0 +1,112 @@
+package subtree
+
+import "sync/atomic"
+
+//-------------------
+// Entry IDs
+//-------------------
+
+// lastID is the last entry ID handed out. IDs are unique across all trees, so entries moved between trees
+// by SplitAt and Graft keep theirs.
+var lastID atomic.Uint64
+
+// WithEntryIDs gives every entry a 64-bit ID when it is inserted, increasing with every new entry. An update
+// keeps the ID, while an entry deleted and inserted again gets a new one, so external systems can reference
+// entries compactly and tell a re-created entry from the one they knew. The tree keeps an index from IDs to
+// subjects for FindByID, which costs about a copy of every subject.
+func WithEntryIDs() Option {
+	return func(o *options) {
+		o.entryIDs = true
+	}
+}
+
+// IDOf returns the ID of the entry for subject, or false if it does not exist or the tree was not
+// created WithEntryIDs.
+func (t *SubjectTree[T]) IDOf(subject []byte) (uint64, bool) {
+	if t == nil || t.ids == nil {
+		return 0, false
+	}
+	return t.idOf(subject)
+}
+
+// idOf returns the ID of the entry for subject, if it has one.
+func (t *SubjectTree[T]) idOf(subject []byte) (uint64, bool) {
+	if ln := t.findLeaf(subject); ln != nil && ln.md != nil && ln.md.id != 0 {
+		return ln.md.id, true
+	}
+	return 0, false
+}
+
+// FindByID returns the subject and value of the entry with the given ID, or false if there is none.
+// The value pointer has the same semantics as the one returned from Find.
+func (t *SubjectTree[T]) FindByID(id uint64) ([]byte, *T, bool) {
+	if t == nil || t.ids == nil {
+		return nil, nil, false
+	}
+	subject, ok := t.ids[id]
+	if !ok {
+		return nil, nil, false
+	}
+	ln := t.findLeaf([]byte(subject))
+	if ln == nil || ln.md == nil || ln.md.id != id {
+		return nil, nil, false
+	}
+	return []byte(subject), &ln.value, true
+}
+
+// MatchIDs is like Match but also hands the callback the ID of each matched entry.
+func (t *SubjectTree[T]) MatchIDs(filter []byte, cb func(subject []byte, id uint64, val *T)) {
+	if t == nil || cb == nil {
+		return
+	}
+	t.Match(filter, func(subject []byte, val *T) {
+		id, _ := t.IDOf(subject)
+		cb(subject, id, val)
+	})
+}
+
+// idInserted gives the entry for subject a new ID, unless it was updated and already has one.
+// The leaf has to be ours to modify, which it is right after an insert.
+func (t *SubjectTree[T]) idInserted(subject []byte, updated bool) {
+	ln := t.findLeaf(subject)
+	if ln == nil || (updated && ln.md != nil && ln.md.id != 0) {
+		return
+	}
+	var md entryMeta
+	if ln.md != nil {
+		md = *ln.md
+	}
+	md.id = lastID.Add(1)
+	ln.md = &md
+	t.ids[md.id] = string(subject)
+}
+
+// idsMoved removes the entries of other, which were moved out of this tree from below prefix, from the
+// index and adds them to the index of other, which has the same options.
+func (t *SubjectTree[T]) idsMoved(prefix []byte, other *SubjectTree[T]) {
+	other.iterIDs(func(subject []byte, id uint64) {
+		full := append(prefix[:len(prefix):len(prefix)], subject...)
+		if t.ids[id] == string(full) {
+			delete(t.ids, id)
+		}
+		other.ids[id] = string(subject)
+	})
+}
+
+// idsGrafted adds the entries of other, which are about to be moved into this tree below prefix, to the
+// index. Entries from a tree without IDs have none until they are updated.
+func (t *SubjectTree[T]) idsGrafted(prefix []byte, other *SubjectTree[T]) {
+	other.iterIDs(func(subject []byte, id uint64) {
+		t.ids[id] = string(append(prefix[:len(prefix):len(prefix)], subject...))
+	})
+}
+
+// Internal function to walk the IDs of all entries.
+func (t *SubjectTree[T]) iterIDs(cb func(subject []byte, id uint64)) {
+	t.iterAll(false, func(subject []byte, _ *T) bool {
+		if id, ok := t.idOf(subject); ok {
+			cb(subject, id)
+		}
+		return true
+	})
+}
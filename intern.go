@@ -0,0 +1,100 @@
+package subtree
+
+import (
+	"sync"
+	"unsafe"
+)
+
+//-------------------
+// Interning of prefixes and suffixes
+//-------------------
+
+// Interner shares the memory of identical node prefixes and leaf suffixes, within a tree or across trees.
+// Subjects with many identical trailing tokens, e.g. "<device>.<id>.temperature", end up with many leaves
+// holding the same suffix, and interning stores each distinct fragment only once.
+// Interned fragments are never released, so the interner can be bounded to a number of entries, after
+// which new fragments are copied as usual. An Interner is safe for concurrent use.
+type Interner struct {
+	mu      sync.Mutex
+	frags   map[string][]byte // Interned fragments, keyed by their own memory
+	max     int               // Maximum number of fragments, 0 for no limit
+	maxLen  int               // Maximum length of fragments to intern, 0 for no limit
+	hits    uint64            // Number of times a fragment was shared
+	skipped uint64            // Number of fragments copied because of the limits
+}
+
+// NewInterner creates an interner holding at most maxEntries fragments of at most maxLen bytes each.
+// Zero means no limit for either.
+func NewInterner(maxEntries, maxLen int) *Interner {
+	return &Interner{frags: make(map[string][]byte), max: maxEntries, maxLen: maxLen}
+}
+
+// InternerStats reports the state of an interner.
+type InternerStats struct {
+	Entries int    // Number of distinct fragments held
+	Bytes   int    // Total bytes held by those fragments
+	Hits    uint64 // Number of times an existing fragment was shared
+	Skipped uint64 // Number of fragments not interned because of the limits
+}
+
+// Stats returns the current statistics of the interner.
+func (in *Interner) Stats() InternerStats {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	st := InternerStats{Entries: len(in.frags), Hits: in.hits, Skipped: in.skipped}
+	for k := range in.frags {
+		st.Bytes += len(k)
+	}
+	return st
+}
+
+// intern returns the shared copy of b. If owned is true b is not referenced by anyone else and can be
+// retained as is, otherwise it is copied when needed.
+func (in *Interner) intern(b []byte, owned bool) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	if f, ok := in.frags[string(b)]; ok {
+		in.hits++
+		return f
+	}
+	if !owned {
+		b = copyBytes(b)
+	}
+	if (in.max > 0 && len(in.frags) >= in.max) || (in.maxLen > 0 && len(b) > in.maxLen) {
+		in.skipped++
+		return b
+	}
+	// The fragment is never modified so its memory can double as the key.
+	in.frags[unsafe.String(&b[0], len(b))] = b
+	return b
+}
+
+// SetInterner sets the interner used for prefixes and suffixes of nodes created from now on.
+// A nil interner disables interning.
+func (t *SubjectTree[T]) SetInterner(in *Interner) {
+	if t == nil {
+		return
+	}
+	t.interner = in
+}
+
+// copyFrag returns a copy of a prefix or suffix for the tree to retain, shared through the interner if set.
+func (t *SubjectTree[T]) copyFrag(b []byte) []byte {
+	t.counts.PrefixCopies++
+	if t.interner != nil {
+		return t.interner.intern(b, false)
+	}
+	return copyBytes(b)
+}
+
+// internFrag is like copyFrag for a prefix or suffix that was freshly allocated by the caller.
+func (t *SubjectTree[T]) internFrag(b []byte) []byte {
+	t.counts.PrefixCopies++
+	if t.interner != nil {
+		return t.interner.intern(b, true)
+	}
+	return b
+}
@@ -0,0 +1,107 @@
+package subtree
+
+import "bytes"
+
+//-------------------
+// Walks modified by their callbacks
+//-------------------
+
+// A callback may delete the entry it was handed, or modify the tree otherwise, while a walk is in progress.
+// Deletes move children around within packed nodes, shrink nodes into other kinds and collapse a node down
+// to a single child into that child, prepending the prefix of the node in place. So once the tree changed
+// a walk no longer trusts the node and positions it holds, and instead finds the node for its path again
+// and continues with the children it has not visited, by key.
+
+// walkProgress tracks the children of a node a walk has visited, by key.
+type walkProgress struct {
+	seen [4]uint64 // Bitmap of visited keys
+	last int       // Rank of the last visited key
+	any  bool      // If any child was visited
+}
+
+// keyRank returns the position of a child key in subject order, where the child without a pivot sorts first.
+func keyRank(c byte) int {
+	if c == noPivot {
+		return -1
+	}
+	return int(c)
+}
+
+// visit records the child with key c as visited.
+func (p *walkProgress) visit(c byte) {
+	p.seen[c>>6] |= 1 << (c & 63)
+	p.last, p.any = keyRank(c), true
+}
+
+// pending returns true if the child with key c still needs to be visited. An ordered walk only moves forward,
+// so it skips children inserted before the last one visited.
+func (p *walkProgress) pending(c byte, ordered bool) bool {
+	if p.seen[c>>6]&(1<<(c&63)) != 0 {
+		return false
+	}
+	return !ordered || !p.any || keyRank(c) > p.last
+}
+
+// locate finds the node holding the entries below the path pre, and returns it with the length of the path
+// leading to it. The path of the node may extend beyond pre when a delete collapsed our node into its child.
+func (t *SubjectTree[T]) locate(pre []byte) (node, int) {
+	n, si := t.root, 0
+	for n != nil {
+		path := n.path()
+		if rest := pre[si:]; len(rest) <= len(path) {
+			if !bytes.HasPrefix(path, rest) {
+				return nil, 0
+			}
+			return n, si
+		}
+		if n.isLeaf() || !bytes.HasPrefix(pre[si:], path) {
+			return nil, 0
+		}
+		si += len(path)
+		cp := n.findChild(pre[si])
+		if cp == nil {
+			return nil, 0
+		}
+		n = *cp
+	}
+	return nil, 0
+}
+
+// iterResume continues a walk of the children of the node at path pre after the tree was modified by the callback.
+func (t *SubjectTree[T]) iterResume(pre []byte, ordered bool, prog *walkProgress, cb func(subject []byte, val *T) bool) bool {
+	var _nodes [256]node
+	for {
+		n, si := t.locate(pre)
+		if n == nil {
+			return true
+		}
+		if end := si + len(n.path()); n.isLeaf() || end > len(pre) {
+			// Our node was collapsed into this child, which now starts further up.
+			if c := pivot(n.path(), len(pre)-si); prog.pending(c, ordered) {
+				prog.visit(c)
+				if !t.iter(n, pre[:si], ordered, cb) {
+					return false
+				}
+				continue
+			}
+			return true
+		}
+		// Still an internal node at our path, so find the next child to visit.
+		var next node
+		var nc byte
+		children := sortedChildren(n, _nodes[:0])
+		for _, cn := range children {
+			if c := pivot(cn.path(), 0); prog.pending(c, ordered) {
+				next, nc = cn, c
+				break
+			}
+		}
+		if next == nil {
+			return true
+		}
+		prog.visit(nc)
+		if !t.iter(next, pre, ordered, cb) {
+			return false
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package subtree
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+//-------------------
+// JSON
+//-------------------
+
+// MarshalJSON encodes the tree as a JSON object with a member for every entry, holding its subject and
+// value, in subject order. Values are encoded with encoding/json. Returns an error for subjects that are not
+// valid UTF-8, which JSON strings can not hold as they are.
+func (t *SubjectTree[T]) MarshalJSON() ([]byte, error) {
+	if t == nil {
+		return []byte("null"), nil
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	var err error
+	t.IterOrdered(func(subject []byte, v *T) bool {
+		if !utf8.Valid(subject) {
+			err = fmt.Errorf("subtree: subject %q is not valid UTF-8", subject)
+			return false
+		}
+		var b []byte
+		if b, err = json.Marshal(bytesString(subject)); err != nil {
+			return false
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		buf.Write(b)
+		buf.WriteByte(':')
+		if b, err = json.Marshal(*v); err != nil {
+			return false
+		}
+		buf.Write(b)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON replaces the entries of the tree with the members of a JSON object as written by
+// MarshalJSON, keeping the options of the tree. The replacement is logged as an empty followed by inserts.
+// A JSON null leaves the tree as it is.
+func (t *SubjectTree[T]) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	var entries map[string]T
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for subject := range entries {
+		if len(subject) == 0 || bytes.IndexByte(stringBytes(subject), noPivot) >= 0 {
+			return fmt.Errorf("%w: %q", ErrInvalidSubject, subject)
+		}
+	}
+	t.Empty()
+	for subject, v := range entries {
+		t.Insert([]byte(subject), v)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package subtree
+
+import (
+	"fmt"
+	"time"
+)
+
+//-------------------
+// Latency hooks
+//-------------------
+
+// Call identifies an operation timed for a latency hook.
+type Call uint8
+
+const (
+	CallInsert Call = iota + 1 // Insert and its variants
+	CallDelete                 // Delete and its variants
+	CallFind                   // Find
+	CallMatch                  // Match and its variants
+)
+
+// String returns the name of the call.
+func (c Call) String() string {
+	switch c {
+	case CallInsert:
+		return "INSERT"
+	case CallDelete:
+		return "DELETE"
+	case CallFind:
+		return "FIND"
+	case CallMatch:
+		return "MATCH"
+	}
+	return fmt.Sprintf("Call(%d)", uint8(c))
+}
+
+// LatencyHook receives the duration of a call and the number of results: entries added by an insert or
+// removed by a delete, 1 for a successful find, and the number of matches handed to the callback.
+// The duration of a match includes the time spent in its callback.
+type LatencyHook func(call Call, d time.Duration, results int)
+
+// WithLatencyHook calls hook after every insert, delete, find and match, e.g. to record latency histograms
+// without timing every call site. The hook is called synchronously and should be cheap. Without a hook
+// nothing is timed.
+func WithLatencyHook(hook LatencyHook) Option {
+	return func(o *options) {
+		o.latency = hook
+	}
+}
+
+// countMatches wraps cb to count the matches handed to it into n.
+func countMatches[T any](n *int, cb func(subject []byte, val *T)) func(subject []byte, val *T) {
+	return func(subject []byte, val *T) {
+		*n++
+		cb(subject, val)
+	}
+}
+
+// boolResults returns 1 for true and 0 for false, the results of calls on a single entry.
+func boolResults(ok bool) int {
+	if ok {
+		return 1
+	}
+	return 0
+}
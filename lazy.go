@@ -0,0 +1,218 @@
+package subtree
+
+//-------------------
+// Lazy deletes and compaction
+//-------------------
+
+// deadMeta marks a lazily deleted leaf that has no other metadata.
+var deadMeta = &entryMeta{dead: true}
+
+// WithLazyDelete makes Delete mark the leaf of the entry dead instead of removing it and restructuring
+// the tree. Dead leaves are invisible to lookups, matches and iteration, and inserting the subject again
+// simply revives the leaf. Compact removes the dead leaves and shrinks, collapses and prunes the nodes
+// in a single pass, which makes a bulk purge one sweep instead of restructuring on every delete.
+// Unless a compact threshold is set, dead leaves stay until Compact is called.
+func WithLazyDelete() Option {
+	return func(o *options) {
+		o.lazyDelete = true
+	}
+}
+
+// WithCompactThreshold makes a tree in lazy delete mode compact itself once the dead leaves exceed the
+// given fraction of all leaves, e.g. 0.5 to sweep once more than half of them are dead. A sweep visits
+// the whole tree, so a low threshold trades memory for more frequent pauses. Zero disables it.
+func WithCompactThreshold(fraction float64) Option {
+	return func(o *options) {
+		if fraction < 0 || fraction > 1 {
+			o.invalid("WithCompactThreshold of %v, outside of 0 to 1", fraction)
+		}
+		o.compactAt = max(fraction, 0)
+	}
+}
+
+// Dead returns the number of lazily deleted leaves waiting for a compaction.
+func (t *SubjectTree[T]) Dead() int {
+	if t == nil {
+		return 0
+	}
+	return t.dead
+}
+
+// CompactStats reports what Compact did to the tree.
+type CompactStats struct {
+	Removed     int // Dead leaves removed
+	Collapsed   int // Internal nodes with a single child merged into that child
+	NodesBefore int // Internal nodes before compacting
+	NodesAfter  int // Internal nodes after compacting
+}
+
+// Compact removes all lazily deleted leaves and restructures the nodes they leave behind,
+// shrinking nodes to the smallest kind that holds their remaining children. It also collapses any
+// chain of internal nodes with a single child, merging their prefixes, wherever it came from.
+// This does not change the contents, so it does not create a new version or op log entry, but it does
+// invalidate node handles from WalkNodes.
+func (t *SubjectTree[T]) Compact() CompactStats {
+	var stats CompactStats
+	if t == nil || t.root == nil {
+		return stats
+	}
+	root := t.root
+	if t.compact(&t.root, &stats) {
+		t.shape++
+	}
+	t.rootSwapped(root)
+	stats.Removed, t.dead = t.dead, 0
+	if debugChecks {
+		t.debugCheck("compact")
+	}
+	return stats
+}
+
+// deleteLazy marks the leaf for subject dead, decrementing the leaf counts on the way down.
+func (t *SubjectTree[T]) deleteLazy(subject []byte) (*T, bool) {
+	if t.findLeaf(subject) == nil {
+		return nil, false
+	}
+	// We know the leaf is there, so walk down making the path ours.
+	np, si := &t.root, 0
+	for !(*np).isLeaf() {
+		n := t.writable(np)
+		bn := n.base()
+		bn.leaves--
+		si += len(bn.prefix)
+		np = n.findChild(pivot(subject, si))
+	}
+	ln := t.writable(np).(*leaf[T])
+	old := ln.value
+	// Release whatever the value references, the leaf is only kept for its structure.
+	var zero T
+	ln.value = zero
+	if ln.md != nil {
+		ln.md = &entryMeta{stamp: ln.md.stamp, dead: true}
+	} else {
+		ln.md = deadMeta
+	}
+	t.dead++
+	return &old, true
+}
+
+// compact removes the dead leaves below *np, fixes up the nodes left behind and collapses single
+// child nodes. Returns true if anything changed, in which case *np has been updated.
+func (t *SubjectTree[T]) compact(np *node, stats *CompactStats) bool {
+	n := *np
+	if ln, ok := n.(*leaf[T]); ok {
+		if ln.dead() {
+			*np = nil
+			return true
+		}
+		return false
+	}
+	// Leaf counts do not include dead leaves, so without any live ones the whole subtree can go.
+	if n.base().leaves == 0 {
+		stats.NodesBefore += countNodes(n)
+		t.emit(EventPrune, n, nil)
+		*np = nil
+		return true
+	}
+	stats.NodesBefore++
+	// Collect the children first, since removing them may reorder the node.
+	var _nodes [256]node
+	children := _nodes[:0]
+	for _, cn := range n.children() {
+		if cn != nil {
+			children = append(children, cn)
+		}
+	}
+	var changed bool
+	for _, cn := range children {
+		c, ncn := pivot(cn.path(), 0), cn
+		if !t.compact(&ncn, stats) {
+			continue
+		}
+		// Only copy this node if something below it changed.
+		if !changed {
+			n, changed = t.writable(np), true
+		}
+		if ncn == nil {
+			n.deleteChild(c)
+		} else {
+			*n.findChild(c) = ncn
+		}
+	}
+	if n.numChildren() == 0 {
+		t.emit(EventPrune, n, nil)
+		*np = nil
+		return true
+	}
+	// Shrink as far as possible, a bulk purge can leave a node256 with only a few children.
+	// Nodes that did not change only need a look if they are down to a single child.
+	if !changed && (n.numChildren() > 1 || t.chained(n.base().prefix, n)) {
+		stats.NodesAfter++
+		return false
+	}
+	if !changed {
+		n = t.writable(np)
+	}
+	bn := n.base()
+	pre := bn.prefix[:len(bn.prefix):len(bn.prefix)]
+	for {
+		_, collapse := n.(*node4)
+		if collapse && t.chained(pre, n) {
+			break
+		}
+		sn := t.shrunk(n, n.shrink())
+		if sn == nil {
+			break
+		}
+		if !collapse {
+			// A smaller kind of the same node, which keeps our prefix.
+			sn.base().prefix = pre
+			n = sn
+			continue
+		}
+		// A single child left, which takes our place with our prefix added. It may still be shared.
+		sn = t.cow(sn)
+		if ln, ok := sn.(*leaf[T]); ok {
+			ln.suffix = t.internFrag(append(pre, ln.suffix...))
+		} else if len(pre) > 0 {
+			bsn := sn.base()
+			bsn.prefix = t.internFrag(append(pre, bsn.prefix...))
+		}
+		stats.Collapsed++
+		*np = sn
+		return true
+	}
+	stats.NodesAfter++
+	*np = n
+	return true
+}
+
+// countNodes returns the number of internal nodes in the subtree rooted at n.
+func countNodes(n node) int {
+	if n.isLeaf() {
+		return 0
+	}
+	count := 1
+	n.iter(func(cn node) bool {
+		count += countNodes(cn)
+		return true
+	})
+	return count
+}
+
+// countDead returns the number of lazily deleted leaves in the subtree rooted at n.
+func countDead(n node) int {
+	if n.isLeaf() {
+		if ln, ok := n.(interface{ dead() bool }); ok && ln.dead() {
+			return 1
+		}
+		return 0
+	}
+	var dead int
+	for _, cn := range n.children() {
+		if cn != nil {
+			dead += countDead(cn)
+		}
+	}
+	return dead
+}
@@ -11,36 +11,37 @@ import (
 // The leaf struct represents a leaf node in the tree.
 // It holds the value and suffix for the leaf. The order of fields is optimized for memory alignment.
 type leaf[T any] struct {
-	value  T      // The value associated with this leaf
-	suffix []byte // Suffix portion that we will store, assuming the prefix has been checked already
+	value  T          // The value associated with this leaf
+	suffix []byte     // Suffix portion that we will store, assuming the prefix has been checked already
+	md     *entryMeta // Optional metadata, only set when a feature that needs it is enabled
+}
+
+// entryMeta holds optional per entry metadata. It may be shared between copies of a leaf,
+// so it is never modified in place but replaced as a whole.
+type entryMeta struct {
+	stamp Stamp  // Last-writer-wins stamp of the last write
+	dead  bool   // Deleted in lazy delete mode, the leaf stays until the tree is compacted
+	id    uint64 // ID of the entry, when entry IDs are enabled
 }
 
 //-------------------
 // Leaf Node Methods
 //-------------------
 
-// newLeaf creates a new leaf node with the given suffix and value.
-// It returns a pointer to the newly created leaf.
-func newLeaf[T any](suffix []byte, value T) *leaf[T] {
-	return &leaf[T]{value, copyBytes(suffix)} // Use copyBytes to ensure suffix is safely copied
-}
-
 // isLeaf returns true as this node is a leaf.
 func (n *leaf[T]) isLeaf() bool { return true }
 
 // base returns nil because leaves do not have a base node.
 func (n *leaf[T]) base() *meta { return nil }
 
+// dead returns true if the entry was lazily deleted and only waits to be removed by a compaction.
+func (n *leaf[T]) dead() bool { return n.md != nil && n.md.dead }
+
 // match checks if the given subject matches the leaf's suffix.
 func (n *leaf[T]) match(subject []byte) bool {
 	return bytes.Equal(subject, n.suffix) // Compare subject with the leaf's suffix
 }
 
-// setSuffix sets the suffix for this leaf node.
-func (n *leaf[T]) setSuffix(suffix []byte) {
-	n.suffix = copyBytes(suffix) // Copy the provided suffix to ensure safety
-}
-
 // isFull returns true because leaf nodes are considered "full" once they have a value.
 func (n *leaf[T]) isFull() bool { return true }
 
@@ -62,14 +63,22 @@ func (n *leaf[T]) numChildren() uint16 { return 0 }
 // path returns the suffix for this leaf as its path.
 func (n *leaf[T]) path() []byte { return n.suffix }
 
+// clone returns a copy of this leaf. The suffix is shared since it is never modified in place.
+func (n *leaf[T]) clone() node {
+	nn := *n
+	return &nn
+}
+
 //-------------------
-// Methods that should panic when called on a leaf node
+// Methods of internal nodes on a leaf node
 //-------------------
 
-// These methods are not applicable to leaf nodes. If they are called, a panic will occur.
+// Leaves have no children, so looking one up, deleting one or shrinking is safe and finds nothing to do.
+func (n *leaf[T]) findChild(_ byte) *node { return nil }
+func (n *leaf[T]) deleteChild(_ byte)     {}
+func (n *leaf[T]) shrink() node           { return nil }
+
+// These methods would lose data when called on a leaf node. If they are called, a panic will occur.
 func (n *leaf[T]) setPrefix(pre []byte)    { panic("setPrefix called on leaf") }
 func (n *leaf[T]) addChild(_ byte, _ node) { panic("addChild called on leaf") }
-func (n *leaf[T]) findChild(_ byte) *node  { panic("findChild called on leaf") }
 func (n *leaf[T]) grow() node              { panic("grow called on leaf") }
-func (n *leaf[T]) deleteChild(_ byte)      { panic("deleteChild called on leaf") }
-func (n *leaf[T]) shrink() node            { panic("shrink called on leaf") }
@@ -0,0 +1,112 @@
+package subtree
+
+import "errors"
+
+//-------------------
+// Values stored out of line
+//-------------------
+
+// ErrLoadBatch is returned by Match when a batch loader did not return one value per reference.
+var ErrLoadBatch = errors.New("subtree: batch loader returned the wrong number of values")
+
+// LoadingTree resolves the references stored in a SubjectTree[R] to values T kept elsewhere, e.g. large
+// payloads in external storage. The tree only holds the small references, and values are loaded on demand
+// when found or matched. References are inserted and deleted through the underlying tree itself.
+// A LoadingTree is not safe for concurrent use, unless the tree and the loaders are.
+type LoadingTree[R, T any] struct {
+	t         *SubjectTree[R]
+	load      func(ref R) (T, error)
+	loadBatch func(refs []R) ([]T, error)
+	batch     int // Number of references loaded at once by Match
+}
+
+// WithValueLoader returns a LoadingTree for t resolving references with load.
+func WithValueLoader[R, T any](t *SubjectTree[R], load func(ref R) (T, error)) *LoadingTree[R, T] {
+	return &LoadingTree[R, T]{t: t, load: load}
+}
+
+// WithBatch makes Match load the values of up to size matches at once with load, which must return one
+// value per reference in the same order. Returns the LoadingTree itself.
+func (l *LoadingTree[R, T]) WithBatch(size int, load func(refs []R) ([]T, error)) *LoadingTree[R, T] {
+	l.batch, l.loadBatch = max(size, 1), load
+	return l
+}
+
+// Tree returns the underlying tree holding the references.
+func (l *LoadingTree[R, T]) Tree() *SubjectTree[R] {
+	return l.t
+}
+
+// Find will find the reference stored for subject and return the value it refers to, or false if it was
+// not found. An error is returned if the value could not be loaded.
+func (l *LoadingTree[R, T]) Find(subject []byte) (T, bool, error) {
+	var zero T
+	ref, ok := l.t.FindVal(subject)
+	if !ok {
+		return zero, false, nil
+	}
+	val, err := l.load(ref)
+	if err != nil {
+		return zero, true, err
+	}
+	return val, true, nil
+}
+
+// Match will match against a subject that can have wildcards and invoke the callback with the loaded value
+// of each match, in subject order. A non-nil error from loading or from the callback stops the match and is
+// returned. With a batch loader, values are loaded a batch at a time before the callback sees any of them.
+// The subject passed to the callback is only valid for the duration of the callback.
+func (l *LoadingTree[R, T]) Match(filter []byte, cb func(subject []byte, val T) error) error {
+	if cb == nil {
+		return nil
+	}
+	if l.loadBatch == nil {
+		return l.t.MatchE(filter, func(subject []byte, ref *R) error {
+			val, err := l.load(*ref)
+			if err != nil {
+				return err
+			}
+			return cb(subject, val)
+		})
+	}
+	var (
+		refs     []R
+		subjects []byte // Subjects of the batch, back to back
+		ends     []int  // End of each subject in subjects
+	)
+	flush := func() error {
+		if len(refs) == 0 {
+			return nil
+		}
+		vals, err := l.loadBatch(refs)
+		if err != nil {
+			return err
+		}
+		if len(vals) != len(refs) {
+			return ErrLoadBatch
+		}
+		start := 0
+		for i, end := range ends {
+			if err := cb(subjects[start:end], vals[i]); err != nil {
+				return err
+			}
+			start = end
+		}
+		clear(refs)
+		refs, subjects, ends = refs[:0], subjects[:0], ends[:0]
+		return nil
+	}
+	err := l.t.MatchE(filter, func(subject []byte, ref *R) error {
+		refs = append(refs, *ref)
+		subjects = append(subjects, subject...)
+		ends = append(ends, len(subjects))
+		if len(refs) < l.batch {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,173 @@
+package subtree
+
+import "time"
+
+//-------------------
+// Last-writer-wins replication
+//-------------------
+
+// Stamp orders writes to the same subject across replicas for last-writer-wins merging.
+// Stamps are compared by time first and replica second, so every replica resolves conflicts the same way.
+type Stamp struct {
+	Time    uint64 // Lamport clock or wall clock time in nanoseconds, depending on the StampMode
+	Replica uint64 // Replica that made the write, used to break ties
+}
+
+// Less reports whether s happened before o.
+func (s Stamp) Less(o Stamp) bool {
+	if s.Time != o.Time {
+		return s.Time < o.Time
+	}
+	return s.Replica < o.Replica
+}
+
+// StampMode selects the clock used to stamp writes.
+type StampMode uint8
+
+const (
+	StampLamport   StampMode = iota // Logical lamport clock, advanced on every write and merge
+	StampWallClock                  // Wall clock in nanoseconds, kept monotonic per replica
+)
+
+// lwwState holds the last-writer-wins state of a tree.
+type lwwState struct {
+	replica uint64           // Our replica id
+	mode    StampMode        // Clock used for new stamps
+	clock   uint64           // Last time handed out or observed
+	now     func() time.Time // Wall clock of the tree
+	tombs   map[string]Stamp // Stamps of deleted subjects
+}
+
+// EnableLWW turns on last-writer-wins tracking for this tree. Every write is stamped with the given replica id
+// and a clock according to mode, and deletes are remembered as tombstones so they can be merged as well.
+// Entries already in the tree have a zero stamp and lose against any write made after this call.
+// Each replica that will be merged must use a unique replica id.
+func (t *SubjectTree[T]) EnableLWW(replica uint64, mode StampMode) {
+	if t == nil {
+		return
+	}
+	t.lww = &lwwState{replica: replica, mode: mode, now: t.opts.nowFunc(), tombs: make(map[string]Stamp)}
+}
+
+// StampOf returns the stamp of the last write to the subject, which can be a delete, and if one is known.
+func (t *SubjectTree[T]) StampOf(subject []byte) (Stamp, bool) {
+	if t == nil || t.lww == nil {
+		return Stamp{}, false
+	}
+	if ln := t.findLeaf(subject); ln != nil {
+		if ln.md == nil {
+			return Stamp{}, true
+		}
+		return ln.md.stamp, true
+	}
+	st, ok := t.lww.tombs[string(subject)]
+	return st, ok
+}
+
+// MergeLWW merges the contents of other into this tree. For every subject the write with the highest stamp wins,
+// including deletes, so merging two diverged replicas in any order and direction converges to the same contents.
+// Both trees should have last-writer-wins enabled. Returns the number of changes made to this tree.
+func (t *SubjectTree[T]) MergeLWW(other *SubjectTree[T]) int {
+	if t == nil || other == nil || t.lww == nil {
+		return 0
+	}
+	var changes int
+	// Entries from other win if their stamp is newer than what we know about the subject.
+	other.IterFast(func(subject []byte, v *T) bool {
+		var st Stamp
+		if ln := other.findLeaf(subject); ln != nil && ln.md != nil {
+			st = ln.md.stamp
+		}
+		t.lww.observe(st)
+		if cur, ok := t.StampOf(subject); !ok || cur.Less(st) {
+			t.insertMeta(subject, *v, &entryMeta{stamp: st})
+			changes++
+		}
+		return true
+	})
+	if other.lww == nil {
+		return changes
+	}
+	// Tombstones from other win if they are newer than our entry.
+	for subject, st := range other.lww.tombs {
+		t.lww.observe(st)
+		if ln := t.findLeaf([]byte(subject)); ln != nil {
+			var cur Stamp
+			if ln.md != nil {
+				cur = ln.md.stamp
+			}
+			if cur.Less(st) {
+				t.deleteStamped([]byte(subject), &st)
+				changes++
+			}
+		} else if cur, ok := t.lww.tombs[subject]; !ok || cur.Less(st) {
+			t.lww.tombs[subject] = st
+		}
+	}
+	return changes
+}
+
+// PruneTombstones forgets tombstones with a stamp time before the given time and returns how many were removed.
+// This should only be done for times that all replicas have merged past, otherwise deletes can be undone.
+func (t *SubjectTree[T]) PruneTombstones(before uint64) int {
+	if t == nil || t.lww == nil {
+		return 0
+	}
+	var pruned int
+	for subject, st := range t.lww.tombs {
+		if st.Time < before {
+			delete(t.lww.tombs, subject)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// next returns a new stamp for a local write.
+func (l *lwwState) next() Stamp {
+	l.clock++
+	if l.mode == StampWallClock {
+		l.clock = max(l.clock, uint64(l.now().UnixNano()))
+	}
+	return Stamp{Time: l.clock, Replica: l.replica}
+}
+
+// observe advances our clock past a stamp seen from another replica.
+func (l *lwwState) observe(st Stamp) {
+	l.clock = max(l.clock, st.Time)
+}
+
+// lwwInserted stamps the leaf for subject after an insert, using md if not nil.
+// The leaf has just been written so it is ours to modify.
+func (t *SubjectTree[T]) lwwInserted(subject []byte, md *entryMeta) {
+	if md == nil {
+		md = &entryMeta{stamp: t.lww.next()}
+	}
+	if ln := t.findLeaf(subject); ln != nil {
+		if ln.md != nil && ln.md.id != md.id {
+			// Keep the entry ID, the metadata may be shared so it is copied.
+			cp := *md
+			cp.id = ln.md.id
+			md = &cp
+		}
+		ln.md = md
+	}
+	delete(t.lww.tombs, string(subject))
+}
+
+// lwwDeleted records a tombstone for subject, using stamp if not nil.
+func (t *SubjectTree[T]) lwwDeleted(subject []byte, stamp *Stamp) {
+	st := t.lww.next()
+	if stamp != nil {
+		st = *stamp
+	}
+	t.lww.tombs[string(subject)] = st
+}
+
+// lwwEmptied records a tombstone for every entry in the tree before it is emptied.
+func (t *SubjectTree[T]) lwwEmptied() {
+	t.IterFast(func(subject []byte, _ *T) bool {
+		t.lwwDeleted(subject, nil)
+		return true
+	})
+}
@@ -1,11 +1,18 @@
 package subtree
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
+	"sort"
 	"strings"
 	"testing"
 	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 //-------------------
@@ -127,6 +134,1258 @@ func TestSubjectTreeMatchSubjectParam(t *testing.T) {
 	})
 }
 
+//-------------------
+//  Test for Matching Values Only
+//-------------------
+
+// Test case to ensure MatchValues visits the same values as Match without building subjects.
+func TestSubjectTreeMatchValues(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.bar.A"), 1)
+	st.Insert(b("foo.bar.B"), 2)
+	st.Insert(b("foo.baz.A"), 11)
+	st.Insert(b("foo.bar"), 42)
+
+	for _, filter := range []string{">", "foo.>", "foo.*.A", "foo.bar", "foo.*", "bar.>"} {
+		var expected, got int
+		st.Match(b(filter), func(_ []byte, v *int) { expected += *v })
+		st.MatchValues(b(filter), func(v *int) { got += *v })
+		require_Equal(t, got, expected)
+	}
+}
+
+//-------------------
+//  Test for Aggregating Matches
+//-------------------
+
+// Test that Reduce and the built-in aggregates fold over the same entries as Match.
+func TestSubjectTreeReduce(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.Insert(b("foo.bar.A"), 1)
+	st.Insert(b("foo.bar.B"), 2)
+	st.Insert(b("foo.baz.A"), 11)
+	st.Insert(b("foo.bar"), 42)
+
+	for _, filter := range []string{">", "foo.>", "foo.*.A", "foo.bar", "foo.*", "bar.>"} {
+		var n, sum int
+		st.Match(b(filter), func(_ []byte, v *int) { n, sum = n+1, sum+*v })
+		require_Equal(t, st.CountMatching(b(filter)), n)
+		require_Equal(t, SumMatching(st, b(filter), func(v *int) int { return *v }), sum)
+		got := Reduce(st, b(filter), 0, func(acc int, subject []byte, v *int) int { return acc + len(subject) + *v })
+		var expected int
+		st.Match(b(filter), func(subject []byte, v *int) { expected += len(subject) + *v })
+		require_Equal(t, got, expected)
+	}
+
+	lo, ok := MinMatching(st, b("foo.>"), func(v *int) int { return *v })
+	require_True(t, ok)
+	require_Equal(t, lo, 1)
+	hi, ok := MaxMatching(st, b("foo.*.A"), func(v *int) float64 { return float64(*v) / 2 })
+	require_True(t, ok)
+	require_Equal(t, hi, 5.5)
+	_, ok = MaxMatching(st, b("bar.>"), func(v *int) int { return *v })
+	require_False(t, ok)
+
+	// Collecting subjects through the accumulator.
+	subjects := Reduce(st, b("foo.bar.*"), []string(nil), func(acc []string, subject []byte, _ *int) []string {
+		return append(acc, string(subject))
+	})
+	sort.Strings(subjects)
+	require_Equal(t, strings.Join(subjects, " "), "foo.bar.A foo.bar.B")
+
+	var nt *SubjectTree[int]
+	require_Equal(t, nt.CountMatching(b(">")), 0)
+	require_Equal(t, Reduce(nt, b(">"), 7, func(acc int, _ []byte, _ *int) int { return acc + 1 }), 7)
+}
+
+// Test that MatchProject hands out the projections of the values Match visits.
+func TestSubjectTreeMatchProject(t *testing.T) {
+	type record struct {
+		id      int
+		payload [64]byte
+	}
+	st := NewSubjectTree[record]()
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.%d", i%4, i)), record{id: i})
+	}
+	for _, filter := range []string{">", "foo.1.*", "foo.*.7", "bar.>"} {
+		var expected, got []string
+		st.Match(b(filter), func(subject []byte, v *record) { expected = append(expected, fmt.Sprintf("%s=%d", subject, v.id)) })
+		MatchProject(st, b(filter), func(v *record) int { return v.id }, func(subject []byte, id int) {
+			got = append(got, fmt.Sprintf("%s=%d", subject, id))
+		})
+		sort.Strings(expected)
+		sort.Strings(got)
+		require_Equal(t, strings.Join(got, " "), strings.Join(expected, " "))
+	}
+
+	var nt *SubjectTree[record]
+	MatchProject(nt, b(">"), func(v *record) int { return v.id }, func(_ []byte, _ int) { t.Fatal("unexpected match") })
+}
+
+//-------------------
+//  Test for Matching in Subject Order
+//-------------------
+
+// Test that ordered matching visits the same entries as Match, in order, and respects the starting point.
+func TestSubjectTreeMatchOrdered(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 500; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.%d", i%13, i)), i)
+		st.Insert(b(fmt.Sprintf("foo.%d", i%7)), i)
+	}
+	st.Insert(b("foo"), 0)
+	for _, filter := range []string{">", "foo", "foo.*", "foo.>", "foo.*.*", "foo.1.*", "*.*.1", "foo.12.>", "bar.>"} {
+		var expected []string
+		st.Match(b(filter), func(subject []byte, _ *int) { expected = append(expected, string(subject)) })
+		sort.Strings(expected)
+		for _, after := range []string{"", "foo.1", "foo.11.300", "foo.5.", "zzz"} {
+			var from []byte
+			if after != "" {
+				from = b(after)
+			}
+			var got []string
+			st.matchOrdered(b(filter), from, func(subject []byte, _ *int) bool {
+				got = append(got, string(subject))
+				return true
+			})
+			i := sort.SearchStrings(expected, after)
+			if i < len(expected) && expected[i] == after {
+				i++
+			}
+			require_Equal(t, strings.Join(got, ","), strings.Join(expected[i:], ","))
+		}
+	}
+}
+
+//-------------------
+//  Test for Matching in Value Order with a Limit
+//-------------------
+
+// Test that MatchOrdered hands out the same leading entries as sorting all matches, for any limit.
+func TestSubjectTreeMatchOrderedLimit(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.%d", i%11, i)), rand.Intn(50))
+	}
+	byValue := func(a, b *int) int { return *a - *b }
+	for _, filter := range []string{">", "foo.3.*", "foo.*.7", "bar.>"} {
+		var all []Entry[int]
+		st.Match(b(filter), func(subject []byte, v *int) { all = append(all, entryOf(subject, v)) })
+		for _, cmp := range []func(a, b *int) int{byValue, nil} {
+			sort.Slice(all, func(i, j int) bool {
+				if cmp != nil && all[i].Value != all[j].Value {
+					return all[i].Value < all[j].Value
+				}
+				return bytes.Compare(all[i].Subject, all[j].Subject) < 0
+			})
+			for _, limit := range []int{1, 5, 64, 5000, 0} {
+				var got []Entry[int]
+				st.MatchOrdered(b(filter), limit, cmp, func(subject []byte, v *int) bool {
+					got = append(got, entryOf(subject, v))
+					return true
+				})
+				want := all
+				if limit > 0 && limit < len(all) {
+					want = all[:limit]
+				}
+				require_Equal(t, fmt.Sprint(got), fmt.Sprint(want))
+			}
+		}
+	}
+
+	// The callback can stop early.
+	var n int
+	st.MatchOrdered(b(">"), 10, byValue, func(_ []byte, _ *int) bool { n++; return n < 3 })
+	require_Equal(t, n, 3)
+}
+
+//-------------------
+//  Test for Iterating Matches in Order
+//-------------------
+
+// Test case for walking the matches of a filter in subject order with early termination.
+func TestSubjectTreeIterOrderedMatched(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar", i)), i)
+		st.Insert(b(fmt.Sprintf("foo.%d.baz", i)), i)
+	}
+	var got []string
+	st.IterOrderedMatched(b("foo.*.bar"), func(subject []byte, _ *int) bool {
+		got = append(got, string(subject))
+		return true
+	})
+	require_Equal(t, len(got), 100)
+	require_True(t, sort.StringsAreSorted(got))
+
+	// Stop after the first few.
+	var first []string
+	st.IterOrderedMatched(b("foo.*.bar"), func(subject []byte, _ *int) bool {
+		first = append(first, string(subject))
+		return len(first) < 3
+	})
+	require_Equal(t, strings.Join(first, ","), strings.Join(got[:3], ","))
+
+	// Sealed trees hand out copies, as with the other walks.
+	st.SetSealed(true)
+	st.IterOrderedMatched(b("foo.1.>"), func(_ []byte, v *int) bool {
+		*v = -1
+		return true
+	})
+	v, _ := st.Find(b("foo.1.bar"))
+	require_Equal(t, *v, 1)
+}
+
+//-------------------
+//  Test for Matching with a Pruner
+//-------------------
+
+// Test case for cutting off subtrees during a match.
+func TestSubjectTreeMatchWithPruner(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for _, tenant := range []string{"acme", "globex", "initech"} {
+		for i := 0; i < 20; i++ {
+			st.Insert(b(fmt.Sprintf("%s.orders.%d", tenant, i)), i)
+		}
+	}
+	// Cut off one tenant as soon as its token is complete.
+	var depth0 int
+	var got []string
+	st.MatchWithPruner(b("*.orders.*"), func(depth int, prefix []byte) bool {
+		if depth == 0 {
+			depth0++
+		}
+		return strings.HasPrefix(string(prefix), "globex.")
+	}, func(subject []byte, _ *int) {
+		got = append(got, string(subject))
+	})
+	require_Equal(t, len(got), 40)
+	require_Equal(t, depth0, 1)
+	for _, subj := range got {
+		require_False(t, strings.HasPrefix(subj, "globex."))
+	}
+	// Matches come in subject order.
+	require_True(t, sort.StringsAreSorted(got))
+
+	// Pruning the root cuts off everything, never pruning is the same as Match.
+	var n int
+	st.MatchWithPruner(b(">"), func(int, []byte) bool { return true }, func([]byte, *int) { n++ })
+	require_Equal(t, n, 0)
+	st.MatchWithPruner(b(">"), func(int, []byte) bool { return false }, func([]byte, *int) { n++ })
+	require_Equal(t, n, 60)
+}
+
+//-------------------
+//  Test for Matching with Permissions
+//-------------------
+
+// Test case for matching only allowed subjects, checked against filtering all matches afterwards.
+func TestSubjectTreeMatchAllowed(t *testing.T) {
+	_, err := NewPermissions([]string{"foo.>.bar"}, nil)
+	require_True(t, errors.Is(err, ErrInvalidFilter))
+
+	st := NewSubjectTree[int]()
+	var i int
+	for _, kind := range []string{"orders", "billing", "secret", "public"} {
+		for _, region := range []string{"eu", "us", "apac"} {
+			for n := 0; n < 10; n++ {
+				st.Insert(b(fmt.Sprintf("%s.%s.%d", kind, region, n)), i)
+				i++
+			}
+		}
+	}
+	for _, tc := range []struct{ allow, deny []string }{
+		{nil, nil},
+		{[]string{"orders.>", "public.*.1"}, nil},
+		{nil, []string{"secret.>", "*.apac.>", "billing.us.3"}},
+		{[]string{"*.eu.*", "billing.>"}, []string{"billing.eu.>", "*.*.7"}},
+		{[]string{"nothing.>"}, nil},
+		{[]string{">"}, []string{">"}},
+	} {
+		perms, err := NewPermissions(tc.allow, tc.deny)
+		require_True(t, err == nil)
+		for _, filter := range []string{">", "*.eu.*", "billing.>", "secret.us.*"} {
+			var got, want []string
+			st.MatchAllowed(b(filter), perms, func(subject []byte, _ *int) {
+				got = append(got, string(subject))
+			})
+			st.Match(b(filter), func(subject []byte, _ *int) {
+				if perms.Allowed(subject) {
+					want = append(want, string(subject))
+				}
+			})
+			sort.Strings(want)
+			require_Equal(t, strings.Join(got, " "), strings.Join(want, " "))
+		}
+	}
+
+	// Denied subtrees are not walked at all.
+	perms, _ := NewPermissions(nil, []string{"secret.>"})
+	var pruned bool
+	st.MatchWithPruner(b(">"), func(_ int, prefix []byte) bool {
+		if perms.prunes(prefix) {
+			require_True(t, strings.HasPrefix(string(prefix), "secret."))
+			pruned = true
+			return true
+		}
+		return false
+	}, func([]byte, *int) {})
+	require_True(t, pruned)
+	require_True(t, (*Permissions)(nil).Allowed(b("foo")))
+}
+
+//-------------------
+//  Test for Compiled Filter Sets
+//-------------------
+
+// Test that matching a filter set visits every entry matching any filter once, and survives a round trip.
+func TestSubjectTreeMatchSet(t *testing.T) {
+	_, err := NewFilterSet([]string{"foo.>.bar"})
+	require_True(t, errors.Is(err, ErrInvalidFilter))
+
+	st := NewSubjectTree[int]()
+	var i int
+	for _, kind := range []string{"orders", "billing", "secret", "public"} {
+		for _, region := range []string{"eu", "us", "apac"} {
+			for n := 0; n < 10; n++ {
+				st.Insert(b(fmt.Sprintf("%s.%s.%d", kind, region, n)), i)
+				i++
+			}
+		}
+	}
+	filters := []string{"orders.>", "orders.eu.*", "*.us.3", "public.apac.7", "billing.*.1", "nothing.>", "orders.eu.*"}
+	fs, err := NewFilterSet(filters)
+	require_True(t, err == nil)
+	require_Equal(t, fs.Len(), 6)
+	require_Equal(t, strings.Join(fs.Filters(), " "), "*.us.3 billing.*.1 nothing.> orders.> orders.eu.* public.apac.7")
+
+	check := func(fs *FilterSet) {
+		t.Helper()
+		var got, want []string
+		st.MatchSet(fs, func(subject []byte, _ *int) { got = append(got, string(subject)) })
+		st.IterOrdered(func(subject []byte, _ *int) bool {
+			for _, f := range filters {
+				var match bool
+				st.Match(b(f), func(s []byte, _ *int) { match = match || string(s) == string(subject) })
+				if match {
+					want = append(want, string(subject))
+					break
+				}
+			}
+			return true
+		})
+		require_Equal(t, strings.Join(got, " "), strings.Join(want, " "))
+		require_Equal(t, len(got), 30+3+1+3)
+	}
+	check(fs)
+
+	require_True(t, fs.MatchesSubject(b("orders.eu.1")))
+	require_True(t, fs.MatchesSubject(b("secret.us.3")))
+	require_False(t, fs.MatchesSubject(b("secret.us.4")))
+	var matched []string
+	fs.MatchingFilters(b("orders.eu.1"), func(filter []byte) { matched = append(matched, string(filter)) })
+	sort.Strings(matched)
+	require_Equal(t, strings.Join(matched, " "), "orders.> orders.eu.*")
+
+	var buf bytes.Buffer
+	n, err := fs.WriteTo(&buf)
+	require_True(t, err == nil)
+	require_Equal(t, int(n), buf.Len())
+	rfs, err := ReadFilterSet(bytes.NewReader(buf.Bytes()))
+	require_True(t, err == nil)
+	require_Equal(t, rfs.Len(), fs.Len())
+	check(rfs)
+	data := buf.Bytes()
+	data[len(data)/2] ^= 0xff
+	_, err = ReadFilterSet(bytes.NewReader(data))
+	require_True(t, errors.Is(err, ErrCorrupt))
+
+	// Empty and nil sets match nothing.
+	empty, _ := NewFilterSet(nil)
+	for _, fs := range []*FilterSet{empty, nil} {
+		st.MatchSet(fs, func([]byte, *int) { t.Fatalf("Unexpected match") })
+		require_False(t, fs.MatchesSubject(b("orders.eu.1")))
+	}
+}
+
+// Test that the entries no filter covers are found, without walking subtrees covered by a full wildcard.
+func TestSubjectTreeUncovered(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i, subj := range []string{"orders.eu.1", "orders.us.1", "billing.eu.1", "billing.eu.2", "billing.us.1", "audit.1", "audit.2.x"} {
+		st.Insert(b(subj), i)
+	}
+	uncovered := func(fs *FilterSet) string {
+		var subjects []string
+		st.Uncovered(fs, func(subject []byte, _ *int) { subjects = append(subjects, string(subject)) })
+		return strings.Join(subjects, " ")
+	}
+	fs, _ := NewFilterSet([]string{"orders.>", "billing.eu.*", "audit.*"})
+	require_Equal(t, uncovered(fs), "audit.2.x billing.us.1")
+	fs, _ = NewFilterSet([]string{">"})
+	require_Equal(t, uncovered(fs), "")
+	require_Equal(t, uncovered(nil), "audit.1 audit.2.x billing.eu.1 billing.eu.2 billing.us.1 orders.eu.1 orders.us.1")
+
+	// Covered subtrees are pruned.
+	fs, _ = NewFilterSet([]string{"orders.>"})
+	require_True(t, fs.t.coversPrefix(b("orders.e")))
+	require_False(t, fs.t.coversPrefix(b("orders")))
+	require_False(t, fs.t.coversPrefix(b("billing.")))
+}
+
+//-------------------
+//  Test for Routing Tables
+//-------------------
+
+// Test case for looking up the most specific route for a subject.
+func TestSubjectTreeRouteTable(t *testing.T) {
+	rt := NewRouteTable[string]()
+	require_True(t, rt.Add(b("foo.>.bar"), "x") == ErrInvalidFilter)
+	routes := []string{">", "foo.>", "foo.*", "*.bar", "foo.bar", "foo.*.baz", "foo.bar.>", "*.*.baz"}
+	// The result must not depend on the order routes were added in.
+	for _, perm := range [][]int{{0, 1, 2, 3, 4, 5, 6, 7}, {7, 6, 5, 4, 3, 2, 1, 0}, {3, 5, 0, 7, 2, 4, 6, 1}} {
+		rt = NewRouteTable[string]()
+		for _, i := range perm {
+			require_True(t, rt.Add(b(routes[i]), routes[i]) == nil)
+		}
+		for subject, want := range map[string]string{
+			"foo.bar":     "foo.bar",
+			"foo.baz":     "foo.*",
+			"qux.bar":     "*.bar",
+			"qux":         ">",
+			"foo.bar.baz": "foo.bar.>",
+			"foo.qux.baz": "foo.*.baz",
+			"qux.qux.baz": "*.*.baz",
+			"foo.a.b.c":   "foo.>",
+		} {
+			pattern, val, ok := rt.Lookup(b(subject))
+			require_True(t, ok)
+			require_Equal(t, string(pattern), want)
+			require_Equal(t, val, want)
+		}
+	}
+	require_Equal(t, rt.Size(), len(routes))
+	val, ok := rt.Remove(b(">"))
+	require_True(t, ok)
+	require_Equal(t, val, ">")
+	_, _, ok = rt.Lookup(b("qux"))
+	require_False(t, ok)
+	_, ok = rt.Remove(b(">"))
+	require_False(t, ok)
+}
+
+//-------------------
+//  Test for Hot Prefixes
+//-------------------
+
+// Test that match counts per prefix decay over time, so the hottest prefixes are those matched recently.
+func TestSubjectTreeHotSubtrees(t *testing.T) {
+	require_True(t, NewSubjectTree[int]().HotSubtrees(3) == nil)
+
+	st := NewSubjectTree[int](WithHotPrefixes(2, time.Minute))
+	clock := time.Unix(1000, 0)
+	st.hot.now = func() time.Time { return clock }
+	st.Insert(b("orders.eu.1"), 1)
+	st.Insert(b("billing.us.1"), 2)
+	format := func(top []HotPrefix) string {
+		var parts []string
+		for _, hp := range top {
+			parts = append(parts, fmt.Sprintf("%s=%.1f", hp.Prefix, hp.Matches))
+		}
+		return strings.Join(parts, " ")
+	}
+
+	for i := 0; i < 8; i++ {
+		st.Match(b("orders.eu.*"), func(_ []byte, _ *int) {})
+	}
+	// Wildcards among the tracked tokens count for the prefixes the match found entries below.
+	st.MatchValues(b("orders.>"), func(_ *int) {})
+	st.MatchValues(b("orders.us.1.x"), func(_ *int) {})
+	st.HasSubjectsMatching(b("*.eu.1"))
+	require_Equal(t, format(st.HotSubtrees(5)), "orders.eu=10.0 orders.us=1.0")
+
+	// Four minutes later the old matches count for a sixteenth.
+	clock = clock.Add(4 * time.Minute)
+	for i := 0; i < 2; i++ {
+		st.MatchValues(b("billing.us.>"), func(_ *int) {})
+	}
+	require_Equal(t, format(st.HotSubtrees(2)), "billing.us=2.0 orders.eu=0.6")
+	require_Equal(t, len(st.HotSubtrees(10)), 3)
+
+	// A match spread over the tree counts once for every prefix it went to, whatever way it is matched.
+	st.Insert(b("orders.eu.2"), 3)
+	st.Insert(b("shipping.eu.1"), 4)
+	st.Match(b(">"), func(_ []byte, _ *int) {})
+	st.MatchWithPruner(b("*.eu.*"), func(_ int, _ []byte) bool { return false }, func(_ []byte, _ *int) {})
+	st.MatchDeadline(b("*.*.1"), time.Hour, func(_ []byte, _ *int) {})
+	st.IterOrderedMatched(b("*.us.>"), func(_ []byte, _ *int) bool { return true })
+	require_Equal(t, format(st.HotSubtrees(5)), "billing.us=5.0 orders.eu=3.6 shipping.eu=3.0 orders.us=0.1")
+
+	// Prefixes that went cold are dropped eventually.
+	clock = clock.Add(time.Hour)
+	for i := 0; i < hotSweep; i++ {
+		st.MatchValues(b("billing.us.1"), func(_ *int) {})
+	}
+	require_Equal(t, len(st.HotSubtrees(10)), 1)
+	require_Equal(t, string(st.HotSubtrees(1)[0].Prefix), "billing.us")
+}
+
+//-------------------
+//  Test for Match Statistics
+//-------------------
+
+// Test case for reporting how much of the tree a match looked at.
+func TestSubjectTreeMatchWithStats(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar", i)), i)
+	}
+	var n int
+	stats := st.MatchWithStats(b("foo.*.bar"), func(_ []byte, _ *int) { n++ })
+	require_Equal(t, n, 100)
+	require_Equal(t, stats.Matches, 100)
+	require_True(t, stats.Leaves >= 100)
+	require_True(t, stats.Nodes > 1)
+
+	// A filter with poor selectivity looks at everything and matches nothing.
+	stats = st.MatchWithStats(b("foo.*.baz"), func(_ []byte, _ *int) {})
+	require_Equal(t, stats.Matches, 0)
+	require_True(t, stats.Leaves >= 100)
+
+	// A literal filter only looks at its own path.
+	stats = st.MatchWithStats(b("foo.42.bar"), func(_ []byte, _ *int) {})
+	require_Equal(t, stats.Matches, 1)
+	require_Equal(t, stats.Leaves, 1)
+	require_True(t, stats.Nodes <= 3)
+
+	// Terminal wildcards inspect the leaves below the last node.
+	stats = st.MatchWithStats(b("foo.>"), func(_ []byte, _ *int) {})
+	require_Equal(t, stats.Matches, 100)
+}
+
+//-------------------
+//  Test for Matching with a Deadline
+//-------------------
+
+// Test case for stopping a match at a deadline and reporting partial results.
+func TestSubjectTreeMatchDeadline(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%04d", i)), i)
+	}
+	var got []string
+	complete := st.MatchDeadline(b("foo.*"), time.Minute, func(subject []byte, _ *int) {
+		got = append(got, string(subject))
+	})
+	require_True(t, complete)
+	require_Equal(t, len(got), 1000)
+
+	// An expired deadline stops right away.
+	var n int
+	complete = st.MatchDeadline(b("foo.*"), 0, func(_ []byte, _ *int) { n++ })
+	require_False(t, complete)
+	require_True(t, n < 1000)
+
+	// Partial results are the leading part of the full ones.
+	var partial []string
+	complete = st.MatchDeadline(b("foo.*"), 5*time.Millisecond, func(subject []byte, _ *int) {
+		partial = append(partial, string(subject))
+		time.Sleep(time.Millisecond)
+	})
+	require_False(t, complete)
+	require_True(t, len(partial) > 0 && len(partial) < 1000)
+	for i, subj := range partial {
+		require_Equal(t, subj, got[i])
+	}
+}
+
+//-------------------
+//  Test for Stable Callback Subjects
+//-------------------
+
+// Test that subjects handed to callbacks can be retained when asked for, and are reused otherwise.
+func TestSubjectTreeStableCallbacksSubjects(t *testing.T) {
+	fill := func(st *SubjectTree[int]) {
+		for i := 0; i < 20; i++ {
+			st.Insert(b(fmt.Sprintf("foo.bar.%d", i)), i)
+		}
+	}
+	collect := func(st *SubjectTree[int]) [][][]byte {
+		var all [][][]byte
+		var retained [][]byte
+		st.Match(b("foo.>"), func(subject []byte, _ *int) { retained = append(retained, subject) })
+		all, retained = append(all, retained), nil
+		st.IterOrdered(func(subject []byte, _ *int) bool { retained = append(retained, subject); return true })
+		all, retained = append(all, retained), nil
+		st.IterFast(func(subject []byte, _ *int) bool { retained = append(retained, subject); return true })
+		all, retained = append(all, retained), nil
+		st.IterOrderedMatched(b("foo.*.*"), func(subject []byte, _ *int) bool { retained = append(retained, subject); return true })
+		all, retained = append(all, retained), nil
+		st.MatchSnapshot(b("foo.bar.*"), func(subject []byte, _ *int) { retained = append(retained, subject) })
+		return append(all, retained)
+	}
+
+	st := NewSubjectTree[int](WithStableCallbacksSubjects())
+	fill(st)
+	for _, retained := range collect(st) {
+		require_Equal(t, len(retained), 20)
+		seen := make(map[string]bool)
+		for _, subject := range retained {
+			v, found := st.Find(subject)
+			require_True(t, found)
+			require_Equal(t, string(subject), fmt.Sprintf("foo.bar.%d", *v))
+			seen[string(subject)] = true
+		}
+		require_Equal(t, len(seen), 20)
+	}
+
+	// Without the option the subjects share a reused buffer.
+	st = NewSubjectTree[int]()
+	fill(st)
+	retained := collect(st)[1]
+	require_True(t, &retained[0][0] == &retained[1][0])
+}
+
+//-------------------
+//  Test for Unicode Folding
+//-------------------
+
+// Test that subjects differing in case or in the normal form are the same subject with Unicode folding.
+func TestSubjectTreeUnicodeFold(t *testing.T) {
+	composed, decomposed := "caf\u00e9", "cafe\u0301"
+	st := NewSubjectTree[int](WithUnicodeFold())
+	_, updated := st.Insert(b("Users."+composed+".Orders"), 1)
+	require_False(t, updated)
+	_, updated = st.Insert(b("users.CAF\u00c9.orders"), 2)
+	require_True(t, updated)
+	_, updated = st.Insert(b("users."+decomposed+".orders"), 3)
+	require_True(t, updated)
+	_, updated = st.Insert(b("users.\u212aelvin"), 4) // Kelvin sign
+	require_False(t, updated)
+	require_Equal(t, st.Size(), 2)
+
+	v, found := st.Find(b("USERS." + decomposed + ".ORDERS"))
+	require_True(t, found)
+	require_Equal(t, *v, 3)
+	v, found = st.Find(b("users.kelvin"))
+	require_True(t, found)
+	require_Equal(t, *v, 4)
+
+	var got []string
+	st.Match(b("Users.*.Orders"), func(subject []byte, _ *int) { got = append(got, string(subject)) })
+	require_Equal(t, len(got), 1)
+	require_Equal(t, got[0], "users."+composed+".orders")
+	got = nil
+	st.IterOrderedMatched(b("USERS."+decomposed+".>"), func(subject []byte, _ *int) bool {
+		got = append(got, string(subject))
+		return true
+	})
+	require_Equal(t, len(got), 1)
+
+	// Marks are put in canonical order before composing, and compose onto composed letters.
+	st.Insert(b("vi\u1ec6t"), 6)
+	for _, s := range []string{"VIE\u0323\u0302T", "vie\u0302\u0323t", "vi\u1eb9\u0302t", "Vi\u00ca\u0323t"} {
+		v, found = st.Find(b(s))
+		require_True(t, found)
+		require_Equal(t, *v, 6)
+	}
+	// Greek and Cyrillic letters, and runes that normalize to another one.
+	st.Insert(b("\u03ac.\u0439"), 7)
+	v, found = st.Find(b("\u1f71.\u0418\u0306"))
+	require_True(t, found)
+	require_Equal(t, *v, 7)
+	st.Delete(b("vi\u1ec6t"))
+	st.Delete(b("\u03ac.\u0439"))
+
+	// Bytes that are not UTF-8 are kept.
+	st.Insert([]byte{'A', 0xff, '.', 'x'}, 5)
+	v, found = st.Find([]byte{'a', 0xff, '.', 'X'})
+	require_True(t, found)
+	require_Equal(t, *v, 5)
+
+	_, found = st.Delete(b("USERS.Caf\u00c9.ORDERS"))
+	require_True(t, found)
+	require_Equal(t, st.Size(), 2)
+
+	// Without the option the subjects are compared byte by byte.
+	st = NewSubjectTree[int]()
+	st.Insert(b("users."+composed), 1)
+	st.Insert(b("users."+decomposed), 2)
+	st.Insert(b("Users."+composed), 3)
+	require_Equal(t, st.Size(), 3)
+
+	// Striped safe trees put all spellings of the first token into the same stripe.
+	s := NewSafeSubjectTree[int](WithUnicodeFold(), WithStripedLocks(8))
+	for i, first := range []string{"Caf\u00c9", "CAFE\u0301", "caf\u00e9"} {
+		s.Insert(b(first+".x"), i)
+	}
+	require_Equal(t, s.Size(), 1)
+	sv, found := s.Find(b(decomposed + ".X"))
+	require_True(t, found)
+	require_Equal(t, sv, 2)
+}
+
+// Test that every rune folds the same composed and decomposed, and that folded subjects stay as they are.
+func TestSubjectTreeUnicodeFoldAllRunes(t *testing.T) {
+	for r := rune(utf8.RuneSelf); r <= unicode.MaxRune; r++ {
+		if !utf8.ValidRune(r) {
+			continue
+		}
+		s := "x" + string(r) + "Y"
+		folded := string(foldSubject([]byte(norm.NFC.String(s))))
+		if got := string(foldSubject([]byte(norm.NFD.String(s)))); got != folded {
+			t.Errorf("U+%04X folds to %q composed but to %q decomposed", r, folded, got)
+		}
+		if got := string(foldSubject([]byte(folded))); got != folded {
+			t.Errorf("U+%04X folds to %q, which folds again to %q", r, folded, got)
+		}
+	}
+	// Letters the fold has to get right beyond the Latin script, composed and decomposed.
+	for _, tc := range []struct{ subject, folded string }{
+		{"\u0130", "i\u0307"}, {"I\u0307", "i\u0307"},
+		{"\u1f88", "\u1f00\u03b9"}, {"\u0391\u0313\u0345", "\u1f00\u03b9"},
+		{"\uac01", "\uac01"}, {"\u1100\u1161\u11a8", "\uac01"},
+		{"\u13a0", "\u13a0"}, {"\uab70", "\u13a0"},
+		{"STRASSE", "strasse"}, {"Stra\u00dfe", "strasse"},
+	} {
+		require_Equal(t, string(foldSubject(b(tc.subject))), tc.folded)
+	}
+}
+
+//-------------------
+//  Test for Token Rewrites
+//-------------------
+
+// Test that rewritten tokens are replaced wherever subjects and filters enter the tree.
+func TestSubjectTreeTokenRewrites(t *testing.T) {
+	st := NewSubjectTree[int](WithTokenRewrites(map[string]string{"evt": "events", "old": "legacy.v0"}))
+	st.Insert(b("evt.created"), 1)
+	st.Insert(b("events.deleted"), 2)
+	st.Insert(b("evt.old.updated"), 3)
+	st.Insert(b("orders.evt"), 4)
+	require_Equal(t, st.Size(), 4)
+
+	v, found := st.Find(b("events.created"))
+	require_True(t, found)
+	require_Equal(t, *v, 1)
+	v, found = st.Find(b("evt.deleted"))
+	require_True(t, found)
+	require_Equal(t, *v, 2)
+	v, found = st.Find(b("events.legacy.v0.updated"))
+	require_True(t, found)
+	require_Equal(t, *v, 3)
+	_, found = st.Find(b("evtx.created"))
+	require_False(t, found)
+
+	var got []string
+	st.Match(b("evt.>"), func(subject []byte, _ *int) { got = append(got, string(subject)) })
+	sort.Strings(got)
+	require_Equal(t, strings.Join(got, " "), "events.created events.deleted events.legacy.v0.updated")
+	got = nil
+	st.Match(b("*.events"), func(subject []byte, _ *int) { got = append(got, string(subject)) })
+	require_Equal(t, strings.Join(got, " "), "orders.events")
+
+	_, found = st.Delete(b("evt.created"))
+	require_True(t, found)
+	require_Equal(t, st.Size(), 3)
+
+	// Keys are folded with the subjects.
+	st = NewSubjectTree[int](WithUnicodeFold(), WithTokenRewrites(map[string]string{"EVT": "Events"}))
+	st.Insert(b("Evt.x"), 1)
+	v, found = st.Find(b("events.X"))
+	require_True(t, found)
+	require_Equal(t, *v, 1)
+
+	// Rewrites that are not single tokens, would be rewritten again or turn subjects into filters are refused.
+	for _, rewrites := range []map[string]string{{"a.b": "c"}, {"*": "c"}, {"": "c"}, {"a": ""}, {"a": "b", "b": "c"}, {"a": "x.a"},
+		{"a": "*"}, {"a": ">"}, {"a": "x.*.y"}, {"a": "x.>"}} {
+		require_True(t, errors.Is(ValidateOptions(WithTokenRewrites(rewrites)), ErrInvalidOption))
+		var err error
+		func() {
+			defer func() { err, _ = recover().(error) }()
+			NewSubjectTree[int](WithTokenRewrites(rewrites))
+		}()
+		require_True(t, errors.Is(err, ErrInvalidOption))
+	}
+	// Prefixes of splits, moves and views are rewritten as well.
+	st = NewSubjectTree[int](WithTokenRewrites(map[string]string{"evt": "events"}))
+	st.Insert(b("evt.a"), 1)
+	st.Insert(b("orders.evt.b"), 2)
+	require_Equal(t, st.View(b("evt")).Size(), 1)
+	require_Equal(t, st.View(b("orders.evt")).Size(), 1)
+	nt, ok := st.SplitAt(b("orders.evt."))
+	require_True(t, ok)
+	require_Equal(t, nt.Size(), 1)
+	require_True(t, st.Graft(b("orders.evt."), nt) == nil)
+	_, found = st.Find(b("orders.events.b"))
+	require_True(t, found)
+	moved, err := st.MovePrefix(b("evt."), b("archive.evt."))
+	require_True(t, err == nil)
+	require_Equal(t, moved, 1)
+	_, found = st.Find(b("archive.events.a"))
+	require_True(t, found)
+
+	// Keys that only collide once folded as well.
+	require_True(t, ValidateOptions(WithTokenRewrites(map[string]string{"a": "B"})) == nil)
+	require_True(t, errors.Is(ValidateOptions(WithUnicodeFold(), WithTokenRewrites(map[string]string{"a": "B", "b": "c"})), ErrInvalidOption))
+}
+
+//-------------------
+//  Test for Matching by Suffix
+//-------------------
+
+// Test that MatchSuffix finds the subjects ending with the tokens, with and without the index, and that
+// the index follows the tree through every kind of modification.
+func TestSubjectTreeMatchSuffix(t *testing.T) {
+	collect := func(st *SubjectTree[int], suffix string) string {
+		var got []string
+		st.MatchSuffix(b(suffix), func(subject []byte, _ *int) { got = append(got, string(subject)) })
+		sort.Strings(got)
+		return strings.Join(got, " ")
+	}
+	indexed, scanned := NewSubjectTree[int](WithSuffixIndex()), NewSubjectTree[int]()
+	for _, st := range []*SubjectTree[int]{indexed, scanned} {
+		st.Insert(b("site.a.PROPERTY-A"), 1)
+		st.Insert(b("site.b.PROPERTY-A"), 2)
+		st.Insert(b("site.b.PROPERTY-B"), 3)
+		st.Insert(b("PROPERTY-A"), 4)
+		st.Insert(b("site.a.XPROPERTY-A"), 5)
+		st.Insert(b("other.b.PROPERTY-A.x"), 6)
+	}
+	for _, st := range []*SubjectTree[int]{indexed, scanned} {
+		require_Equal(t, collect(st, ".PROPERTY-A"), "PROPERTY-A site.a.PROPERTY-A site.b.PROPERTY-A")
+		require_Equal(t, collect(st, "b.PROPERTY-A"), "site.b.PROPERTY-A")
+		require_Equal(t, collect(st, "b.*"), "site.b.PROPERTY-A site.b.PROPERTY-B")
+		require_Equal(t, collect(st, "PROPERTY-A.*"), "other.b.PROPERTY-A.x")
+		require_Equal(t, collect(st, "nope"), "")
+		require_Equal(t, collect(st, "a.>"), "")
+		require_Equal(t, collect(st, ""), "")
+	}
+
+	// The index follows deletes, splits, grafts, imports and emptying the tree.
+	indexed.Delete(b("site.a.PROPERTY-A"))
+	require_Equal(t, collect(indexed, "PROPERTY-A"), "PROPERTY-A site.b.PROPERTY-A")
+	sub, ok := indexed.SplitAt(b("site."))
+	require_True(t, ok)
+	require_Equal(t, collect(indexed, "PROPERTY-A"), "PROPERTY-A")
+	require_Equal(t, collect(sub, "PROPERTY-A"), "b.PROPERTY-A")
+	require_True(t, indexed.Graft(b("moved."), sub) == nil)
+	require_Equal(t, collect(indexed, "PROPERTY-A"), "PROPERTY-A moved.b.PROPERTY-A")
+	chunks := make(chan Chunk[int], 1)
+	chunks <- Chunk[int]{Entries: []Entry[int]{{Subject: b("z.PROPERTY-A"), Value: 7}}}
+	close(chunks)
+	_, err := indexed.ImportChunks(chunks, 1)
+	require_True(t, err == nil)
+	require_Equal(t, collect(indexed, "PROPERTY-A"), "PROPERTY-A moved.b.PROPERTY-A z.PROPERTY-A")
+	indexed.Empty()
+	require_Equal(t, collect(indexed, "PROPERTY-A"), "")
+
+	// Striped safe trees move subjects between their stripes on Update, taking the index along.
+	s := NewSafeSubjectTree[int](WithSuffixIndex(), WithStripedLocks(4))
+	for i := 0; i < 50; i++ {
+		s.Insert(b(fmt.Sprintf("t%d.x.%d", i, i%2)), i)
+	}
+	for round := 0; round < 2; round++ {
+		s.Update(func(st *SubjectTree[int]) {
+			var n int
+			st.MatchSuffix(b("x.1"), func(_ []byte, v *int) {
+				require_Equal(t, *v%2, 1)
+				n++
+			})
+			require_Equal(t, n, 25)
+		})
+	}
+}
+
+//-------------------
+//  Test for Matching by Token Position
+//-------------------
+
+// Test that MatchTokenAt finds the subjects with the token at the position, with and without the index.
+func TestSubjectTreeMatchTokenAt(t *testing.T) {
+	indexed, scanned := NewSubjectTree[int](WithTokenIndex(1, 2)), NewSubjectTree[int]()
+	for i := 1; i <= 2000; i++ {
+		subj := fmt.Sprintf("foo.%d.%d", rand.Intn(20)+1, i)
+		if i%3 == 0 {
+			subj += ".x"
+		}
+		indexed.Insert(b(subj), i)
+		scanned.Insert(b(subj), i)
+	}
+	collect := func(st *SubjectTree[int], pos int, token string) []string {
+		var got []string
+		st.MatchTokenAt(pos, b(token), func(subject []byte, _ *int) { got = append(got, string(subject)) })
+		sort.Strings(got)
+		return got
+	}
+	for _, tc := range []struct {
+		pos   int
+		token string
+	}{{0, "foo"}, {1, "2"}, {1, "21"}, {2, "42"}, {3, "x"}, {1, "*"}, {1, ""}, {1, "2.3"}} {
+		var want []string
+		scanned.IterOrdered(func(subject []byte, _ *int) bool {
+			if tokens := strings.Split(string(subject), "."); tc.pos < len(tokens) && tokens[tc.pos] == tc.token && !strings.Contains(tc.token, ".") && tc.token != "*" {
+				want = append(want, string(subject))
+			}
+			return true
+		})
+		require_Equal(t, strings.Join(collect(indexed, tc.pos, tc.token), " "), strings.Join(want, " "))
+		require_Equal(t, strings.Join(collect(scanned, tc.pos, tc.token), " "), strings.Join(want, " "))
+	}
+
+	// The index follows deletes and emptying the tree.
+	two := collect(indexed, 1, "2")
+	require_True(t, len(two) > 0)
+	for _, subject := range two[1:] {
+		indexed.Delete(b(subject))
+	}
+	require_Equal(t, len(collect(indexed, 1, "2")), 1)
+	indexed.Empty()
+	require_Equal(t, len(collect(indexed, 1, "2")), 0)
+	require_Equal(t, len(indexed.tokens.subjects), 0)
+}
+
+//-------------------
+//  Test for Composable Queries
+//-------------------
+
+// Test that queries find the same subjects as filtering all of them, in order and up to the limit.
+func TestSubjectTreeQuery(t *testing.T) {
+	st := NewSubjectTree[int]()
+	var all []string
+	for i := 0; i < 500; i++ {
+		subj := fmt.Sprintf("%s.%d.%c", []string{"foo", "foobar", "bar"}[i%3], i%7, 'A'+rune(i%5))
+		if i%4 == 0 {
+			subj += ".x"
+		}
+		if _, updated := st.Insert(b(subj), i); !updated {
+			all = append(all, subj)
+		}
+	}
+	st.Insert(b("foo"), -1)
+	all = append(all, "foo")
+	sort.Strings(all)
+
+	run := func(q *Query) []string {
+		var got []string
+		err := st.Query(q, func(subject []byte, _ *int) bool {
+			got = append(got, string(subject))
+			return true
+		})
+		require_True(t, err == nil)
+		return got
+	}
+	filter := func(keep func(tokens []string) bool) []string {
+		var want []string
+		for _, subj := range all {
+			if keep(strings.Split(subj, ".")) {
+				want = append(want, subj)
+			}
+		}
+		return want
+	}
+	same := func(got, want []string) {
+		t.Helper()
+		require_Equal(t, strings.Join(got, " "), strings.Join(want, " "))
+	}
+
+	same(run(Q()), all)
+	fooA := filter(func(tokens []string) bool { return tokens[0] == "foo" && len(tokens) > 2 && tokens[2] == "A" })
+	require_True(t, len(fooA) > 10)
+	same(run(Q().Prefix("foo").TokenAt(2, "A")), fooA)
+	same(run(Q().Prefix("foo").TokenAt(2, "A").Limit(10).OrderAsc()), fooA[:10])
+	var desc []string
+	for i := len(fooA) - 1; i >= len(fooA)-10; i-- {
+		desc = append(desc, fooA[i])
+	}
+	same(run(Q().Prefix("foo").TokenAt(2, "A").Limit(10).OrderDesc()), desc)
+	same(run(Q().Prefix("foo").Limit(1)), []string{"foo"})
+	same(run(Q().Prefix("foo.3")), filter(func(tokens []string) bool { return tokens[0] == "foo" && len(tokens) > 1 && tokens[1] == "3" }))
+	same(run(Q().TokenAt(3, "x").TokenAt(1, "2")), filter(func(tokens []string) bool { return len(tokens) > 3 && tokens[1] == "2" }))
+	same(run(Q().Prefix("foo.3").TokenAt(1, "4")), nil)
+	same(run(Q().Prefix("fo")), nil)
+
+	// The callback can stop the query early.
+	var n int
+	require_True(t, st.Query(Q().OrderDesc(), func(_ []byte, _ *int) bool { n++; return n < 3 }) == nil)
+	require_Equal(t, n, 3)
+
+	for _, q := range []*Query{Q().Prefix("foo.*"), Q().Prefix("foo..bar"), Q().TokenAt(-1, "a"), Q().TokenAt(1, "a.b"), Q().TokenAt(0, ">")} {
+		require_True(t, errors.Is(st.Query(q, func(_ []byte, _ *int) bool { return true }), ErrInvalidQuery))
+	}
+}
+
+//-------------------
+//  Test for Matching with Caller Owned Buffers
+//-------------------
+
+// Test that matching with a scratch finds the same entries without allocating.
+func TestSubjectTreeMatchScratch(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%10, i)), i)
+	}
+	long := strings.Repeat("x.", 200) + "y"
+	st.Insert(b(long), -1)
+
+	var sc Scratch
+	for _, filter := range []string{"foo.*.bar.*", "foo.>", "foo.1.>", "*.*.*.9", ">", "nope", long, strings.Repeat("*.", 200) + "*"} {
+		var expected, got []string
+		st.Match(b(filter), func(subject []byte, _ *int) { expected = append(expected, string(subject)) })
+		st.MatchScratch(b(filter), &sc, func(subject []byte, _ *int) { got = append(got, string(subject)) })
+		require_Equal(t, len(got), len(expected))
+		for i := range got {
+			require_Equal(t, got[i], expected[i])
+		}
+	}
+	// The filter is not retained.
+	for _, p := range sc.parts[:cap(sc.parts)] {
+		require_True(t, p == nil)
+	}
+	var n int
+	st.MatchScratch(b("foo.>"), nil, func(_ []byte, _ *int) { n++ })
+	require_Equal(t, n, 100)
+
+	filter := b("foo.*.bar.*")
+	cb := func(_ []byte, _ *int) { n++ }
+	sc2 := NewScratch(64)
+	allocs := testing.AllocsPerRun(10, func() {
+		st.MatchScratch(filter, sc2, cb)
+	})
+	// Debug builds track the entries every match visits.
+	if !debugChecks {
+		require_Equal(t, allocs, 0)
+	}
+}
+
+//-------------------
+//  Test for Callbacks Returning Errors
+//-------------------
+
+// Test that an error returned by a callback stops the walk and is returned.
+func TestSubjectTreeMatchE(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 10; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	errStop := errors.New("stop")
+	stopAt := func(n int, visited *int) func(_ []byte, v *int) error {
+		return func(_ []byte, v *int) error {
+			if *visited++; *visited == n {
+				return errStop
+			}
+			return nil
+		}
+	}
+	var visited int
+	require_True(t, st.MatchE(b("foo.*"), stopAt(3, &visited)) == errStop)
+	require_Equal(t, visited, 3)
+	visited = 0
+	require_True(t, st.MatchE(b("foo.>"), stopAt(100, &visited)) == nil)
+	require_Equal(t, visited, 10)
+	visited = 0
+	require_True(t, st.IterOrderedE(stopAt(5, &visited)) == errStop)
+	require_Equal(t, visited, 5)
+	visited = 0
+	require_True(t, st.IterFastE(stopAt(1, &visited)) == errStop)
+	require_Equal(t, visited, 1)
+	visited = 0
+	require_True(t, st.IterFastE(stopAt(0, &visited)) == nil)
+	require_Equal(t, visited, 10)
+
+	var empty *SubjectTree[int]
+	require_True(t, empty.MatchE(b(">"), stopAt(1, &visited)) == nil)
+	require_True(t, empty.IterOrderedE(stopAt(1, &visited)) == nil)
+}
+
+//-------------------
+//  Test for Selecting One Match
+//-------------------
+
+// Test the selection policies of MatchOne.
+func TestSubjectTreeMatchOne(t *testing.T) {
+	st := NewSubjectTree[int]()
+	_, _, ok := st.MatchOne(b("foo.*"), SelectFirst)
+	require_False(t, ok)
+	for i := 0; i < 10; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+		st.Insert(b(fmt.Sprintf("bar.%d", i)), i)
+	}
+	subject, v, ok := st.MatchOne(b("foo.*"), SelectFirst)
+	require_True(t, ok)
+	require_Equal(t, string(subject), "foo.0")
+	require_Equal(t, *v, 0)
+	_, _, ok = st.MatchOne(b("baz.*"), SelectRandom)
+	require_False(t, ok)
+
+	// Round robin takes turns in subject order, and keeps going as entries come and go.
+	rr := NewRoundRobin()
+	for i := 0; i < 25; i++ {
+		subject, v, ok = st.MatchOne(b("foo.*"), rr)
+		require_True(t, ok)
+		require_Equal(t, string(subject), fmt.Sprintf("foo.%d", i%10))
+		require_Equal(t, *v, i%10)
+	}
+	st.Delete(b("foo.5"))
+	st.Delete(b("foo.6"))
+	subject, _, _ = st.MatchOne(b("foo.*"), rr)
+	require_Equal(t, string(subject), "foo.7")
+
+	// Random selection is uniform enough.
+	counts := make(map[int]int)
+	for i := 0; i < 10_000; i++ {
+		_, v, ok = st.MatchOne(b("bar.*"), SelectRandom)
+		require_True(t, ok)
+		counts[*v]++
+	}
+	require_Equal(t, len(counts), 10)
+	for _, c := range counts {
+		require_True(t, c > 800 && c < 1200)
+	}
+	// Weighted selection follows the weights and never picks a zero weight.
+	clear(counts)
+	weighted := WeightedBy(func(v int) int { return v % 3 })
+	for i := 0; i < 9000; i++ {
+		_, v, ok = st.MatchOne(b("bar.*"), weighted)
+		require_True(t, ok)
+		counts[*v%3]++
+	}
+	require_Equal(t, counts[0], 0)
+	// Weights 1 and 2 appear three times each, so a third and two thirds.
+	require_True(t, counts[1] > 2600 && counts[1] < 3400)
+	require_True(t, counts[2] > 5600 && counts[2] < 6400)
+	_, _, ok = st.MatchOne(b("bar.0"), weighted)
+	require_False(t, ok)
+
+	// A weight function for another value type is a programming error.
+	defer func() { require_True(t, recover() != nil) }()
+	st.MatchOne(b("bar.*"), WeightedBy(func(v string) int { return 1 }))
+}
+
+//-------------------
+//  Test for Reverse Matching
+//-------------------
+
+// Test case for matching stored filters against literal subjects, checked against Match.
+func TestSubjectTreeReverseMatch(t *testing.T) {
+	st := NewSubjectTree[int]()
+	filters := []string{
+		"foo.bar", "foo.*", "*.bar", "foo.>", ">", "*", "*.*", "foo.*.baz", "foo.bar.>",
+		"*x.bar", "foo.*x", "*.>", "foo.>x", "foo.ba", "foo.barr", "fo.*", "foo", "*.*.>",
+	}
+	for i, f := range filters {
+		st.Insert(b(f), i)
+	}
+	subjects := []string{"foo", "foo.bar", "foo.baz", "foo.bar.baz", "*x.bar", "foo.*x", "foo.>x", "bar", "a.b.c.d", "fo.o"}
+	for _, subj := range subjects {
+		var got []string
+		st.ReverseMatch(b(subj), func(filter []byte, v *int) {
+			require_Equal(t, filters[*v], string(filter))
+			got = append(got, string(filter))
+		})
+		// Each filter should be reported if and only if matching it against the subject would find it.
+		var want []string
+		for _, f := range filters {
+			lt := NewSubjectTree[struct{}]()
+			lt.Insert(b(subj), struct{}{})
+			lt.Match(b(f), func(_ []byte, _ *struct{}) { want = append(want, f) })
+		}
+		sort.Strings(got)
+		sort.Strings(want)
+		require_Equal(t, strings.Join(got, " "), strings.Join(want, " "))
+	}
+	// Deleted filters are gone.
+	st.Delete(b("foo.>"))
+	var n int
+	st.ReverseMatch(b("foo.bar"), func(_ []byte, _ *int) { n++ })
+	require_Equal(t, n, 6)
+}
+
+//-------------------
+//  Test for Interest Checks
+//-------------------
+
+// Test case for checking interest in a subject and subjects for a filter without enumerating matches.
+func TestSubjectTreeHasInterest(t *testing.T) {
+	st := NewSubjectTree[int]()
+	require_False(t, st.HasInterestMatching(b("foo.bar")))
+	require_False(t, st.HasSubjectsMatching(b(">")))
+	st.Insert(b("foo.*.baz"), 1)
+	st.Insert(b("bar.>"), 2)
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("baz.%d.%d", i%10, i)), i)
+	}
+	require_True(t, st.HasInterestMatching(b("foo.bar.baz")))
+	require_True(t, st.HasInterestMatching(b("bar.a.b.c")))
+	require_True(t, st.HasInterestMatching(b("baz.3.123")))
+	require_False(t, st.HasInterestMatching(b("foo.bar")))
+	require_False(t, st.HasInterestMatching(b("bar")))
+	require_False(t, st.HasInterestMatching(b("baz.4.123")))
+
+	require_True(t, st.HasSubjectsMatching(b("baz.*.5")))
+	require_True(t, st.HasSubjectsMatching(b("foo.>")))
+	require_False(t, st.HasSubjectsMatching(b("baz.*.1000")))
+	require_False(t, st.HasSubjectsMatching(b("foo.bar.baz")))
+
+	// Each check stops at the first match.
+	filter := b("baz.>")
+	allocs := testing.AllocsPerRun(100, func() { st.HasSubjectsMatching(filter) })
+	require_True(t, allocs <= 2)
+
+	r := NewRegistry[int]()
+	r.Subscribe(b("foo.*"), 1)
+	require_True(t, r.HasInterest(b("foo.bar")))
+	require_False(t, r.HasInterest(b("foo.bar.baz")))
+}
+
+//-------------------
+//  Test for the Subscription Registry
+//-------------------
+
+// Test case for subscribing, delivering and unsubscribing through a Registry.
+func TestSubjectTreeRegistry(t *testing.T) {
+	r := NewRegistry[string]()
+	for _, f := range []string{"", "foo..bar", "foo.>.bar", "foo."} {
+		_, err := r.Subscribe(b(f), "a")
+		require_True(t, err == ErrInvalidFilter)
+	}
+	sub := func(filter, s string) bool {
+		added, err := r.Subscribe(b(filter), s)
+		require_True(t, err == nil)
+		return added
+	}
+	require_True(t, sub("foo.*", "a"))
+	require_True(t, sub("foo.>", "a"))
+	require_True(t, sub("foo.bar", "b"))
+	require_True(t, sub(">", "c"))
+	require_False(t, sub("foo.*", "a"))
+	require_Equal(t, r.Filters(), 4)
+	require_Equal(t, r.Subscriptions(), 4)
+
+	deliver := func(subject string) string {
+		var got []string
+		n := r.DeliverTo(b(subject), func(s string) { got = append(got, s) })
+		require_Equal(t, n, len(got))
+		sort.Strings(got)
+		return strings.Join(got, ",")
+	}
+	// Subscriber a matches twice but is only delivered to once.
+	require_Equal(t, deliver("foo.bar"), "a,b,c")
+	require_Equal(t, deliver("foo.bar.baz"), "a,c")
+	require_Equal(t, deliver("bar"), "c")
+
+	require_False(t, r.Unsubscribe(b("foo.*"), "b"))
+	require_True(t, r.Unsubscribe(b("foo.*"), "a"))
+	require_True(t, r.Unsubscribe(b("foo.bar"), "b"))
+	require_Equal(t, r.Filters(), 2)
+	require_Equal(t, r.Subscriptions(), 2)
+	require_Equal(t, deliver("foo.bar"), "a,c")
+
+	// The callback can modify the registry.
+	r.DeliverTo(b("foo.bar"), func(s string) { r.Unsubscribe(b(">"), s) })
+	require_Equal(t, deliver("foo.bar"), "a")
+}
+
 //-------------------
 //  Test for Matching Random Double PWC (Partial Wildcard)
 //-------------------
@@ -208,6 +1467,162 @@ func TestSubjectTreeMatchMultipleWildcardBasic(t *testing.T) {
 	match(t, st, "A.B.*.D.1.*.*.I.0", 1)
 }
 
+//-------------------
+//  Test for Matching Every Entry Once
+//-------------------
+
+// Test that overlapping wildcards never hand the same entry to the callback twice, whatever the shape of the
+// tree, by checking every way to match against a token by token model.
+func TestSubjectTreeMatchOnce(t *testing.T) {
+	rng := rand.New(rand.NewSource(7))
+	tokens := []string{"a", "ab", "abc", "x", "xy", "*", ">"}
+	random := func() []byte {
+		var parts []string
+		for n := 1 + rng.Intn(4); n > 0; n-- {
+			parts = append(parts, tokens[rng.Intn(len(tokens))])
+		}
+		return b(strings.Join(parts, "."))
+	}
+	// matches is the model, comparing the filter and the subject token by token.
+	matches := func(filter, subject []byte) bool {
+		ft, st := strings.Split(string(filter), "."), strings.Split(string(subject), ".")
+		for i, f := range ft {
+			if f == ">" {
+				return len(st) > i
+			}
+			if i >= len(st) || f != "*" && f != st[i] {
+				return false
+			}
+		}
+		return len(ft) == len(st)
+	}
+	for round := 0; round < 50; round++ {
+		st := NewSubjectTree[int](WithMaxPrefix(rng.Intn(3)))
+		for i := 0; i < 200; i++ {
+			st.Insert(random(), i)
+		}
+		fst, err := st.Freeze()
+		require_True(t, err == nil)
+		for f := 0; f < 50; f++ {
+			filter := random()
+			if !validFilter(filter) {
+				continue
+			}
+			var want []string
+			st.IterOrdered(func(subject []byte, _ *int) bool {
+				if matches(filter, subject) {
+					want = append(want, string(subject))
+				}
+				return true
+			})
+			check := func(how string, got []string) {
+				sort.Strings(got)
+				if strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Fatalf("%s of %q: expected %q, got %q", how, filter, want, got)
+				}
+			}
+			var got []string
+			st.Match(filter, func(subject []byte, _ *int) { got = append(got, string(subject)) })
+			check("Match", got)
+			got = nil
+			st.IterOrderedMatched(filter, func(subject []byte, _ *int) bool {
+				got = append(got, string(subject))
+				return true
+			})
+			check("IterOrderedMatched", got)
+			got = nil
+			fst.Match(filter, func(subject []byte, _ *int) { got = append(got, string(subject)) })
+			check("Freeze", got)
+			vals := make(map[*int]bool)
+			st.MatchValues(filter, func(val *int) {
+				require_False(t, vals[val])
+				vals[val] = true
+			})
+			require_Equal(t, len(vals), len(want))
+		}
+	}
+}
+
+//-------------------
+//  Test for MatchesSubject
+//-------------------
+
+// Test that MatchesSubject compares token by token, and that matching a tree agrees with it for tokens that
+// only partly look like wildcards, which used to match as wildcards once their start was matched.
+func TestSubjectTreeMatchesSubject(t *testing.T) {
+	for _, tc := range []struct {
+		filter, subject string
+		match           bool
+	}{
+		{"foo.bar", "foo.bar", true},
+		{"foo.bar", "foo.baz", false},
+		{"foo.*", "foo.bar", true},
+		{"foo.*", "foo.bar.baz", false},
+		{"*.bar", "foo.bar", true},
+		{"foo.>", "foo.bar.baz", true},
+		{"foo.>", "foo", false},
+		{">", "foo", true},
+		{"foo", "foo.bar", false},
+		{"foo.bar", "foo", false},
+		{"foo.b*", "foo.bar", false},
+		{"foo.b*", "foo.b*", true},
+		{"foo.>>", "foo.>", false},
+		{"foo.'*", "foo.'x", false},
+		{"foo.'*'", "foo.'*'", true},
+	} {
+		require_Equal(t, MatchesSubject(b(tc.filter), b(tc.subject)), tc.match)
+	}
+
+	rng := rand.New(rand.NewSource(11))
+	tokens := []string{"a", "ab", "*", ">", "a*", "*a", ">>", "'*", "*'", "'>'"}
+	random := func() []byte {
+		var parts []string
+		for n := 1 + rng.Intn(4); n > 0; n-- {
+			parts = append(parts, tokens[rng.Intn(len(tokens))])
+		}
+		return b(strings.Join(parts, "."))
+	}
+	for round := 0; round < 50; round++ {
+		st := NewSubjectTree[int](WithMaxPrefix(rng.Intn(3)))
+		for i := 0; i < 200; i++ {
+			st.Insert(random(), i)
+		}
+		fst, err := st.Freeze()
+		require_True(t, err == nil)
+		for f := 0; f < 50; f++ {
+			filter := random()
+			if !validFilter(filter) {
+				continue
+			}
+			var want []string
+			st.IterOrdered(func(subject []byte, _ *int) bool {
+				if MatchesSubject(filter, subject) {
+					want = append(want, string(subject))
+				}
+				return true
+			})
+			check := func(how string, got []string) {
+				sort.Strings(got)
+				if strings.Join(got, " ") != strings.Join(want, " ") {
+					t.Fatalf("%s of %q: expected %q, got %q", how, filter, want, got)
+				}
+			}
+			var got []string
+			st.Match(filter, func(subject []byte, _ *int) { got = append(got, string(subject)) })
+			check("Match", got)
+			got = nil
+			st.IterOrderedMatched(filter, func(subject []byte, _ *int) bool {
+				got = append(got, string(subject))
+				return true
+			})
+			check("IterOrderedMatched", got)
+			got = nil
+			fst.Match(filter, func(subject []byte, _ *int) { got = append(got, string(subject)) })
+			check("Freeze", got)
+		}
+	}
+}
+
 //-------------------
 //  Test for Long Tokens in SubjectTree
 //-------------------
@@ -266,6 +1681,33 @@ func TestSubjectTreeIterPerf(t *testing.T) {
 	t.Logf("Iter took %s and matched %d entries", time.Since(start), count)
 }
 
+//-------------------
+// Benchmark: Match versus MatchValues on a deep tree
+//-------------------
+
+// Benchmark matching with and without subject reconstruction.
+func BenchmarkSubjectTreeMatchValues(b *testing.B) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 10_000; i++ {
+		subj := fmt.Sprintf("one.two.three.four.five.six.%d.%d", i%100, i)
+		st.Insert([]byte(subj), i)
+	}
+	filter := []byte("one.two.three.four.five.six.*.>")
+
+	b.Run("Match", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			st.Match(filter, func(_ []byte, _ *int) {})
+		}
+	})
+	b.Run("MatchValues", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			st.MatchValues(filter, func(_ *int) {})
+		}
+	})
+}
+
 //-------------------
 //  Test Helper Functions
 //-------------------
@@ -22,6 +22,7 @@ type node interface {
 	children() []node                           // Returns the children of the node
 	numChildren() uint16                        // Returns the number of children the node has
 	path() []byte                               // Returns the path (or prefix) associated with the node
+	clone() node                                // Returns a shallow copy of the node for copy-on-write
 }
 
 //-------------------
@@ -31,7 +32,9 @@ type node interface {
 // The meta struct holds metadata about a node, specifically the prefix and the number of children it has.
 type meta struct {
 	prefix []byte // The prefix associated with this node
+	gen    uint64 // The copy-on-write generation that owns this node
 	size   uint16 // The number of children this node has
+	leaves uint32 // The number of leaves in the subtree below this node
 }
 
 //-------------------
@@ -55,6 +58,36 @@ func (n *meta) numChildren() uint16 { return n.size }
 // path returns the prefix of the node.
 func (n *meta) path() []byte { return n.prefix }
 
+// appendSorted appends the children with the given keys to nodes in subject order, sorting them by key
+// on the way. Nodes holding their children packed are small, so an insertion sort does just fine.
+func appendSorted(nodes []node, keys []byte, children []node) []node {
+	start := len(nodes)
+	nodes = append(nodes, children...)
+	var _keys [16]byte
+	ks, cs := append(_keys[:0], keys...), nodes[start:]
+	for i := 1; i < len(ks); i++ {
+		for j := i; j > 0 && keyRank(ks[j]) < keyRank(ks[j-1]); j-- {
+			ks[j], ks[j-1] = ks[j-1], ks[j]
+			cs[j], cs[j-1] = cs[j-1], cs[j]
+		}
+	}
+	return nodes
+}
+
+// leafCount returns the number of leaves in the subtree rooted at n, not counting lazily deleted ones.
+func leafCount(n node) uint32 {
+	if n == nil {
+		return 0
+	}
+	if bn := n.base(); bn != nil {
+		return bn.leaves
+	}
+	if ln, ok := n.(interface{ dead() bool }); ok && ln.dead() {
+		return 0
+	}
+	return 1
+}
+
 //-------------------
 // Meta Node Matching
 //-------------------
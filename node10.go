@@ -52,7 +52,10 @@ func (n *node10) isFull() bool { return n.size >= 10 }
 // grow converts this node10 into a node16 (a larger node type) when more children are needed.
 // It copies over the existing children to the new node16.
 func (n *node10) grow() node {
-	nn := newNode16(n.prefix) // Create a new node16 with the same prefix
+	nn := newNode16(nil) // Create a new node16
+	nn.prefix = n.prefix // Share the prefix, prefixes are never modified in place
+	nn.gen = n.gen       // Keep the same copy-on-write owner
+	nn.leaves = n.leaves // Same leaves below
 	for i := 0; i < 10; i++ {
 		nn.addChild(n.key[i], n.child[i]) // Add each child to the new node16
 	}
@@ -85,7 +88,9 @@ func (n *node10) shrink() node {
 	if n.size > 4 {
 		return nil // Return nil if shrinking is not possible (more than 4 children)
 	}
-	nn := newNode4(nil) // Create a new node4 with no prefix
+	nn := newNode4(nil)  // Create a new node4 with no prefix
+	nn.gen = n.gen       // Keep the same copy-on-write owner
+	nn.leaves = n.leaves // Same leaves below
 	for i := uint16(0); i < n.size; i++ {
 		nn.addChild(n.key[i], n.child[i]) // Add each child to the new node4
 	}
@@ -102,7 +107,18 @@ func (n *node10) iter(f func(node) bool) {
 	}
 }
 
+// appendChildren appends the children to nodes in subject order.
+func (n *node10) appendChildren(nodes []node) []node {
+	return appendSorted(nodes, n.key[:n.size], n.child[:n.size])
+}
+
 // children returns a slice containing all the child nodes.
 func (n *node10) children() []node {
 	return n.child[:n.size] // Return only the children that are currently in use (up to 'size')
 }
+
+// clone returns a shallow copy of the node. Children are shared with the original.
+func (n *node10) clone() node {
+	nn := *n
+	return &nn
+}
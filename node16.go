@@ -52,7 +52,10 @@ func (n *node16) isFull() bool { return n.size >= 16 }
 // grow converts this node16 into a node48 (a larger node type) when more children are needed.
 // It copies over the existing children to the new node48.
 func (n *node16) grow() node {
-	nn := newNode48(n.prefix) // Create a new node48 with the same prefix
+	nn := newNode48(nil) // Create a new node48
+	nn.prefix = n.prefix // Share the prefix, prefixes are never modified in place
+	nn.gen = n.gen       // Keep the same copy-on-write owner
+	nn.leaves = n.leaves // Same leaves below
 	for i := 0; i < 16; i++ {
 		nn.addChild(n.key[i], n.child[i]) // Add each child to the new node48
 	}
@@ -86,6 +89,8 @@ func (n *node16) shrink() node {
 		return nil // Return nil if shrinking is not possible (more than 10 children)
 	}
 	nn := newNode10(nil) // Create a new node10 with no prefix
+	nn.gen = n.gen       // Keep the same copy-on-write owner
+	nn.leaves = n.leaves // Same leaves below
 	for i := uint16(0); i < n.size; i++ {
 		nn.addChild(n.key[i], n.child[i]) // Add each child to the new node10
 	}
@@ -102,7 +107,18 @@ func (n *node16) iter(f func(node) bool) {
 	}
 }
 
+// appendChildren appends the children to nodes in subject order.
+func (n *node16) appendChildren(nodes []node) []node {
+	return appendSorted(nodes, n.key[:n.size], n.child[:n.size])
+}
+
 // children returns a slice containing all the child nodes.
 func (n *node16) children() []node {
 	return n.child[:n.size] // Return only the children that are currently in use (up to 'size')
 }
+
+// clone returns a shallow copy of the node. Children are shared with the original.
+func (n *node16) clone() node {
+	nn := *n
+	return &nn
+}
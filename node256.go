@@ -1,5 +1,7 @@
 package subtree
 
+import "math/bits"
+
 //-------------------
 // Node256 Definition
 //-------------------
@@ -7,10 +9,12 @@ package subtree
 // node256 represents a node with up to 256 possible children. It is designed for situations
 // where the node needs to support a larger number of children without requiring additional
 // memory optimizations. The child array is directly indexed by the byte value of the key.
+// An occupancy bitmap lets iteration skip empty slots instead of checking all 256 of them.
 // The struct is optimized for memory alignment according to govet/fieldalignment recommendations.
 type node256 struct {
 	child [256]node // Array of child nodes (up to 256 children)
 	meta            // Inherited metadata (prefix and size)
+	bits  [4]uint64 // Occupancy bitmap, bit c is set when child[c] is present
 }
 
 //-------------------
@@ -27,8 +31,9 @@ func newNode256(prefix []byte) *node256 {
 // addChild adds a child node to the current node. The child is indexed by the byte value of its key.
 // This method directly stores the child in the array at the position corresponding to the key.
 func (n *node256) addChild(c byte, nn node) {
-	n.child[c] = nn // Store the child node at the index corresponding to the key
-	n.size++        // Increment the size to reflect the added child
+	n.child[c] = nn               // Store the child node at the index corresponding to the key
+	n.bits[c>>6] |= 1 << (c & 63) // Mark the slot as occupied
+	n.size++                      // Increment the size to reflect the added child
 }
 
 // findChild looks for a child node by its key (byte). If found, it returns a pointer to the child node.
@@ -51,8 +56,9 @@ func (n *node256) grow() node {
 // deleteChild removes a child node by its key. It sets the child at the given index to nil and reduces the size.
 func (n *node256) deleteChild(c byte) {
 	if n.child[c] != nil {
-		n.child[c] = nil // Remove the child by setting it to nil
-		n.size--         // Decrease the size to reflect the removal
+		n.child[c] = nil               // Remove the child by setting it to nil
+		n.bits[c>>6] &^= 1 << (c & 63) // Mark the slot as empty
+		n.size--                       // Decrease the size to reflect the removal
 	}
 }
 
@@ -63,10 +69,10 @@ func (n *node256) shrink() node {
 		return nil // Return nil if shrinking is not possible (more than 48 children)
 	}
 	nn := newNode48(nil) // Create a new node48 with no prefix
-	for c, child := range n.child {
-		if child != nil {
-			nn.addChild(byte(c), child) // Add each non-nil child to the new node48
-		}
+	nn.gen = n.gen       // Keep the same copy-on-write owner
+	nn.leaves = n.leaves // Same leaves below
+	for c := n.next(0); c < 256; c = n.next(c + 1) {
+		nn.addChild(byte(c), n.child[c]) // Add each present child to the new node48
 	}
 	return nn // Return the newly shrunk node (node48)
 }
@@ -74,16 +80,48 @@ func (n *node256) shrink() node {
 // iter iterates over all children nodes and applies the function f to each of them.
 // If the function returns false, the iteration stops.
 func (n *node256) iter(f func(node) bool) {
-	for i := 0; i < 256; i++ {
-		if n.child[i] != nil { // Only call the function for non-nil children
-			if !f(n.child[i]) { // Stop iteration if the function returns false
-				return
-			}
+	for c := n.next(0); c < 256; c = n.next(c + 1) {
+		if !f(n.child[c]) { // Stop iteration if the function returns false
+			return
+		}
+	}
+}
+
+// next returns the first key at or after c with a child present, or 256 if there is none.
+func (n *node256) next(c int) int {
+	for w := c >> 6; w < 4; w++ {
+		word := n.bits[w]
+		if w == c>>6 {
+			word &= ^uint64(0) << (c & 63) // Ignore the keys before c in the first word
+		}
+		if word != 0 {
+			return w<<6 + bits.TrailingZeros64(word)
 		}
 	}
+	return 256
+}
+
+// appendChildren appends the children to nodes in subject order, which is key order except for the
+// child without a pivot that sorts first.
+func (n *node256) appendChildren(nodes []node) []node {
+	if cn := n.child[noPivot]; cn != nil {
+		nodes = append(nodes, cn)
+	}
+	for c := n.next(0); c < 256; c = n.next(c + 1) {
+		if c != int(noPivot) {
+			nodes = append(nodes, n.child[c])
+		}
+	}
+	return nodes
 }
 
 // children returns a slice containing all the child nodes. This includes all 256 slots, even if some are nil.
 func (n *node256) children() []node {
 	return n.child[:256] // Return all children (up to 256)
 }
+
+// clone returns a shallow copy of the node. Children are shared with the original.
+func (n *node256) clone() node {
+	nn := *n
+	return &nn
+}
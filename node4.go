@@ -51,7 +51,10 @@ func (n *node4) isFull() bool { return n.size >= 4 }
 // grow converts this node4 into a node10 (a larger node type) when more children are needed.
 // It copies over the existing children to the new node10.
 func (n *node4) grow() node {
-	nn := newNode10(n.prefix) // Create a new node10 with the same prefix
+	nn := newNode10(nil) // Create a new node10
+	nn.prefix = n.prefix // Share the prefix, prefixes are never modified in place
+	nn.gen = n.gen       // Keep the same copy-on-write owner
+	nn.leaves = n.leaves // Same leaves below
 	for i := 0; i < 4; i++ {
 		nn.addChild(n.key[i], n.child[i]) // Add each child to the new node10
 	}
@@ -97,7 +100,18 @@ func (n *node4) iter(f func(node) bool) {
 	}
 }
 
+// appendChildren appends the children to nodes in subject order.
+func (n *node4) appendChildren(nodes []node) []node {
+	return appendSorted(nodes, n.key[:n.size], n.child[:n.size])
+}
+
 // children returns a slice containing all the child nodes.
 func (n *node4) children() []node {
 	return n.child[:n.size] // Return only the children that are currently in use (up to 'size')
 }
+
+// clone returns a shallow copy of the node. Children are shared with the original.
+func (n *node4) clone() node {
+	nn := *n
+	return &nn
+}
@@ -53,7 +53,10 @@ func (n *node48) isFull() bool { return n.size >= 48 }
 // grow converts this node48 into a node256 (a larger node type) when more children are needed.
 // It copies over the existing children to the new node256.
 func (n *node48) grow() node {
-	nn := newNode256(n.prefix) // Create a new node256 with the same prefix
+	nn := newNode256(nil) // Create a new node256
+	nn.prefix = n.prefix  // Share the prefix, prefixes are never modified in place
+	nn.gen = n.gen        // Keep the same copy-on-write owner
+	nn.leaves = n.leaves  // Same leaves below
 	for c := 0; c < len(n.key); c++ {
 		if i := n.key[byte(c)]; i > 0 {
 			nn.addChild(byte(c), n.child[i-1]) // Add each child to the new node256
@@ -92,6 +95,8 @@ func (n *node48) shrink() node {
 		return nil // Return nil if shrinking is not possible (more than 16 children)
 	}
 	nn := newNode16(nil) // Create a new node16 with no prefix
+	nn.gen = n.gen       // Keep the same copy-on-write owner
+	nn.leaves = n.leaves // Same leaves below
 	for c := 0; c < len(n.key); c++ {
 		if i := n.key[byte(c)]; i > 0 {
 			nn.addChild(byte(c), n.child[i-1]) // Add each child to the new node16
@@ -110,7 +115,27 @@ func (n *node48) iter(f func(node) bool) {
 	}
 }
 
+// appendChildren appends the children to nodes in subject order, which is key order except for the
+// child without a pivot that sorts first.
+func (n *node48) appendChildren(nodes []node) []node {
+	if i := n.key[noPivot]; i > 0 {
+		nodes = append(nodes, n.child[i-1])
+	}
+	for c, i := range n.key {
+		if i > 0 && byte(c) != noPivot {
+			nodes = append(nodes, n.child[i-1])
+		}
+	}
+	return nodes
+}
+
 // children returns a slice containing all the child nodes.
 func (n *node48) children() []node {
 	return n.child[:n.size] // Return only the children that are currently in use (up to 'size')
 }
+
+// clone returns a shallow copy of the node. Children are shared with the original.
+func (n *node48) clone() node {
+	nn := *n
+	return &nn
+}
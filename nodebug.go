@@ -0,0 +1,17 @@
+//go:build !subtree_debug
+
+package subtree
+
+// debugChecks is not set without the subtree_debug tag, so the checks after every modification compile away.
+const debugChecks = false
+
+// debugCheck does nothing without the subtree_debug tag.
+func (t *SubjectTree[T]) debugCheck(op string) {}
+
+// matchOnce is never called without the subtree_debug tag.
+func matchOnce[T any](filter []byte) func(val *T) { return nil }
+
+// matchConsistent is never called without the subtree_debug tag.
+func (t *SubjectTree[T]) matchConsistent(filter []byte) (visit func(val *T), done func()) {
+	return nil, nil
+}
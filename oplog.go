@@ -0,0 +1,126 @@
+package subtree
+
+import (
+	"errors"
+	"fmt"
+)
+
+//-------------------
+// Operation log
+//-------------------
+
+// Op identifies a modification of the tree as reported to an op logger.
+type Op uint8
+
+const (
+	OpInsert Op = iota + 1 // A new subject was inserted
+	OpUpdate               // The value of an existing subject was replaced
+	OpDelete               // A subject was deleted
+	OpEmpty                // All subjects were removed
+)
+
+// ErrInvalidOp is returned by ApplyOp when the op can not be applied.
+var ErrInvalidOp = errors.New("subtree: invalid op")
+
+// String returns the name of the op.
+func (op Op) String() string {
+	switch op {
+	case OpInsert:
+		return "INSERT"
+	case OpUpdate:
+		return "UPDATE"
+	case OpDelete:
+		return "DELETE"
+	case OpEmpty:
+		return "EMPTY"
+	}
+	return fmt.Sprintf("Op(%d)", uint8(op))
+}
+
+// SetOpLogger registers a function that will be called after every successful modification of the tree.
+// For inserts and updates the value is the new value, for deletes it is the removed value, and for OpEmpty
+// both subject and value are nil. The subject is only valid for the duration of the call.
+// Replaying the ops in order on another tree with ApplyOp will keep it in sync. A nil logger disables logging.
+func (t *SubjectTree[T]) SetOpLogger(logger func(op Op, subject []byte, v *T)) {
+	if t == nil {
+		return
+	}
+	t.oplog = logger
+}
+
+// logging returns true if modifications have to be reported to logOp.
+func (t *SubjectTree[T]) logging() bool {
+	return t.oplog != nil || t.recorder != nil || t.indexed() || t.churn != nil
+}
+
+// logOp reports a modification to the indexes, the churn counts, the recorder and the op logger.
+func (t *SubjectTree[T]) logOp(op Op, subject []byte, v *T) {
+	if t.indexed() {
+		t.indexLogged(op, subject)
+	}
+	if t.churn != nil && op != OpEmpty {
+		// Empty counts the subjects it removes itself.
+		t.churn.record(op, 1)
+	}
+	if t.recorder != nil {
+		// A nil value has to stay a nil any, for the recorder to tell there is none.
+		if v != nil {
+			t.recorder.recordOp(op, subject, v)
+		} else {
+			t.recorder.recordOp(op, subject, nil)
+		}
+	}
+	if t.oplog != nil {
+		t.oplog(op, subject, v)
+	}
+}
+
+// indexed returns true if the tree keeps indexes of its subjects next to the nodes.
+func (t *SubjectTree[T]) indexed() bool {
+	return t.suffixes != nil || t.tokens != nil
+}
+
+// indexLogged updates the indexes for a modification of the tree.
+func (t *SubjectTree[T]) indexLogged(op Op, subject []byte) {
+	if t.suffixes != nil {
+		t.suffixLogged(op, subject)
+	}
+	if t.tokens != nil {
+		t.tokens.logged(op, subject)
+	}
+}
+
+// indexAdopted adds the subjects below the node n, with path as its full path, to the indexes. They were
+// moved into the tree without being logged.
+func (t *SubjectTree[T]) indexAdopted(path []byte, n node) {
+	if !t.indexed() {
+		return
+	}
+	var _pre [256]byte
+	pre := append(_pre[:0], path[:len(path)-len(n.path())]...)
+	t.iter(n, pre, false, func(subject []byte, _ *T) bool {
+		t.indexLogged(OpInsert, subject)
+		return true
+	})
+}
+
+// ApplyOp applies an op as reported by an op logger to this tree.
+func (t *SubjectTree[T]) ApplyOp(op Op, subject []byte, v *T) error {
+	if t == nil {
+		return ErrInvalidOp
+	}
+	switch op {
+	case OpInsert, OpUpdate:
+		if v == nil || len(subject) == 0 {
+			return fmt.Errorf("%w: %v requires a subject and value", ErrInvalidOp, op)
+		}
+		t.Insert(subject, *v)
+	case OpDelete:
+		t.Delete(subject)
+	case OpEmpty:
+		t.Empty()
+	default:
+		return fmt.Errorf("%w: %v", ErrInvalidOp, op)
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package subtree
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+)
+
+//-------------------
+// Tree options
+//-------------------
+
+// ErrInvalidOption is what NewSubjectTree panics with, wrapped, for options with invalid or contradicting
+// settings, and what ValidateOptions returns.
+var ErrInvalidOption = errors.New("subtree: invalid option")
+
+// Option configures a SubjectTree when it is created with NewSubjectTree. Options are checked when the tree
+// is created, and Config reports the settings in effect. What can be turned on and off over the lifetime of
+// a tree is set through its methods instead: SetOpLogger, SetRecorder, SetSealed, SetCheckValueWrites,
+// SetInterner, SetVersionRetention and EnableLWW.
+type Option func(*options)
+
+// options holds the settings applied by Option functions.
+type options struct {
+	shrinkSlack    int               // Extra children to lose below the next smaller node kind before shrinking
+	lazyDelete     bool              // Mark deleted leaves dead and leave restructuring to Compact
+	compactAt      float64           // Fraction of dead leaves that triggers a compaction, 0 for never
+	equals         any               // Value equality from WithValueEquals, a func(a, b T) bool
+	stable         bool              // Hand callbacks copies of subjects that are safe to retain
+	recover        bool              // Recover from panics caused by a corrupted tree
+	panicHook      PanicHook         // Called for every recovered panic
+	maxPrefix      int               // Longest prefix held by a node before chaining, 0 for no limit
+	entryIDs       bool              // Give every entry an ID and index them
+	hotDepth       int               // Tokens of the prefixes to track matches for, 0 for no tracking
+	hotHalfLife    time.Duration     // Time for tracked match counts to decay by half
+	latency        LatencyHook       // Called with the duration of every call
+	sink           EventSink         // Receives structural events
+	stripes        int               // Stripes of a SafeSubjectTree, each locked on its own
+	writeBatch     int               // Writes a SafeSubjectTree applies at once
+	readerGrace    time.Duration     // Time a match on a SafeSubjectTree keeps waiting writers out
+	fold           bool              // Case fold and normalize subjects and filters
+	rewrites       map[string]string // Tokens to replace in subjects and filters
+	suffixIndex    bool              // Keep the subjects with reversed tokens for MatchSuffix
+	tokenPositions []int             // Positions of tokens to index for MatchTokenAt
+	churnInterval  time.Duration     // Length of the intervals to count modifications in, 0 for no counting
+	churnKeep      int               // Number of recent intervals to keep counts for
+	dedup          any               // Value hashing and equality from WithValueDedup, a valueDedup[T]
+	clock          Clock             // Source of the time, nil for the system clock
+	errs           []error           // Invalid settings found by the options
+}
+
+// ValidateOptions returns an error wrapping ErrInvalidOption for each invalid setting of the options or
+// combination of them, or nil if NewSubjectTree would accept them. Options only valid for some value
+// types are checked by NewSubjectTreeE, which returns the same errors for them.
+func ValidateOptions(opts ...Option) error {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.validate()
+}
+
+// invalid records an invalid setting, to be reported when the tree is created.
+func (o *options) invalid(format string, args ...any) {
+	o.errs = append(o.errs, fmt.Errorf("%w: "+format, append([]any{ErrInvalidOption}, args...)...))
+}
+
+// checkValueTypes records the options given functions for another value type than T, which only a tree
+// with values T can tell.
+func checkValueTypes[T any](o *options) {
+	if _, ok := o.equals.(func(a, b T) bool); o.equals != nil && !ok {
+		o.invalid("WithValueEquals of %T used for values of type %T", o.equals, *new(T))
+	}
+	if _, ok := o.dedup.(valueDedup[T]); o.dedup != nil && !ok {
+		o.invalid("WithValueDedup of %T used for values of type %T", o.dedup, *new(T))
+	}
+}
+
+// validate returns the invalid settings recorded by the options and those only invalid in combination.
+func (o *options) validate() error {
+	errs := o.errs
+	errs = append(errs, checkRewrites(o.rewriteTable())...)
+	if o.compactAt > 0 && !o.lazyDelete {
+		errs = append(errs, fmt.Errorf("%w: WithCompactThreshold without WithLazyDelete", ErrInvalidOption))
+	}
+	return errors.Join(errs...)
+}
+
+// WithShrinkHysteresis delays shrinking a node to the next smaller kind until it has slack fewer children
+// than that kind can hold. By default a node shrinks as soon as its children fit in the smaller kind, and
+// a workload that keeps adding and removing a child around that boundary grows and shrinks the node on
+// every change. A node down to a single child is always collapsed regardless of the slack.
+func WithShrinkHysteresis(slack int) Option {
+	return func(o *options) {
+		if slack < 0 {
+			o.invalid("WithShrinkHysteresis of negative slack %d", slack)
+		}
+		o.shrinkSlack = max(slack, 0)
+	}
+}
+
+// WithValueEquals sets how values are compared when a subject is inserted again. An insert of a value equal
+// to the stored one is a no-op: the tree is not modified, its version does not change and nothing is logged,
+// so op logs and anything watching them see no spurious updates. Insert still reports the entry as updated,
+// InsertChanged tells the two apart. The function must be for the value type of the tree, or the option is invalid.
+func WithValueEquals[T any](eq func(a, b T) bool) Option {
+	return func(o *options) {
+		o.equals = eq
+	}
+}
+
+// WithStableCallbacksSubjects hands the callbacks of Match, IterOrdered, IterFast, ReverseMatch and their
+// variants a copy of the subject that is safe to retain after the callback returns. By default the subject
+// is a buffer reused for the next entry, so retaining it without copying sees it change under you.
+// This costs an allocation per entry handed to a callback.
+func WithStableCallbacksSubjects() Option {
+	return func(o *options) {
+		o.stable = true
+	}
+}
+
+// shrinkCap returns the number of children the next smaller kind of n can hold, or 0 for a node4
+// which does not shrink into another kind.
+func shrinkCap(n node) int {
+	switch n.(type) {
+	case *node10:
+		return 4
+	case *node16:
+		return 10
+	case *node48:
+		return 16
+	case *node256:
+		return 48
+	}
+	return 0
+}
+
+// shrink returns the node n should be replaced with after losing a child, or nil to keep n.
+// This applies the configured hysteresis on top of the node's own shrink.
+func (t *SubjectTree[T]) shrink(n node) node {
+	nc := int(n.numChildren())
+	if t.chained(n.base().prefix, n) {
+		return nil
+	}
+	if slack := t.opts.shrinkSlack; slack > 0 && nc > 1 {
+		if lower := shrinkCap(n); lower > 0 && nc > lower-slack {
+			return nil
+		}
+	}
+	sn := t.shrunk(n, n.shrink())
+	// With hysteresis we can shrink from a larger kind straight down to a single child, so keep
+	// going until that child is collapsed into its parent as well. Only the smaller kinds have no prefix,
+	// a node4 shrinks to its child which may be a chain node holding a single child itself.
+	for sn != nil && !sn.isLeaf() && sn.numChildren() == 1 && len(sn.base().prefix) == 0 {
+		sn = t.shrunk(sn, sn.shrink())
+	}
+	return sn
+}
+
+// Config reports the settings a tree works with, as set by the options it was created with.
+type Config struct {
+	ShrinkSlack      int               // From WithShrinkHysteresis
+	LazyDelete       bool              // From WithLazyDelete
+	CompactThreshold float64           // From WithCompactThreshold, 0 for no automatic compaction
+	ValueEquals      bool              // Whether an equality function was given WithValueEquals
+	StableSubjects   bool              // From WithStableCallbacksSubjects
+	Recover          bool              // From WithRecover or WithPanicHook
+	MaxPrefix        int               // From WithMaxPrefix, 0 for no limit
+	EntryIDs         bool              // From WithEntryIDs
+	HotPrefixDepth   int               // From WithHotPrefixes, 0 for no tracking
+	HotHalfLife      time.Duration     // From WithHotPrefixes
+	LatencyHook      bool              // Whether a hook was given WithLatencyHook
+	EventSink        bool              // Whether a sink was given WithEventSink
+	Stripes          int               // Stripes of a SafeSubjectTree, 1 for a SubjectTree
+	WriteBatch       int               // From WithWriteBatching for a SafeSubjectTree, 0 for none
+	ReaderGrace      time.Duration     // From WithReaderGrace for a SafeSubjectTree, 0 for none
+	UnicodeFold      bool              // From WithUnicodeFold
+	TokenRewrites    map[string]string // From WithTokenRewrites, folded WithUnicodeFold
+	SuffixIndex      bool              // From WithSuffixIndex
+	TokenIndex       []int             // Positions indexed WithTokenIndex
+	ChurnInterval    time.Duration     // From WithChurnRates, 0 for no counting
+	ChurnIntervals   int               // Number of intervals kept WithChurnRates
+	ValueDedup       bool              // From WithValueDedup
+	Clock            Clock             // From WithClock, nil for the system clock
+}
+
+// config returns the settings of the options, as they apply to a SubjectTree.
+func (o *options) config() Config {
+	return Config{
+		ShrinkSlack:      o.shrinkSlack,
+		LazyDelete:       o.lazyDelete,
+		CompactThreshold: o.compactAt,
+		ValueEquals:      o.equals != nil,
+		StableSubjects:   o.stable,
+		Recover:          o.recover,
+		MaxPrefix:        o.maxPrefix,
+		EntryIDs:         o.entryIDs,
+		HotPrefixDepth:   o.hotDepth,
+		HotHalfLife:      o.hotHalfLife,
+		LatencyHook:      o.latency != nil,
+		EventSink:        o.sink != nil,
+		Stripes:          1,
+		UnicodeFold:      o.fold,
+		TokenRewrites:    maps.Clone(o.rewrites),
+		SuffixIndex:      o.suffixIndex,
+		TokenIndex:       slices.Clone(o.tokenPositions),
+		ChurnInterval:    o.churnInterval,
+		ChurnIntervals:   o.churnKeep,
+		ValueDedup:       o.dedup != nil,
+		Clock:            o.clock,
+	}
+}
+
+// Config returns the settings the tree works with.
+func (t *SubjectTree[T]) Config() Config {
+	if t == nil {
+		var o options
+		return o.config()
+	}
+	return t.opts.config()
+}
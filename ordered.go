@@ -0,0 +1,354 @@
+package subtree
+
+import (
+	"bytes"
+	"slices"
+	"time"
+)
+
+//-------------------
+// Matching in subject order
+//-------------------
+
+// IterOrderedMatched will walk all entries matching the filter in subject order. The callback can return false
+// to terminate the walk. Like Match only the parts of the tree that can match are visited, and like IterOrdered
+// the subject is only valid for the duration of the callback.
+func (t *SubjectTree[T]) IterOrderedMatched(filter []byte, cb func(subject []byte, val *T) bool) {
+	if t == nil || cb == nil {
+		return
+	}
+	t.recordMatch(filter)
+	t.matchOrdered(filter, nil, t.guardIter(cb))
+}
+
+// Internal function to match a filter in subject order, handing the callback pointers to the stored values.
+// When after is not nil only subjects sorting after it are visited, skipping whole subtrees before it.
+// The callback can return false to stop the match.
+func (t *SubjectTree[T]) matchOrdered(filter, after []byte, cb func(subject []byte, val *T) bool) {
+	filter = t.canon(filter)
+	visit, visited := t.observeMatch(filter)
+	if t == nil || t.root == nil || len(filter) == 0 || cb == nil {
+		return
+	}
+	if visit != nil {
+		defer visited()
+		inner := cb
+		cb = func(subject []byte, val *T) bool {
+			visit(subject)
+			return inner(subject, val)
+		}
+	}
+	if hook := t.opts.latency; hook != nil {
+		var n int
+		inner := cb
+		cb = func(subject []byte, val *T) bool {
+			n++
+			return inner(subject, val)
+		}
+		defer func(start time.Time) { hook(CallMatch, t.opts.since(start), n) }(t.opts.now())
+	}
+	if debugChecks {
+		once, inner := matchOnce[T](filter), cb
+		cb = func(subject []byte, val *T) bool {
+			once(val)
+			return inner(subject, val)
+		}
+	}
+	var raw [16][]byte
+	parts := genParts(filter, raw[:0])
+	pre := preBufs.Get().(*[256]byte)
+	defer preBufs.Put(pre)
+	t.matchSorted(t.root, parts, pre[:0], after, 0, nil, cb)
+}
+
+// before returns true if every subject starting with path sorts before after, or is equal to it for a leaf.
+func before(path, after []byte, leaf bool) bool {
+	if after == nil {
+		return false
+	}
+	if leaf {
+		return bytes.Compare(path, after) <= 0
+	}
+	k := min(len(path), len(after))
+	return bytes.Compare(path[:k], after[:k]) < 0
+}
+
+// Internal recursive match function visiting children in subject order. Follows the same logic as match.
+// When prune is not nil it is asked about every matching internal node at the given depth before it is entered.
+// Returns false if the callback asked to stop.
+func (t *SubjectTree[T]) matchSorted(n node, parts [][]byte, pre, after []byte, depth int, prune func(depth int, prefix []byte) bool, cb func(subject []byte, val *T) bool) bool {
+	// Note that this append may reallocate, but it doesn't modify "pre" at the callsite.
+	path := append(pre, n.path()...)
+	if before(path, after, n.isLeaf()) {
+		return true
+	}
+	// Capture if we are sitting on a terminal fwc.
+	var hasFWC bool
+	if lp := len(parts); lp > 0 && isFWC(parts[lp-1]) {
+		hasFWC = true
+	}
+	nparts, matched := n.matchParts(parts)
+	if !matched {
+		return true
+	}
+	// Let the caller cut off this subtree.
+	if prune != nil && !n.isLeaf() && prune(depth, path) {
+		return true
+	}
+	// If we are a leaf and have exhausted all parts or have a FWC fire callback.
+	if n.isLeaf() {
+		if ln := n.(*leaf[T]); !ln.dead() && (len(nparts) == 0 || (hasFWC && len(nparts) == 1)) {
+			return cb(path, &ln.value)
+		}
+		return true
+	}
+	pre = path
+	var _nodes [256]node
+	// Check our remaining parts.
+	if len(nparts) == 0 && !hasFWC {
+		// We could have a leaf with no suffix which would be a match, or a terminal pwc.
+		var hasTermPWC bool
+		if lp := len(parts); lp > 0 && isPWC(parts[lp-1]) {
+			nparts = parts[len(parts)-1:]
+			hasTermPWC = true
+		}
+		for _, cn := range sortedChildren(n, _nodes[:0]) {
+			if cn.isLeaf() {
+				ln := cn.(*leaf[T])
+				if ln.dead() || (len(ln.suffix) > 0 && (!hasTermPWC || bytes.IndexByte(ln.suffix, tsep) >= 0)) {
+					continue
+				}
+				if subject := append(pre, ln.suffix...); !before(subject, after, true) && !cb(subject, &ln.value) {
+					return false
+				}
+			} else if hasTermPWC && !t.matchSorted(cn, nparts, pre, after, depth+1, prune, cb) {
+				return false
+			}
+		}
+		return true
+	}
+	// If we are sitting on a terminal fwc, put back and continue.
+	if hasFWC && len(nparts) == 0 {
+		nparts = parts[len(parts)-1:]
+	}
+	// Check if the first part is a wildcard, which means we need to look at all children.
+	fp := nparts[0]
+	p := pivot(fp, 0)
+	if isPWC(fp) || isFWC(fp) {
+		for _, cn := range sortedChildren(n, _nodes[:0]) {
+			if !t.matchSorted(cn, nparts, pre, after, depth+1, prune, cb) {
+				return false
+			}
+		}
+		return true
+	}
+	// Here we have normal traversal, so find the next child.
+	nn := n.findChild(p)
+	if nn == nil {
+		return true
+	}
+	return t.matchSorted(*nn, nparts, pre, after, depth+1, prune, cb)
+}
+
+//-------------------
+// Matching with pruning
+//-------------------
+
+// MatchWithPruner will match all entries to the filter like Match, but lets the caller cut off whole subtrees
+// during the walk, e.g. for access checks or tenancy boundaries. Before a matching internal node is entered prune is
+// called with its depth, the root being at 0, and the subject prefix leading to and including the node's prefix.
+// If prune returns true nothing below that node is visited. The prefix is only valid for the duration of the call.
+// Matches are visited in subject order.
+func (t *SubjectTree[T]) MatchWithPruner(filter []byte, prune func(depth int, prefix []byte) bool, cb func(subject []byte, val *T)) {
+	t.recordMatch(filter)
+	filter = t.canon(filter)
+	visit, visited := t.observeMatch(filter)
+	if t == nil || t.root == nil || len(filter) == 0 || cb == nil {
+		return
+	}
+	if visit != nil {
+		defer visited()
+		inner := cb
+		cb = func(subject []byte, val *T) {
+			visit(subject)
+			inner(subject, val)
+		}
+	}
+	if debugChecks {
+		once, inner := matchOnce[T](filter), cb
+		cb = func(subject []byte, val *T) {
+			once(val)
+			inner(subject, val)
+		}
+	}
+	var raw [16][]byte
+	parts := genParts(filter, raw[:0])
+	pre := preBufs.Get().(*[256]byte)
+	defer preBufs.Put(pre)
+	cb = t.guardMatch(cb)
+	if hook := t.opts.latency; hook != nil {
+		var n int
+		cb = countMatches(&n, cb)
+		defer func(start time.Time) { hook(CallMatch, t.opts.since(start), n) }(t.opts.now())
+	}
+	t.matchSorted(t.root, parts, pre[:0], nil, 0, prune, func(subject []byte, val *T) bool {
+		cb(subject, val)
+		return true
+	})
+}
+
+//-------------------
+// Matching with a deadline
+//-------------------
+
+// MatchDeadline will match all entries to the filter like Match, but stops once d has passed and returns false
+// to tell the matches are incomplete. Matches are visited in subject order, so a partial result is always the
+// leading part of the full one. The deadline is checked during the walk, not only between matches, so a filter
+// that matches little in a large tree stops on time as well.
+func (t *SubjectTree[T]) MatchDeadline(filter []byte, d time.Duration, cb func(subject []byte, val *T)) bool {
+	t.recordMatch(filter)
+	filter = t.canon(filter)
+	visit, visited := t.observeMatch(filter)
+	if t == nil || t.root == nil || len(filter) == 0 || cb == nil {
+		return true
+	}
+	if visit != nil {
+		defer visited()
+		inner := cb
+		cb = func(subject []byte, val *T) {
+			visit(subject)
+			inner(subject, val)
+		}
+	}
+	deadline := t.opts.now().Add(d)
+	var expired bool
+	var checks int
+	// Reading the clock is not free, so only do it every few steps.
+	past := func() bool {
+		if !expired && checks&15 == 0 && !t.opts.now().Before(deadline) {
+			expired = true
+		}
+		checks++
+		return expired
+	}
+	if debugChecks {
+		once, inner := matchOnce[T](filter), cb
+		cb = func(subject []byte, val *T) {
+			once(val)
+			inner(subject, val)
+		}
+	}
+	var raw [16][]byte
+	parts := genParts(filter, raw[:0])
+	pre := preBufs.Get().(*[256]byte)
+	defer preBufs.Put(pre)
+	cb = t.guardMatch(cb)
+	if hook := t.opts.latency; hook != nil {
+		var n int
+		cb = countMatches(&n, cb)
+		defer func(start time.Time) { hook(CallMatch, t.opts.since(start), n) }(t.opts.now())
+	}
+	t.matchSorted(t.root, parts, pre[:0], nil, 0, func(int, []byte) bool {
+		return past()
+	}, func(subject []byte, val *T) bool {
+		cb(subject, val)
+		return !past()
+	})
+	return !expired
+}
+
+//-------------------
+// Matching in value order with a limit
+//-------------------
+
+// MatchOrdered invokes the callback for the first limit entries matching the filter, in the order given by cmp
+// on their values and by subject for values comparing equal. The callback can return false to stop.
+// Only limit candidates are kept while matching, in a bounded heap, so for m matches this takes O(m log limit)
+// time and O(limit) memory however many entries match, instead of sorting all of them. With a nil cmp the
+// entries come in subject order straight from an ordered walk that ends after limit matches. A limit of 0 or
+// less keeps every match. The value pointers have the same semantics as for Match, and the subject is only
+// valid for the duration of the callback.
+func (t *SubjectTree[T]) MatchOrdered(filter []byte, limit int, cmp func(a, b *T) int, cb func(subject []byte, val *T) bool) {
+	if t == nil || cb == nil {
+		return
+	}
+	if cmp == nil {
+		var n int
+		t.matchOrdered(filter, nil, t.guardIter(func(subject []byte, val *T) bool {
+			n++
+			return cb(subject, val) && (limit <= 0 || n < limit)
+		}))
+		return
+	}
+	h := topHeap[T]{limit: limit, cmp: cmp}
+	t.matchFilter(filter, true, t.guardMatch(h.offer))
+	slices.SortFunc(h.entries, h.compare)
+	for i := range h.entries {
+		if !cb(h.entries[i].Subject, h.entries[i].Value) {
+			return
+		}
+	}
+}
+
+// topHeap keeps the limit entries sorting first, as a heap with the entry sorting last at the top.
+type topHeap[T any] struct {
+	entries []Entry[*T]
+	limit   int
+	cmp     func(a, b *T) int
+}
+
+// compare orders entries by value and then by subject.
+func (h *topHeap[T]) compare(a, b Entry[*T]) int {
+	if c := h.cmp(a.Value, b.Value); c != 0 {
+		return c
+	}
+	return bytes.Compare(a.Subject, b.Subject)
+}
+
+// offer adds a match if the heap is not full yet or it sorts before the top, which it then replaces.
+func (h *topHeap[T]) offer(subject []byte, val *T) {
+	if h.limit <= 0 || len(h.entries) < h.limit {
+		h.entries = append(h.entries, Entry[*T]{Subject: copyBytes(subject), Value: val})
+		if h.limit > 0 {
+			h.up(len(h.entries) - 1)
+		}
+		return
+	}
+	top := &h.entries[0]
+	if h.compare(Entry[*T]{Subject: subject, Value: val}, *top) >= 0 {
+		return
+	}
+	// Reuse the subject of the entry dropped.
+	top.Subject, top.Value = append(top.Subject[:0], subject...), val
+	h.down(0)
+}
+
+// up moves the entry at i towards the top while it sorts after its parent.
+func (h *topHeap[T]) up(i int) {
+	for i > 0 {
+		p := (i - 1) / 2
+		if h.compare(h.entries[i], h.entries[p]) <= 0 {
+			return
+		}
+		h.entries[i], h.entries[p] = h.entries[p], h.entries[i]
+		i = p
+	}
+}
+
+// down moves the entry at i away from the top while a child sorts after it.
+func (h *topHeap[T]) down(i int) {
+	for {
+		c := 2*i + 1
+		if c >= len(h.entries) {
+			return
+		}
+		if r := c + 1; r < len(h.entries) && h.compare(h.entries[r], h.entries[c]) > 0 {
+			c = r
+		}
+		if h.compare(h.entries[c], h.entries[i]) <= 0 {
+			return
+		}
+		h.entries[i], h.entries[c] = h.entries[c], h.entries[i]
+		i = c
+	}
+}
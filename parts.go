@@ -8,6 +8,23 @@ import (
 // Function: genParts
 //-------------------
 
+// Wildcard parts are always these slices, so they can be told apart from what is left of a literal part
+// after matching its start, which may be a lone '*' or '>' as well, e.g. for a quoted wildcard.
+var (
+	pwcPart = []byte{pwc}
+	fwcPart = []byte{fwc}
+)
+
+// isPWC returns true if the part is a pwc generated by genParts.
+func isPWC(part []byte) bool {
+	return len(part) == 1 && &part[0] == &pwcPart[0]
+}
+
+// isFWC returns true if the part is an fwc generated by genParts.
+func isFWC(part []byte) bool {
+	return len(part) == 1 && &part[0] == &fwcPart[0]
+}
+
 // genParts breaks a filter subject (filter) into parts based on wildcards (`pwc '*'` or `fwc '>'`).
 // It processes the input filter, identifies the wildcards, and separates the parts accordingly.
 // Wildcards are used to separate the string into chunks, either as prefixes or suffixes.
@@ -21,8 +38,8 @@ func genParts(filter []byte, parts [][]byte) [][]byte {
 				if i > start {
 					parts = append(parts, filter[start:i+1]) // Add part before pwc
 				}
-				parts = append(parts, filter[i+1:i+2]) // Add the pwc itself
-				i++                                    // Skip pwc
+				parts = append(parts, pwcPart) // Add the pwc itself
+				i++                            // Skip pwc
 				if i+2 <= e {
 					i++ // Skip next tsep from the next part too.
 				}
@@ -32,8 +49,8 @@ func genParts(filter []byte, parts [][]byte) [][]byte {
 				if i > start {
 					parts = append(parts, filter[start:i+1]) // Add part before fwc
 				}
-				parts = append(parts, filter[i+1:i+2]) // Add the fwc itself
-				i++                                    // Skip fwc
+				parts = append(parts, fwcPart) // Add the fwc itself
+				i++                            // Skip fwc
 				start = i + 1
 			}
 		} else if filter[i] == pwc || filter[i] == fwc {
@@ -46,7 +63,11 @@ func genParts(filter []byte, parts [][]byte) [][]byte {
 				continue
 			}
 			// We start with a pwc or fwc.
-			parts = append(parts, filter[i:i+1])
+			if filter[i] == pwc {
+				parts = append(parts, pwcPart)
+			} else {
+				parts = append(parts, fwcPart)
+			}
 			if i+1 <= e {
 				i++ // Skip next tsep from next part too.
 			}
@@ -85,7 +106,7 @@ func matchParts(parts [][]byte, frag []byte) ([][]byte, bool) {
 		lp := len(part)
 		// Check for pwc or fwc placeholders.
 		if lp == 1 {
-			if part[0] == pwc {
+			if isPWC(part) {
 				index := bytes.IndexByte(frag[si:], tsep)
 				// If no tsep is found, it indicates we need to move to the next node from the caller.
 				if index < 0 {
@@ -96,7 +117,7 @@ func matchParts(parts [][]byte, frag []byte) ([][]byte, bool) {
 				}
 				si += index + 1
 				continue
-			} else if part[0] == fwc {
+			} else if isFWC(part) {
 				// If we reach an fwc, we have matched the part.
 				return nil, true
 			}
@@ -133,3 +154,31 @@ func matchParts(parts [][]byte, frag []byte) ([][]byte, bool) {
 	}
 	return parts, false
 }
+
+//-------------------
+// Function: MatchesSubject
+//-------------------
+
+// MatchesSubject returns true if the filter matches the literal subject, comparing them token by token: a
+// "*" token matches any single token, a ">" token at the end matches one or more tokens, and every other
+// token only matches itself. This is the answer Match gives for a tree holding the subject, without one.
+func MatchesSubject(filter, subject []byte) bool {
+	for fi, si := 0, 0; ; {
+		if si > len(subject) {
+			// No tokens of the subject are left, so neither may be of the filter.
+			return fi > len(filter)
+		}
+		if fi > len(filter) {
+			return false
+		}
+		fe, se := tokenEnd(filter, fi), tokenEnd(subject, si)
+		switch ft := filter[fi:fe]; {
+		case len(ft) == 1 && ft[0] == fwc && fe == len(filter):
+			return true
+		case len(ft) == 1 && ft[0] == pwc:
+		case !bytes.Equal(ft, subject[si:se]):
+			return false
+		}
+		fi, si = fe+1, se+1
+	}
+}
@@ -0,0 +1,82 @@
+package subtree
+
+import "fmt"
+
+//-------------------
+// Subject permissions
+//-------------------
+
+// Permissions is a set of allow and deny filters, compiled once into trees so checking a subject or
+// pruning a match does not depend on the number of filters. A subject is allowed if it matches an allow
+// filter, or there are no allow filters, and it matches no deny filter.
+// Permissions are immutable once created and safe for concurrent use.
+type Permissions struct {
+	allow *SubjectTree[struct{}] // Nil allows every subject not denied
+	deny  *SubjectTree[struct{}] // Nil denies nothing
+}
+
+// NewPermissions compiles the allow and deny filters into Permissions.
+// Returns ErrInvalidFilter if any of the filters is not valid.
+func NewPermissions(allow, deny []string) (*Permissions, error) {
+	compile := func(filters []string) (*SubjectTree[struct{}], error) {
+		if len(filters) == 0 {
+			return nil, nil
+		}
+		st := NewSubjectTree[struct{}]()
+		for _, f := range filters {
+			if !validFilter(stringBytes(f)) {
+				return nil, fmt.Errorf("%w: %q", ErrInvalidFilter, f)
+			}
+			st.Insert(stringBytes(f), struct{}{})
+		}
+		return st, nil
+	}
+	var p Permissions
+	var err error
+	if p.allow, err = compile(allow); err != nil {
+		return nil, err
+	}
+	if p.deny, err = compile(deny); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Allowed returns true if the literal subject is allowed. Nil permissions allow everything.
+func (p *Permissions) Allowed(subject []byte) bool {
+	if p == nil {
+		return true
+	}
+	if p.allow != nil && !p.allow.HasInterestMatching(subject) {
+		return false
+	}
+	return p.deny == nil || !p.deny.HasInterestMatching(subject)
+}
+
+// prunes returns true if no subject starting with prefix can be allowed, either because no allow filter
+// could match it or because a deny filter ending in a full wildcard matches all of them.
+func (p *Permissions) prunes(prefix []byte) bool {
+	if p == nil {
+		return false
+	}
+	if p.allow != nil && !p.allow.interestUnder(prefix) {
+		return true
+	}
+	return p.deny != nil && p.deny.coversPrefix(prefix)
+}
+
+// MatchAllowed will match all entries to the filter like Match, but only calls the callback for subjects
+// the permissions allow. Subtrees the permissions rule out completely are not walked at all.
+// Matches are visited in subject order.
+func (t *SubjectTree[T]) MatchAllowed(filter []byte, perms *Permissions, cb func(subject []byte, val *T)) {
+	if cb == nil {
+		return
+	}
+	t.MatchWithPruner(filter, func(_ int, prefix []byte) bool {
+		return perms.prunes(prefix)
+	}, func(subject []byte, val *T) {
+		if perms.Allowed(subject) {
+			cb(subject, val)
+		}
+	})
+}
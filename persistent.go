@@ -0,0 +1,101 @@
+package subtree
+
+//-------------------
+// Persistent Subject Tree
+//-------------------
+
+// PersistentSubjectTree is an immutable version of the SubjectTree. Insert and Delete never modify the
+// receiver, instead they return a new tree which shares all untouched nodes with the original (path copying).
+// This makes versions cheap to keep around and allows a tree to be handed to other goroutines without locks.
+// Values returned from Find or handed to callbacks point into shared leaves and must not be modified.
+type PersistentSubjectTree[T any] struct {
+	root node
+	size int
+}
+
+// NewPersistentSubjectTree creates a new empty PersistentSubjectTree with values T.
+func NewPersistentSubjectTree[T any]() *PersistentSubjectTree[T] {
+	return &PersistentSubjectTree[T]{}
+}
+
+// Persistent returns a PersistentSubjectTree with the current contents of the tree.
+// The tree will copy nodes on future modifications so the returned tree is never affected by them.
+func (t *SubjectTree[T]) Persistent() *PersistentSubjectTree[T] {
+	if t == nil {
+		return NewPersistentSubjectTree[T]()
+	}
+	t.share()
+	return &PersistentSubjectTree[T]{root: t.root, size: t.size}
+}
+
+// Size returns the number of elements stored.
+func (p *PersistentSubjectTree[T]) Size() int {
+	if p == nil {
+		return 0
+	}
+	return p.size
+}
+
+// Insert returns a new tree with the value inserted, along with the old value and if it was an update.
+func (p *PersistentSubjectTree[T]) Insert(subject []byte, value T) (*PersistentSubjectTree[T], *T, bool) {
+	t := p.transient()
+	old, updated := t.Insert(subject, value)
+	return &PersistentSubjectTree[T]{root: t.root, size: t.size}, old, updated
+}
+
+// Delete returns a new tree without the subject, along with the removed value and if it was found.
+// If the subject was not found the receiver is returned unchanged.
+func (p *PersistentSubjectTree[T]) Delete(subject []byte) (*PersistentSubjectTree[T], *T, bool) {
+	t := p.transient()
+	val, deleted := t.Delete(subject)
+	if !deleted {
+		return p, nil, false
+	}
+	return &PersistentSubjectTree[T]{root: t.root, size: t.size}, val, true
+}
+
+// Find will find the value and return it or false if it was not found.
+func (p *PersistentSubjectTree[T]) Find(subject []byte) (*T, bool) {
+	t := p.view()
+	return t.Find(subject)
+}
+
+// Match will match against a subject that can have wildcards and invoke the callback func for each matched value.
+func (p *PersistentSubjectTree[T]) Match(filter []byte, cb func(subject []byte, val *T)) {
+	t := p.view()
+	t.Match(filter, cb)
+}
+
+// MatchValues is like Match but does not reconstruct the matched subjects.
+func (p *PersistentSubjectTree[T]) MatchValues(filter []byte, cb func(val *T)) {
+	t := p.view()
+	t.MatchValues(filter, cb)
+}
+
+// IterOrdered will walk all entries lexographically. The callback can return false to terminate the walk.
+func (p *PersistentSubjectTree[T]) IterOrdered(cb func(subject []byte, val *T) bool) {
+	t := p.view()
+	t.IterOrdered(cb)
+}
+
+// IterFast will walk all entries with no guarantees of ordering. The callback can return false to terminate the walk.
+func (p *PersistentSubjectTree[T]) IterFast(cb func(subject []byte, val *T) bool) {
+	t := p.view()
+	t.IterFast(cb)
+}
+
+// view returns a SubjectTree over our nodes that must only be used for reading.
+func (p *PersistentSubjectTree[T]) view() SubjectTree[T] {
+	if p == nil {
+		return SubjectTree[T]{}
+	}
+	return SubjectTree[T]{root: p.root, size: p.size}
+}
+
+// transient returns a SubjectTree over our nodes with a fresh generation, so any modification will
+// copy the nodes it touches and leave ours alone.
+func (p *PersistentSubjectTree[T]) transient() *SubjectTree[T] {
+	t := p.view()
+	t.gen = nextGen()
+	return &t
+}
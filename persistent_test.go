@@ -0,0 +1,772 @@
+package subtree
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//-------------------
+//  Test for Persistent Subject Tree
+//-------------------
+
+// Test that every version of a persistent tree keeps its own contents.
+func TestPersistentSubjectTreeVersions(t *testing.T) {
+	v0 := NewPersistentSubjectTree[int]()
+	v1, old, updated := v0.Insert(b("foo.bar.A"), 1)
+	require_True(t, old == nil)
+	require_False(t, updated)
+	v2, _, _ := v1.Insert(b("foo.bar.B"), 2)
+	v3, old, updated := v2.Insert(b("foo.bar.A"), 11)
+	require_True(t, updated)
+	require_Equal(t, *old, 1)
+	v4, val, deleted := v3.Delete(b("foo.bar.B"))
+	require_True(t, deleted)
+	require_Equal(t, *val, 2)
+
+	require_Equal(t, v0.Size(), 0)
+	require_Equal(t, v1.Size(), 1)
+	require_Equal(t, v2.Size(), 2)
+	require_Equal(t, v3.Size(), 2)
+	require_Equal(t, v4.Size(), 1)
+
+	v, found := v2.Find(b("foo.bar.A"))
+	require_True(t, found)
+	require_Equal(t, *v, 1)
+	v, found = v3.Find(b("foo.bar.A"))
+	require_True(t, found)
+	require_Equal(t, *v, 11)
+	_, found = v4.Find(b("foo.bar.B"))
+	require_False(t, found)
+	_, found = v3.Find(b("foo.bar.B"))
+	require_True(t, found)
+
+	// Deleting something missing returns the same tree.
+	v5, _, deleted := v4.Delete(b("foo.bar.Z"))
+	require_False(t, deleted)
+	require_True(t, v5 == v4)
+}
+
+// Test that growing, shrinking and splitting nodes never changes older versions.
+func TestPersistentSubjectTreeStructuralSharing(t *testing.T) {
+	versions := []*PersistentSubjectTree[int]{NewPersistentSubjectTree[int]()}
+	for i := 0; i < 300; i++ {
+		nv, _, _ := versions[len(versions)-1].Insert(b(fmt.Sprintf("foo.%d.bar", i)), i)
+		versions = append(versions, nv)
+	}
+	for i := 0; i < 300; i += 2 {
+		nv, _, _ := versions[len(versions)-1].Delete(b(fmt.Sprintf("foo.%d.bar", i)))
+		versions = append(versions, nv)
+	}
+	for n, v := range versions[:301] {
+		require_Equal(t, v.Size(), n)
+		count := 0
+		v.Match(b("foo.*.bar"), func(_ []byte, _ *int) { count++ })
+		require_Equal(t, count, n)
+	}
+	last := versions[len(versions)-1]
+	require_Equal(t, last.Size(), 150)
+	last.IterFast(func(subject []byte, v *int) bool {
+		require_True(t, *v%2 == 1)
+		return true
+	})
+}
+
+// Test that a mutable tree can publish a persistent tree and keep on going.
+func TestSubjectTreePersistent(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	p := st.Persistent()
+	for i := 0; i < 100; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), -1)
+		if i%3 == 0 {
+			st.Delete(b(fmt.Sprintf("foo.%d", i)))
+		}
+	}
+	require_Equal(t, p.Size(), 100)
+	for i := 0; i < 100; i++ {
+		v, found := p.Find(b(fmt.Sprintf("foo.%d", i)))
+		require_True(t, found)
+		require_Equal(t, *v, i)
+	}
+
+	// Readers on other goroutines can use the persistent tree without locks while we keep writing.
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			count := 0
+			p.MatchValues(b("foo.*"), func(_ *int) { count++ })
+			if count != 100 {
+				t.Errorf("Expected 100 matches, got %d", count)
+			}
+		}()
+	}
+	for i := 100; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	wg.Wait()
+}
+
+//-------------------
+//  Test for Versions and Read Views
+//-------------------
+
+// Test that retained versions can be read after the tree moved on and older ones are evicted.
+func TestSubjectTreeAtVersion(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.SetVersionRetention(3)
+	require_Equal(t, st.Version(), 0)
+	for i := 1; i <= 5; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+		require_Equal(t, st.Version(), uint64(i))
+	}
+	st.Insert(b("foo.1"), 100)
+	st.Delete(b("foo.2"))
+	// Deleting something that does not exist is not a new version.
+	st.Delete(b("foo.22"))
+	require_Equal(t, st.Version(), 7)
+
+	// Only the last 3 versions and the current one are available.
+	for v := uint64(0); v < 4; v++ {
+		_, err := st.AtVersion(v)
+		require_True(t, err == ErrVersionNotRetained)
+	}
+	rv, err := st.AtVersion(4)
+	require_True(t, err == nil)
+	require_Equal(t, rv.Version(), 4)
+	require_Equal(t, rv.Size(), 4)
+	_, found := rv.Find(b("foo.5"))
+	require_False(t, found)
+
+	rv, err = st.AtVersion(6)
+	require_True(t, err == nil)
+	v, found := rv.Find(b("foo.1"))
+	require_True(t, found)
+	require_Equal(t, *v, 100)
+	_, found = rv.Find(b("foo.2"))
+	require_True(t, found)
+
+	rv, err = st.AtVersion(7)
+	require_True(t, err == nil)
+	require_Equal(t, rv.Size(), 4)
+	count := 0
+	rv.Match(b("foo.*"), func(_ []byte, _ *int) { count++ })
+	require_Equal(t, count, 4)
+
+	// Views are unaffected by later changes, and reducing retention drops old versions.
+	st.Empty()
+	require_Equal(t, st.Size(), 0)
+	require_Equal(t, rv.Size(), 4)
+	st.SetVersionRetention(1)
+	_, err = st.AtVersion(6)
+	require_True(t, err == ErrVersionNotRetained)
+	rv, err = st.AtVersion(7)
+	require_True(t, err == nil)
+	_, found = rv.Find(b("foo.3"))
+	require_True(t, found)
+}
+
+// Test that a snapshot can be read on another goroutine while the tree is being written.
+func TestSubjectTreeSnapshot(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar", i)), i)
+	}
+	snap := st.Snapshot()
+	done := make(chan int)
+	go func() {
+		sum := 0
+		snap.IterOrdered(func(_ []byte, v *int) bool {
+			sum += *v
+			return true
+		})
+		done <- sum
+	}()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar", i)), 0)
+		st.Delete(b(fmt.Sprintf("foo.%d.bar", i+500)))
+	}
+	require_Equal(t, <-done, 999*1000/2)
+	require_Equal(t, snap.Size(), 1000)
+}
+
+// Test that read views spell subjects and filters the way the tree they came from does.
+func TestSubjectTreeSnapshotCanon(t *testing.T) {
+	opts := []Option{WithUnicodeFold(), WithTokenRewrites(map[string]string{"evt": "events"})}
+	st := NewSubjectTree[int](opts...)
+	st.SetVersionRetention(1)
+	st.Insert(b("Evt.Created"), 1)
+	version := st.Version()
+	st.Insert(b("evt.deleted"), 2)
+
+	views := []*ReadView[int]{st.Snapshot()}
+	view, err := st.AtVersion(version)
+	require_True(t, err == nil)
+	views = append(views, view)
+	sst := NewSafeSubjectTree[int](opts...)
+	sst.Insert(b("EVT.created"), 1)
+	views = append(views, sst.Snapshot())
+	sst = NewSafeSubjectTree[int](append(opts, WithStripedLocks(4))...)
+	sst.Insert(b("EVT.created"), 1)
+	views = append(views, sst.Snapshot())
+	for _, view := range views {
+		v, found := view.Find(b("EVT.CREATED"))
+		require_True(t, found)
+		require_Equal(t, *v, 1)
+		var got []string
+		view.Match(b("Evt.*"), func(subject []byte, _ *int) { got = append(got, string(subject)) })
+		sort.Strings(got)
+		require_True(t, len(got) > 0)
+		require_Equal(t, got[0], "events.created")
+	}
+
+	var got []string
+	sst.MatchSnapshot(b("EVT.>"), func(subject []byte, _ int) { got = append(got, string(subject)) })
+	require_Equal(t, strings.Join(got, " "), "events.created")
+}
+
+//-------------------
+//  Test for Frozen Subject Trees
+//-------------------
+
+// Test that a frozen tree returns the same results as the tree it was frozen from.
+func TestSubjectTreeFreeze(t *testing.T) {
+	st := NewSubjectTree[int]()
+	empty, err := st.Freeze()
+	require_True(t, err == nil)
+	require_Equal(t, empty.Size(), 0)
+	_, found := empty.Find(b("foo"))
+	require_False(t, found)
+
+	for i := 0; i < 2000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d.bar.%d", i%37, i)), i)
+	}
+	st.Insert(b("foo"), -1)
+	st.Insert(b("foo.1"), -2)
+	st.Insert(b("foo.1.bar"), -3)
+	ft, err := st.Freeze()
+	require_True(t, err == nil)
+	require_Equal(t, ft.Size(), st.Size())
+
+	for _, subj := range []string{"foo", "foo.1", "foo.1.bar", "foo.1.bar.1", "foo.36.bar.1999", "foo.2", "fo", "foo.1.bar.2", "",
+		"foo.5.bar.5", "foo.15.bar.15", "foo.25.bar.1320"} {
+		v1, found1 := st.Find(b(subj))
+		v2, found2 := ft.Find(b(subj))
+		require_Equal(t, found1, found2)
+		if found1 {
+			require_Equal(t, *v1, *v2)
+		}
+	}
+	collect := func(iter func(cb func([]byte, *int) bool)) []string {
+		var out []string
+		iter(func(subject []byte, v *int) bool {
+			out = append(out, fmt.Sprintf("%s=%d", subject, *v))
+			return true
+		})
+		return out
+	}
+	expected, got := collect(st.IterOrdered), collect(ft.IterOrdered)
+	require_Equal(t, len(got), len(expected))
+	for i := range expected {
+		require_Equal(t, got[i], expected[i])
+	}
+	for _, filter := range []string{">", "foo", "foo.*", "foo.*.bar", "foo.1.>", "*.*.bar.*", "foo.*.*.1999", "bar.>"} {
+		var e, g []string
+		st.Match(b(filter), func(subject []byte, v *int) { e = append(e, fmt.Sprintf("%s=%d", subject, *v)) })
+		ft.Match(b(filter), func(subject []byte, v *int) { g = append(g, fmt.Sprintf("%s=%d", subject, *v)) })
+		// Match makes no ordering guarantees.
+		sort.Strings(e)
+		sort.Strings(g)
+		require_Equal(t, len(g), len(e))
+		for i := range e {
+			require_Equal(t, g[i], e[i])
+		}
+	}
+
+	// Thaw gives back an independent modifiable tree.
+	nt := ft.Thaw()
+	require_True(t, nt.Equal(st, func(a, b int) bool { return a == b }))
+	nt.Delete(b("foo"))
+	_, found = ft.Find(b("foo"))
+	require_True(t, found)
+}
+
+//-------------------
+//  Test for Arena Subject Trees
+//-------------------
+
+// Test that an arena tree gives the same results as a SubjectTree through random inserts and deletes, and
+// that it keeps its blocks, free lists and data consistent along the way.
+func TestArenaSubjectTree(t *testing.T) {
+	at, st := NewArenaSubjectTree[int](), NewSubjectTree[int]()
+	_, found := at.Find(b("foo"))
+	require_False(t, found)
+	_, found = at.Delete(b("foo"))
+	require_False(t, found)
+
+	// check compares the trees and walks the arena, checking what every node and leaf in use holds.
+	check := func() {
+		t.Helper()
+		require_Equal(t, at.Size(), st.Size())
+		var e, g []string
+		st.IterOrdered(func(subject []byte, v *int) bool { e = append(e, fmt.Sprintf("%s=%d", subject, *v)); return true })
+		at.IterOrdered(func(subject []byte, v *int) bool { g = append(g, fmt.Sprintf("%s=%d", subject, *v)); return true })
+		require_Equal(t, strings.Join(g, " "), strings.Join(e, " "))
+		live, leaves := 0, 0
+		var walk func(ref uint32)
+		walk = func(ref uint32) {
+			span := at.pathSpan(ref)
+			live += int(span.len)
+			if ref&frozenLeafBit != 0 {
+				leaves++
+				return
+			}
+			fn := at.f.nodes[ref]
+			require_True(t, fn.count >= 2 && fn.count <= arenaMinBlock<<at.classes[ref])
+			keys := at.f.keys[fn.first : fn.first+fn.count]
+			require_True(t, sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] < keys[j] }))
+			for _, cref := range at.f.refs[fn.first : fn.first+fn.count] {
+				walk(cref)
+			}
+		}
+		if at.f.root != noRef {
+			walk(at.f.root)
+		}
+		require_Equal(t, leaves, at.Size())
+		require_Equal(t, live, at.live)
+		require_Equal(t, len(at.f.leaves)-len(at.freeLeaves), leaves)
+	}
+
+	rng := rand.New(rand.NewSource(626))
+	random := func() []byte {
+		var parts []string
+		for n := 1 + rng.Intn(4); n > 0; n-- {
+			parts = append(parts, fmt.Sprint(rng.Intn(300)))
+		}
+		return b(strings.Join(parts, "."))
+	}
+	for round := 0; round < 20; round++ {
+		for i := 0; i < 500; i++ {
+			subj := random()
+			o1, u1 := st.Insert(subj, i)
+			o2, u2 := at.Insert(subj, i)
+			require_Equal(t, u1, u2)
+			if u1 {
+				require_Equal(t, *o1, *o2)
+			}
+		}
+		// Delete most of the entries again every other round, so freed nodes, leaves, blocks and data get reused.
+		for i := 0; i < 450*(round%2); i++ {
+			subj := random()
+			o1, d1 := st.Delete(subj)
+			o2, d2 := at.Delete(subj)
+			require_Equal(t, d1, d2)
+			if d1 {
+				require_Equal(t, *o1, *o2)
+			}
+		}
+		check()
+		for f := 0; f < 20; f++ {
+			subj := random()
+			v1, f1 := st.Find(subj)
+			v2, f2 := at.Find(subj)
+			require_Equal(t, f1, f2)
+			if f1 {
+				require_Equal(t, *v1, *v2)
+			}
+			parts := strings.Split(string(subj), ".")
+			parts[rng.Intn(len(parts))] = "*"
+			if rng.Intn(2) == 0 {
+				parts[len(parts)-1] = ">"
+			}
+			filter := b(strings.Join(parts, "."))
+			var e, g []string
+			st.Match(filter, func(subject []byte, v *int) { e = append(e, fmt.Sprintf("%s=%d", subject, *v)) })
+			at.Match(filter, func(subject []byte, v *int) { g = append(g, fmt.Sprintf("%s=%d", subject, *v)) })
+			sort.Strings(e)
+			sort.Strings(g)
+			require_Equal(t, strings.Join(g, " "), strings.Join(e, " "))
+		}
+	}
+
+	// Subjects that are prefixes of others, and a wide node that grows to the largest block and back.
+	for _, subj := range []string{"foo", "foo.bar", "foo.ba", "", "foo.bar.baz"} {
+		st.Insert(b(subj), len(subj))
+		at.Insert(b(subj), len(subj))
+	}
+	check()
+	for c := 0; c < 256; c++ {
+		if c != int(noPivot) {
+			st.Insert([]byte{'w', byte(c)}, c)
+			at.Insert([]byte{'w', byte(c)}, c)
+		}
+	}
+	check()
+	for c := 0; c < 256; c++ {
+		st.Delete([]byte{'w', byte(c)})
+		at.Delete([]byte{'w', byte(c)})
+	}
+	check()
+	_, updated := at.Insert([]byte{'a', noPivot}, 1)
+	require_False(t, updated)
+	_, found = at.Find([]byte{'a', noPivot})
+	require_False(t, found)
+
+	// Deleting everything leaves only unused space, and compaction keeps the data to what is still in use.
+	st.IterOrdered(func(subject []byte, _ *int) bool {
+		_, found := at.Delete(subject)
+		require_True(t, found)
+		return true
+	})
+	require_Equal(t, at.Size(), 0)
+	require_True(t, at.f.root == noRef)
+	require_Equal(t, at.live, 0)
+	require_True(t, len(at.f.data) < arenaMinCompact)
+	at.Insert(b("foo.bar"), 1)
+	v, found := at.Find(b("foo.bar"))
+	require_True(t, found)
+	require_Equal(t, *v, 1)
+	require_Equal(t, at.Empty().Size(), 0)
+	_, found = at.Find(b("foo.bar"))
+	require_False(t, found)
+}
+
+//-------------------
+//  Test for Matching Against Snapshots
+//-------------------
+
+// Test that MatchSnapshot sees every entry exactly once while the callback and other goroutines write.
+func TestSubjectTreeMatchSnapshot(t *testing.T) {
+	st := NewSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		st.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	seen := make(map[string]int)
+	st.MatchSnapshot(b("foo.*"), func(subject []byte, v *int) {
+		seen[string(subject)]++
+		// Delete this and some other entries, and add new ones that also match.
+		st.Delete(subject)
+		st.Delete(b(fmt.Sprintf("foo.%d", (*v+500)%1000)))
+		st.Insert(b(fmt.Sprintf("foo.new.%d", *v)), *v)
+		st.Insert(b(fmt.Sprintf("foo.x%d", *v)), *v)
+	})
+	require_Equal(t, len(seen), 1000)
+	for subj, times := range seen {
+		if times != 1 {
+			t.Fatalf("Expected %q to be matched once, got %d", subj, times)
+		}
+	}
+	require_Equal(t, st.Size(), 2000)
+
+	// The same with a safe tree and concurrent writers.
+	sst := NewSafeSubjectTree[int]()
+	for i := 0; i < 1000; i++ {
+		sst.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				// Churn entries next to the ones we match, and update the ones we match.
+				subj := b(fmt.Sprintf("foo.%d.%d", w, i%100))
+				sst.Insert(subj, i)
+				sst.Delete(subj)
+				sst.Insert(b(fmt.Sprintf("foo.%d", i%1000)), i)
+			}
+		}(w)
+	}
+	for r := 0; r < 20; r++ {
+		count := 0
+		sst.MatchSnapshot(b("foo.*"), func(_ []byte, _ int) { count++ })
+		require_Equal(t, count, 1000)
+		// Writing from the callback is fine as well.
+		sst.MatchSnapshot(b("foo.1"), func(subject []byte, v int) { sst.Insert(subject, v+1) })
+	}
+	close(done)
+	wg.Wait()
+	require_Equal(t, sst.Size(), 1000)
+}
+
+//-------------------
+//  Test for Applying Mutations Atomically
+//-------------------
+
+// Test that mutations are applied as a single version and not at all when one is invalid.
+func TestSubjectTreeApply(t *testing.T) {
+	st := NewSubjectTree[int]()
+	st.SetVersionRetention(5)
+	st.Insert(b("stream.x.state"), 1)
+	st.Insert(b("stream.x.meta"), 1)
+	st.Insert(b("stream.y.state"), 1)
+	v := st.Version()
+
+	err := st.Apply([]Mutation[int]{
+		{Op: OpUpdate, Subject: b("stream.x.state"), Value: 2},
+		{Op: OpUpdate, Subject: b("stream.x.meta"), Value: 2},
+		{Op: OpDelete, Subject: b("stream.y.state")},
+		{Op: OpInsert, Subject: b("stream.z.state"), Value: 2},
+	})
+	require_True(t, err == nil)
+	require_Equal(t, st.Version(), v+1)
+	require_Equal(t, st.Size(), 3)
+	// The version before has none of the changes.
+	rv, err := st.AtVersion(v)
+	require_True(t, err == nil)
+	val, _ := rv.Find(b("stream.x.meta"))
+	require_Equal(t, *val, 1)
+	_, found := rv.Find(b("stream.y.state"))
+	require_True(t, found)
+	require_Equal(t, rv.Size(), 3)
+
+	// An invalid mutation leaves the tree alone.
+	for _, bad := range []Mutation[int]{{Op: OpInsert}, {Op: OpDelete}, {Op: Op(42), Subject: b("foo")}, {Op: OpInsert, Subject: []byte{'a', noPivot}}} {
+		err = st.Apply([]Mutation[int]{{Op: OpEmpty}, bad})
+		require_True(t, errors.Is(err, ErrInvalidOp))
+		require_Equal(t, st.Size(), 3)
+		require_Equal(t, st.Version(), v+1)
+	}
+	// Nothing changing does not make a version.
+	require_True(t, st.Apply([]Mutation[int]{{Op: OpDelete, Subject: b("nope")}}) == nil)
+	require_Equal(t, st.Version(), v+1)
+	require_True(t, st.retain == 5)
+
+	// Readers of a safe tree see none or all of the mutations.
+	sst := NewSafeSubjectTree[int]()
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			if err := sst.Apply([]Mutation[int]{
+				{Op: OpInsert, Subject: b("stream.x.state"), Value: i},
+				{Op: OpInsert, Subject: b("stream.x.meta"), Value: i},
+			}); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for r := 0; r < 1000; r++ {
+		var vals []int
+		sst.MatchSnapshot(b("stream.x.*"), func(_ []byte, v int) { vals = append(vals, v) })
+		require_True(t, len(vals) == 0 || len(vals) == 2 && vals[0] == vals[1])
+	}
+	close(done)
+	wg.Wait()
+}
+
+//-------------------
+//  Test for Striped Locks
+//-------------------
+
+// Test that a striped safe tree behaves as a single tree, with its entries spread over the stripes.
+func TestSafeSubjectTreeStripedLocks(t *testing.T) {
+	for _, opts := range [][]Option{{WithStripedLocks(8)}, {WithStripedLocks(8), WithLazyDelete()}} {
+		sst := NewSafeSubjectTree[int](opts...)
+		require_Equal(t, len(sst.stripes), 8)
+		var wg sync.WaitGroup
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				// First tokens that are prefixes of each other, and subjects equal to them.
+				for i := 0; i < 500; i++ {
+					first := strings.Repeat("a", 1+(w*500+i)%7) + fmt.Sprint(w)
+					sst.Insert(b(first), i)
+					sst.Insert(b(fmt.Sprintf("%s.%d", first, i)), i)
+					if i%3 == 0 {
+						sst.Delete(b(fmt.Sprintf("%s.%d", first, i)))
+					}
+				}
+			}(w)
+		}
+		wg.Wait()
+		expected := NewSubjectTree[int]()
+		for w := 0; w < 4; w++ {
+			for i := 0; i < 500; i++ {
+				first := strings.Repeat("a", 1+(w*500+i)%7) + fmt.Sprint(w)
+				expected.Insert(b(first), i)
+				if i%3 != 0 {
+					expected.Insert(b(fmt.Sprintf("%s.%d", first, i)), i)
+				}
+			}
+		}
+		require_Equal(t, sst.Size(), expected.Size())
+		var used int
+		for i := range sst.stripes {
+			if sst.stripes[i].t.Size() > 0 {
+				used++
+			}
+		}
+		require_True(t, used > 1)
+
+		// Literal and wildcard first tokens match the same as a single tree.
+		for _, filter := range []string{"*", ">", "*.1", "aa1.*", "aaa2.>", "a0"} {
+			var got []string
+			sst.Match(b(filter), func(subject []byte, v int) { got = append(got, fmt.Sprintf("%s=%d", subject, v)) })
+			var want []string
+			expected.Match(b(filter), func(subject []byte, v *int) { want = append(want, fmt.Sprintf("%s=%d", subject, *v)) })
+			sort.Strings(got)
+			sort.Strings(want)
+			require_Equal(t, strings.Join(got, " "), strings.Join(want, " "))
+		}
+
+		// Snapshots combine the stripes without changing them.
+		snap := sst.Snapshot()
+		require_Equal(t, snap.Size(), expected.Size())
+		var n int
+		snap.IterOrdered(func(subject []byte, v *int) bool {
+			ev, ok := expected.Find(subject)
+			require_True(t, ok && *ev == *v)
+			n++
+			return true
+		})
+		require_Equal(t, n, expected.Size())
+		sst.Insert(b("a0.new"), 1)
+		_, found := snap.Find(b("a0.new"))
+		require_False(t, found)
+
+		// Update sees all entries in one tree, and spreads them over the stripes again.
+		sst.Update(func(st *SubjectTree[int]) {
+			require_Equal(t, st.Size(), expected.Size()+1)
+			require_True(t, st.Validate() == nil)
+			st.Delete(b("a0.new"))
+			st.Insert(b("b.c"), 2)
+			expected.Insert(b("b.c"), 2)
+		})
+		for i := range sst.stripes {
+			st := &sst.stripes[i]
+			require_True(t, st.t.Validate() == nil)
+			st.t.IterFast(func(subject []byte, _ *int) bool {
+				require_True(t, sst.stripe(subject) == st)
+				return true
+			})
+		}
+		v, found := sst.Find(b("b.c"))
+		require_True(t, found && v == 2)
+		require_Equal(t, sst.Size(), expected.Size())
+		// The snapshot still has the entries it had.
+		require_Equal(t, snap.Size(), expected.Size()-1)
+
+		// Apply holds all stripes, empties included.
+		require_True(t, sst.Apply([]Mutation[int]{{Op: OpEmpty}, {Op: OpInsert, Subject: b("x.y"), Value: 1}, {Op: OpInsert, Subject: b("z"), Value: 2}}) == nil)
+		require_Equal(t, sst.Size(), 2)
+		require_True(t, errors.Is(sst.Apply([]Mutation[int]{{Op: OpEmpty}, {Op: OpInsert}}), ErrInvalidOp))
+		require_Equal(t, sst.Size(), 2)
+	}
+	// Entry IDs turn striping off.
+	require_Equal(t, len(NewSafeSubjectTree[int](WithStripedLocks(8), WithEntryIDs()).stripes), 1)
+	require_Equal(t, len(NewSafeSubjectTree[int]().stripes), 1)
+}
+
+//-------------------
+//  Test for Fairness Between Readers and Writers
+//-------------------
+
+// Test that queued writers are applied in batches, each a single version, with the results of every write.
+func TestSafeSubjectTreeWriteBatching(t *testing.T) {
+	sst := NewSafeSubjectTree[int](WithWriteBatching(4))
+	sst.Insert(b("foo.0"), -1)
+	st := &sst.stripes[0]
+	start := st.t.Version()
+	st.lock()
+	var wg sync.WaitGroup
+	olds := make([]int, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if old, updated := sst.Insert(b(fmt.Sprintf("foo.%d", i)), i); updated {
+				olds[i] = old
+			}
+		}(i)
+		// Wait for the first writer to wait for the lock, and the others to queue up behind it.
+		for {
+			st.queue.mu.Lock()
+			queued := len(st.queue.pending)
+			st.queue.mu.Unlock()
+			if i == 0 && st.waiting.Load() == 1 || i > 0 && queued == i {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	st.mu.Unlock()
+	wg.Wait()
+	// The first write on its own, then the other nine in batches of four.
+	require_Equal(t, st.t.Version(), start+4)
+	require_Equal(t, sst.Size(), 10)
+	require_Equal(t, olds[0], -1)
+	v, _ := sst.Delete(b("foo.3"))
+	require_Equal(t, v, 3)
+	_, found := sst.Delete(b("foo.3"))
+	require_False(t, found)
+	require_False(t, st.queue.active)
+}
+
+// Test that a long match lets waiting writers in after the grace period, and still visits every entry once.
+func TestSafeSubjectTreeReaderGrace(t *testing.T) {
+	for _, grace := range []time.Duration{0, time.Millisecond} {
+		sst := NewSafeSubjectTree[int](WithReaderGrace(grace))
+		for i := 0; i < 1000; i++ {
+			sst.Insert(b(fmt.Sprintf("foo.%04d", i)), i)
+		}
+		written := make(chan struct{})
+		seen := make(map[string]int)
+		var sawWrite bool
+		sst.Match(b("foo.*"), func(subject []byte, _ int) {
+			if len(seen) == 0 {
+				go func() {
+					sst.Insert(b("foo.zzz"), 1)
+					close(written)
+				}()
+				for sst.stripes[0].waiting.Load() == 0 {
+					time.Sleep(time.Millisecond)
+				}
+				time.Sleep(2 * time.Millisecond)
+			}
+			seen[string(subject)]++
+			select {
+			case <-written:
+				sawWrite = true
+			default:
+			}
+		})
+		<-written
+		// Without a grace period the writer waits for the match to be done.
+		require_Equal(t, sawWrite, grace > 0)
+		expected := 1000
+		if grace > 0 {
+			expected++
+		}
+		require_Equal(t, len(seen), expected)
+		for subj, n := range seen {
+			if n != 1 {
+				t.Fatalf("Expected %q to be matched once, got %d", subj, n)
+			}
+		}
+	}
+}
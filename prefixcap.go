@@ -0,0 +1,57 @@
+package subtree
+
+//-------------------
+// Capping node prefixes
+//-------------------
+
+// WithMaxPrefix caps the prefix held by an internal node at max bytes. A longer shared prefix, e.g. of long
+// IDs, is spread over a chain of nodes holding a single child each, instead of one allocation holding all of
+// it that is copied again whenever the node is split or collapsed. Deletes and compactions do not collapse
+// a chain node into its child when the result would exceed the cap. Leaf suffixes are not capped.
+// The number of chain nodes created is reported as PrefixChains in Stats. A max of 0 disables the cap.
+func WithMaxPrefix(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			o.invalid("WithMaxPrefix of negative length %d", n)
+		}
+		o.maxPrefix = max(n, 0)
+	}
+}
+
+// capPrefix returns n, or the head of a chain of new nodes holding the part of its prefix over the cap.
+// The node must be ours to modify.
+func (t *SubjectTree[T]) capPrefix(n node) node {
+	limit, bn := t.opts.maxPrefix, n.base()
+	if limit <= 0 || bn == nil || len(bn.prefix) <= limit {
+		return n
+	}
+	prefix := bn.prefix
+	head := t.newNode4(prefix[:limit])
+	bn.prefix = t.copyFrag(prefix[limit:])
+	c := bn.prefix[0]
+	head.addChild(c, t.capPrefix(n))
+	head.leaves = bn.leaves
+	t.counts.PrefixChains++
+	return head
+}
+
+// collapses returns true if a node with prefix pre and cn as its only child can be collapsed into cn
+// without exceeding the prefix cap.
+func (t *SubjectTree[T]) collapses(pre []byte, cn node) bool {
+	limit := t.opts.maxPrefix
+	return limit <= 0 || cn.isLeaf() || len(pre)+len(cn.path()) <= limit
+}
+
+// chained returns true if n, with prefix pre, is down to a single child it can not be collapsed into
+// because of the prefix cap.
+func (t *SubjectTree[T]) chained(pre []byte, n node) bool {
+	if t.opts.maxPrefix <= 0 || n.numChildren() != 1 {
+		return false
+	}
+	var cn node
+	n.iter(func(c node) bool {
+		cn = c
+		return false
+	})
+	return cn != nil && !t.collapses(pre, cn)
+}
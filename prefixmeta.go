@@ -0,0 +1,76 @@
+package subtree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//-------------------
+// Prefix annotations
+//-------------------
+
+// SetPrefixMeta attaches meta to the literal tokens of prefix, e.g. a routing policy for the namespace of all
+// subjects below "tenant.a". Annotations are kept apart from the entries, so a namespace no longer has to be
+// stored as a subject of its own to carry a value: they are not counted by Size, not visited by iteration or
+// matches, and kept by Empty. MatchWithMeta hands them to its callback. A nil meta removes the annotation.
+// Panics if the prefix is empty, has empty tokens or has wildcard tokens, like View.
+func (t *SubjectTree[T]) SetPrefixMeta(prefix []byte, meta any) {
+	if t == nil {
+		return
+	}
+	if n := len(prefix); n > 0 && prefix[n-1] == tsep {
+		prefix = prefix[:n-1]
+	}
+	if !validFilter(prefix) || prefixHasWildcard(prefix) {
+		panic(fmt.Sprintf("subtree: invalid meta prefix %q", prefix))
+	}
+	prefix = t.canon(prefix)
+	if meta == nil {
+		delete(t.prefixMeta, string(prefix))
+		return
+	}
+	if t.prefixMeta == nil {
+		t.prefixMeta = make(map[string]any)
+	}
+	t.prefixMeta[string(prefix)] = meta
+}
+
+// PrefixMeta returns the meta attached to exactly the prefix, or false if there is none.
+func (t *SubjectTree[T]) PrefixMeta(prefix []byte) (any, bool) {
+	if t == nil || len(t.prefixMeta) == 0 {
+		return nil, false
+	}
+	if n := len(prefix); n > 0 && prefix[n-1] == tsep {
+		prefix = prefix[:n-1]
+	}
+	meta, ok := t.prefixMeta[string(t.canon(prefix))]
+	return meta, ok
+}
+
+// MetaFor returns the meta that applies to the subject: the one attached to the longest prefix of its tokens,
+// the subject itself included, or nil if none of them is annotated.
+func (t *SubjectTree[T]) MetaFor(subject []byte) any {
+	if t == nil || len(t.prefixMeta) == 0 {
+		return nil
+	}
+	return t.metaFor(t.canon(subject))
+}
+
+// metaFor is MetaFor for a subject as the tree holds it.
+func (t *SubjectTree[T]) metaFor(subject []byte) any {
+	for end := len(subject); end > 0; end = max(bytes.LastIndexByte(subject[:end], tsep), 0) {
+		if meta, ok := t.prefixMeta[string(subject[:end])]; ok {
+			return meta
+		}
+	}
+	return nil
+}
+
+// MatchWithMeta is like Match but also hands the callback the meta that applies to each subject, as returned
+// by MetaFor, so policies attached with SetPrefixMeta can be applied while matching.
+func (t *SubjectTree[T]) MatchWithMeta(filter []byte, cb func(subject []byte, val *T, meta any)) {
+	if t == nil || cb == nil {
+		return
+	}
+	t.Match(filter, func(subject []byte, val *T) { cb(subject, val, t.metaFor(subject)) })
+}
@@ -0,0 +1,179 @@
+package subtree
+
+import (
+	"bytes"
+	"cmp"
+	"slices"
+)
+
+//-------------------
+// Profiling the stored subjects
+//-------------------
+
+// Histogram counts how often each value was seen.
+type Histogram map[int]int
+
+// Total returns the number of values seen.
+func (h Histogram) Total() int {
+	var total int
+	for _, c := range h {
+		total += c
+	}
+	return total
+}
+
+// Fraction returns the fraction of the values seen that were v.
+func (h Histogram) Fraction(v int) float64 {
+	if total := h.Total(); total > 0 {
+		return float64(h[v]) / float64(total)
+	}
+	return 0
+}
+
+// Quantile returns the smallest value such that at least the fraction q of the values seen are at or below it.
+func (h Histogram) Quantile(q float64) int {
+	values := make([]int, 0, len(h))
+	for v := range h {
+		values = append(values, v)
+	}
+	slices.Sort(values)
+	need, seen := q*float64(h.Total()), 0
+	for _, v := range values {
+		if seen += h[v]; float64(seen) >= need {
+			return v
+		}
+	}
+	return 0
+}
+
+// Profile describes the shape of the stored subjects, e.g. to choose shard keys or to check assumptions
+// like most subjects having five tokens.
+type Profile struct {
+	Subjects     int         // Number of subjects
+	Tokens       Histogram   // Number of tokens per subject
+	TokenLengths Histogram   // Length in bytes of every token of every subject
+	Fanout       []Histogram // Fanout[l] has the number of distinct tokens following each distinct prefix of l tokens
+}
+
+// Profile walks the tree and returns the distributions of tokens per subject, token lengths and per level fanout.
+func (t *SubjectTree[T]) Profile() Profile {
+	p := Profile{Tokens: Histogram{}, TokenLengths: Histogram{}}
+	// Distinct tokens seen so far at each level below the prefix shared with the previous subject.
+	var open []int
+	var prev []byte
+	var prevTokens, tokens [][]byte
+	closeLevel := func(l int) {
+		for len(p.Fanout) <= l {
+			p.Fanout = append(p.Fanout, Histogram{})
+		}
+		p.Fanout[l][open[l]]++
+	}
+	t.IterOrdered(func(subject []byte, _ *T) bool {
+		p.Subjects++
+		tokens = appendTokens(tokens[:0], subject)
+		p.Tokens[len(tokens)]++
+		for _, tok := range tokens {
+			p.TokenLengths[len(tok)]++
+		}
+		// Subjects come in order, so all subjects sharing a prefix are next to each other.
+		d := 0
+		for d < len(tokens) && d < len(prevTokens) && bytes.Equal(tokens[d], prevTokens[d]) {
+			d++
+		}
+		for l := len(open) - 1; l > d; l-- {
+			closeLevel(l)
+		}
+		open = open[:min(len(open), d+1)]
+		if d < len(open) {
+			open[d]++
+		} else {
+			open = append(open, 1)
+		}
+		for l := d + 1; l < len(tokens); l++ {
+			open = append(open, 1)
+		}
+		prev = append(prev[:0], subject...)
+		prevTokens = appendTokens(prevTokens[:0], prev)
+		return true
+	})
+	for l := len(open) - 1; l >= 0; l-- {
+		closeLevel(l)
+	}
+	return p
+}
+
+// appendTokens appends the tokens of subject to tokens and returns the result.
+func appendTokens(tokens [][]byte, subject []byte) [][]byte {
+	for start := 0; ; {
+		end := tokenEnd(subject, start)
+		tokens = append(tokens, subject[start:end])
+		if end == len(subject) {
+			return tokens
+		}
+		start = end + 1
+	}
+}
+
+//-------------------
+// Most populous prefixes
+//-------------------
+
+// PrefixCount is a prefix of subjects and the number of subjects starting with it.
+type PrefixCount struct {
+	Prefix []byte // The first tokens of the subjects, without a trailing separator
+	Leaves int    // The number of subjects starting with the prefix
+}
+
+// TopPrefixes returns the k prefixes of depth tokens with the most subjects, most populous first and ties in
+// subject order. Subjects with fewer than depth tokens are not counted. Only the nodes above the prefixes are
+// walked, as the leaf counts kept by every node tell how many subjects are below, which makes this cheap even
+// for huge tenants or streams.
+func (t *SubjectTree[T]) TopPrefixes(depth, k int) []PrefixCount {
+	if t == nil || t.root == nil || depth <= 0 || k <= 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	var _pre [256]byte
+	t.countPrefixes(t.root, _pre[:0], 0, depth, counts)
+	top := make([]PrefixCount, 0, len(counts))
+	for prefix, n := range counts {
+		if n > 0 {
+			top = append(top, PrefixCount{Prefix: []byte(prefix), Leaves: n})
+		}
+	}
+	slices.SortFunc(top, func(a, b PrefixCount) int {
+		if a.Leaves != b.Leaves {
+			return cmp.Compare(b.Leaves, a.Leaves)
+		}
+		return bytes.Compare(a.Prefix, b.Prefix)
+	})
+	return top[:min(k, len(top))]
+}
+
+// Internal recursive function for TopPrefixes, seps being the number of separators in pre.
+func (t *SubjectTree[T]) countPrefixes(n node, pre []byte, seps, depth int, counts map[string]int) {
+	start := len(pre)
+	pre = append(pre, n.path()...)
+	for i := start; i < len(pre); i++ {
+		if pre[i] != tsep {
+			continue
+		}
+		if seps++; seps == depth {
+			// Everything below shares the prefix up to this separator.
+			counts[string(pre[:i])] += int(leafCount(n))
+			return
+		}
+	}
+	if n.isLeaf() {
+		// A subject with exactly depth tokens.
+		if seps == depth-1 {
+			counts[string(pre)] += int(leafCount(n))
+		}
+		return
+	}
+	for _, cn := range n.children() {
+		if cn != nil {
+			t.countPrefixes(cn, pre, seps, depth, counts)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package subtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+//-------------------
+// Composable queries
+//-------------------
+
+// ErrInvalidQuery is returned by Query for a query built with an invalid prefix or token.
+var ErrInvalidQuery = errors.New("subtree: invalid query")
+
+// Query describes a lookup combining conditions on the tokens of subjects, built with Q and run with Query.
+// The conditions are checked against the node prefixes during a single walk of the tree, so subtrees that
+// can not hold a match are skipped instead of filtering all subjects in the callback.
+type Query struct {
+	prefix []byte
+	tokens []tokenAt
+	limit  int
+	desc   bool
+	err    error
+}
+
+// Q starts a new query matching every subject.
+func Q() *Query {
+	return &Query{}
+}
+
+// Prefix restricts the query to subjects starting with the literal tokens of prefix, including the subject
+// equal to it. Prefixes that are empty, have empty tokens or wildcards make the query invalid.
+func (q *Query) Prefix(prefix string) *Query {
+	if !validFilter([]byte(prefix)) || prefixHasWildcard([]byte(prefix)) {
+		q.fail(fmt.Errorf("%w: prefix %q", ErrInvalidQuery, prefix))
+	}
+	q.prefix = []byte(prefix)
+	return q
+}
+
+// TokenAt restricts the query to subjects with the literal token at the position, counted from 0. Tokens
+// that are empty, wildcards or hold a separator, and negative positions, make the query invalid.
+func (q *Query) TokenAt(pos int, token string) *Query {
+	if pos < 0 || token == "" || token == string(pwc) || token == string(fwc) || bytes.IndexByte([]byte(token), tsep) >= 0 {
+		q.fail(fmt.Errorf("%w: token %q at %d", ErrInvalidQuery, token, pos))
+	}
+	q.tokens = append(q.tokens, tokenAt{pos, token})
+	return q
+}
+
+// Limit stops the query after n subjects. Zero or less means no limit.
+func (q *Query) Limit(n int) *Query {
+	q.limit = max(n, 0)
+	return q
+}
+
+// OrderAsc visits the subjects in increasing subject order, which is the default.
+func (q *Query) OrderAsc() *Query {
+	q.desc = false
+	return q
+}
+
+// OrderDesc visits the subjects in decreasing subject order. The walk still goes through the matches in
+// increasing order and keeps the last ones, up to the limit, so a limit does not end it early.
+func (q *Query) OrderDesc() *Query {
+	q.desc = true
+	return q
+}
+
+// fail records the first error of the query.
+func (q *Query) fail(err error) {
+	if q.err == nil {
+		q.err = err
+	}
+}
+
+// queryPlan is a query compiled for a tree, with the token wanted at every position that has a condition.
+type queryPlan struct {
+	want  [][]byte // Token wanted at each position, nil for any
+	empty bool     // The conditions contradict each other, so nothing matches
+}
+
+// compile turns the conditions of the query into a plan for the tree, with the tokens as the tree holds them.
+func (t *SubjectTree[T]) compile(q *Query) queryPlan {
+	var p queryPlan
+	set := func(pos int, token []byte) {
+		if bytes.IndexByte(token, tsep) >= 0 {
+			// Rewritten into several tokens, which no single position can hold.
+			p.empty = true
+			return
+		}
+		for len(p.want) <= pos {
+			p.want = append(p.want, nil)
+		}
+		if p.want[pos] != nil && !bytes.Equal(p.want[pos], token) {
+			p.empty = true
+		}
+		p.want[pos] = token
+	}
+	if q.prefix != nil {
+		prefix := t.canon(q.prefix)
+		for start, pos := 0, 0; start <= len(prefix); pos++ {
+			end := tokenEnd(prefix, start)
+			set(pos, prefix[start:end])
+			start = end + 1
+		}
+	}
+	for _, ta := range q.tokens {
+		set(ta.pos, t.canon([]byte(ta.token)))
+	}
+	return p
+}
+
+// excludes returns true if no subject starting with path meets the conditions of the plan. If whole is true
+// path is a complete subject.
+func (p *queryPlan) excludes(path []byte, whole bool) bool {
+	pos, start := 0, 0
+	for ; pos < len(p.want) && start <= len(path); pos++ {
+		end := tokenEnd(path, start)
+		if want := p.want[pos]; want != nil {
+			token := path[start:end]
+			if end < len(path) || whole {
+				if !bytes.Equal(token, want) {
+					return true
+				}
+			} else if !bytes.HasPrefix(want, token) {
+				// The last token may still go on in the nodes below.
+				return true
+			}
+		}
+		if end == len(path) {
+			pos++
+			break
+		}
+		start = end + 1
+	}
+	// A complete subject has to reach every position with a condition.
+	return whole && pos < len(p.want)
+}
+
+// Query runs the query and invokes the callback for every matching subject, in the order of the query and
+// up to its limit. The callback can return false to stop. Returns an error wrapping ErrInvalidQuery if the
+// query was built with invalid conditions. The value pointer and subject have the same semantics as for
+// IterOrdered.
+func (t *SubjectTree[T]) Query(q *Query, cb func(subject []byte, val *T) bool) error {
+	if q.err != nil {
+		return q.err
+	}
+	if t == nil || t.root == nil || cb == nil {
+		return nil
+	}
+	p := t.compile(q)
+	if p.empty {
+		return nil
+	}
+	cb = t.guardIter(cb)
+	if hook := t.opts.latency; hook != nil {
+		var n int
+		inner := cb
+		cb = func(subject []byte, val *T) bool {
+			n++
+			return inner(subject, val)
+		}
+		defer func(start time.Time) { hook(CallMatch, t.opts.since(start), n) }(t.opts.now())
+	}
+	var n int
+	var last []Entry[*T] // Ring of the last matches, for a descending query
+	visit := func(subject []byte, val *T) bool {
+		if p.excludes(subject, true) {
+			return true
+		}
+		n++
+		if q.desc {
+			if q.limit == 0 || len(last) < q.limit {
+				last = append(last, Entry[*T]{Subject: copyBytes(subject), Value: val})
+			} else {
+				// Replace the oldest match, reusing its subject.
+				e := &last[(n-1)%q.limit]
+				e.Subject, e.Value = append(e.Subject[:0], subject...), val
+			}
+			return true
+		}
+		return cb(subject, val) && (q.limit == 0 || n < q.limit)
+	}
+	pre := preBufs.Get().(*[256]byte)
+	defer preBufs.Put(pre)
+	parts := [][]byte{fwcPart}
+	t.matchSorted(t.root, parts, pre[:0], nil, 0, func(_ int, path []byte) bool {
+		return p.excludes(path, false)
+	}, visit)
+	for i := range last {
+		if e := &last[(n-1-i)%len(last)]; !cb(e.Subject, e.Value) {
+			break
+		}
+	}
+	return nil
+}
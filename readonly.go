@@ -0,0 +1,52 @@
+package subtree
+
+//-------------------
+// Read only handles
+//-------------------
+
+// ROTree is a read only handle to a tree, for components that must never modify it, e.g. metrics exporters
+// and debug handlers. Unlike the tree it has no methods that modify, and values are handed out as copies, so
+// it can not be written through either. It reads the current contents of the tree, so it has the same
+// synchronization requirements as the tree it came from. Use Snapshot for a view that does not change.
+type ROTree[T any] struct {
+	t *SubjectTree[T]
+}
+
+// ReadOnly returns a read only handle to the tree.
+func (t *SubjectTree[T]) ReadOnly() ROTree[T] {
+	return ROTree[T]{t: t}
+}
+
+// Size returns the number of elements stored.
+func (r ROTree[T]) Size() int { return r.t.Size() }
+
+// Version returns the current version of the tree.
+func (r ROTree[T]) Version() uint64 { return r.t.Version() }
+
+// Stats returns the structural statistics of the tree.
+func (r ROTree[T]) Stats() TreeStats { return r.t.Stats() }
+
+// Find returns a copy of the value of the subject, or false if it was not found.
+func (r ROTree[T]) Find(subject []byte) (T, bool) { return r.t.FindVal(subject) }
+
+// Match calls the callback with a copy of the value of every subject matching the filter.
+// The subject is only valid for the duration of the callback.
+func (r ROTree[T]) Match(filter []byte, cb func(subject []byte, val T)) { r.t.MatchVals(filter, cb) }
+
+// IterOrdered walks all entries in subject order, handing the callback copies of the values.
+// The callback can return false to terminate the walk.
+func (r ROTree[T]) IterOrdered(cb func(subject []byte, val T) bool) {
+	if cb == nil {
+		return
+	}
+	r.t.IterOrdered(func(subject []byte, val *T) bool { return cb(subject, *val) })
+}
+
+// IterFast walks all entries with no guarantees of ordering, handing the callback copies of the values.
+// The callback can return false to terminate the walk.
+func (r ROTree[T]) IterFast(cb func(subject []byte, val T) bool) {
+	if cb == nil {
+		return
+	}
+	r.t.IterFast(func(subject []byte, val *T) bool { return cb(subject, *val) })
+}
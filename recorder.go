@@ -0,0 +1,208 @@
+package subtree
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+//-------------------
+// Recording and replaying workloads
+//-------------------
+
+// ErrInvalidRecord is returned by Replay for a recording it can not read.
+var ErrInvalidRecord = errors.New("subtree: invalid record")
+
+// Names of the recorded operations.
+const (
+	recInsert = "insert"
+	recDelete = "delete"
+	recFind   = "find"
+	recMatch  = "match"
+	recEmpty  = "empty"
+)
+
+// Recorder captures the operations done on a tree, so that a workload seen in production can be replayed
+// deterministically elsewhere with Replay. It records inserts, deletes, finds, matches and empties with
+// their subject or filter. Modifications are recorded once they succeeded, so inserts of invalid subjects or
+// deletes of missing ones are left out. Matches are recorded for the Match methods, not for walks the tree
+// makes to serve other calls, like Reduce, MatchOne or Dump. Values are only recorded by a Recorder created
+// with NewValueRecorder. Each operation is written as one line holding its name, the quoted subject and the
+// quoted value, if any. A Recorder is safe for concurrent use, so it can record readers sharing a tree.
+type Recorder struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	encode func(dst []byte, v any) ([]byte, error) // Encoder of values, nil to not record them
+	buf    []byte
+	vbuf   []byte
+	ops    int
+	err    error
+}
+
+// NewRecorder creates a Recorder writing to w. Call Flush when done recording.
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{w: bufio.NewWriter(w)}
+}
+
+// NewValueRecorder creates a Recorder like NewRecorder that also records the values of inserts, encoded
+// with encodeValue, so that ReplayValues can insert them again. It can only record trees with values T,
+// recording any other tree fails with an error returned by Flush.
+func NewValueRecorder[T any](w io.Writer, encodeValue func(dst []byte, v T) ([]byte, error)) *Recorder {
+	r := NewRecorder(w)
+	r.encode = func(dst []byte, v any) ([]byte, error) {
+		tv, ok := v.(*T)
+		if !ok {
+			return dst, fmt.Errorf("subtree: recorder for values of type %T used with %T", *new(T), v)
+		}
+		return encodeValue(dst, *tv)
+	}
+	return r
+}
+
+// SetRecorder starts recording the operations on the tree with r, or stops recording if r is nil.
+func (t *SubjectTree[T]) SetRecorder(r *Recorder) {
+	if t == nil {
+		return
+	}
+	t.recorder = r
+}
+
+// recordMatch records a match of the filter with the recorder, if set.
+func (t *SubjectTree[T]) recordMatch(filter []byte) {
+	if t != nil && t.recorder != nil {
+		t.recorder.record(recMatch, t.canon(filter), nil)
+	}
+}
+
+// recordOp records a modification as logged by the tree.
+func (r *Recorder) recordOp(op Op, subject []byte, v any) {
+	switch op {
+	case OpInsert, OpUpdate:
+		r.record(recInsert, subject, v)
+	case OpDelete:
+		r.record(recDelete, subject, nil)
+	case OpEmpty:
+		r.record(recEmpty, nil, nil)
+	}
+}
+
+// Ops returns the number of operations recorded.
+func (r *Recorder) Ops() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ops
+}
+
+// Flush writes out any buffered records and returns the first error writing the recording, if any.
+func (r *Recorder) Flush() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err == nil {
+		r.err = r.w.Flush()
+	}
+	return r.err
+}
+
+// record writes a single operation, with the value if not nil and values are recorded.
+// After a write or encoding error nothing more is recorded.
+func (r *Recorder) record(op string, subject []byte, v any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.err != nil {
+		return
+	}
+	r.buf = append(r.buf[:0], op...)
+	if subject != nil {
+		r.buf = append(r.buf, ' ')
+		r.buf = strconv.AppendQuote(r.buf, bytesString(subject))
+	}
+	if v != nil && r.encode != nil {
+		if r.vbuf, r.err = r.encode(r.vbuf[:0], v); r.err != nil {
+			return
+		}
+		r.buf = append(r.buf, ' ')
+		r.buf = strconv.AppendQuote(r.buf, bytesString(r.vbuf))
+	}
+	r.buf = append(r.buf, '\n')
+	if _, r.err = r.w.Write(r.buf); r.err == nil {
+		r.ops++
+	}
+}
+
+// Replay reads a recording made by a Recorder and runs its operations on the tree in order.
+// Inserts store the zero value, whether the recording holds values or not.
+func Replay[T any](r io.Reader, st *SubjectTree[T]) error {
+	return replay(r, st, nil)
+}
+
+// ReplayValues is like Replay for a recording made by a Recorder from NewValueRecorder, and inserts the
+// recorded values decoded with decodeValue. A recording without values is invalid.
+func ReplayValues[T any](r io.Reader, st *SubjectTree[T], decodeValue func(b []byte) (T, error)) error {
+	return replay(r, st, decodeValue)
+}
+
+// replay runs the operations of a recording on the tree, decoding the values of inserts if decodeValue is set.
+func replay[T any](r io.Reader, st *SubjectTree[T], decodeValue func(b []byte) (T, error)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for line := 1; sc.Scan(); line++ {
+		invalid := func() error { return fmt.Errorf("%w on line %d: %q", ErrInvalidRecord, line, sc.Bytes()) }
+		op, args, ok := parseRecord(sc.Text())
+		if !ok || len(args) > 2 {
+			return invalid()
+		}
+		var subject []byte
+		if len(args) > 0 {
+			subject = []byte(args[0])
+		}
+		switch op {
+		case recInsert:
+			var value T
+			if decodeValue != nil {
+				if len(args) != 2 {
+					return invalid()
+				}
+				var err error
+				if value, err = decodeValue([]byte(args[1])); err != nil {
+					return fmt.Errorf("%w: %w", invalid(), err)
+				}
+			}
+			st.Insert(subject, value)
+		case recDelete:
+			st.Delete(subject)
+		case recFind:
+			st.Find(subject)
+		case recMatch:
+			st.MatchValues(subject, func(_ *T) {})
+		case recEmpty:
+			st.Empty()
+		default:
+			return invalid()
+		}
+	}
+	return sc.Err()
+}
+
+// parseRecord splits a line of a recording into the name of the operation and its quoted arguments.
+func parseRecord(line string) (op string, args []string, ok bool) {
+	op, rest, _ := strings.Cut(line, " ")
+	for rest != "" {
+		q, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return "", nil, false
+		}
+		arg, _ := strconv.Unquote(q)
+		args = append(args, arg)
+		if rest = rest[len(q):]; rest != "" {
+			if rest[0] != ' ' {
+				return "", nil, false
+			}
+			rest = rest[1:]
+		}
+	}
+	return op, args, true
+}
@@ -0,0 +1,69 @@
+package subtree
+
+import (
+	"fmt"
+	"io"
+)
+
+//-------------------
+// Recovering from corruption
+//-------------------
+
+// WithRecover makes Insert, Delete and Match recover from panics caused by a corrupted tree instead of taking
+// the process down. The operation is abandoned, possibly halfway, and the error is kept until Validate finds
+// the tree intact again, see Err. InsertE and DeleteE return it. Panics raised by callbacks are not recovered.
+func WithRecover() Option {
+	return func(o *options) {
+		o.recover = true
+	}
+}
+
+// PanicHook is called for every panic recovered from, with a function that dumps the tree for diagnostics.
+// Dumping a corrupted tree can itself fail, so the hook should be ready for that.
+type PanicHook func(err error, dump func(w io.Writer))
+
+// WithPanicHook enables WithRecover and calls hook for every recovered panic.
+func WithPanicHook(hook PanicHook) Option {
+	return func(o *options) {
+		o.recover = true
+		o.panicHook = hook
+	}
+}
+
+// Err returns the error of the last panic recovered from with WithRecover, or nil. Once set the tree should
+// be checked with Validate, and rebuilt or compacted when that fails. A successful Validate clears the error.
+func (t *SubjectTree[T]) Err() error {
+	if t == nil {
+		return nil
+	}
+	return t.broken
+}
+
+// recoverPanic is deferred by operations when recovering is enabled, and records a panic as the error
+// of the tree. A panic raised while inCb is set came from a callback and is passed on.
+func (t *SubjectTree[T]) recoverPanic(op string, subject []byte, inCb *bool) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	if inCb != nil && *inCb {
+		panic(r)
+	}
+	t.broken = fmt.Errorf("%w: %s of %q: %v", ErrInvalidTree, op, subject, r)
+	if hook := t.opts.panicHook; hook != nil {
+		hook(t.broken, t.Dump)
+	}
+}
+
+// DeleteE is like Delete but returns the error of a panic recovered from with WithRecover.
+func (t *SubjectTree[T]) DeleteE(subject []byte) (*T, bool, error) {
+	if t == nil {
+		return nil, false, nil
+	}
+	before := t.broken
+	val, deleted := t.Delete(subject)
+	if t.broken != before {
+		return nil, false, t.broken
+	}
+	return val, deleted, nil
+}
@@ -0,0 +1,82 @@
+package subtree
+
+import "cmp"
+
+//-------------------
+// Aggregating matches
+//-------------------
+
+// Number is the constraint for the results of SumMatching.
+type Number interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr |
+		~float32 | ~float64
+}
+
+// Reduce folds all entries matching the filter into a result, starting from init and calling f with the
+// result so far for every match, which returns the next result. Matches are visited in no particular order.
+// The subject and value pointer passed to f have the same semantics as for Match.
+func Reduce[T, A any](t *SubjectTree[T], filter []byte, init A, f func(acc A, subject []byte, v *T) A) A {
+	if t == nil || f == nil {
+		return init
+	}
+	acc := init
+	t.matchFilter(filter, true, t.guardMatch(func(subject []byte, v *T) { acc = f(acc, subject, v) }))
+	return acc
+}
+
+// MatchProject invokes the callback for every entry matching the filter with what proj returns for its value,
+// evaluated during the walk, so callers can pass small records on instead of pointers into large values. Matches
+// are visited in no particular order. The subject has the same semantics as for Match.
+func MatchProject[T, P any](t *SubjectTree[T], filter []byte, proj func(v *T) P, cb func(subject []byte, p P)) {
+	if t == nil || proj == nil || cb == nil {
+		return
+	}
+	t.matchFilter(filter, true, t.guardMatch(func(subject []byte, v *T) { cb(subject, proj(v)) }))
+}
+
+// reduceValues is Reduce without building the subjects of the matches.
+func reduceValues[T, A any](t *SubjectTree[T], filter []byte, init A, f func(acc A, v *T) A) A {
+	if t == nil {
+		return init
+	}
+	acc := init
+	t.matchFilter(filter, false, t.guardMatch(func(_ []byte, v *T) { acc = f(acc, v) }))
+	return acc
+}
+
+// CountMatching returns the number of entries matching the filter.
+func (t *SubjectTree[T]) CountMatching(filter []byte) int {
+	return reduceValues(t, filter, 0, func(n int, _ *T) int { return n + 1 })
+}
+
+// SumMatching returns the sum of what extract returns for the values of the entries matching the filter.
+func SumMatching[T any, N Number](t *SubjectTree[T], filter []byte, extract func(v *T) N) N {
+	return reduceValues(t, filter, 0, func(sum N, v *T) N { return sum + extract(v) })
+}
+
+// MinMatching returns the smallest of what key returns for the values of the entries matching the filter,
+// or false if nothing matched.
+func MinMatching[T any, K cmp.Ordered](t *SubjectTree[T], filter []byte, key func(v *T) K) (K, bool) {
+	return extremeMatching(t, filter, key, -1)
+}
+
+// MaxMatching returns the largest of what key returns for the values of the entries matching the filter,
+// or false if nothing matched.
+func MaxMatching[T any, K cmp.Ordered](t *SubjectTree[T], filter []byte, key func(v *T) K) (K, bool) {
+	return extremeMatching(t, filter, key, 1)
+}
+
+// extremeMatching returns the key comparing as sign to all others, -1 for the smallest and 1 for the largest.
+func extremeMatching[T any, K cmp.Ordered](t *SubjectTree[T], filter []byte, key func(v *T) K, sign int) (K, bool) {
+	type extreme struct {
+		k  K
+		ok bool
+	}
+	e := reduceValues(t, filter, extreme{}, func(e extreme, v *T) extreme {
+		if k := key(v); !e.ok || cmp.Compare(k, e.k) == sign {
+			return extreme{k, true}
+		}
+		return e
+	})
+	return e.k, e.ok
+}
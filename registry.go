@@ -0,0 +1,151 @@
+package subtree
+
+import (
+	"errors"
+	"sync"
+)
+
+//-------------------
+// Subscription registry
+//-------------------
+
+// ErrInvalidFilter is returned when subscribing with a filter that is empty, has empty tokens or has a
+// full wildcard that is not the last token.
+var ErrInvalidFilter = errors.New("subtree: invalid filter")
+
+// Registry keeps track of subscribers and the filters they subscribed with, and finds the subscribers
+// interested in a subject. Filters are stored in a SubjectTree and looked up with ReverseMatch, so
+// delivering costs the same regardless of how many unrelated filters are registered.
+// A Registry is safe for concurrent use by multiple goroutines.
+type Registry[S comparable] struct {
+	mu   sync.RWMutex
+	t    *SubjectTree[map[S]struct{}] // Filter to the set of its subscribers
+	subs int                          // Number of (filter, subscriber) pairs
+}
+
+// NewRegistry creates a new empty Registry for subscribers S.
+func NewRegistry[S comparable]() *Registry[S] {
+	return &Registry[S]{t: NewSubjectTree[map[S]struct{}]()}
+}
+
+// Subscribe registers interest of sub in subjects matching filter. Returns false if sub was already
+// subscribed with this filter, or ErrInvalidFilter if the filter is not valid.
+func (r *Registry[S]) Subscribe(filter []byte, sub S) (bool, error) {
+	if !validFilter(filter) {
+		return false, ErrInvalidFilter
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if set, ok := r.t.Find(filter); ok {
+		if _, ok := (*set)[sub]; ok {
+			return false, nil
+		}
+		(*set)[sub] = struct{}{}
+	} else {
+		r.t.Insert(filter, map[S]struct{}{sub: {}})
+	}
+	r.subs++
+	return true, nil
+}
+
+// Unsubscribe removes interest of sub in filter. The filter must be the same one used to subscribe.
+// Returns false if sub was not subscribed with this filter.
+func (r *Registry[S]) Unsubscribe(filter []byte, sub S) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	set, ok := r.t.Find(filter)
+	if !ok {
+		return false
+	}
+	if _, ok := (*set)[sub]; !ok {
+		return false
+	}
+	delete(*set, sub)
+	if len(*set) == 0 {
+		// Don't keep filters nobody is interested in around.
+		r.t.Delete(filter)
+	}
+	r.subs--
+	return true
+}
+
+// DeliverTo calls the callback once for every subscriber with a filter matching the literal subject,
+// in no particular order. A subscriber matched through several filters is only delivered to once.
+// The callback is run without holding the lock, so it can subscribe and unsubscribe.
+// Returns the number of subscribers delivered to.
+func (r *Registry[S]) DeliverTo(subject []byte, cb func(sub S)) int {
+	var subs []S
+	var seen map[S]struct{}
+	var filters int
+	r.mu.RLock()
+	r.t.ReverseMatch(subject, func(_ []byte, set *map[S]struct{}) {
+		// Only pay for deduplication when more than one filter matched.
+		if filters++; filters == 2 {
+			seen = make(map[S]struct{}, len(subs)+len(*set))
+			for _, sub := range subs {
+				seen[sub] = struct{}{}
+			}
+		}
+		for sub := range *set {
+			if seen != nil {
+				if _, ok := seen[sub]; ok {
+					continue
+				}
+				seen[sub] = struct{}{}
+			}
+			subs = append(subs, sub)
+		}
+	})
+	r.mu.RUnlock()
+	if cb != nil {
+		for _, sub := range subs {
+			cb(sub)
+		}
+	}
+	return len(subs)
+}
+
+// HasInterest returns true if any subscriber has a filter matching the literal subject.
+func (r *Registry[S]) HasInterest(subject []byte) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.t.HasInterestMatching(subject)
+}
+
+// Filters returns the number of distinct filters with at least one subscriber.
+func (r *Registry[S]) Filters() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.t.Size()
+}
+
+// Subscriptions returns the number of (filter, subscriber) pairs registered.
+func (r *Registry[S]) Subscriptions() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.subs
+}
+
+// validFilter returns true if the filter is not empty, has no empty tokens, and a full wildcard only
+// as the last token. It must also be storable in the tree.
+func validFilter(filter []byte) bool {
+	if len(filter) == 0 {
+		return false
+	}
+	for start := 0; start <= len(filter); {
+		end := tokenEnd(filter, start)
+		if end == start {
+			return false // Empty token
+		}
+		for _, c := range filter[start:end] {
+			if c == noPivot {
+				return false
+			}
+		}
+		if end-start == 1 && filter[start] == fwc && end != len(filter) {
+			return false // Full wildcard must be last
+		}
+		start = end + 1
+	}
+	return true
+}
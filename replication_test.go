@@ -0,0 +1,126 @@
+package subtree
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"testing"
+)
+
+//-------------------
+//  Test for Last-Writer-Wins Merging
+//-------------------
+
+// Test that two diverged replicas converge after merging in both directions.
+func TestSubjectTreeMergeLWW(t *testing.T) {
+	for _, mode := range []StampMode{StampLamport, StampWallClock} {
+		a, bt := NewSubjectTree[int](), NewSubjectTree[int]()
+		a.EnableLWW(1, mode)
+		bt.EnableLWW(2, mode)
+
+		// Common starting point.
+		for i := 0; i < 10; i++ {
+			a.Insert(b(fmt.Sprintf("foo.%d", i)), i)
+		}
+		require_Equal(t, bt.MergeLWW(a), 10)
+
+		// Diverge. a updates 1 and deletes 2, b deletes 1 and updates 2, both add their own and update 3.
+		// With lamport clocks the conflicting writes have the same time and the higher replica id wins,
+		// with wall clocks the writes made on b are later.
+		a.Insert(b("foo.1"), 100)
+		a.Delete(b("foo.2"))
+		a.Insert(b("foo.a"), 1)
+		a.Insert(b("foo.3"), 300)
+		bt.Delete(b("foo.1"))
+		bt.Insert(b("foo.2"), 200)
+		bt.Insert(b("foo.b"), 2)
+		bt.Insert(b("foo.3"), 301)
+
+		a.MergeLWW(bt)
+		bt.MergeLWW(a)
+
+		var ea, eb []string
+		a.IterOrdered(func(subject []byte, v *int) bool {
+			ea = append(ea, fmt.Sprintf("%s=%d", subject, *v))
+			return true
+		})
+		bt.IterOrdered(func(subject []byte, v *int) bool {
+			eb = append(eb, fmt.Sprintf("%s=%d", subject, *v))
+			return true
+		})
+		require_Equal(t, fmt.Sprint(ea), fmt.Sprint(eb))
+
+		// The writes from b win.
+		_, found := a.Find(b("foo.1"))
+		require_False(t, found)
+		v, found := a.Find(b("foo.2"))
+		require_True(t, found)
+		require_Equal(t, *v, 200)
+		v, found = a.Find(b("foo.3"))
+		require_True(t, found)
+		require_Equal(t, *v, 301)
+		_, found = a.Find(b("foo.a"))
+		require_True(t, found)
+		_, found = a.Find(b("foo.b"))
+		require_True(t, found)
+
+		// Merging again is a no-op.
+		require_Equal(t, a.MergeLWW(bt), 0)
+		require_Equal(t, bt.MergeLWW(a), 0)
+
+		st, ok := a.StampOf(b("foo.1"))
+		require_True(t, ok)
+		require_Equal(t, st.Replica, 2)
+		require_True(t, a.PruneTombstones(st.Time+1) > 0)
+		_, ok = a.StampOf(b("foo.1"))
+		require_False(t, ok)
+	}
+}
+
+//-------------------
+//  Test for Comparing Trees
+//-------------------
+
+// Test equality, hashing and diffing of trees built in different orders.
+func TestSubjectTreeEqualHashDiff(t *testing.T) {
+	eq := func(a, b int) bool { return a == b }
+	hashValue := func(h hash.Hash, v int) { fmt.Fprint(h, v) }
+	sum := func(st *SubjectTree[int]) string {
+		h := sha256.New()
+		st.Hash(h, hashValue)
+		return string(h.Sum(nil))
+	}
+
+	a, bt := NewSubjectTree[int](), NewSubjectTree[int]()
+	require_True(t, a.Equal(bt, eq))
+	for i := 0; i < 500; i++ {
+		a.Insert(b(fmt.Sprintf("foo.%d.bar", i)), i)
+		bt.Insert(b(fmt.Sprintf("foo.%d.bar", 499-i)), 499-i)
+	}
+	// Add and remove something in one of them so the shapes differ.
+	a.Insert(b("foo.bar"), 1)
+	a.Delete(b("foo.bar"))
+	require_True(t, a.Equal(bt, eq))
+	require_Equal(t, sum(a), sum(bt))
+
+	bt.Insert(b("foo.22.bar"), 0)
+	bt.Delete(b("foo.33.bar"))
+	bt.Insert(b("foo.new"), 1)
+	require_False(t, a.Equal(bt, eq))
+	require_True(t, sum(a) != sum(bt))
+
+	var diffs []string
+	a.Diff(bt, eq, func(subject []byte, av, bv *int) bool {
+		diffs = append(diffs, fmt.Sprintf("%s:%v:%v", subject, av != nil, bv != nil))
+		return true
+	})
+	require_Equal(t, fmt.Sprint(diffs), "[foo.22.bar:true:true foo.33.bar:true:false foo.new:false:true]")
+
+	// Stopping early.
+	count := 0
+	a.Diff(bt, eq, func(_ []byte, _, _ *int) bool {
+		count++
+		return false
+	})
+	require_Equal(t, count, 1)
+}
@@ -0,0 +1,252 @@
+package subtree
+
+import "bytes"
+
+//-------------------
+// Matching stored filters against a subject
+//-------------------
+
+// ReverseMatch calls the callback for every stored entry whose subject, read as a filter, matches the
+// literal subject. This is the reverse of Match: the wildcards are in the tree, not in the argument.
+// A stored token that is exactly `*` matches any single token, a stored `>` as the last token matches
+// one or more remaining tokens, and all other tokens must match literally.
+// The filter passed to the callback is only valid for the duration of the callback.
+func (t *SubjectTree[T]) ReverseMatch(subject []byte, cb func(filter []byte, val *T)) {
+	if t == nil || cb == nil {
+		return
+	}
+	cb = t.guardMatch(cb)
+	t.reverseMatchAll(subject, func(filter []byte, val *T) bool {
+		cb(filter, val)
+		return true
+	})
+}
+
+// Internal function to run a reverse match from the root. The callback can return false to stop.
+// Returns false if the callback asked to stop.
+func (t *SubjectTree[T]) reverseMatchAll(subject []byte, cb func(filter []byte, val *T) bool) bool {
+	if t == nil || t.root == nil || len(subject) == 0 {
+		return true
+	}
+	subject = t.canon(subject)
+	pre := preBufs.Get().(*[256]byte)
+	defer preBufs.Put(pre)
+	return t.reverseMatch(t.root, subject, reverseState{tok: true}, pre[:0], cb)
+}
+
+// Modes of a reverse match, telling how the last stored byte was read.
+const (
+	revLiteral uint8 = iota // Stored bytes are compared with the subject
+	revPWC                  // A `*` started a token, it is a wildcard if the token ends here
+	revFWC                  // A `>` started a token, it is a wildcard if the stored subject ends here
+)
+
+// reverseState tracks how far a stored subject has been matched against a literal subject.
+// Every stored subject is read one way only, so a stored entry is never reported twice.
+type reverseState struct {
+	si   int   // Position in the subject
+	mode uint8 // How the last stored byte was read
+	tok  bool  // True if the next stored byte starts a token
+}
+
+// step consumes the next stored byte c. Returns false if the stored subject can no longer match.
+func (s *reverseState) step(subject []byte, c byte) bool {
+	switch s.mode {
+	case revPWC:
+		if c == tsep {
+			// The `*` was a full token, skip over a token in the subject.
+			end := tokenEnd(subject, s.si)
+			if end == s.si || end >= len(subject) {
+				return false
+			}
+			s.si, s.mode, s.tok = end+1, revLiteral, true
+			return true
+		}
+		// The `*` was part of a longer token, so it has to be matched literally.
+		if !s.literal(subject, pwc) {
+			return false
+		}
+	case revFWC:
+		// A `>` that is not the last token is matched literally.
+		if !s.literal(subject, fwc) {
+			return false
+		}
+	}
+	if s.tok && (c == pwc || c == fwc) {
+		// Can not tell yet if this is a wildcard, that depends on the stored byte after it.
+		if c == pwc {
+			s.mode = revPWC
+		} else {
+			s.mode = revFWC
+		}
+		return true
+	}
+	if !s.literal(subject, c) {
+		return false
+	}
+	s.tok = c == tsep
+	return true
+}
+
+// literal matches c against the subject and moves past it.
+func (s *reverseState) literal(subject []byte, c byte) bool {
+	if s.si >= len(subject) || subject[s.si] != c {
+		return false
+	}
+	s.si++
+	s.mode, s.tok = revLiteral, false
+	return true
+}
+
+// end returns true if a stored subject ending here matches the subject.
+func (s *reverseState) end(subject []byte) bool {
+	switch s.mode {
+	case revPWC:
+		end := tokenEnd(subject, s.si)
+		return end > s.si && end == len(subject)
+	case revFWC:
+		return s.si < len(subject)
+	}
+	return s.si == len(subject)
+}
+
+// exhausted returns true if the subject ran out, so a longer subject could still match from here.
+func (s *reverseState) exhausted(subject []byte) bool {
+	if s.mode == revLiteral {
+		return s.si >= len(subject)
+	}
+	// A pending wildcard could take the rest of the subject and more.
+	return tokenEnd(subject, s.si) == len(subject)
+}
+
+// keys appends the child keys that can continue a match from this state and returns the result.
+func (s *reverseState) keys(subject []byte, keys []byte) []byte {
+	add := func(c byte) {
+		if bytes.IndexByte(keys, c) < 0 {
+			keys = append(keys, c)
+		}
+	}
+	switch s.mode {
+	case revPWC:
+		add(tsep)
+		add(noPivot)
+		if s.si < len(subject) && subject[s.si] == pwc {
+			add(pivot(subject, s.si+1))
+		}
+	case revFWC:
+		add(noPivot)
+		if s.si < len(subject) && subject[s.si] == fwc {
+			add(pivot(subject, s.si+1))
+		}
+	default:
+		add(pivot(subject, s.si))
+		if s.tok {
+			add(pwc)
+			add(fwc)
+		}
+	}
+	return keys
+}
+
+// tokenEnd returns the position of the separator ending the token starting at si, or the subject length.
+func tokenEnd(subject []byte, si int) int {
+	if i := bytes.IndexByte(subject[si:], tsep); i >= 0 {
+		return si + i
+	}
+	return len(subject)
+}
+
+// Internal recursive function for ReverseMatch. Only children that can continue the match are visited.
+// Returns false if the callback asked to stop.
+func (t *SubjectTree[T]) reverseMatch(n node, subject []byte, s reverseState, pre []byte, cb func(filter []byte, val *T) bool) bool {
+	path := n.path()
+	for _, c := range path {
+		if !s.step(subject, c) {
+			return true
+		}
+	}
+	// Note that this append may reallocate, but it doesn't modify "pre" at the callsite.
+	pre = append(pre, path...)
+	if n.isLeaf() {
+		if ln := n.(*leaf[T]); !ln.dead() && s.end(subject) {
+			return cb(pre, &ln.value)
+		}
+		return true
+	}
+	var _keys [4]byte
+	for _, c := range s.keys(subject, _keys[:0]) {
+		if cn := n.findChild(c); cn != nil && !t.reverseMatch(*cn, subject, s, pre, cb) {
+			return false
+		}
+	}
+	return true
+}
+
+// Internal function returning true if a stored entry, read as a filter, could match a subject starting with
+// prefix. Errs on the side of true, e.g. when the prefix ends before a stored literal token does.
+func (t *SubjectTree[T]) interestUnder(prefix []byte) bool {
+	if t == nil || t.root == nil {
+		return false
+	}
+	return t.mayMatch(t.root, prefix, reverseState{tok: true})
+}
+
+// Internal recursive function for interestUnder.
+func (t *SubjectTree[T]) mayMatch(n node, prefix []byte, s reverseState) bool {
+	if leafCount(n) == 0 {
+		return false // Nothing live below
+	}
+	for _, c := range n.path() {
+		if s.exhausted(prefix) {
+			return true
+		}
+		if !s.step(prefix, c) {
+			return false
+		}
+	}
+	if n.isLeaf() || s.exhausted(prefix) {
+		return s.end(prefix) || s.exhausted(prefix)
+	}
+	var _keys [4]byte
+	for _, c := range s.keys(prefix, _keys[:0]) {
+		if cn := n.findChild(c); cn != nil && t.mayMatch(*cn, prefix, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Internal function returning true if a stored entry, read as a filter, matches every subject starting with
+// prefix. That is one matching the prefix with its last `>`.
+func (t *SubjectTree[T]) coversPrefix(prefix []byte) bool {
+	return !t.reverseMatchAll(prefix, func(filter []byte, _ *T) bool {
+		lf := len(filter)
+		return filter[lf-1] != fwc || lf > 1 && filter[lf-2] != tsep
+	})
+}
+
+//-------------------
+// Interest checks
+//-------------------
+
+// HasInterestMatching returns true if any stored entry, read as a filter, matches the literal subject.
+// This is ReverseMatch stopping at the first match, so it does not enumerate all interested filters.
+func (t *SubjectTree[T]) HasInterestMatching(subject []byte) bool {
+	var found bool
+	t.reverseMatchAll(subject, func(_ []byte, _ *T) bool {
+		found = true
+		return false
+	})
+	return found
+}
+
+// HasSubjectsMatching returns true if any stored subject matches the filter.
+// This is Match stopping at the first match, so it does not enumerate all matching subjects.
+func (t *SubjectTree[T]) HasSubjectsMatching(filter []byte) bool {
+	var found bool
+	t.matchOrdered(filter, nil, func(_ []byte, _ *T) bool {
+		found = true
+		return false
+	})
+	return found
+}
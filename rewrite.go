@@ -0,0 +1,102 @@
+package subtree
+
+import (
+	"bytes"
+	"fmt"
+)
+
+//-------------------
+// Token rewrites
+//-------------------
+
+// WithTokenRewrites replaces tokens of subjects and filters on their way into the tree, e.g. {"evt": "events"}
+// to move producers still using a legacy prefix over to the new one, without rewriting code in all of them.
+// Every token equal to a key is replaced by its value before the subject is inserted, looked up, deleted or
+// matched, so the tree only ever holds the new spelling and that is what callbacks get. Values may span
+// several tokens. A key has to be a single token other than a wildcard, and a value can not be empty or hold
+// a wildcard token, which would turn subjects into filters, or a token that is rewritten itself, so rewriting
+// twice changes nothing, or the option is invalid. With
+// WithUnicodeFold keys and values are folded as well. The map is copied.
+func WithTokenRewrites(rewrites map[string]string) Option {
+	table := make(map[string]string, len(rewrites))
+	for from, to := range rewrites {
+		table[from] = to
+	}
+	return func(o *options) {
+		for from, to := range table {
+			if from == "" || from == string(pwc) || from == string(fwc) || bytes.IndexByte([]byte(from), tsep) >= 0 {
+				o.invalid("WithTokenRewrites of %q, which is not a single literal token", from)
+			} else if to == "" {
+				o.invalid("WithTokenRewrites of %q to an empty token", from)
+			}
+		}
+		o.rewrites = table
+	}
+}
+
+// rewriteTable returns the rewrites as they apply to subjects, folded with WithUnicodeFold.
+func (o *options) rewriteTable() map[string]string {
+	if !o.fold || o.rewrites == nil {
+		return o.rewrites
+	}
+	table := make(map[string]string, len(o.rewrites))
+	for from, to := range o.rewrites {
+		table[string(foldSubject([]byte(from)))] = string(foldSubject([]byte(to)))
+	}
+	return table
+}
+
+// checkRewrites returns an error for each value of the rewrites holding a wildcard token or a token that
+// would be rewritten again.
+func checkRewrites(rewrites map[string]string) []error {
+	var errs []error
+	for from, to := range rewrites {
+		if prefixHasWildcard([]byte(to)) {
+			errs = append(errs, fmt.Errorf("%w: WithTokenRewrites of %q to %q, which holds a wildcard", ErrInvalidOption, from, to))
+		} else if string(rewriteTokens([]byte(to), rewrites)) != to {
+			errs = append(errs, fmt.Errorf("%w: WithTokenRewrites of %q to %q, which would be rewritten again", ErrInvalidOption, from, to))
+		}
+	}
+	return errs
+}
+
+// rewriteTokens returns the subject with the tokens found in rewrites replaced, or the subject itself if
+// none is.
+func rewriteTokens(subject []byte, rewrites map[string]string) []byte {
+	var out []byte
+	var copied int // Bytes of the subject up to here are in out
+	for start := 0; start <= len(subject); {
+		end := tokenEnd(subject, start)
+		if to, ok := rewrites[string(subject[start:end])]; ok {
+			if out == nil {
+				out = make([]byte, 0, len(subject)+len(to))
+			}
+			out = append(append(out, subject[copied:start]...), to...)
+			copied = end
+		}
+		start = end + 1
+	}
+	if out == nil {
+		return subject
+	}
+	return append(out, subject[copied:]...)
+}
+
+// canon returns the subject or filter as a tree with these options holds it.
+func (o *options) canon(subject []byte) []byte {
+	if o.fold {
+		subject = foldSubject(subject)
+	}
+	if o.rewrites != nil {
+		subject = rewriteTokens(subject, o.rewrites)
+	}
+	return subject
+}
+
+// canon returns the subject or filter as the tree holds it.
+func (t *SubjectTree[T]) canon(subject []byte) []byte {
+	if t == nil {
+		return subject
+	}
+	return t.opts.canon(subject)
+}
@@ -0,0 +1,84 @@
+package subtree
+
+import "bytes"
+
+//-------------------
+// Longest match routing
+//-------------------
+
+// RouteTable maps patterns, which can contain wildcards, to values and looks up the single most specific
+// pattern matching a subject. Patterns are compared token by token from the left, and at the first token
+// where they differ a literal beats `*` which beats `>`. Remaining ties are broken by byte order, so the
+// result never depends on the order patterns were added in.
+// Like SubjectTree, a RouteTable is not safe for concurrent modification.
+type RouteTable[T any] struct {
+	t *SubjectTree[T]
+}
+
+// NewRouteTable creates a new empty RouteTable with values T, configured with the given options.
+func NewRouteTable[T any](opts ...Option) *RouteTable[T] {
+	return &RouteTable[T]{t: NewSubjectTree[T](opts...)}
+}
+
+// Add adds or replaces the route for pattern. Returns ErrInvalidFilter if the pattern is not valid.
+func (r *RouteTable[T]) Add(pattern []byte, value T) error {
+	if !validFilter(pattern) {
+		return ErrInvalidFilter
+	}
+	r.t.Insert(pattern, value)
+	return nil
+}
+
+// Remove removes the route for pattern and returns its value, or false if there was none.
+func (r *RouteTable[T]) Remove(pattern []byte) (T, bool) {
+	if val, ok := r.t.Delete(pattern); ok {
+		return *val, true
+	}
+	var zero T
+	return zero, false
+}
+
+// Size returns the number of routes.
+func (r *RouteTable[T]) Size() int { return r.t.Size() }
+
+// Lookup returns the most specific pattern matching the literal subject and its value,
+// or false if no pattern matches.
+func (r *RouteTable[T]) Lookup(subject []byte) ([]byte, T, bool) {
+	var best []byte
+	var val *T
+	r.t.ReverseMatch(subject, func(pattern []byte, v *T) {
+		if val == nil || moreSpecific(pattern, best) {
+			best, val = append(best[:0], pattern...), v
+		}
+	})
+	if val == nil {
+		var zero T
+		return nil, zero, false
+	}
+	return best, *val, true
+}
+
+// moreSpecific returns true if pattern a wins over pattern b when both match the same subject.
+func moreSpecific(a, b []byte) bool {
+	for ai, bi := 0, 0; ai < len(a) && bi < len(b); {
+		ae, be := tokenEnd(a, ai), tokenEnd(b, bi)
+		if ka, kb := tokenKind(a[ai:ae]), tokenKind(b[bi:be]); ka != kb {
+			return ka > kb
+		}
+		ai, bi = ae+1, be+1
+	}
+	return bytes.Compare(a, b) < 0
+}
+
+// tokenKind ranks a pattern token by how specific it is: 2 for a literal, 1 for `*` and 0 for `>`.
+func tokenKind(token []byte) int {
+	if len(token) == 1 {
+		switch token[0] {
+		case pwc:
+			return 1
+		case fwc:
+			return 0
+		}
+	}
+	return 2
+}
@@ -0,0 +1,296 @@
+package subtree
+
+import (
+	"bytes"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//-------------------
+// Trees safe for concurrent use
+//-------------------
+
+// SafeSubjectTree is a SubjectTree that is safe for concurrent use by multiple goroutines.
+// Writes are serialized, reads can run in parallel, and MatchSnapshot can run against a consistent
+// view of the tree while writers carry on. Values are handed out as copies, since pointers into the
+// tree could be read while a writer modifies them.
+type SafeSubjectTree[T any] struct {
+	stripes []safeStripe[T] // A single one unless created WithStripedLocks
+	seed    maphash.Seed    // Seed for hashing first tokens to stripes
+	batch   int             // Writes to apply at once, from WithWriteBatching
+	grace   time.Duration   // Time a match keeps waiting writers out, from WithReaderGrace
+}
+
+// safeStripe is the tree holding the subjects of one stripe, with the lock guarding it.
+type safeStripe[T any] struct {
+	mu      sync.RWMutex
+	t       *SubjectTree[T]
+	waiting atomic.Int32  // Writers waiting for the lock
+	queue   writeQueue[T] // Writes waiting to be applied in a batch
+}
+
+// WithStripedLocks splits a SafeSubjectTree into n stripes, each a tree with a lock of its own, and puts
+// every subject into the stripe its first token hashes to. Writes to subjects with different first tokens
+// then mostly run in parallel instead of one after the other, while the tree still behaves as a single one.
+// Match only has to visit all stripes for filters starting with a wildcard, and does so one stripe after
+// the other, so it may see writes made in between. MatchSnapshot, Snapshot, Update and Apply lock all
+// stripes and stay atomic. Options like hooks and sinks are used by every stripe, so they have to be safe
+// for concurrent use. Striping is turned off WithEntryIDs, and the option has no effect on a SubjectTree.
+func WithStripedLocks(n int) Option {
+	return func(o *options) {
+		if n < 0 {
+			o.invalid("WithStripedLocks of negative count %d", n)
+		}
+		o.stripes = max(n, 1)
+	}
+}
+
+// NewSafeSubjectTree creates a new SafeSubjectTree with values T, configured with the given options.
+// Panics if the options are invalid, see NewSafeSubjectTreeE.
+func NewSafeSubjectTree[T any](opts ...Option) *SafeSubjectTree[T] {
+	s, err := NewSafeSubjectTreeE[T](opts...)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// NewSafeSubjectTreeE is like NewSafeSubjectTree but returns an error wrapping ErrInvalidOption for each
+// invalid setting instead of panicking.
+func NewSafeSubjectTreeE[T any](opts ...Option) (*SafeSubjectTree[T], error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	n := max(o.stripes, 1)
+	if o.entryIDs {
+		n = 1
+	}
+	s := &SafeSubjectTree[T]{stripes: make([]safeStripe[T], n), seed: maphash.MakeSeed(), batch: o.writeBatch, grace: o.readerGrace}
+	for i := range s.stripes {
+		t, err := NewSubjectTreeE[T](opts...)
+		if err != nil {
+			return nil, err
+		}
+		s.stripes[i].t = t
+	}
+	return s, nil
+}
+
+// Config returns the settings the tree works with, including the number of stripes in effect.
+func (s *SafeSubjectTree[T]) Config() Config {
+	c := s.stripes[0].t.Config()
+	c.Stripes, c.WriteBatch, c.ReaderGrace = len(s.stripes), s.batch, s.grace
+	return c
+}
+
+// stripe returns the stripe for the subject or filter, which is chosen by its first token.
+func (s *SafeSubjectTree[T]) stripe(subject []byte) *safeStripe[T] {
+	if len(s.stripes) == 1 {
+		return &s.stripes[0]
+	}
+	// Spellings of the first token the stripes hold the same have to end up in the same stripe.
+	subject = s.stripes[0].t.canon(subject)
+	if i := bytes.IndexByte(subject, tsep); i >= 0 {
+		subject = subject[:i]
+	}
+	return &s.stripes[maphash.Bytes(s.seed, subject)%uint64(len(s.stripes))]
+}
+
+// lockAll takes the write locks of all stripes, in order.
+func (s *SafeSubjectTree[T]) lockAll() {
+	for i := range s.stripes {
+		s.stripes[i].lock()
+	}
+}
+
+// unlockAll releases the write locks of all stripes.
+func (s *SafeSubjectTree[T]) unlockAll() {
+	for i := range s.stripes {
+		s.stripes[i].mu.Unlock()
+	}
+}
+
+// Size returns the number of elements stored.
+func (s *SafeSubjectTree[T]) Size() int {
+	var size int
+	for i := range s.stripes {
+		st := &s.stripes[i]
+		st.mu.RLock()
+		size += st.t.Size()
+		st.mu.RUnlock()
+	}
+	return size
+}
+
+// Insert a value into the tree. Will return if the value was updated and if so the old value.
+func (s *SafeSubjectTree[T]) Insert(subject []byte, value T) (T, bool) {
+	return s.write(s.stripe(subject), OpInsert, subject, value)
+}
+
+// Delete will delete the item and return its value, or not found if it did not exist.
+func (s *SafeSubjectTree[T]) Delete(subject []byte) (T, bool) {
+	var zero T
+	return s.write(s.stripe(subject), OpDelete, subject, zero)
+}
+
+// DeleteIf deletes the subject only if pred returns true for its current value, and returns the deleted value.
+// The predicate runs while holding the write lock, so the value can not change between checking and deleting.
+// It must not use this tree.
+func (s *SafeSubjectTree[T]) DeleteIf(subject []byte, pred func(v T) bool) (T, bool) {
+	st := s.stripe(subject)
+	st.lock()
+	defer st.mu.Unlock()
+	return st.t.DeleteIf(subject, pred)
+}
+
+// Find will find the value and return a copy of it, or false if it was not found.
+func (s *SafeSubjectTree[T]) Find(subject []byte) (T, bool) {
+	st := s.stripe(subject)
+	st.mu.RLock()
+	defer st.mu.RUnlock()
+	return st.t.FindVal(subject)
+}
+
+// Match will match against a subject that can have wildcards and invoke the callback func for each matched value.
+// The callback runs while holding the read lock, so it must not write to this tree. Use MatchSnapshot for that.
+// WithReaderGrace lets go of the read lock for waiting writers during long matches.
+func (s *SafeSubjectTree[T]) Match(filter []byte, cb func(subject []byte, val T)) {
+	first := filter
+	if i := bytes.IndexByte(filter, tsep); i >= 0 {
+		first = filter[:i]
+	}
+	if len(s.stripes) == 1 || len(first) != 1 || first[0] != pwc && first[0] != fwc {
+		s.match(s.stripe(filter), filter, cb)
+		return
+	}
+	for i := range s.stripes {
+		s.match(&s.stripes[i], filter, cb)
+	}
+}
+
+// MatchSnapshot is like Match but runs against a snapshot of the tree taken when it is called, without
+// holding any lock. Every entry present at that time and matching the filter is visited exactly once, no
+// matter what writers, including the callback itself, do to the tree while the match is running.
+func (s *SafeSubjectTree[T]) MatchSnapshot(filter []byte, cb func(subject []byte, val T)) {
+	s.Snapshot().t.MatchVals(filter, cb)
+}
+
+// Snapshot returns a read view of the current version of the tree, which is never affected by later writes.
+// With striped locks the view is combined from the stripes, which costs about an insert for every stripe.
+func (s *SafeSubjectTree[T]) Snapshot() *ReadView[T] {
+	if len(s.stripes) == 1 {
+		st := &s.stripes[0]
+		st.lock()
+		defer st.mu.Unlock()
+		return st.t.Snapshot()
+	}
+	s.lockAll()
+	defer s.unlockAll()
+	// A tree of its own generation copies every node it changes, leaving the stripes intact.
+	ct := SubjectTree[T]{opts: s.stripes[0].t.opts.viewOptions()}
+	ct.share()
+	for i := range s.stripes {
+		t := s.stripes[i].t
+		t.share()
+		if t.root != nil {
+			ct.adopt(t.root.path(), t.root, t.gen)
+		}
+		ct.version += t.version
+	}
+	return newReadView[T](treeVersion{ct.root, ct.size, ct.version}, &ct.opts)
+}
+
+// Update calls fn with the underlying tree while holding the write lock, for anything not covered by
+// the methods above. The tree and any pointers into it must not be used once fn returns.
+// With striped locks fn gets the tree of the first stripe with the entries of all others moved into it,
+// and once fn returns they are moved back into the stripes of their first tokens, which costs about an
+// insert for every distinct first token. Settings made through fn, such as op loggers, only stay with the
+// first stripe.
+func (s *SafeSubjectTree[T]) Update(fn func(t *SubjectTree[T])) {
+	if len(s.stripes) == 1 {
+		st := &s.stripes[0]
+		st.lock()
+		defer st.mu.Unlock()
+		fn(st.t)
+		return
+	}
+	s.lockAll()
+	defer s.unlockAll()
+	t := s.stripes[0].t
+	for i := 1; i < len(s.stripes); i++ {
+		t.adoptAll(s.stripes[i].t)
+	}
+	fn(t)
+	// Move everything out, including the entries of the first stripe, and back into the stripe of each.
+	root, gen := t.root, t.gen
+	t.root, t.size, t.dead = nil, 0, 0
+	if t.indexed() {
+		t.indexLogged(OpEmpty, nil)
+	}
+	if root != nil {
+		var _pre [256]byte
+		s.spread(root, _pre[:0], gen)
+	}
+}
+
+// MatchSnapshot will match against a subject that can have wildcards and invoke the callback func for each
+// matched value, like Match, but against a snapshot of the tree taken when it is called. The callback is free
+// to modify the tree, and sees every matching entry that was present at the time exactly once.
+// The values handed to the callback are shared with the snapshot and must not be modified.
+func (t *SubjectTree[T]) MatchSnapshot(filter []byte, cb func(subject []byte, val *T)) {
+	if t == nil || cb == nil {
+		return
+	}
+	if t.opts.stable {
+		inner := cb
+		cb = func(subject []byte, val *T) { inner(t.stable(subject), val) }
+	}
+	t.Snapshot().Match(filter, cb)
+}
+
+// spread moves every subject of the node n, below pre, into the tree of the stripe of its first token. The
+// nodes down to the first token separator are left behind.
+func (s *SafeSubjectTree[T]) spread(n node, pre []byte, gen uint64) {
+	pre = append(pre, n.path()...)
+	if n.isLeaf() || bytes.IndexByte(pre, tsep) >= 0 {
+		s.stripe(pre).t.adopt(pre, n, gen)
+		return
+	}
+	n.iter(func(cn node) bool {
+		s.spread(cn, pre, gen)
+		return true
+	})
+}
+
+// adoptAll moves all entries of other into the tree, leaving other empty. None of its subjects may be in the
+// tree already. Unlike Graft nothing is logged, as the entries are only moved between stripes.
+func (t *SubjectTree[T]) adoptAll(other *SubjectTree[T]) {
+	if other.root != nil {
+		t.adopt(other.root.path(), other.root, other.gen)
+	}
+	other.root, other.size, other.dead = nil, 0, 0
+	if other.indexed() {
+		other.indexLogged(OpEmpty, nil)
+	}
+	other.version++
+}
+
+// adopt merges the node n, with path as its full path, into the tree. The node comes from a tree of the
+// given generation and none of its subjects may be in the tree already.
+func (t *SubjectTree[T]) adopt(path []byte, n node, gen uint64) {
+	if gen != 0 && gen != t.gen {
+		// The nodes may still be shared, so from now on this tree has to copy before writing.
+		t.share()
+	}
+	// Index the subjects first, as merging may change the nodes.
+	t.indexAdopted(path, n)
+	t.merge(&t.root, path, 0, n)
+	t.size += int(leafCount(n))
+	if t.opts.lazyDelete {
+		t.dead += countDead(n)
+	}
+	t.version++
+}
@@ -0,0 +1,120 @@
+package subtree
+
+import "math/rand/v2"
+
+//-------------------
+// Sampling entries
+//-------------------
+
+// Sample returns n distinct entries chosen uniformly at random, or all entries in random order if the tree
+// holds no more than n. Entries are picked by descending from the root weighted by the number of leaves
+// below each child, so a small sample of a giant tree costs a few descents instead of a full iteration.
+// If rng is nil the global random source is used. The subjects are copies owned by the caller.
+func (t *SubjectTree[T]) Sample(n int, rng *rand.Rand) []Entry[T] {
+	if t == nil || t.root == nil || n <= 0 || t.size == 0 {
+		return nil
+	}
+	intN := rand.IntN
+	if rng != nil {
+		intN = rng.IntN
+	}
+	// Close to or more than all entries, so picking by rejecting duplicates would be slow.
+	if n > t.size/2 {
+		entries := make([]Entry[T], 0, t.size)
+		t.IterFast(func(subject []byte, val *T) bool {
+			entries = append(entries, entryOf(subject, val))
+			return true
+		})
+		// Partial shuffle of the first n.
+		n = min(n, len(entries))
+		for i := 0; i < n; i++ {
+			j := i + intN(len(entries)-i)
+			entries[i], entries[j] = entries[j], entries[i]
+		}
+		return entries[:n]
+	}
+	entries := make([]Entry[T], 0, n)
+	seen := make(map[*leaf[T]]struct{}, n)
+	var _pre [256]byte
+	for len(entries) < n {
+		subject, ln := t.descend(intN, _pre[:0])
+		if _, ok := seen[ln]; ok {
+			continue
+		}
+		seen[ln] = struct{}{}
+		entries = append(entries, entryOf(subject, &ln.value))
+	}
+	return entries
+}
+
+// descend walks from the root to a uniformly random live leaf, choosing each child with a probability
+// proportional to the number of leaves below it. Returns the subject, appended to pre, and the leaf.
+func (t *SubjectTree[T]) descend(intN func(int) int, pre []byte) ([]byte, *leaf[T]) {
+	n := t.root
+	for {
+		pre = append(pre, n.path()...)
+		if n.isLeaf() {
+			return pre, n.(*leaf[T])
+		}
+		r := intN(int(n.base().leaves))
+		for _, cn := range n.children() {
+			if cn == nil {
+				continue
+			}
+			if lc := int(leafCount(cn)); r >= lc {
+				r -= lc
+			} else {
+				n = cn
+				break
+			}
+		}
+	}
+}
+
+//-------------------
+// Partitioning subjects
+//-------------------
+
+// Partition divides the subjects into n contiguous ranges holding about the same number of entries each, e.g.
+// to export, scan or move parts of a tree in parallel. Every range is the first and last subject in it, both
+// included, the ranges are in subject order and together hold every subject exactly once. The bounds are
+// found by descending from the root by the number of leaves below each child, so the cost depends on n and
+// the depth of the tree, not on the number of entries. Returns fewer ranges if there are fewer than n
+// entries, and none for an empty tree. The subjects are copies owned by the caller.
+func (t *SubjectTree[T]) Partition(n int) [][2][]byte {
+	if t == nil || t.root == nil || n <= 0 || t.size == 0 {
+		return nil
+	}
+	n = min(n, t.size)
+	ranges := make([][2][]byte, n)
+	var _pre [256]byte
+	for i := range ranges {
+		lo, hi := i*t.size/n, (i+1)*t.size/n-1
+		ranges[i] = [2][]byte{copyBytes(t.nth(lo, _pre[:0])), copyBytes(t.nth(hi, _pre[:0]))}
+	}
+	return ranges
+}
+
+// nth returns the subject of the live leaf at position i in subject order, appended to pre, choosing each
+// child to descend into by the number of leaves below the ones before it.
+func (t *SubjectTree[T]) nth(i int, pre []byte) []byte {
+	var _nodes [256]node
+	n := t.root
+	for n != nil && !n.isLeaf() {
+		pre = append(pre, n.path()...)
+		next := node(nil)
+		for _, cn := range sortedChildren(n, _nodes[:0]) {
+			if lc := int(leafCount(cn)); i >= lc {
+				i -= lc
+			} else {
+				next = cn
+				break
+			}
+		}
+		n = next
+	}
+	if n == nil {
+		return pre
+	}
+	return append(pre, n.path()...)
+}
@@ -0,0 +1,41 @@
+package subtree
+
+//-------------------
+// Caller owned match buffers
+//-------------------
+
+// Scratch holds the buffers a match works in: the parts of the filter and the subjects handed to the callback.
+// Matching with a Scratch owned by the caller, e.g. one per goroutine or taken from a pool, does not allocate
+// for subjects of up to the capacity it was created with. A Scratch must not be used by more than one match
+// at a time. The zero value is ready to use and grows on first use.
+type Scratch struct {
+	parts [][]byte // Parts of the filter, cleared after every match
+	pre   []byte   // Subject buffer
+}
+
+// NewScratch creates a Scratch for subjects of up to subjectLen bytes. Longer subjects still match, at the
+// cost of allocating.
+func NewScratch(subjectLen int) *Scratch {
+	return &Scratch{parts: make([][]byte, 0, 16), pre: make([]byte, 0, max(subjectLen, 256))}
+}
+
+// MatchScratch is like Match but works in the buffers of the scratch instead of its own.
+// The subject handed to the callback is the buffer of the scratch, so it is only valid for the duration of
+// the callback unless the tree was created WithStableCallbacksSubjects. A nil scratch works like Match.
+func (t *SubjectTree[T]) MatchScratch(filter []byte, sc *Scratch, cb func(subject []byte, val *T)) {
+	if t == nil || cb == nil {
+		return
+	}
+	if sc == nil {
+		t.Match(filter, cb)
+		return
+	}
+	if sc.pre == nil {
+		*sc = *NewScratch(0)
+	}
+	t.recordMatch(filter)
+	parts := t.matchBufs(filter, true, nil, sc.parts[:0], sc.pre[:0], t.guardMatch(cb))
+	// Keep a grown parts buffer, without holding on to the filter.
+	clear(parts)
+	sc.parts = parts[:0]
+}
@@ -0,0 +1,93 @@
+package subtree
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+//-------------------
+// Guarding values handed to callers
+//-------------------
+
+// SetSealed controls if callers are handed copies of values instead of pointers into the tree.
+// When sealed, Find returns a pointer to a copy and callbacks of Match, MatchValues, IterOrdered, IterFast and their variants
+// receive pointers to copies, so writes through them can never race with or corrupt the tree.
+// This costs a copy per value, and an allocation per Find.
+func (t *SubjectTree[T]) SetSealed(sealed bool) {
+	if t == nil {
+		return
+	}
+	t.sealed = sealed
+}
+
+// SetCheckValueWrites enables an assertion mode for tracking down writes through value pointers handed to
+// callbacks. The memory of each value is compared before and after the callback and any change panics,
+// naming the subject. The check is a plain memory comparison, so it works with or without the race detector
+// and only catches shallow changes of the value itself, not of memory it points to. It has no effect when sealed.
+func (t *SubjectTree[T]) SetCheckValueWrites(check bool) {
+	if t == nil {
+		return
+	}
+	t.checkWrites = check
+}
+
+// guarded returns if values or subjects handed to callers need guarding.
+func (t *SubjectTree[T]) guarded() bool { return t.sealed || t.checkWrites || t.opts.stable }
+
+// guardMatch wraps a match callback according to the guard settings.
+func (t *SubjectTree[T]) guardMatch(cb func(subject []byte, val *T)) func(subject []byte, val *T) {
+	if !t.guarded() {
+		return cb
+	}
+	return func(subject []byte, val *T) {
+		subject = t.stable(subject)
+		t.guard(subject, val, func(v *T) bool {
+			cb(subject, v)
+			return true
+		})
+	}
+}
+
+// guardIter wraps an iter callback according to the guard settings.
+func (t *SubjectTree[T]) guardIter(cb func(subject []byte, val *T) bool) func(subject []byte, val *T) bool {
+	if !t.guarded() {
+		return cb
+	}
+	return func(subject []byte, val *T) bool {
+		subject = t.stable(subject)
+		return t.guard(subject, val, func(v *T) bool { return cb(subject, v) })
+	}
+}
+
+// stable returns a copy of the subject if callbacks may retain it.
+func (t *SubjectTree[T]) stable(subject []byte) []byte {
+	if !t.opts.stable || subject == nil {
+		return subject
+	}
+	return append(make([]byte, 0, len(subject)), subject...)
+}
+
+// guard calls f with a copy of val when sealed, or with val checking it is not modified when checking writes.
+func (t *SubjectTree[T]) guard(subject []byte, val *T, f func(v *T) bool) bool {
+	if t.sealed {
+		cv := *val
+		return f(&cv)
+	}
+	if !t.checkWrites {
+		return f(val)
+	}
+	before := string(valueBytes(val))
+	ok := f(val)
+	if before != string(valueBytes(val)) {
+		if subject == nil {
+			panic("subtree: stored value modified through a callback pointer")
+		}
+		panic(fmt.Sprintf("subtree: value of %q modified through a callback pointer", subject))
+	}
+	return ok
+}
+
+// valueBytes returns the memory of a value.
+func valueBytes[T any](v *T) []byte {
+	return unsafe.Slice((*byte)(unsafe.Pointer(v)), unsafe.Sizeof(*v))
+}
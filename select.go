@@ -0,0 +1,119 @@
+package subtree
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"sync"
+)
+
+//-------------------
+// Selecting one match
+//-------------------
+
+// selectKind is the kind of selection a SelectPolicy makes.
+type selectKind uint8
+
+const (
+	selectFirst selectKind = iota
+	selectRandom
+	selectRoundRobin
+	selectWeighted
+)
+
+// SelectPolicy decides which entry MatchOne returns when a filter matches several of them.
+type SelectPolicy struct {
+	kind   selectKind
+	rr     *roundRobin // State of a round robin policy
+	weight any         // Weight function of a weighted policy, a func(T) int
+}
+
+// roundRobin remembers the last subject selected by a round robin policy.
+type roundRobin struct {
+	mu   sync.Mutex
+	last []byte
+}
+
+var (
+	// SelectFirst selects the first match in subject order. It stops at that match.
+	SelectFirst = SelectPolicy{kind: selectFirst}
+	// SelectRandom selects a match uniformly at random. It visits all matches to do so, but does not collect them.
+	SelectRandom = SelectPolicy{kind: selectRandom}
+)
+
+// NewRoundRobin returns a policy that selects matches in turn. Each selection returns the first match in
+// subject order after the subject it selected last, wrapping around at the end, so it stops at that match
+// and keeps spreading selections evenly as entries come and go. The policy can be shared between goroutines,
+// and between filters, but each filter should have its own to take turns among its own matches.
+func NewRoundRobin() SelectPolicy {
+	return SelectPolicy{kind: selectRoundRobin, rr: &roundRobin{}}
+}
+
+// WeightedBy returns a policy that selects a match at random with a probability proportional to its weight,
+// as returned by the weight function for its value. Matches with a weight of zero or less are never selected.
+// Like SelectRandom it visits all matches. Using it with a tree of another value type panics.
+func WeightedBy[T any](weight func(T) int) SelectPolicy {
+	return SelectPolicy{kind: selectWeighted, weight: weight}
+}
+
+// MatchOne will match against a subject that can have wildcards and return one of the matches, selected
+// according to the policy, with its subject. Returns false if nothing matched.
+// The value pointer has the same semantics as the one returned from Find.
+func (t *SubjectTree[T]) MatchOne(filter []byte, policy SelectPolicy) ([]byte, *T, bool) {
+	if t == nil {
+		return nil, nil, false
+	}
+	var subject []byte
+	var val *T
+	switch policy.kind {
+	case selectRandom:
+		// Reservoir sampling, the n-th match replaces the selection with a probability of 1/n.
+		var n int
+		t.matchFilter(filter, true, func(subj []byte, v *T) {
+			if n++; rand.IntN(n) == 0 {
+				subject, val = append(subject[:0], subj...), v
+			}
+		})
+	case selectWeighted:
+		weight, ok := policy.weight.(func(T) int)
+		if !ok {
+			panic(fmt.Sprintf("subtree: weighted policy for %T used with values of type %T", policy.weight, *new(T)))
+		}
+		// Weighted reservoir sampling, a match replaces the selection with a probability of its share
+		// of the total weight so far.
+		var total int
+		t.matchFilter(filter, true, func(subj []byte, v *T) {
+			if w := weight(*v); w > 0 {
+				if total += w; rand.IntN(total) < w {
+					subject, val = append(subject[:0], subj...), v
+				}
+			}
+		})
+	case selectRoundRobin:
+		rr := policy.rr
+		rr.mu.Lock()
+		defer rr.mu.Unlock()
+		first := func(subj []byte, v *T) bool {
+			subject, val = append([]byte(nil), subj...), v
+			return false
+		}
+		if t.matchOrdered(filter, rr.last, first); val == nil && rr.last != nil {
+			t.matchOrdered(filter, nil, first)
+		}
+		if val != nil {
+			rr.last = append(rr.last[:0], subject...)
+		}
+	default:
+		t.matchOrdered(filter, nil, func(subj []byte, v *T) bool {
+			subject, val = append([]byte(nil), subj...), v
+			return false
+		})
+	}
+	if val == nil {
+		return nil, nil, false
+	}
+	if t.sealed {
+		cv := *val
+		val = &cv
+	}
+	return subject, val, true
+}
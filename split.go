@@ -0,0 +1,292 @@
+package subtree
+
+import (
+	"bytes"
+	"errors"
+)
+
+//-------------------
+// Splitting and grafting subtrees
+//-------------------
+
+// ErrPrefixInUse is returned by Graft when the tree already holds subjects starting with the prefix.
+var ErrPrefixInUse = errors.New("subtree: prefix already in use")
+
+// SplitAt detaches all subjects starting with the literal prefix into a new tree, or returns false if there
+// are none. The new tree holds the subjects with the prefix removed, so a subject equal to the prefix becomes
+// the empty subject there. Graft puts them back under a prefix, in this or any other tree.
+// The nodes are moved, not copied, so the cost is that of a single delete regardless of how many subjects
+// are detached. Nodes shared with snapshots or versions stay intact, the new tree copies them on write.
+// The new tree is created with the same options, and has the indexes and entry IDs of the subjects moved into
+// it. The prefix is folded and rewritten like a subject.
+func (t *SubjectTree[T]) SplitAt(prefix []byte) (*SubjectTree[T], bool) {
+	if t == nil {
+		return nil, false
+	}
+	prefix = t.canon(prefix)
+	if t.prefixNode(prefix) == nil {
+		return nil, false
+	}
+	t.beforeModify()
+	root := t.root
+	dn, rest := t.detach(&t.root, prefix, 0)
+	t.rootSwapped(root)
+	nt := newTree[T](t.opts)
+	nt.root, nt.size = dn, int(leafCount(dn))
+	if t.dead > 0 {
+		nt.dead = countDead(dn)
+	}
+	// The nodes may still be shared, in which case the new tree has to copy them before writing.
+	if t.gen != 0 {
+		nt.share()
+	}
+	nt.rebase(&nt.root, rest)
+	if t.ids != nil {
+		t.idsMoved(prefix, nt)
+	}
+	nt.indexAdopted(nt.root.path(), nt.root)
+	if nt.dedup != nil {
+		nt.dedupRebuild()
+	}
+	t.size -= nt.size
+	t.dead -= nt.dead
+	t.version++
+	if t.logging() || t.lww != nil {
+		nt.iterAll(false, func(subject []byte, val *T) bool {
+			full := append(prefix[:len(prefix):len(prefix)], subject...)
+			if t.lww != nil {
+				t.lwwDeleted(full, nil)
+			}
+			if t.logging() {
+				t.logOp(OpDelete, full, val)
+			}
+			return true
+		})
+	}
+	if debugChecks {
+		t.debugCheck("split")
+		nt.debugCheck("split")
+	}
+	return nt, true
+}
+
+// Graft moves all subjects of other into this tree under the prefix, leaving other empty. This is the
+// counterpart of SplitAt. The nodes are moved, not copied, so the cost does not depend on how many subjects
+// are moved. Returns ErrPrefixInUse, without changing either tree, if this tree already holds subjects
+// starting with the prefix. The prefix is folded and rewritten like a subject.
+func (t *SubjectTree[T]) Graft(prefix []byte, other *SubjectTree[T]) error {
+	if t == nil || other == nil || other == t || other.root == nil || other.size == 0 {
+		return nil
+	}
+	prefix = t.canon(prefix)
+	if t.prefixNode(prefix) != nil {
+		return ErrPrefixInUse
+	}
+	// Lazily deleted paths could overlap with the grafted ones.
+	if t.dead > 0 {
+		t.Compact()
+	}
+	if t.ids != nil && t.lww == nil {
+		t.idsGrafted(prefix, other)
+	}
+	r, size, dead := other.root, other.size, other.dead
+	// Empty other first, which may keep its current nodes as a retained version.
+	other.Empty()
+	if t.gen == 0 && other.gen != 0 {
+		// The nodes may still be shared, so from now on this tree has to copy before writing.
+		t.share()
+	}
+	var entries []Entry[T]
+	if t.lww != nil || t.logging() {
+		var _pre [256]byte
+		t.iter(r, append(_pre[:0], prefix...), false, func(subject []byte, val *T) bool {
+			entries = append(entries, entryOf(subject, val))
+			return true
+		})
+		if t.lww != nil {
+			// Every entry needs a stamp of its own, so insert them one by one.
+			for _, e := range entries {
+				t.Insert(e.Subject, e.Value)
+			}
+			return nil
+		}
+	}
+	t.beforeModify()
+	root := t.root
+	t.graft(&t.root, append(prefix[:len(prefix):len(prefix)], r.path()...), 0, r)
+	t.rootSwapped(root)
+	t.size += size
+	t.dead += dead
+	t.version++
+	// Log once the entries are in, so the logger sees the tree they were inserted into.
+	for _, e := range entries {
+		t.logOp(OpInsert, e.Subject, &e.Value)
+	}
+	if debugChecks {
+		t.debugCheck("graft")
+	}
+	return nil
+}
+
+// MovePrefix moves all subjects starting with the literal prefix from to the same subjects starting with to
+// instead, and returns how many were moved. It is SplitAt followed by Graft, so the cost does not depend on
+// how many subjects are moved. Returns ErrPrefixInUse, without changing the tree, if subjects that are not
+// moved already start with to. Both prefixes are folded and rewritten like subjects.
+func (t *SubjectTree[T]) MovePrefix(from, to []byte) (int, error) {
+	if t == nil {
+		return 0, nil
+	}
+	from, to = t.canon(from), t.canon(to)
+	fn := t.prefixNode(from)
+	if fn == nil {
+		return 0, nil
+	}
+	moved := int(leafCount(fn))
+	if bytes.Equal(from, to) {
+		return moved, nil
+	}
+	// Subjects starting with to are fine as long as they are moved out of the way first.
+	if tn := t.prefixNode(to); tn != nil && !bytes.HasPrefix(to, from) {
+		if inUse := int(leafCount(tn)); !bytes.HasPrefix(from, to) || inUse > moved {
+			return 0, ErrPrefixInUse
+		}
+	}
+	nt, _ := t.SplitAt(from)
+	if err := t.Graft(to, nt); err != nil {
+		return 0, err
+	}
+	return moved, nil
+}
+
+// prefixNode returns the highest node holding all subjects starting with prefix, or nil if there are none.
+// The prefix has to be in the form the tree holds subjects, see canon.
+func (t *SubjectTree[T]) prefixNode(prefix []byte) node {
+	var si int
+	for n := t.root; n != nil; {
+		rem, path := prefix[si:], n.path()
+		if len(path) >= len(rem) {
+			if !bytes.HasPrefix(path, rem) || leafCount(n) == 0 {
+				return nil
+			}
+			return n
+		}
+		if n.isLeaf() || !bytes.HasPrefix(rem, path) {
+			return nil
+		}
+		si += len(path)
+		cn := n.findChild(prefix[si])
+		if cn == nil {
+			return nil
+		}
+		n = *cn
+	}
+	return nil
+}
+
+// Internal recursive function to detach the node found by prefixNode, which must exist. The node is removed
+// from its parent, and returned with the part of its path past the prefix.
+func (t *SubjectTree[T]) detach(np *node, prefix []byte, si int) (node, []byte) {
+	n := *np
+	if path := n.path(); len(path) >= len(prefix)-si {
+		*np = nil
+		return n, path[len(prefix)-si:]
+	}
+	n = t.writable(np)
+	si += len(n.path())
+	c := prefix[si]
+	cnp := n.findChild(c)
+	dn, rest := t.detach(cnp, prefix, si)
+	n.base().leaves -= leafCount(dn)
+	if *cnp == nil {
+		n.deleteChild(c)
+		t.shrinkAfterDelete(np, n)
+	}
+	return dn, rest
+}
+
+// Internal recursive function to attach r where key, its full path, belongs. No existing subject may start
+// with the part of key before r's own path, so key always branches off before r's path starts.
+func (t *SubjectTree[T]) graft(np *node, key []byte, si int, r node) {
+	n := *np
+	if n == nil {
+		*np = r
+		t.rebase(np, key[si:])
+		return
+	}
+	count := leafCount(r)
+	if n.isLeaf() {
+		// Split the leaf, which ends before or branches off from the key.
+		ln := t.writable(np).(*leaf[T])
+		cpi := commonPrefixLen(ln.suffix, key[si:])
+		nn := t.newNode4(key[si : si+cpi])
+		t.split(ln, nn)
+		ln.suffix = t.copyFrag(ln.suffix[cpi:])
+		nn.addChild(pivot(ln.suffix, 0), ln)
+		nn.addChild(key[si+cpi], t.rebased(r, key[si+cpi:]))
+		nn.leaves = leafCount(ln) + count
+		*np = nn
+		return
+	}
+	n = t.writable(np)
+	bn := n.base()
+	cpi := commonPrefixLen(bn.prefix, key[si:])
+	if cpi < len(bn.prefix) {
+		// Split the prefix, the same as insert does.
+		nn := t.newNode4(bn.prefix[:cpi])
+		t.split(n, nn)
+		bn.prefix = t.copyFrag(bn.prefix[cpi:])
+		nn.addChild(pivot(bn.prefix, 0), n)
+		si += cpi
+		nn.addChild(key[si], t.rebased(r, key[si:]))
+		nn.leaves = bn.leaves + count
+		*np = nn
+		return
+	}
+	si += cpi
+	bn.leaves += count
+	if cn := n.findChild(key[si]); cn != nil {
+		t.graft(cn, key, si, r)
+		return
+	}
+	if n.isFull() {
+		n = t.grew(n, n.grow())
+		*np = n
+	}
+	n.addChild(key[si], t.rebased(r, key[si:]))
+}
+
+// rebase replaces the prefix or suffix of the node np refers to with path, making the node ours first.
+func (t *SubjectTree[T]) rebase(np *node, path []byte) {
+	n := t.writable(np)
+	if ln, ok := n.(*leaf[T]); ok {
+		ln.suffix = t.copyFrag(path)
+	} else {
+		n.base().prefix = t.copyFrag(path)
+		*np = t.capPrefix(n)
+	}
+}
+
+// rebased returns r, or a copy of it owned by this tree, with its prefix or suffix replaced by path.
+func (t *SubjectTree[T]) rebased(r node, path []byte) node {
+	t.rebase(&r, path)
+	return r
+}
+
+//-------------------
+// Extracting matching entries
+//-------------------
+
+// ExtractMatching returns a new tree holding only the entries matching the filter, leaving this tree as is.
+// Values are copied by assignment, so values that are pointers, maps or slices refer to the same data in
+// both trees. The new tree is created with the same options.
+func (t *SubjectTree[T]) ExtractMatching(filter []byte) *SubjectTree[T] {
+	if t == nil {
+		return nil
+	}
+	nt := newTree[T](t.opts)
+	t.matchOrdered(filter, nil, func(subject []byte, val *T) bool {
+		nt.Insert(subject, *val)
+		return true
+	})
+	return nt
+}
@@ -0,0 +1,50 @@
+package subtree
+
+//-------------------
+// Structural statistics
+//-------------------
+
+// TreeStats counts the structural work a tree has done since it was created. Comparing the counts before and
+// after a workload quantifies e.g. the benefit of batch loading, and a fast growing count points at churn.
+type TreeStats struct {
+	NodeAllocs   uint64 // Internal nodes allocated, including grown, shrunk and copied ones
+	LeafAllocs   uint64 // Leaves allocated, including copied ones
+	Grows        uint64 // Nodes grown into a larger kind
+	Shrinks      uint64 // Nodes shrunk into a smaller kind or collapsed into their only child
+	Splits       uint64 // Leaves and node prefixes split by inserts
+	Clones       uint64 // Nodes and leaves copied because they were shared with a snapshot or version
+	PrefixCopies uint64 // Prefixes and suffixes copied
+	PrefixChains uint64 // Nodes added to keep prefixes within WithMaxPrefix
+
+	Churn *ChurnStats // Modifications in recent intervals, nil unless created WithChurnRates
+}
+
+// Stats returns the structural statistics of the tree since it was created.
+func (t *SubjectTree[T]) Stats() TreeStats {
+	if t == nil {
+		return TreeStats{}
+	}
+	stats := t.counts
+	if t.churn != nil {
+		stats.Churn = t.churn.stats()
+	}
+	return stats
+}
+
+// grew counts a node grown into a newly allocated larger kind.
+func (s *TreeStats) grew() {
+	s.Grows++
+	s.NodeAllocs++
+}
+
+// shrunk counts shrinking n into sn, and returns sn. A smaller kind is newly allocated, while a node4
+// collapses into its only child.
+func (s *TreeStats) shrunk(n, sn node) node {
+	if sn != nil {
+		s.Shrinks++
+		if _, collapse := n.(*node4); !collapse {
+			s.NodeAllocs++
+		}
+	}
+	return sn
+}
@@ -0,0 +1,29 @@
+package subtree
+
+//-------------------
+// String keyed API
+//-------------------
+
+// These variants take subjects and filters as strings and avoid the allocation of converting them to
+// byte slices. The subject handed to an op logger during InsertString or DeleteString refers to the
+// string's memory and must not be modified.
+
+// InsertString is like Insert but takes the subject as a string.
+func (t *SubjectTree[T]) InsertString(subject string, value T) (*T, bool) {
+	return t.Insert(stringBytes(subject), value)
+}
+
+// FindString is like Find but takes the subject as a string.
+func (t *SubjectTree[T]) FindString(subject string) (*T, bool) {
+	return t.Find(stringBytes(subject))
+}
+
+// DeleteString is like Delete but takes the subject as a string.
+func (t *SubjectTree[T]) DeleteString(subject string) (*T, bool) {
+	return t.Delete(stringBytes(subject))
+}
+
+// MatchString is like Match but takes the filter as a string.
+func (t *SubjectTree[T]) MatchString(filter string, cb func(subject []byte, val *T)) {
+	t.Match(stringBytes(filter), cb)
+}
@@ -2,7 +2,8 @@ package subtree
 
 import (
 	"bytes"
-	"slices"
+	"sync"
+	"time"
 )
 
 // SubjectTree is an adaptive radix trie (ART) for storing subject information on literal subjects.
@@ -12,11 +13,80 @@ import (
 type SubjectTree[T any] struct {
 	root node
 	size int
+	dead int    // Number of lazily deleted leaves still in the tree
+	gen  uint64 // Copy-on-write generation, 0 if nodes have never been shared
+
+	version uint64        // Incremented on every modification
+	shape   uint64        // Incremented when nodes are rebuilt without a modification, e.g. by Compact
+	retain  int           // Number of historical versions to retain
+	history []treeVersion // Retained historical versions, oldest first
+
+	oplog    func(op Op, subject []byte, v *T) // Optional logger of all modifications
+	recorder *Recorder                         // Optional recorder of all operations
+	lww      *lwwState                         // Last-writer-wins state, nil if not enabled
+
+	sealed      bool // Hand out copies of values instead of pointers into the tree
+	checkWrites bool // Panic if a callback modifies a value through its pointer
+
+	interner *Interner // Optional interner for prefixes and suffixes
+	opts     options   // Settings from the options given at creation
+
+	equals func(a, b T) bool // Optional value equality to detect no-op inserts
+	counts TreeStats         // Structural changes since creation
+	broken error             // Last panic recovered from, until the tree validates again
+	ids    map[uint64]string // Subjects by entry ID, nil if not enabled
+	hot    *hotTracker       // Match counts per prefix, nil if not enabled
+
+	prefixMeta map[string]any         // Annotations of prefixes, from SetPrefixMeta
+	suffixes   *SubjectTree[struct{}] // Subjects with reversed tokens, nil if not enabled
+	tokens     *tokenIndex            // Subjects by their tokens at some positions, nil if not enabled
+	churn      *churnTracker          // Modifications per recent interval, nil if not enabled
+	dedup      *valueDedup[T]         // Instances of the values to share, nil if not enabled
 }
 
-// NewSubjectTree creates a new SubjectTree with values T.
-func NewSubjectTree[T any]() *SubjectTree[T] {
-	return &SubjectTree[T]{}
+// NewSubjectTree creates a new SubjectTree with values T, configured with the given options.
+// Panics if the options are invalid, see NewSubjectTreeE.
+func NewSubjectTree[T any](opts ...Option) *SubjectTree[T] {
+	t, err := NewSubjectTreeE[T](opts...)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// NewSubjectTreeE is like NewSubjectTree but returns an error wrapping ErrInvalidOption for each invalid
+// setting instead of panicking, e.g. for options built from configuration that comes from users.
+func NewSubjectTreeE[T any](opts ...Option) (*SubjectTree[T], error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	checkValueTypes[T](&o)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	return newTree[T](o), nil
+}
+
+// newTree creates an empty tree with options that are valid already, setting up what they ask for next to
+// the nodes. Trees created from another one, e.g. by SplitAt, use the options of that one.
+func newTree[T any](o options) *SubjectTree[T] {
+	t := &SubjectTree[T]{opts: o}
+	if t.opts.equals != nil {
+		t.equals = t.opts.equals.(func(a, b T) bool)
+	}
+	if t.opts.entryIDs {
+		t.ids = make(map[uint64]string)
+	}
+	t.opts.rewrites = t.opts.rewriteTable()
+	if t.opts.suffixIndex {
+		t.suffixes = NewSubjectTree[struct{}](WithMaxPrefix(t.opts.maxPrefix))
+	}
+	t.tokens = newTokenIndex(t.opts.tokenPositions)
+	t.hot = newHotTracker(&t.opts)
+	t.churn = newChurnTracker(&t.opts)
+	t.dedup = newValueDedup[T](&t.opts)
+	return t
 }
 
 // Size returns the number of elements stored.
@@ -32,124 +102,540 @@ func (t *SubjectTree[T]) Empty() *SubjectTree[T] {
 	if t == nil {
 		return NewSubjectTree[T]()
 	}
-	t.root, t.size = nil, 0
+	t.beforeModify()
+	if t.lww != nil {
+		t.lwwEmptied()
+	}
+	if t.churn != nil {
+		t.churn.record(OpDelete, t.size)
+	}
+	root := t.root
+	t.root, t.size, t.dead = nil, 0, 0
+	t.rootSwapped(root)
+	clear(t.ids)
+	if t.dedup != nil {
+		t.dedup.emptied()
+	}
+	t.version++
+	if t.logging() {
+		t.logOp(OpEmpty, nil, nil)
+	}
+	if debugChecks {
+		t.debugCheck("empty")
+	}
 	return t
 }
 
 // Insert a value into the tree. Will return if the value was updated and if so the old value.
+// The returned old value is a copy and no longer part of the tree.
 func (t *SubjectTree[T]) Insert(subject []byte, value T) (*T, bool) {
+	old, updated, _ := t.insertMeta(subject, value, nil)
+	return old, updated
+}
+
+// InsertChanged is like Insert but also reports if the tree was changed. This is only ever false when the
+// tree was created WithValueEquals and the value is equal to the one already stored.
+func (t *SubjectTree[T]) InsertChanged(subject []byte, value T) (old *T, updated, changed bool) {
+	return t.insertMeta(subject, value, nil)
+}
+
+// InsertEvents reports the structural changes an insert made to the tree.
+type InsertEvents struct {
+	Splits int // Leaves and node prefixes split to make room for the subject
+	Grows  int // Nodes grown into a larger kind to hold another child
+}
+
+// Structural returns true if the insert split or grew any nodes.
+func (e InsertEvents) Structural() bool { return e.Splits > 0 || e.Grows > 0 }
+
+// InsertWithEvents is like Insert but also reports the structural changes the insert made, e.g. to correlate
+// latency spikes with splits and growth.
+func (t *SubjectTree[T]) InsertWithEvents(subject []byte, value T) (*T, bool, InsertEvents) {
 	if t == nil {
-		return nil, false
+		return nil, false, InsertEvents{}
+	}
+	before := t.counts
+	old, updated := t.Insert(subject, value)
+	return old, updated, InsertEvents{
+		Splits: int(t.counts.Splits - before.Splits),
+		Grows:  int(t.counts.Grows - before.Grows),
+	}
+}
+
+// insertMeta inserts a value with the given metadata, or newly generated metadata if md is nil.
+// Also returns if the tree was changed.
+func (t *SubjectTree[T]) insertMeta(subject []byte, value T, md *entryMeta) (old *T, updated, changed bool) {
+	if t == nil {
+		return nil, false, false
+	}
+	subject = t.canon(subject)
+	if hook := t.opts.latency; hook != nil {
+		start := t.opts.now()
+		defer func() { hook(CallInsert, t.opts.since(start), boolResults(changed && !updated)) }()
+	}
+	if t.opts.recover {
+		defer t.recoverPanic("insert", subject, nil)
+	}
+	if debugChecks {
+		defer t.debugCheck("insert")
 	}
 
 	// Make sure we never insert anything with a noPivot byte.
 	if bytes.IndexByte(subject, noPivot) >= 0 {
-		return nil, false
+		return nil, false, false
 	}
 
-	old, updated := t.insert(&t.root, subject, value, 0)
+	// Skip rewriting an equal value. Replicated inserts carry metadata that still has to be applied.
+	if t.equals != nil && md == nil {
+		if ln := t.findLeaf(subject); ln != nil && t.equals(ln.value, value) {
+			old := ln.value
+			return &old, true, false
+		}
+	}
+
+	if t.dedup != nil {
+		value = t.dedup.instance(value)
+	}
+	t.beforeModify()
+	root := t.root
+	old, updated = t.insert(&t.root, subject, value, 0)
+	t.rootSwapped(root)
 	if !updated {
 		t.size++
 	}
-	return old, updated
+	if t.dedup != nil {
+		t.dedupInserted()
+	}
+	t.version++
+	if t.lww != nil {
+		t.lwwInserted(subject, md)
+	}
+	if t.ids != nil {
+		t.idInserted(subject, updated)
+	}
+	if t.logging() {
+		// Copy the value here, taking the address of the argument would move it to the heap on every insert.
+		logged, op := value, OpInsert
+		if updated {
+			op = OpUpdate
+		}
+		t.logOp(op, subject, &logged)
+	}
+	return old, updated, true
 }
 
 // Find will find the value and return it or false if it was not found.
+// The returned pointer refers to the value stored in the tree. Writing through it changes the stored value
+// in place, without a new version or op log entry, and is only safe with the same synchronization as Insert.
+// The pointer no longer refers to the stored value once the entry is deleted, or replaced because the tree
+// shares its nodes with a snapshot, version or persistent tree. Use FindVal to get a copy instead.
+// This is the hot path for literal lookups, so it is written to never allocate and to keep
+// bounds checks and interface calls to a minimum. Changes here should be checked against
+// BenchmarkSubjectTreeFind and TestSubjectTreeFindNoAllocs.
 func (t *SubjectTree[T]) Find(subject []byte) (*T, bool) {
-	if t == nil {
-		return nil, false
+	if t != nil && t.recorder != nil {
+		t.recorder.record(recFind, subject, nil)
+	}
+	if t != nil && t.opts.latency != nil {
+		start := t.opts.now()
+		v, found := t.find(subject)
+		t.opts.latency(CallFind, t.opts.since(start), boolResults(found))
+		return v, found
 	}
+	return t.find(subject)
+}
 
-	var si int
-	for n := t.root; n != nil; {
-		if n.isLeaf() {
-			if ln := n.(*leaf[T]); ln.match(subject[si:]) {
-				return &ln.value, true
-			}
-			return nil, false
-		}
-		// We are a node type here, grab meta portion.
-		if bn := n.base(); len(bn.prefix) > 0 {
-			end := min(si+len(bn.prefix), len(subject))
-			if !bytes.Equal(subject[si:end], bn.prefix) {
-				return nil, false
-			}
-			// Increment our subject index.
-			si += len(bn.prefix)
-		}
-		if an := n.findChild(pivot(subject, si)); an != nil {
-			n = *an
-		} else {
-			return nil, false
+// Internal function for Find.
+func (t *SubjectTree[T]) find(subject []byte) (*T, bool) {
+	if ln := t.findLeaf(subject); ln != nil {
+		if t.sealed {
+			cv := ln.value
+			return &cv, true
 		}
+		return &ln.value, true
 	}
 	return nil, false
 }
 
+// FindVal is like Find but returns a copy of the value instead of a pointer into the tree.
+func (t *SubjectTree[T]) FindVal(subject []byte) (T, bool) {
+	if t != nil && t.recorder != nil {
+		t.recorder.record(recFind, subject, nil)
+	}
+	if ln := t.findLeaf(subject); ln != nil {
+		return ln.value, true
+	}
+	var zero T
+	return zero, false
+}
+
 // Delete will delete the item and return its value, or not found if it did not exist.
+// The returned value is no longer part of the tree.
 func (t *SubjectTree[T]) Delete(subject []byte) (*T, bool) {
+	return t.deleteStamped(subject, nil)
+}
+
+// DeleteEvents reports what a delete removed and the structural changes it made to the tree.
+type DeleteEvents struct {
+	Shrinks   int   // Nodes shrunk into a smaller kind or collapsed into their only child
+	Lazy      bool  // The entry was marked dead and its leaf is kept until the tree is compacted
+	Compacted bool  // The delete pushed the dead leaves over the threshold and compacted the tree
+	Stamp     Stamp // Stamp of the last write to the entry, when last-writer-wins is enabled
+	Stamped   bool  // If the tree tracked a stamp for the entry
+}
+
+// DeleteEntry is like Delete but returns the removed entry, with a copy of the subject, and reports the
+// structural changes the delete made together with the metadata tracked for the entry, e.g. for audit logs
+// recording what was removed and when it was written.
+func (t *SubjectTree[T]) DeleteEntry(subject []byte) (Entry[T], bool, DeleteEvents) {
+	var events DeleteEvents
+	if t == nil {
+		return Entry[T]{}, false, events
+	}
+	if t.lww != nil {
+		if ln := t.findLeaf(subject); ln != nil {
+			if ln.md != nil {
+				events.Stamp = ln.md.stamp
+			}
+			events.Stamped = true
+		}
+	}
+	before := t.counts
+	val, deleted := t.Delete(subject)
+	if !deleted {
+		return Entry[T]{}, false, DeleteEvents{}
+	}
+	events.Shrinks = int(t.counts.Shrinks - before.Shrinks)
+	if t.opts.lazyDelete {
+		// A lazy delete adds a dead leaf, so none are left only if it compacted the tree.
+		events.Lazy, events.Compacted = true, t.dead == 0
+	}
+	return entryOf(subject, val), true, events
+}
+
+// DeleteIf deletes the subject only if pred returns true for its current value, and returns the deleted value.
+// A nil pred deletes unconditionally.
+func (t *SubjectTree[T]) DeleteIf(subject []byte, pred func(v T) bool) (T, bool) {
+	var zero T
+	ln := t.findLeaf(subject)
+	if ln == nil || pred != nil && !pred(ln.value) {
+		return zero, false
+	}
+	val, deleted := t.Delete(subject)
+	if !deleted {
+		return zero, false
+	}
+	return *val, true
+}
+
+// deleteStamped deletes the item, recording a tombstone with the given stamp, or a new one if nil,
+// when last-writer-wins is enabled.
+func (t *SubjectTree[T]) deleteStamped(subject []byte, stamp *Stamp) (val *T, deleted bool) {
 	if t == nil {
 		return nil, false
 	}
+	subject = t.canon(subject)
+	if hook := t.opts.latency; hook != nil {
+		start := t.opts.now()
+		defer func() { hook(CallDelete, t.opts.since(start), boolResults(deleted)) }()
+	}
+	if t.opts.recover {
+		defer t.recoverPanic("delete", subject, nil)
+	}
+	if debugChecks {
+		defer t.debugCheck("delete")
+	}
+	// When nodes are shared the delete would copy the path, so make sure there is something to delete.
+	if t.gen != 0 || t.retain > 0 {
+		if t.findLeaf(subject) == nil {
+			return nil, false
+		}
+	}
+
+	var id uint64
+	if t.ids != nil {
+		id, _ = t.idOf(subject)
+	}
 
-	val, deleted := t.delete(&t.root, subject, 0)
+	t.beforeModify()
+	root := t.root
+	if t.opts.lazyDelete {
+		val, deleted = t.deleteLazy(subject)
+	} else {
+		val, deleted = t.delete(&t.root, subject, 0)
+	}
+	t.rootSwapped(root)
 	if deleted {
 		t.size--
+		if t.dead > 0 && t.opts.compactAt > 0 && float64(t.dead) > t.opts.compactAt*float64(t.dead+t.size) {
+			t.Compact()
+		}
+		t.version++
+		if id != 0 {
+			delete(t.ids, id)
+		}
+		if t.lww != nil {
+			t.lwwDeleted(subject, stamp)
+		}
+		if t.logging() {
+			t.logOp(OpDelete, subject, val)
+		}
 	}
 	return val, deleted
 }
 
 // Match will match against a subject that can have wildcards and invoke the callback func for each matched value.
+// The value pointer has the same semantics as the one returned from Find, and the subject is only valid
+// for the duration of the callback unless the tree was created WithStableCallbacksSubjects.
+// Every matching entry is handed to the callback exactly once, however the wildcards of the filter overlap.
 func (t *SubjectTree[T]) Match(filter []byte, cb func(subject []byte, val *T)) {
-	if t == nil || t.root == nil || len(filter) == 0 || cb == nil {
+	if t == nil || cb == nil {
 		return
 	}
-	// We need to break this up into chunks based on wildcards, either pwc '*' or fwc '>'.
-	var raw [16][]byte
-	parts := genParts(filter, raw[:0])
-	var _pre [256]byte
-	t.match(t.root, parts, _pre[:0], cb)
+	t.recordMatch(filter)
+	t.matchFilter(filter, true, t.guardMatch(cb))
+}
+
+// MatchValues will match against a subject that can have wildcards and invoke the callback func for each matched value.
+// Unlike Match it will not reconstruct the matched subject, which saves the prefix and suffix copying on deep trees.
+func (t *SubjectTree[T]) MatchValues(filter []byte, cb func(val *T)) {
+	if t == nil || cb == nil {
+		return
+	}
+	t.recordMatch(filter)
+	t.matchFilter(filter, false, t.guardMatch(func(_ []byte, val *T) { cb(val) }))
+}
+
+// MatchStats reports how much of the tree a match had to look at to produce its matches.
+// A filter visiting many nodes and leaves for few matches has poor selectivity.
+type MatchStats struct {
+	Nodes   int // Internal nodes visited
+	Leaves  int // Leaves inspected
+	Matches int // Matches handed to the callback
+}
+
+// MatchWithStats is like Match but also returns statistics about the traversal.
+func (t *SubjectTree[T]) MatchWithStats(filter []byte, cb func(subject []byte, val *T)) MatchStats {
+	var stats MatchStats
+	if t == nil || cb == nil {
+		return stats
+	}
+	t.recordMatch(filter)
+	t.matchFilterStats(filter, true, &stats, t.guardMatch(cb))
+	return stats
+}
+
+// visit counts a node the match looked at.
+func (s *MatchStats) visit(n node) {
+	if n.isLeaf() {
+		s.Leaves++
+	} else {
+		s.Nodes++
+	}
+}
+
+// MatchVals is like Match but hands copies of the values to the callback instead of pointers into the tree.
+func (t *SubjectTree[T]) MatchVals(filter []byte, cb func(subject []byte, val T)) {
+	if cb == nil {
+		return
+	}
+	t.Match(filter, func(subject []byte, val *T) { cb(subject, *val) })
 }
 
 // IterOrdered will walk all entries in the SubjectTree lexographically. The callback can return false to terminate the walk.
+// The subject is only valid for the duration of the callback unless the tree was created WithStableCallbacksSubjects.
+// The walk itself does not allocate.
 func (t *SubjectTree[T]) IterOrdered(cb func(subject []byte, val *T) bool) {
-	if t == nil || t.root == nil {
+	if t == nil {
 		return
 	}
-	var _pre [256]byte
-	t.iter(t.root, _pre[:0], true, cb)
+	t.iterAll(true, t.guardIter(cb))
 }
 
 // IterFast will walk all entries in the SubjectTree with no guarantees of ordering. The callback can return false to terminate the walk.
+// Every entry is visited exactly once, whatever kind of node holds it. This holds even if the callback deletes
+// the entry it was handed, while other entries inserted or deleted by the callback may or may not be visited.
 func (t *SubjectTree[T]) IterFast(cb func(subject []byte, val *T) bool) {
-	if t == nil || t.root == nil {
+	if t == nil {
 		return
 	}
-	var _pre [256]byte
-	t.iter(t.root, _pre[:0], false, cb)
+	t.iterAll(false, t.guardIter(cb))
 }
 
 // Internal methods
 
+// Internal function to create a new leaf node with the given suffix and value, retaining a copy of the suffix.
+func (t *SubjectTree[T]) newLeaf(suffix []byte, value T) *leaf[T] {
+	t.counts.LeafAllocs++
+	return &leaf[T]{value: value, suffix: t.copyFrag(suffix)}
+}
+
+// Internal function to create a new node4 retaining a copy of the prefix, owned by this tree's generation.
+func (t *SubjectTree[T]) newNode4(prefix []byte) *node4 {
+	t.counts.NodeAllocs++
+	nn := &node4{}
+	nn.prefix = t.copyFrag(prefix)
+	nn.gen = t.gen
+	return nn
+}
+
+// Internal function to match a filter, handing the callback pointers to the stored values.
+// If subj is false the subject is not reconstructed and the callback will receive a nil subject.
+func (t *SubjectTree[T]) matchFilter(filter []byte, subj bool, cb func(subject []byte, val *T)) {
+	t.matchFilterStats(filter, subj, nil, cb)
+}
+
+// Internal function to match a filter like matchFilter, counting the traversal into stats if not nil.
+func (t *SubjectTree[T]) matchFilterStats(filter []byte, subj bool, stats *MatchStats, cb func(subject []byte, val *T)) {
+	var raw [16][]byte
+	var _pre [256]byte
+	t.matchBufs(filter, subj, stats, raw[:0], _pre[:0], cb)
+}
+
+// Internal function to match a filter like matchFilterStats, working in the given buffers for the parts of
+// the filter and the subjects. Returns the parts, which may have outgrown the buffer.
+func (t *SubjectTree[T]) matchBufs(filter []byte, subj bool, stats *MatchStats, raw [][]byte, pre []byte, cb func(subject []byte, val *T)) [][]byte {
+	filter = t.canon(filter)
+	visit, visited := t.observeMatch(filter)
+	if t == nil || t.root == nil || len(filter) == 0 || cb == nil {
+		return raw
+	}
+	if visit != nil {
+		defer visited()
+		subj = true
+		inner := cb
+		cb = func(subject []byte, val *T) {
+			visit(subject)
+			inner(subject, val)
+		}
+	}
+	if hook := t.opts.latency; hook != nil {
+		var n int
+		cb = countMatches(&n, cb)
+		defer func(start time.Time) { hook(CallMatch, t.opts.since(start), n) }(t.opts.now())
+	}
+	if t.opts.recover {
+		var inCb bool
+		defer t.recoverPanic("match", filter, &inCb)
+		inner := cb
+		cb = func(subject []byte, val *T) {
+			inCb = true
+			inner(subject, val)
+			inCb = false
+		}
+	}
+	var done func()
+	if debugChecks {
+		var visit func(val *T)
+		visit, done = t.matchConsistent(filter)
+		inner := cb
+		cb = func(subject []byte, val *T) {
+			visit(val)
+			inner(subject, val)
+		}
+	}
+	// We need to break this up into chunks based on wildcards, either pwc '*' or fwc '>'.
+	parts := genParts(filter, raw)
+	t.match(t.root, parts, pre, subj, stats, cb)
+	if debugChecks {
+		done()
+	}
+	return parts
+}
+
+// Internal function to match a filter like matchFilter for walks the tree makes on its own behalf, e.g. to
+// dump it. These are not calls on the tree, so the recorder, hot prefixes and latency hook do not see them.
+func (t *SubjectTree[T]) matchInternal(filter []byte, subj bool, cb func(subject []byte, val *T)) {
+	filter = t.canon(filter)
+	if t == nil || t.root == nil || len(filter) == 0 || cb == nil {
+		return
+	}
+	var raw [16][]byte
+	var _pre [256]byte
+	t.match(t.root, genParts(filter, raw[:0]), _pre[:0], subj, nil, cb)
+}
+
+// Buffers for the subjects built during walks. The buffer is handed to the callback and so
+// escapes, which would otherwise cost an allocation per walk.
+var preBufs = sync.Pool{New: func() any { return new([256]byte) }}
+
+// Internal function to walk all entries, handing the callback pointers to the stored values.
+func (t *SubjectTree[T]) iterAll(ordered bool, cb func(subject []byte, val *T) bool) {
+	if t == nil || t.root == nil {
+		return
+	}
+	pre := preBufs.Get().(*[256]byte)
+	defer preBufs.Put(pre)
+	t.iter(t.root, pre[:0], ordered, cb)
+}
+
+// Internal function to find the leaf for a literal subject, or nil if it does not exist.
+func (t *SubjectTree[T]) findLeaf(subject []byte) *leaf[T] {
+	if t == nil {
+		return nil
+	}
+	subject = t.canon(subject)
+
+	var si int
+	for n := t.root; n != nil; {
+		// A direct type assertion is cheaper than calling isLeaf through the interface.
+		if ln, ok := n.(*leaf[T]); ok {
+			if string(subject[si:]) == string(ln.suffix) && !ln.dead() {
+				return ln
+			}
+			return nil
+		}
+		// We are a node type here, check the prefix inline.
+		if prefix := n.base().prefix; len(prefix) > 0 {
+			end := si + len(prefix)
+			if end > len(subject) || string(subject[si:end]) != string(prefix) {
+				return nil
+			}
+			// Increment our subject index.
+			si = end
+		}
+		// Inlined pivot, we know si <= len(subject) here.
+		c := noPivot
+		if si < len(subject) {
+			c = subject[si]
+		}
+		an := n.findChild(c)
+		if an == nil {
+			return nil
+		}
+		n = *an
+	}
+	return nil
+}
+
 // Internal call to insert that can be recursive.
 func (t *SubjectTree[T]) insert(np *node, subject []byte, value T, si int) (*T, bool) {
 	n := *np
 	if n == nil {
-		*np = newLeaf(subject, value)
+		*np = t.newLeaf(subject, value)
 		return nil, false
 	}
 	if n.isLeaf() {
 		ln := n.(*leaf[T])
 		if ln.match(subject[si:]) {
 			// Replace with new value.
+			ln = t.writable(np).(*leaf[T])
+			if ln.dead() {
+				// Revive a lazily deleted entry, which counts as a new one.
+				ln.value, ln.md = value, nil
+				t.dead--
+				return nil, false
+			}
 			old := ln.value
 			ln.value = value
 			return &old, true
 		}
 		// Here we need to split this leaf.
+		ln = t.writable(np).(*leaf[T])
 		cpi := commonPrefixLen(ln.suffix, subject[si:])
-		nn := newNode4(subject[si : si+cpi])
-		ln.setSuffix(ln.suffix[cpi:])
+		nn := t.newNode4(subject[si : si+cpi])
+		t.split(ln, nn)
+		ln.suffix = t.copyFrag(ln.suffix[cpi:])
 		si += cpi
 		// Make sure we have different pivot, normally this will be the case unless we have overflowing prefixes.
 		if p := pivot(ln.suffix, 0); cpi > 0 && si < len(subject) && p == subject[si] {
@@ -157,18 +643,21 @@ func (t *SubjectTree[T]) insert(np *node, subject []byte, value T, si int) (*T,
 			t.insert(np, subject, value, si)
 			// Now add the update version of *np as a child to the new node4.
 			nn.addChild(p, *np)
+			nn.leaves = leafCount(*np)
 		} else {
 			// Can just add this new leaf as a sibling.
-			nl := newLeaf(subject[si:], value)
+			nl := t.newLeaf(subject[si:], value)
 			nn.addChild(pivot(nl.suffix, 0), nl)
 			// Add back original.
 			nn.addChild(pivot(ln.suffix, 0), ln)
+			nn.leaves = 1 + leafCount(ln)
 		}
-		*np = nn
+		*np = t.capPrefix(nn)
 		return nil, false
 	}
 
-	// Non-leaf nodes.
+	// Non-leaf nodes. We will modify this node or one of its children, so make sure it is ours.
+	n = t.writable(np)
 	bn := n.base()
 	if len(bn.prefix) > 0 {
 		cpi := commonPrefixLen(bn.prefix, subject[si:])
@@ -177,13 +666,18 @@ func (t *SubjectTree[T]) insert(np *node, subject []byte, value T, si int) (*T,
 			// If one does not exist we can create a new leaf node.
 			si += pli
 			if nn := n.findChild(pivot(subject, si)); nn != nil {
-				return t.insert(nn, subject, value, si)
+				old, updated := t.insert(nn, subject, value, si)
+				if !updated {
+					bn.leaves++
+				}
+				return old, updated
 			}
 			if n.isFull() {
-				n = n.grow()
+				n = t.grew(n, n.grow())
 				*np = n
 			}
-			n.addChild(pivot(subject, si), newLeaf(subject[si:], value))
+			n.addChild(pivot(subject, si), t.newLeaf(subject[si:], value))
+			n.base().leaves++
 			return nil, false
 		} else {
 			// We did not match the prefix completely here.
@@ -191,25 +685,32 @@ func (t *SubjectTree[T]) insert(np *node, subject []byte, value T, si int) (*T,
 			prefix := subject[si : si+cpi]
 			si += len(prefix)
 			// We will insert a new node4 and attach our current node below after adjusting prefix.
-			nn := newNode4(prefix)
+			nn := t.newNode4(prefix)
+			t.split(n, nn)
 			// Shift the prefix for our original node.
-			n.setPrefix(bn.prefix[cpi:])
+			bn.prefix = t.copyFrag(bn.prefix[cpi:])
 			nn.addChild(pivot(bn.prefix[:], 0), n)
 			// Add in our new leaf.
-			nn.addChild(pivot(subject[si:], 0), newLeaf(subject[si:], value))
+			nn.addChild(pivot(subject[si:], 0), t.newLeaf(subject[si:], value))
+			nn.leaves = bn.leaves + 1
 			// Update our node reference.
 			*np = nn
 		}
 	} else {
 		if nn := n.findChild(pivot(subject, si)); nn != nil {
-			return t.insert(nn, subject, value, si)
+			old, updated := t.insert(nn, subject, value, si)
+			if !updated {
+				bn.leaves++
+			}
+			return old, updated
 		}
 		// No prefix and no matched child, so add in new leafnode as needed.
 		if n.isFull() {
-			n = n.grow()
+			n = t.grew(n, n.grow())
 			*np = n
 		}
-		n.addChild(pivot(subject, si), newLeaf(subject[si:], value))
+		n.addChild(pivot(subject, si), t.newLeaf(subject[si:], value))
+		n.base().leaves++
 	}
 
 	return nil, false
@@ -223,7 +724,7 @@ func (t *SubjectTree[T]) delete(np *node, subject []byte, si int) (*T, bool) {
 	n := *np
 	if n.isLeaf() {
 		ln := n.(*leaf[T])
-		if ln.match(subject[si:]) {
+		if ln.match(subject[si:]) && !ln.dead() {
 			*np = nil
 			return &ln.value, true
 		}
@@ -231,59 +732,90 @@ func (t *SubjectTree[T]) delete(np *node, subject []byte, si int) (*T, bool) {
 	}
 	// Not a leaf node.
 	if bn := n.base(); len(bn.prefix) > 0 {
-		if !bytes.Equal(subject[si:si+len(bn.prefix)], bn.prefix) {
+		if end := si + len(bn.prefix); end > len(subject) || !bytes.Equal(subject[si:end], bn.prefix) {
 			return nil, false
 		}
 		// Increment our subject index.
 		si += len(bn.prefix)
 	}
 	p := pivot(subject, si)
-	nna := n.findChild(p)
-	if nna == nil {
+	if n.findChild(p) == nil {
 		return nil, false
 	}
+	// We will modify this node or one of its children, so make sure it is ours.
+	n = t.writable(np)
+	nna := n.findChild(p)
 	nn := *nna
 	if nn.isLeaf() {
 		ln := nn.(*leaf[T])
-		if ln.match(subject[si:]) {
+		if ln.match(subject[si:]) && !ln.dead() {
 			n.deleteChild(p)
-
-			if sn := n.shrink(); sn != nil {
-				bn := n.base()
-				// Make sure to set cap so we force an append to copy below.
-				pre := bn.prefix[:len(bn.prefix):len(bn.prefix)]
-				// Need to fix up prefixes/suffixes.
-				if sn.isLeaf() {
-					ln := sn.(*leaf[T])
-					// Make sure to set cap so we force an append to copy.
-					ln.suffix = append(pre, ln.suffix...)
-				} else {
-					// We are a node here, we need to add in the old prefix.
-					if len(pre) > 0 {
-						bsn := sn.base()
-						sn.setPrefix(append(pre, bsn.prefix...))
-					}
-				}
-				*np = sn
-			}
-
+			n.base().leaves--
+			t.shrinkAfterDelete(np, n)
 			return &ln.value, true
 		}
 		return nil, false
 	}
-	return t.delete(nna, subject, si)
+	val, deleted := t.delete(nna, subject, si)
+	if deleted {
+		n.base().leaves--
+		// Only chain nodes holding a single child can end up empty, or down to a child they now fit into.
+		if *nna == nil {
+			n.deleteChild(p)
+			t.shrinkAfterDelete(np, n)
+		} else if n.numChildren() == 1 {
+			t.shrinkAfterDelete(np, n)
+		}
+	}
+	return val, deleted
+}
+
+// Internal function to shrink n, which np refers to, after it lost a child. If n is replaced by a smaller
+// kind or collapses into its only child, the replacement is stored in np with its prefix fixed up.
+func (t *SubjectTree[T]) shrinkAfterDelete(np *node, n node) {
+	if n.numChildren() == 0 {
+		t.emit(EventPrune, n, nil)
+		*np = nil
+		return
+	}
+	sn := t.shrink(n)
+	if sn == nil {
+		return
+	}
+	bn := n.base()
+	// Make sure to set cap so we force an append to copy below.
+	pre := bn.prefix[:len(bn.prefix):len(bn.prefix)]
+	// Need to fix up prefixes/suffixes. The node we shrunk to may still be shared.
+	sn = t.cow(sn)
+	if sn.isLeaf() {
+		ln := sn.(*leaf[T])
+		// Make sure to set cap so we force an append to copy.
+		ln.suffix = t.internFrag(append(pre, ln.suffix...))
+	} else {
+		// We are a node here, we need to add in the old prefix.
+		if len(pre) > 0 {
+			bsn := sn.base()
+			bsn.prefix = t.internFrag(append(pre, bsn.prefix...))
+		}
+	}
+	*np = sn
 }
 
 // Internal function which can be called recursively to match all leaf nodes to a given filter subject which
 // once here has been decomposed to parts. These parts only care about wildcards, both pwc and fwc.
-func (t *SubjectTree[T]) match(n node, parts [][]byte, pre []byte, cb func(subject []byte, val *T)) {
+// If subj is false the subject is not reconstructed and the callback will receive a nil subject.
+// If stats is not nil the visited nodes, inspected leaves and matches are counted into it.
+func (t *SubjectTree[T]) match(n node, parts [][]byte, pre []byte, subj bool, stats *MatchStats, cb func(subject []byte, val *T)) {
 	// Capture if we are sitting on a terminal fwc.
 	var hasFWC bool
-	if lp := len(parts); lp > 0 && len(parts[lp-1]) > 0 && parts[lp-1][0] == fwc {
+	if lp := len(parts); lp > 0 && isFWC(parts[lp-1]) {
 		hasFWC = true
 	}
 
 	for n != nil {
+		if stats != nil {
+			stats.visit(n)
+		}
 		nparts, matched := n.matchParts(parts)
 		// Check if we did not match.
 		if !matched {
@@ -292,15 +824,19 @@ func (t *SubjectTree[T]) match(n node, parts [][]byte, pre []byte, cb func(subje
 		// We have matched here. If we are a leaf and have exhausted all parts or he have a FWC fire callback.
 		if n.isLeaf() {
 			if len(nparts) == 0 || (hasFWC && len(nparts) == 1) {
-				ln := n.(*leaf[T])
-				cb(append(pre, ln.suffix...), &ln.value)
+				if ln := n.(*leaf[T]); !ln.dead() {
+					if stats != nil {
+						stats.Matches++
+					}
+					cb(leafSubject(pre, ln, subj), &ln.value)
+				}
 			}
 			return
 		}
 		// We have normal nodes here.
 		// We need to append our prefix
 		bn := n.base()
-		if len(bn.prefix) > 0 {
+		if subj && len(bn.prefix) > 0 {
 			// Note that this append may reallocate, but it doesn't modify "pre" at the "match" callsite.
 			pre = append(pre, bn.prefix...)
 		}
@@ -311,7 +847,7 @@ func (t *SubjectTree[T]) match(n node, parts [][]byte, pre []byte, cb func(subje
 			// We could have a leafnode with no suffix which would be a match.
 			// We could also have a terminal pwc. Check for those here.
 			var hasTermPWC bool
-			if lp := len(parts); lp > 0 && len(parts[lp-1]) == 1 && parts[lp-1][0] == pwc {
+			if lp := len(parts); lp > 0 && isPWC(parts[lp-1]) {
 				// If we are sitting on a terminal pwc, put the pwc back and continue.
 				nparts = parts[len(parts)-1:]
 				hasTermPWC = true
@@ -322,14 +858,21 @@ func (t *SubjectTree[T]) match(n node, parts [][]byte, pre []byte, cb func(subje
 				}
 				if cn.isLeaf() {
 					ln := cn.(*leaf[T])
-					if len(ln.suffix) == 0 {
-						cb(append(pre, ln.suffix...), &ln.value)
-					} else if hasTermPWC && bytes.IndexByte(ln.suffix, tsep) < 0 {
-						cb(append(pre, ln.suffix...), &ln.value)
+					if stats != nil {
+						stats.Leaves++
+					}
+					if ln.dead() {
+						continue
+					}
+					if len(ln.suffix) == 0 || hasTermPWC && bytes.IndexByte(ln.suffix, tsep) < 0 {
+						if stats != nil {
+							stats.Matches++
+						}
+						cb(leafSubject(pre, ln, subj), &ln.value)
 					}
 				} else if hasTermPWC {
 					// We have terminal pwc so call into match again with the child node.
-					t.match(cn, nparts, pre, cb)
+					t.match(cn, nparts, pre, subj, stats, cb)
 				}
 			}
 			// Return regardless.
@@ -345,12 +888,12 @@ func (t *SubjectTree[T]) match(n node, parts [][]byte, pre []byte, cb func(subje
 		fp := nparts[0]
 		p := pivot(fp, 0)
 		// Check if we have a pwc/fwc part here. This will cause us to iterate.
-		if len(fp) == 1 && (p == pwc || p == fwc) {
+		if isPWC(fp) || isFWC(fp) {
 			// We need to iterate over all children here for the current node
 			// to see if we match further down.
 			for _, cn := range n.children() {
 				if cn != nil {
-					t.match(cn, nparts, pre, cb)
+					t.match(cn, nparts, pre, subj, stats, cb)
 				}
 			}
 			return
@@ -364,44 +907,78 @@ func (t *SubjectTree[T]) match(n node, parts [][]byte, pre []byte, cb func(subje
 	}
 }
 
+// leafSubject returns the full subject for a leaf given the accumulated prefix, or nil when
+// the caller has asked us not to reconstruct subjects.
+func leafSubject[T any](pre []byte, ln *leaf[T], subj bool) []byte {
+	if !subj {
+		return nil
+	}
+	return append(pre, ln.suffix...)
+}
+
+// reshaped reports whether the nodes of the tree may have changed since a walk saw the given version and shape.
+func (t *SubjectTree[T]) reshaped(version, shape uint64) bool {
+	return t.version != version || t.shape != shape
+}
+
 // Interal iter function to walk nodes in lexigraphical order.
 func (t *SubjectTree[T]) iter(n node, pre []byte, ordered bool, cb func(subject []byte, val *T) bool) bool {
 	if n.isLeaf() {
 		ln := n.(*leaf[T])
+		if ln.dead() {
+			return true
+		}
 		return cb(append(pre, ln.suffix...), &ln.value)
 	}
 	// We are normal node here.
 	bn := n.base()
 	// Note that this append may reallocate, but it doesn't modify "pre" at the "iter" callsite.
 	pre = append(pre, bn.prefix...)
+	// Callbacks may modify the tree, which can move children within this node or replace it.
+	// We notice through the version or shape and then continue from wherever our children are now.
+	var prog walkProgress
+	version, shape := t.version, t.shape
 	// Not everything requires lexicographical sorting, so support a fast path for iterating in
 	// whatever order the stree has things stored instead.
 	if !ordered {
+		if nn, ok := n.(*node256); ok {
+			for c := nn.next(0); c < 256; c = nn.next(c + 1) {
+				prog.visit(byte(c))
+				if !t.iter(nn.child[c], pre, false, cb) {
+					return false
+				}
+				if t.reshaped(version, shape) {
+					return t.iterResume(pre, false, &prog, cb)
+				}
+			}
+			return true
+		}
 		for _, cn := range n.children() {
 			if cn == nil {
 				continue
 			}
+			prog.visit(pivot(cn.path(), 0))
 			if !t.iter(cn, pre, false, cb) {
 				return false
 			}
+			if t.reshaped(version, shape) {
+				return t.iterResume(pre, false, &prog, cb)
+			}
 		}
 		return true
 	}
-	// Collect nodes since unsorted.
+	// Collect nodes since unsorted and sort them.
 	var _nodes [256]node
-	nodes := _nodes[:0]
-	for _, cn := range n.children() {
-		if cn != nil {
-			nodes = append(nodes, cn)
-		}
-	}
-	// Now sort.
-	slices.SortStableFunc(nodes, func(a, b node) int { return bytes.Compare(a.path(), b.path()) })
+	nodes := sortedChildren(n, _nodes[:0])
 	// Now walk the nodes in order and call into next iter.
 	for i := range nodes {
+		prog.visit(pivot(nodes[i].path(), 0))
 		if !t.iter(nodes[i], pre, true, cb) {
 			return false
 		}
+		if t.reshaped(version, shape) {
+			return t.iterResume(pre, true, &prog, cb)
+		}
 	}
 	return true
 }
@@ -0,0 +1,279 @@
+package subtreetest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/rskv-p/subtree"
+)
+
+//-------------------
+// Randomized stress tests
+//-------------------
+
+// Stress runs ops random inserts, deletes, finds and matches against a new tree created with the options,
+// and checks every result against a map of the entries the tree should hold. The structure of the tree is
+// validated as it goes and its contents compared in full at the end. The operations only depend on seed, so
+// a failure, which is reported with the seed and the operation that failed, reproduces with the same seed.
+func Stress(t testing.TB, ops int, seed uint64, opts ...subtree.Option) {
+	t.Helper()
+	st := subtree.NewSubjectTree[int](opts...)
+	s := newStressRun(seed, 0, "")
+	check := func(i int) error {
+		if st.Size() != len(s.model) {
+			return fmt.Errorf("op %d: size %d, want %d", i, st.Size(), len(s.model))
+		}
+		return st.Validate()
+	}
+	for i := range ops {
+		if err := s.step(i, plainTree{st}); err != nil {
+			t.Fatalf("subtreetest: stress with seed %d failed: %v", seed, err)
+		}
+		if i%1000 == 999 {
+			if err := check(i); err != nil {
+				t.Fatalf("subtreetest: stress with seed %d failed: %v", seed, err)
+			}
+		}
+	}
+	err := check(ops)
+	if err == nil {
+		err = s.compare(st)
+	}
+	if err != nil {
+		t.Fatalf("subtreetest: stress with seed %d failed: %v", seed, err)
+	}
+}
+
+// StressConcurrent is like Stress against a SafeSubjectTree used by the given number of goroutines at once,
+// each running its share of the ops on subjects of its own, so every goroutine can check its results while
+// the others modify the tree. Matches alternate between Match and MatchSnapshot. The operations of every
+// goroutine only depend on seed, but their interleaving does not, so failures may take several runs to
+// reproduce.
+func StressConcurrent(t testing.TB, ops int, seed uint64, workers int, opts ...subtree.Option) {
+	t.Helper()
+	workers = max(workers, 1)
+	st := subtree.NewSafeSubjectTree[int](opts...)
+	runs := make([]*stressRun, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for w := range workers {
+		runs[w] = newStressRun(seed, uint64(w), fmt.Sprintf("w%d.", w))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := w; i < ops; i += workers {
+				if errs[w] = runs[w].step(i, safeTree{st}); errs[w] != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for w, err := range errs {
+		if err != nil {
+			t.Fatalf("subtreetest: stress with seed %d failed in goroutine %d: %v", seed, w, err)
+		}
+	}
+	// All together, the runs should add up to the tree.
+	all := newStressRun(seed, 0, "")
+	for _, s := range runs {
+		for subj, v := range s.model {
+			all.model[subj] = v
+		}
+	}
+	var err error
+	st.Update(func(st *subtree.SubjectTree[int]) {
+		if err = st.Validate(); err == nil {
+			err = all.compare(st)
+		}
+	})
+	if err != nil {
+		t.Fatalf("subtreetest: stress with seed %d failed: %v", seed, err)
+	}
+}
+
+// stressTree is the part of a tree the stress tests use, so plain and safe trees run the same operations.
+type stressTree interface {
+	insert(subject []byte, v int) (old int, updated bool)
+	delete(subject []byte) (int, bool)
+	find(subject []byte) (int, bool)
+	match(filter []byte, snapshot bool, cb func(subject []byte, v int))
+}
+
+// plainTree runs the stress operations against a SubjectTree.
+type plainTree struct {
+	st *subtree.SubjectTree[int]
+}
+
+func (p plainTree) insert(subject []byte, v int) (int, bool) {
+	if old, updated := p.st.Insert(subject, v); updated {
+		return *old, true
+	}
+	return 0, false
+}
+
+func (p plainTree) delete(subject []byte) (int, bool) {
+	if v, deleted := p.st.Delete(subject); deleted {
+		return *v, true
+	}
+	return 0, false
+}
+
+func (p plainTree) find(subject []byte) (int, bool) {
+	return p.st.FindVal(subject)
+}
+
+func (p plainTree) match(filter []byte, _ bool, cb func(subject []byte, v int)) {
+	p.st.MatchVals(filter, cb)
+}
+
+// safeTree runs the stress operations against a SafeSubjectTree.
+type safeTree struct {
+	st *subtree.SafeSubjectTree[int]
+}
+
+func (s safeTree) insert(subject []byte, v int) (int, bool) { return s.st.Insert(subject, v) }
+func (s safeTree) delete(subject []byte) (int, bool)        { return s.st.Delete(subject) }
+func (s safeTree) find(subject []byte) (int, bool)          { return s.st.Find(subject) }
+
+func (s safeTree) match(filter []byte, snapshot bool, cb func(subject []byte, v int)) {
+	if snapshot {
+		s.st.MatchSnapshot(filter, cb)
+	} else {
+		s.st.Match(filter, cb)
+	}
+}
+
+// stressRun is a sequence of random operations on subjects under a prefix, with the entries it expects.
+type stressRun struct {
+	r      *rand.Rand
+	prefix string
+	model  map[string]int
+	known  []string // Subjects inserted at some point, to draw deletes, finds and filters from
+}
+
+// newStressRun returns a run drawing from seed and stream, for subjects starting with prefix.
+func newStressRun(seed, stream uint64, prefix string) *stressRun {
+	return &stressRun{r: rand.New(rand.NewPCG(seed, stream)), prefix: prefix, model: make(map[string]int)}
+}
+
+// stressTokens are the tokens subjects are made of. They share prefixes so nodes are split and merged a lot.
+var stressTokens = []string{"a", "b", "c", "ab", "abc", "abd", "foo", "bar", "baz", "x1", "x12", "x123"}
+
+// subject returns a new subject half of the time, and a known one otherwise.
+func (s *stressRun) subject() string {
+	if len(s.known) > 0 && s.r.IntN(2) == 0 {
+		return s.known[s.r.IntN(len(s.known))]
+	}
+	var sb strings.Builder
+	sb.WriteString(s.prefix)
+	for i := range 1 + s.r.IntN(5) {
+		if i > 0 {
+			sb.WriteByte('.')
+		}
+		if s.r.IntN(10) == 0 {
+			// Now and then a long token, to get long prefixes.
+			fmt.Fprintf(&sb, "%x", s.r.Uint64())
+		} else {
+			sb.WriteString(stressTokens[s.r.IntN(len(stressTokens))])
+		}
+	}
+	subj := sb.String()
+	s.known = append(s.known, subj)
+	return subj
+}
+
+// filter returns a filter made from a subject by replacing tokens after the prefix with wildcards.
+func (s *stressRun) filter() string {
+	tokens := strings.Split(strings.TrimPrefix(s.subject(), s.prefix), ".")
+	for i := range tokens {
+		if s.r.IntN(3) == 0 {
+			tokens[i] = "*"
+		}
+	}
+	if n := len(tokens); n > 1 && s.r.IntN(4) == 0 {
+		tokens = append(tokens[:1+s.r.IntN(n-1)], ">")
+	}
+	return s.prefix + strings.Join(tokens, ".")
+}
+
+// step runs operation i against the tree and checks its result.
+func (s *stressRun) step(i int, st stressTree) error {
+	switch w := s.r.IntN(100); {
+	case w < 40:
+		subj := s.subject()
+		old, updated := st.insert([]byte(subj), i)
+		want, ok := s.model[subj]
+		if updated != ok || old != want {
+			return fmt.Errorf("op %d: insert %q returned (%d, %v), want (%d, %v)", i, subj, old, updated, want, ok)
+		}
+		s.model[subj] = i
+	case w < 65:
+		subj := s.subject()
+		v, deleted := st.delete([]byte(subj))
+		want, ok := s.model[subj]
+		if deleted != ok || v != want {
+			return fmt.Errorf("op %d: delete %q returned (%d, %v), want (%d, %v)", i, subj, v, deleted, want, ok)
+		}
+		delete(s.model, subj)
+	case w < 85:
+		subj := s.subject()
+		v, found := st.find([]byte(subj))
+		want, ok := s.model[subj]
+		if found != ok || v != want {
+			return fmt.Errorf("op %d: find %q returned (%d, %v), want (%d, %v)", i, subj, v, found, want, ok)
+		}
+	default:
+		filter := s.filter()
+		var got, want []string
+		st.match([]byte(filter), s.r.IntN(2) == 0, func(subject []byte, v int) {
+			got = append(got, fmt.Sprintf("%s=%d", subject, v))
+		})
+		for subj, v := range s.model {
+			if filterMatches(filter, subj) {
+				want = append(want, fmt.Sprintf("%s=%d", subj, v))
+			}
+		}
+		slices.Sort(got)
+		slices.Sort(want)
+		if !slices.Equal(got, want) {
+			return fmt.Errorf("op %d: match %q returned %v, want %v", i, filter, got, want)
+		}
+	}
+	return nil
+}
+
+// compare checks that the tree holds exactly the expected entries.
+func (s *stressRun) compare(st *subtree.SubjectTree[int]) error {
+	var err error
+	seen := 0
+	st.IterFast(func(subject []byte, v *int) bool {
+		seen++
+		if want, ok := s.model[string(subject)]; !ok || *v != want {
+			err = fmt.Errorf("tree holds %q=%d, want (%d, %v)", subject, *v, want, ok)
+		}
+		return err == nil
+	})
+	if err == nil && seen != len(s.model) {
+		err = fmt.Errorf("tree holds %d entries, want %d", seen, len(s.model))
+	}
+	return err
+}
+
+// filterMatches returns true if the literal subject matches the filter, token by token.
+func filterMatches(filter, subject string) bool {
+	fts, sts := strings.Split(filter, "."), strings.Split(subject, ".")
+	for i, ft := range fts {
+		if ft == ">" {
+			return len(sts) > i
+		}
+		if i >= len(sts) || (ft != "*" && ft != sts[i]) {
+			return false
+		}
+	}
+	return len(fts) == len(sts)
+}
@@ -0,0 +1,213 @@
+// Package subtreetest provides subjects and workloads for benchmarking subject trees, so that performance
+// can be measured and compared on shapes of subjects close to real ones without copying test code around,
+// and randomized stress tests checking trees against a simple model of their contents.
+// Everything generated is deterministic, so results are reproducible across runs and machines.
+package subtreetest
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+
+	"github.com/rskv-p/subtree"
+)
+
+//-------------------
+// Subject shapes
+//-------------------
+
+// Shape describes how generated subjects are distributed over the tree.
+type Shape uint8
+
+const (
+	Uniform Shape = iota // Four tokens, each with the same fanout
+	Wide                 // Two tokens, all subjects below a single parent
+	Deep                 // Sixteen tokens with a fanout of two
+	Zipfian              // Four tokens drawn from a zipfian distribution, so a few prefixes are very hot
+)
+
+// String returns the name of the shape.
+func (s Shape) String() string {
+	switch s {
+	case Uniform:
+		return "uniform"
+	case Wide:
+		return "wide"
+	case Deep:
+		return "deep"
+	case Zipfian:
+		return "zipfian"
+	}
+	return "Shape(" + strconv.Itoa(int(s)) + ")"
+}
+
+// seed is used for everything generated, so the results are the same on every run.
+const seed = 0x5eed
+
+// GenerateSubjects returns n distinct subjects of the given shape, in no particular order.
+func GenerateSubjects(n int, shape Shape) [][]byte {
+	subjects := make([][]byte, 0, n)
+	switch shape {
+	case Uniform:
+		// Spell out the index in the fanout as base, so every subject is distinct.
+		fanout := 2
+		for fanout*fanout*fanout*fanout < n {
+			fanout++
+		}
+		for i := 0; i < n; i++ {
+			subjects = append(subjects, digits("u", i, fanout, 4))
+		}
+	case Wide:
+		for i := 0; i < n; i++ {
+			subjects = append(subjects, fmt.Appendf(nil, "wide.%d", i))
+		}
+	case Deep:
+		for i := 0; i < n; i++ {
+			subjects = append(subjects, digits("d", i, 2, 16))
+		}
+	case Zipfian:
+		r := rand.New(rand.NewPCG(seed, seed))
+		z := rand.NewZipf(r, 1.2, 1, 1000)
+		// The last token is the index, so the zipfian prefixes can repeat while subjects stay distinct.
+		for i := 0; i < n; i++ {
+			subjects = append(subjects, fmt.Appendf(nil, "z%d.z%d.z%d.%d", z.Uint64(), z.Uint64(), z.Uint64(), i))
+		}
+	default:
+		panic(fmt.Sprintf("subtreetest: unknown shape %v", shape))
+	}
+	// Hand them out shuffled so inserting them in order is not a best case.
+	r := rand.New(rand.NewPCG(seed, uint64(shape)))
+	r.Shuffle(len(subjects), func(i, j int) { subjects[i], subjects[j] = subjects[j], subjects[i] })
+	return subjects
+}
+
+// digits returns i in the given base as a subject of tokens, most significant first. The first token
+// takes any digits left over, so indexes beyond base^tokens are still distinct.
+func digits(prefix string, i, base, tokens int) []byte {
+	var buf []byte
+	for t := tokens - 1; t >= 0; t-- {
+		d := i
+		for range t {
+			d /= base
+		}
+		if t < tokens-1 {
+			d %= base
+		}
+		if len(buf) > 0 {
+			buf = append(buf, '.')
+		}
+		buf = append(buf, prefix...)
+		buf = strconv.AppendInt(buf, int64(d), 10)
+	}
+	return buf
+}
+
+//-------------------
+// Workloads
+//-------------------
+
+// OpKind is the kind of an operation in a workload.
+type OpKind uint8
+
+const (
+	OpInsert OpKind = iota // Insert the subject
+	OpDelete               // Delete the subject
+	OpFind                 // Find the subject
+	OpMatch                // Match the subject as a filter
+)
+
+// String returns the name of the kind of operation.
+func (k OpKind) String() string {
+	switch k {
+	case OpInsert:
+		return "insert"
+	case OpDelete:
+		return "delete"
+	case OpFind:
+		return "find"
+	case OpMatch:
+		return "match"
+	}
+	return "OpKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Op is a single operation of a workload.
+type Op struct {
+	Kind    OpKind
+	Subject []byte // The subject, or the filter for OpMatch
+}
+
+// Mix gives the relative weights of the kinds of operations in a workload.
+type Mix struct {
+	Insert, Delete, Find, Match int
+}
+
+// GenerateWorkload returns n operations on the given subjects, with kinds chosen according to the mix.
+// Match filters are made from the subjects by replacing a token with `*`, or the tail with `>`.
+func GenerateWorkload(subjects [][]byte, n int, mix Mix) []Op {
+	total := mix.Insert + mix.Delete + mix.Find + mix.Match
+	if len(subjects) == 0 || total <= 0 {
+		return nil
+	}
+	r := rand.New(rand.NewPCG(seed, uint64(n)))
+	ops := make([]Op, 0, n)
+	for range n {
+		subject := subjects[r.IntN(len(subjects))]
+		var kind OpKind
+		switch w := r.IntN(total); {
+		case w < mix.Insert:
+			kind = OpInsert
+		case w < mix.Insert+mix.Delete:
+			kind = OpDelete
+		case w < mix.Insert+mix.Delete+mix.Find:
+			kind = OpFind
+		default:
+			kind, subject = OpMatch, filterFor(subject, r)
+		}
+		ops = append(ops, Op{Kind: kind, Subject: subject})
+	}
+	return ops
+}
+
+// filterFor turns a subject into a filter matching it and its neighbours.
+func filterFor(subject []byte, r *rand.Rand) []byte {
+	var starts []int
+	for i := range subject {
+		if i == 0 || subject[i-1] == '.' {
+			starts = append(starts, i)
+		}
+	}
+	ti := r.IntN(len(starts))
+	start, end := starts[ti], len(subject)
+	if ti+1 < len(starts) {
+		end = starts[ti+1] - 1
+	}
+	filter := append([]byte(nil), subject[:start]...)
+	// Only a tail can be replaced by a full wildcard.
+	if ti > 0 && r.IntN(2) == 0 {
+		return append(filter, '>')
+	}
+	filter = append(filter, '*')
+	return append(filter, subject[end:]...)
+}
+
+// Replay runs the operations against the tree, inserting value for every OpInsert.
+// Returns the number of Finds and the number of Match results that found something, which benchmarks can
+// report or sink so the work is not optimized away.
+func Replay[T any](st *subtree.SubjectTree[T], ops []Op, value T) (found, matched int) {
+	for _, op := range ops {
+		switch op.Kind {
+		case OpInsert:
+			st.Insert(op.Subject, value)
+		case OpDelete:
+			st.Delete(op.Subject)
+		case OpFind:
+			if _, ok := st.Find(op.Subject); ok {
+				found++
+			}
+		case OpMatch:
+			st.MatchValues(op.Subject, func(_ *T) { matched++ })
+		}
+	}
+	return found, matched
+}
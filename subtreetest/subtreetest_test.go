@@ -0,0 +1,117 @@
+package subtreetest
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rskv-p/subtree"
+)
+
+// Test that generated subjects are distinct, deterministic and of the requested shape.
+func TestGenerateSubjects(t *testing.T) {
+	for _, shape := range []Shape{Uniform, Wide, Deep, Zipfian} {
+		subjects := GenerateSubjects(5000, shape)
+		if len(subjects) != 5000 {
+			t.Fatalf("%v: got %d subjects", shape, len(subjects))
+		}
+		seen := make(map[string]bool)
+		for _, subj := range subjects {
+			if seen[string(subj)] {
+				t.Fatalf("%v: duplicate subject %q", shape, subj)
+			}
+			seen[string(subj)] = true
+		}
+		again := GenerateSubjects(5000, shape)
+		for i := range subjects {
+			if !bytes.Equal(subjects[i], again[i]) {
+				t.Fatalf("%v: not deterministic", shape)
+			}
+		}
+		tokens := bytes.Count(subjects[0], []byte(".")) + 1
+		want := map[Shape]int{Uniform: 4, Wide: 2, Deep: 16, Zipfian: 4}[shape]
+		if tokens != want {
+			t.Fatalf("%v: got %d tokens in %q, want %d", shape, tokens, subjects[0], want)
+		}
+	}
+}
+
+// Test that a generated workload replays against a tree with matching filters.
+func TestGenerateWorkload(t *testing.T) {
+	subjects := GenerateSubjects(1000, Uniform)
+	st := subtree.NewSubjectTree[int]()
+	for _, subj := range subjects {
+		st.Insert(subj, 1)
+	}
+	ops := GenerateWorkload(subjects, 10_000, Mix{Find: 8, Match: 2})
+	var finds, matches int
+	for _, op := range ops {
+		switch op.Kind {
+		case OpFind:
+			finds++
+		case OpMatch:
+			matches++
+		default:
+			t.Fatalf("unexpected op %v", op.Kind)
+		}
+	}
+	if finds < 7500 || finds > 8500 || finds+matches != 10_000 {
+		t.Fatalf("unexpected mix: %d finds, %d matches", finds, matches)
+	}
+	found, matched := Replay(st, ops, 1)
+	if found != finds || matched < matches {
+		t.Fatalf("got %d found and %d matched for %d finds and %d matches", found, matched, finds, matches)
+	}
+	if GenerateWorkload(nil, 10, Mix{Find: 1}) != nil || GenerateWorkload(subjects, 10, Mix{}) != nil {
+		t.Fatalf("expected no workload")
+	}
+}
+
+// Test that stress runs pass with different seeds and options, alone and concurrently.
+func TestStress(t *testing.T) {
+	for seed := range uint64(4) {
+		Stress(t, 5000, seed)
+	}
+	Stress(t, 5000, 1, subtree.WithLazyDelete(), subtree.WithCompactThreshold(0.3))
+	Stress(t, 5000, 2, subtree.WithShrinkHysteresis(2), subtree.WithMaxPrefix(3))
+	StressConcurrent(t, 20_000, 3, 4)
+	StressConcurrent(t, 20_000, 4, 4, subtree.WithStripedLocks(8), subtree.WithLazyDelete())
+	StressConcurrent(t, 20_000, 5, 4, subtree.WithWriteBatching(8), subtree.WithReaderGrace(time.Microsecond))
+
+	// The model matches filters token by token.
+	for _, tc := range []struct {
+		filter, subject string
+		match           bool
+	}{
+		{"a.b", "a.b", true},
+		{"a.*", "a.b", true},
+		{"a.*", "a.b.c", false},
+		{"a.>", "a.b.c", true},
+		{"a.>", "a", false},
+		{"*.b", "ab.b", true},
+		{"a.b.c", "a.b", false},
+	} {
+		if filterMatches(tc.filter, tc.subject) != tc.match {
+			t.Fatalf("%q against %q: want %v", tc.filter, tc.subject, tc.match)
+		}
+	}
+}
+
+// Benchmark a read heavy workload on each shape.
+func BenchmarkReplay(b *testing.B) {
+	for _, shape := range []Shape{Uniform, Wide, Deep, Zipfian} {
+		b.Run(fmt.Sprint(shape), func(b *testing.B) {
+			subjects := GenerateSubjects(10_000, shape)
+			st := subtree.NewSubjectTree[int]()
+			for _, subj := range subjects {
+				st.Insert(subj, 1)
+			}
+			ops := GenerateWorkload(subjects, 1000, Mix{Insert: 1, Delete: 1, Find: 90, Match: 8})
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				Replay(st, ops, 1)
+			}
+		})
+	}
+}
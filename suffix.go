@@ -0,0 +1,86 @@
+package subtree
+
+//-------------------
+// Matching by suffix
+//-------------------
+
+// WithSuffixIndex keeps a second tree alongside the primary one holding every subject with its tokens
+// reversed, so MatchSuffix walks only the subjects ending with the given tokens instead of all of them.
+// This costs about another copy of every subject, and an insert into or delete from the second tree for
+// every new or deleted subject. Snapshots and persistent versions have no index, and MatchSuffix on them
+// scans all subjects.
+func WithSuffixIndex() Option {
+	return func(o *options) {
+		o.suffixIndex = true
+	}
+}
+
+// MatchSuffix invokes the callback for every subject ending with the tokens of suffix, including the subject
+// that equals it, e.g. for ".PROPERTY-A" all subjects with PROPERTY-A as their last token. A leading separator
+// is ignored, and `*` tokens match any single token. Suffixes with empty or `>` tokens match nothing.
+// The value pointer and subject have the same semantics as for Match. Subjects are visited in no particular
+// order. Without WithSuffixIndex every subject of the tree is checked.
+func (t *SubjectTree[T]) MatchSuffix(suffix []byte, cb func(subject []byte, val *T)) {
+	if t == nil || cb == nil {
+		return
+	}
+	if len(suffix) > 0 && suffix[0] == tsep {
+		suffix = suffix[1:]
+	}
+	suffix = t.canon(suffix)
+	// A valid filter can only have a `>` as its last token.
+	if ls := len(suffix); !validFilter(suffix) || suffix[ls-1] == fwc && (ls == 1 || suffix[ls-2] == tsep) {
+		return
+	}
+	cb = t.guardMatch(cb)
+	// A subject ends with the suffix if its reversed tokens are the reversed suffix, or start with it.
+	rev := reverseTokens(nil, suffix)
+	tail := append(rev[:len(rev):len(rev)], tsep, fwc)
+	if t.suffixes == nil {
+		var buf []byte
+		t.iterAll(false, func(subject []byte, val *T) bool {
+			buf = reverseTokens(buf[:0], subject)
+			if MatchesSubject(rev, buf) || MatchesSubject(tail, buf) {
+				cb(subject, val)
+			}
+			return true
+		})
+		return
+	}
+	visit := func(reversed []byte, _ *struct{}) {
+		subject := reverseTokens(nil, reversed)
+		if ln := t.findLeaf(subject); ln != nil {
+			cb(subject, &ln.value)
+		}
+	}
+	t.suffixes.Match(rev, visit)
+	t.suffixes.Match(tail, visit)
+}
+
+// suffixLogged updates the suffix index for a modification of the tree.
+func (t *SubjectTree[T]) suffixLogged(op Op, subject []byte) {
+	switch op {
+	case OpInsert:
+		t.suffixes.Insert(reverseTokens(nil, subject), struct{}{})
+	case OpDelete:
+		t.suffixes.Delete(reverseTokens(nil, subject))
+	case OpEmpty:
+		t.suffixes.Empty()
+	}
+}
+
+// reverseTokens appends the tokens of the subject in reverse order to dst.
+func reverseTokens(dst, subject []byte) []byte {
+	for end := len(subject); ; {
+		start := end
+		for start > 0 && subject[start-1] != tsep {
+			start--
+		}
+		dst = append(dst, subject[start:end]...)
+		if start == 0 {
+			return dst
+		}
+		dst = append(dst, tsep)
+		end = start - 1
+	}
+}
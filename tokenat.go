@@ -0,0 +1,120 @@
+package subtree
+
+import "slices"
+
+//-------------------
+// Matching by token position
+//-------------------
+
+// WithTokenIndex keeps an index from the token at each of the given positions, counted from 0, to the
+// subjects having it there, so MatchTokenAt for those positions only visits the matching subjects. Filters
+// like "*.2.*" otherwise have to visit every subject with enough tokens, as the wildcards in front leave
+// nothing to narrow the walk down. The index costs about another copy of every subject for each position,
+// and an update for every new or deleted subject. Like WithSuffixIndex it is not kept by snapshots and
+// persistent versions.
+func WithTokenIndex(positions ...int) Option {
+	return func(o *options) {
+		for _, pos := range positions {
+			if pos < 0 {
+				o.invalid("WithTokenIndex of negative position %d", pos)
+			}
+			if pos >= 0 && !slices.Contains(o.tokenPositions, pos) {
+				o.tokenPositions = append(o.tokenPositions, pos)
+			}
+		}
+	}
+}
+
+// tokenIndex maps the tokens at the indexed positions to the subjects having them there.
+type tokenIndex struct {
+	positions []int
+	subjects  map[tokenAt]map[string]struct{}
+}
+
+// tokenAt is a token at a position of a subject.
+type tokenAt struct {
+	pos   int
+	token string
+}
+
+// newTokenIndex returns an index for the positions, or nil if there are none.
+func newTokenIndex(positions []int) *tokenIndex {
+	if len(positions) == 0 {
+		return nil
+	}
+	return &tokenIndex{positions: positions, subjects: make(map[tokenAt]map[string]struct{})}
+}
+
+// logged updates the index for a modification of the tree.
+func (ti *tokenIndex) logged(op Op, subject []byte) {
+	if op == OpEmpty {
+		clear(ti.subjects)
+		return
+	}
+	if op != OpInsert && op != OpDelete {
+		return
+	}
+	for _, pos := range ti.positions {
+		token, ok := tokenOf(subject, pos)
+		if !ok {
+			continue
+		}
+		key := tokenAt{pos, string(token)}
+		if op == OpDelete {
+			delete(ti.subjects[key], string(subject))
+			if len(ti.subjects[key]) == 0 {
+				delete(ti.subjects, key)
+			}
+			continue
+		}
+		set := ti.subjects[key]
+		if set == nil {
+			set = make(map[string]struct{})
+			ti.subjects[key] = set
+		}
+		set[string(subject)] = struct{}{}
+	}
+}
+
+// tokenOf returns the token at the position of the subject, counted from 0, or false if it has fewer tokens.
+func tokenOf(subject []byte, pos int) ([]byte, bool) {
+	for start, i := 0, 0; start <= len(subject); i++ {
+		end := tokenEnd(subject, start)
+		if i == pos {
+			return subject[start:end], true
+		}
+		start = end + 1
+	}
+	return nil, false
+}
+
+// MatchTokenAt invokes the callback for every subject whose token at the position, counted from 0, is the
+// literal token, the same subjects as matching "*.*.token" and "*.*.token.>" with pos wildcards in front.
+// Positions indexed WithTokenIndex only visit those subjects, others are matched with the wildcards.
+// Tokens that are empty, wildcards or hold a separator match nothing. The value pointer and subject have
+// the same semantics as for Match. Subjects are visited in no particular order.
+func (t *SubjectTree[T]) MatchTokenAt(pos int, token []byte, cb func(subject []byte, val *T)) {
+	if t == nil || cb == nil || pos < 0 {
+		return
+	}
+	token = t.canon(token)
+	if len(token) == 0 || tokenEnd(token, 0) != len(token) || prefixHasWildcard(token) {
+		return
+	}
+	if t.tokens != nil && slices.Contains(t.tokens.positions, pos) {
+		cb = t.guardMatch(cb)
+		for subject := range t.tokens.subjects[tokenAt{pos, string(token)}] {
+			if ln := t.findLeaf([]byte(subject)); ln != nil {
+				cb([]byte(subject), &ln.value)
+			}
+		}
+		return
+	}
+	filter := make([]byte, 0, 2*pos+len(token)+2)
+	for range pos {
+		filter = append(filter, pwc, tsep)
+	}
+	filter = append(filter, token...)
+	t.Match(filter, cb)
+	t.Match(append(filter, tsep, fwc), cb)
+}
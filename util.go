@@ -13,6 +13,8 @@
 
 package subtree
 
+import "unsafe"
+
 // For subject matching.
 const (
 	pwc  = '*'
@@ -55,3 +57,14 @@ func pivot[N position](subject []byte, pos N) byte {
 	}
 	return subject[pos]
 }
+
+// Returns the bytes of a string without copying. The result must never be modified, which holds for
+// all tree operations since the tree copies any part of a subject it retains.
+func stringBytes(s string) []byte {
+	return unsafe.Slice(unsafe.StringData(s), len(s))
+}
+
+// Returns a string sharing the memory of b without copying. The string must not outlive any change to b.
+func bytesString(b []byte) string {
+	return unsafe.String(unsafe.SliceData(b), len(b))
+}
@@ -0,0 +1,138 @@
+package subtree
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+//-------------------
+// Validating the tree structure
+//-------------------
+
+// ErrInvalidTree is returned when the structure of a tree does not hold up, which means a bug corrupted it.
+var ErrInvalidTree = errors.New("subtree: invalid tree structure")
+
+// ErrInvalidSubject is returned by InsertE for subjects the tree can not store.
+var ErrInvalidSubject = errors.New("subtree: invalid subject")
+
+// Validate checks the structure of the tree: the number of children and leaves recorded in every node, that
+// every child sits under the key it starts with, that every entry can be found by its subject and that the
+// size of the tree adds up. Returns nil or an
+// error wrapping ErrInvalidTree describing the first problem found. It visits every node, so it is meant for
+// tests, debugging and checking a tree after recovering from a failure, not for every operation.
+func (t *SubjectTree[T]) Validate() (err error) {
+	// Corrupted nodes can make even looking at them panic.
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrInvalidTree, r)
+		}
+	}()
+	if t == nil {
+		return nil
+	}
+	if t.root == nil {
+		if t.size != 0 || t.dead != 0 {
+			return fmt.Errorf("%w: empty tree with size %d and %d dead", ErrInvalidTree, t.size, t.dead)
+		}
+		t.broken = nil
+		return nil
+	}
+	var live, dead int
+	if err := t.validate(t.root, nil, &live, &dead); err != nil {
+		return err
+	}
+	if live != t.size || dead != t.dead {
+		return fmt.Errorf("%w: size %d with %d dead, but found %d live and %d dead leaves", ErrInvalidTree, t.size, t.dead, live, dead)
+	}
+	t.broken = nil
+	return nil
+}
+
+// Internal recursive function for Validate, counting the live and dead leaves below n.
+func (t *SubjectTree[T]) validate(n node, pre []byte, live, dead *int) error {
+	pre = append(pre, n.path()...)
+	if n.isLeaf() {
+		ln, ok := n.(*leaf[T])
+		if !ok {
+			return fmt.Errorf("%w: leaf of another type at %q", ErrInvalidTree, pre)
+		}
+		if ln.dead() {
+			*dead++
+			return nil
+		}
+		if t.findLeaf(pre) != ln {
+			return fmt.Errorf("%w: leaf for %q can not be found", ErrInvalidTree, pre)
+		}
+		*live++
+		return nil
+	}
+	if bytes.IndexByte(n.path(), noPivot) >= 0 {
+		return fmt.Errorf("%w: prefix of %s at %q holds the no pivot byte", ErrInvalidTree, n.kind(), pre)
+	}
+	var count int
+	var leaves uint32
+	for c := 0; c < 256; c++ {
+		cn := n.findChild(byte(c))
+		if cn == nil {
+			continue
+		}
+		if *cn == nil {
+			return fmt.Errorf("%w: %s at %q has an empty child for %q", ErrInvalidTree, n.kind(), pre, byte(c))
+		}
+		if p := pivot((*cn).path(), 0); p != byte(c) {
+			return fmt.Errorf("%w: %s at %q has a child starting with %q under %q", ErrInvalidTree, n.kind(), pre, p, byte(c))
+		}
+		if err := t.validate(*cn, pre, live, dead); err != nil {
+			return err
+		}
+		count++
+		leaves += leafCount(*cn)
+	}
+	if nc := int(n.numChildren()); nc != count || count == 0 || count > capacity(n) {
+		return fmt.Errorf("%w: %s at %q records %d children, but has %d", ErrInvalidTree, n.kind(), pre, nc, count)
+	}
+	if bl := n.base().leaves; bl != leaves {
+		return fmt.Errorf("%w: %s at %q records %d leaves, but has %d", ErrInvalidTree, n.kind(), pre, bl, leaves)
+	}
+	return nil
+}
+
+// capacity returns the number of children a node of the kind of n can hold.
+func capacity(n node) int {
+	switch n.(type) {
+	case *node4:
+		return 4
+	case *node10:
+		return 10
+	case *node16:
+		return 16
+	case *node48:
+		return 48
+	}
+	return 256
+}
+
+// InsertE is like Insert but returns an error instead of ignoring subjects the tree can not store, and
+// instead of panicking if the insert runs into a corrupted tree. In the latter case the tree may have been
+// partially modified and should be checked with Validate before it is used again. With WithRecover the
+// error is also kept, see Err.
+func (t *SubjectTree[T]) InsertE(subject []byte, value T) (old *T, updated bool, err error) {
+	if t == nil {
+		return nil, false, nil
+	}
+	if bytes.IndexByte(subject, noPivot) >= 0 {
+		return nil, false, fmt.Errorf("%w: %q holds the no pivot byte", ErrInvalidSubject, subject)
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			old, updated, err = nil, false, fmt.Errorf("%w: insert of %q: %v", ErrInvalidTree, subject, r)
+		}
+	}()
+	before := t.broken
+	old, updated = t.Insert(subject, value)
+	if t.broken != before {
+		return nil, false, t.broken
+	}
+	return old, updated, nil
+}
@@ -0,0 +1,119 @@
+package subtree
+
+import "errors"
+
+//-------------------
+// Versions and read views
+//-------------------
+
+// ErrVersionNotRetained is returned when asking for a version that is no longer, or was never, retained.
+var ErrVersionNotRetained = errors.New("subtree: version not retained")
+
+// treeVersion is a historical root of the tree. Its nodes are shared and never modified.
+type treeVersion struct {
+	root    node
+	size    int
+	version uint64
+}
+
+// ReadView is a read only view of the tree at a given version. It is not affected by any later
+// modification of the tree it came from and can be read from other goroutines while the tree is being written.
+// Values handed out by a ReadView are shared with the tree and must not be modified.
+type ReadView[T any] struct {
+	t       SubjectTree[T]
+	version uint64
+}
+
+// Version returns the current version of the tree, which is incremented on every modification.
+func (t *SubjectTree[T]) Version() uint64 {
+	if t == nil {
+		return 0
+	}
+	return t.version
+}
+
+// SetVersionRetention sets the number of historical versions that will be kept available to AtVersion.
+// A value of 0, the default, disables retention. When enabled every modification copies the nodes on its path,
+// and value pointers returned before a modification may no longer reflect the value stored in the tree.
+func (t *SubjectTree[T]) SetVersionRetention(n int) {
+	if t == nil {
+		return
+	}
+	t.retain = max(n, 0)
+	if len(t.history) > t.retain {
+		t.history = append(t.history[:0], t.history[len(t.history)-t.retain:]...)
+	}
+}
+
+// AtVersion returns a read view of the tree at the given version.
+// The current version is always available, older versions only if they are still retained.
+func (t *SubjectTree[T]) AtVersion(v uint64) (*ReadView[T], error) {
+	if t == nil {
+		return nil, ErrVersionNotRetained
+	}
+	if v == t.version {
+		return t.Snapshot(), nil
+	}
+	for _, tv := range t.history {
+		if tv.version == v {
+			return newReadView[T](tv, &t.opts), nil
+		}
+	}
+	return nil, ErrVersionNotRetained
+}
+
+// Snapshot returns a read view of the current version of the tree.
+// The tree will copy nodes on future modifications so the view is never affected by them.
+func (t *SubjectTree[T]) Snapshot() *ReadView[T] {
+	if t == nil {
+		return &ReadView[T]{}
+	}
+	t.share()
+	return newReadView[T](treeVersion{t.root, t.size, t.version}, &t.opts)
+}
+
+// beforeModify will retain the current version if needed. Must be called before any modification.
+func (t *SubjectTree[T]) beforeModify() {
+	if t.retain == 0 {
+		return
+	}
+	if len(t.history) >= t.retain {
+		copy(t.history, t.history[1:])
+		t.history = t.history[:len(t.history)-1]
+	}
+	t.history = append(t.history, treeVersion{t.root, t.size, t.version})
+	// Move to a new generation so the retained root will not be modified.
+	t.share()
+}
+
+// newReadView creates a read view for a given version, of a tree with the given options.
+func newReadView[T any](tv treeVersion, o *options) *ReadView[T] {
+	return &ReadView[T]{t: SubjectTree[T]{root: tv.root, size: tv.size, version: tv.version, opts: o.viewOptions()}, version: tv.version}
+}
+
+// viewOptions returns the settings a read view of a tree with these options works with, which spell subjects
+// and filters the way the tree holds them. Hooks are left out, as reading a view is not a call on the tree.
+func (o *options) viewOptions() options {
+	return options{fold: o.fold, rewrites: o.rewrites, stable: o.stable, maxPrefix: o.maxPrefix}
+}
+
+// Version returns the version of the tree this view is reading.
+func (v *ReadView[T]) Version() uint64 { return v.version }
+
+// Size returns the number of elements stored in this version.
+func (v *ReadView[T]) Size() int { return v.t.size }
+
+// Find will find the value and return it or false if it was not found.
+func (v *ReadView[T]) Find(subject []byte) (*T, bool) { return v.t.Find(subject) }
+
+// Match will match against a subject that can have wildcards and invoke the callback func for each matched value.
+func (v *ReadView[T]) Match(filter []byte, cb func(subject []byte, val *T)) { v.t.Match(filter, cb) }
+
+// MatchValues is like Match but does not reconstruct the matched subjects.
+func (v *ReadView[T]) MatchValues(filter []byte, cb func(val *T)) { v.t.MatchValues(filter, cb) }
+
+// IterOrdered will walk all entries lexographically. The callback can return false to terminate the walk.
+func (v *ReadView[T]) IterOrdered(cb func(subject []byte, val *T) bool) { v.t.IterOrdered(cb) }
+
+// IterFast will walk all entries with no guarantees of ordering. The callback can return false to terminate the walk.
+func (v *ReadView[T]) IterFast(cb func(subject []byte, val *T) bool) { v.t.IterFast(cb) }
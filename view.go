@@ -0,0 +1,114 @@
+package subtree
+
+import "fmt"
+
+//-------------------
+// Prefix scoped views
+//-------------------
+
+// TreeView is a handle to the part of a tree below a literal prefix. Subjects and filters used with a view
+// are relative to the prefix, which is prepended on the way in and stripped on the way out, and there is
+// no way to reach subjects outside of it. It can be handed to code that should only see its own part of a
+// shared tree, e.g. a tenant. A view has the same synchronization requirements as the tree it came from.
+type TreeView[T any] struct {
+	t      *SubjectTree[T]
+	prefix []byte // The prefix including its trailing separator
+}
+
+// View returns a view of the subjects starting with the literal tokens of prefix. The subject "foo" in the
+// view of "tenant.a" is "tenant.a.foo" in the tree. Panics if the prefix is empty, has empty tokens or has
+// wildcard tokens, since those could not be kept apart from other parts of the tree. The prefix is folded
+// and rewritten like a subject.
+func (t *SubjectTree[T]) View(prefix []byte) *TreeView[T] {
+	prefix = t.canon(prefix)
+	if n := len(prefix); n > 0 && prefix[n-1] == tsep {
+		prefix = prefix[:n-1]
+	}
+	if !validFilter(prefix) || prefixHasWildcard(prefix) {
+		panic(fmt.Sprintf("subtree: invalid view prefix %q", prefix))
+	}
+	return &TreeView[T]{t: t, prefix: append(copyBytes(prefix), tsep)}
+}
+
+// prefixHasWildcard returns true if any token of the subject is a wildcard.
+func prefixHasWildcard(subject []byte) bool {
+	for start := 0; start < len(subject); {
+		end := tokenEnd(subject, start)
+		if end-start == 1 && (subject[start] == pwc || subject[start] == fwc) {
+			return true
+		}
+		start = end + 1
+	}
+	return false
+}
+
+// Prefix returns the prefix of the view, without the trailing separator.
+func (v *TreeView[T]) Prefix() []byte {
+	n := len(v.prefix) - 1
+	return v.prefix[:n:n]
+}
+
+// key returns the subject in the tree for a subject relative to the view, using buf if large enough.
+func (v *TreeView[T]) key(buf []byte, subject []byte) []byte {
+	return append(append(buf[:0], v.prefix...), subject...)
+}
+
+// Size returns the number of subjects in the view.
+func (v *TreeView[T]) Size() int {
+	n := v.t.prefixNode(v.prefix)
+	if n == nil {
+		return 0
+	}
+	return int(leafCount(n))
+}
+
+// Insert inserts the value for the relative subject, like SubjectTree.Insert. An empty subject is ignored.
+func (v *TreeView[T]) Insert(subject []byte, value T) (*T, bool) {
+	if len(subject) == 0 {
+		return nil, false
+	}
+	var buf [128]byte
+	return v.t.Insert(v.key(buf[:0], subject), value)
+}
+
+// Find finds the value of the relative subject, like SubjectTree.Find.
+func (v *TreeView[T]) Find(subject []byte) (*T, bool) {
+	if len(subject) == 0 {
+		return nil, false
+	}
+	var buf [128]byte
+	return v.t.Find(v.key(buf[:0], subject))
+}
+
+// Delete deletes the relative subject, like SubjectTree.Delete.
+func (v *TreeView[T]) Delete(subject []byte) (*T, bool) {
+	if len(subject) == 0 {
+		return nil, false
+	}
+	var buf [128]byte
+	return v.t.Delete(v.key(buf[:0], subject))
+}
+
+// Match matches the relative filter against the subjects in the view, like SubjectTree.Match.
+// The callback receives relative subjects.
+func (v *TreeView[T]) Match(filter []byte, cb func(subject []byte, val *T)) {
+	if len(filter) == 0 || cb == nil {
+		return
+	}
+	var buf [128]byte
+	v.t.Match(v.key(buf[:0], filter), func(subject []byte, val *T) {
+		cb(subject[len(v.prefix):], val)
+	})
+}
+
+// IterOrdered walks all subjects in the view in order, like SubjectTree.IterOrdered.
+// The callback receives relative subjects and can return false to stop.
+func (v *TreeView[T]) IterOrdered(cb func(subject []byte, val *T) bool) {
+	if cb == nil {
+		return
+	}
+	var buf [128]byte
+	v.t.IterOrderedMatched(v.key(buf[:0], fwcFilter), func(subject []byte, val *T) bool {
+		return cb(subject[len(v.prefix):], val)
+	})
+}
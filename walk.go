@@ -0,0 +1,119 @@
+package subtree
+
+import "errors"
+
+//-------------------
+// Walking internal nodes
+//-------------------
+
+// ErrStaleHandle is returned when using a node handle from another tree, or after the tree was modified.
+var ErrStaleHandle = errors.New("subtree: stale node handle")
+
+// NodeInfo describes an internal node of the tree as seen by WalkNodes.
+// The byte slices are only valid for the duration of the callback and must not be modified.
+type NodeInfo struct {
+	Kind     string // The kind of node, e.g. NODE4 or NODE256
+	Prefix   []byte // The prefix stored in this node
+	Path     []byte // The full subject prefix leading to and including this node's prefix
+	Depth    int    // The depth of the node, with the root at 0
+	Children int    // The number of direct children
+	Leaves   int    // The number of leaves in the subtree below this node
+
+	n       node   // The node itself, for Handle
+	tree    any    // The tree walked
+	version uint64 // The version of the tree walked
+	shape   uint64 // The shape of the tree walked
+}
+
+// NodeHandle is an opaque reference to an internal node visited by WalkNodes, to iterate the leaves below
+// it with IterNode later on. A handle is only valid until the tree it came from is modified or compacted.
+type NodeHandle struct {
+	n       node
+	path    []byte // The subject prefix leading to the node, not including its own prefix
+	tree    any
+	version uint64
+	shape   uint64
+}
+
+// Handle returns a handle to the node, which stays valid after the callback returns.
+func (ni NodeInfo) Handle() NodeHandle {
+	path := ni.Path[:len(ni.Path)-len(ni.Prefix)]
+	return NodeHandle{n: ni.n, path: copyBytes(path), tree: ni.tree, version: ni.version, shape: ni.shape}
+}
+
+// WalkNodes walks all internal nodes of the tree in subject order, parents before their children.
+// Leaves are not reported, but are counted in their parents. The callback can return false to terminate the walk.
+func (t *SubjectTree[T]) WalkNodes(cb func(info NodeInfo) bool) {
+	if t == nil || t.root == nil || cb == nil {
+		return
+	}
+	var _pre [256]byte
+	t.walkNodes(t.root, _pre[:0], 0, cb)
+}
+
+// Internal function to recursively walk the internal nodes.
+func (t *SubjectTree[T]) walkNodes(n node, pre []byte, depth int, cb func(info NodeInfo) bool) bool {
+	if n.isLeaf() {
+		return true
+	}
+	bn := n.base()
+	pre = append(pre, bn.prefix...)
+	info := NodeInfo{
+		Kind:     n.kind(),
+		Prefix:   bn.prefix,
+		Path:     pre,
+		Depth:    depth,
+		Children: int(n.numChildren()),
+		Leaves:   int(bn.leaves),
+		n:        n,
+		tree:     t,
+		version:  t.version,
+		shape:    t.shape,
+	}
+	if !cb(info) {
+		return false
+	}
+	var _nodes [256]node
+	for _, cn := range sortedChildren(n, _nodes[:0]) {
+		if !t.walkNodes(cn, pre, depth+1, cb) {
+			return false
+		}
+	}
+	return true
+}
+
+// IterNode walks the entries below the node of a handle from WalkNodes in subject order, stopping when the
+// callback returns false. Returns ErrStaleHandle if the handle is not from this tree, or the tree was
+// modified or compacted since the handle was taken. The subject passed to the callback is only valid for the duration
+// of the callback.
+func (t *SubjectTree[T]) IterNode(h NodeHandle, cb func(subject []byte, val *T) bool) error {
+	if t == nil || h.n == nil || h.tree != any(t) || t.reshaped(h.version, h.shape) {
+		return ErrStaleHandle
+	}
+	if cb == nil {
+		return nil
+	}
+	pre := preBufs.Get().(*[256]byte)
+	defer preBufs.Put(pre)
+	t.iter(h.n, append(pre[:0], h.path...), true, t.guardIter(cb))
+	return nil
+}
+
+// sortedChildren appends the children of n to nodes in lexicographical order and returns the result.
+// This switches on the kind instead of going through the node interface, so that nodes does not escape
+// and callers can keep it on the stack.
+func sortedChildren(n node, nodes []node) []node {
+	switch n := n.(type) {
+	case *node4:
+		return n.appendChildren(nodes)
+	case *node10:
+		return n.appendChildren(nodes)
+	case *node16:
+		return n.appendChildren(nodes)
+	case *node48:
+		return n.appendChildren(nodes)
+	case *node256:
+		return n.appendChildren(nodes)
+	}
+	return nodes
+}
@@ -0,0 +1,107 @@
+package subtree
+
+import (
+	"runtime"
+	"sync"
+	"weak"
+)
+
+//-------------------
+// Weak entries
+//-------------------
+
+// WeakSubjectTree indexes values owned elsewhere by subject without keeping them alive. The tree only holds
+// weak pointers, and once the garbage collector has reclaimed a value its entry is evicted, so resources that
+// are dropped by their owners do not linger in the index until someone remembers to delete them.
+// Entries whose values were reclaimed are never handed out. They are removed from the tree by the next call
+// changing or reading it, or by Sweep, as the garbage collector only queues them.
+// A WeakSubjectTree is not safe for concurrent use.
+type WeakSubjectTree[T any] struct {
+	t       *SubjectTree[weak.Pointer[T]]
+	mu      sync.Mutex // Guards pending, which the garbage collector appends to from other goroutines
+	pending []string   // Subjects whose values were reclaimed
+}
+
+// NewWeakSubjectTree creates a new WeakSubjectTree with values T. The options configure the underlying tree.
+func NewWeakSubjectTree[T any](opts ...Option) *WeakSubjectTree[T] {
+	return &WeakSubjectTree[T]{t: NewSubjectTree[weak.Pointer[T]](opts...)}
+}
+
+// Size returns the number of elements stored, after evicting the entries reclaimed so far.
+func (w *WeakSubjectTree[T]) Size() int {
+	w.Sweep()
+	return w.t.Size()
+}
+
+// Insert a weak pointer to the value into the tree. Will return if the subject was already present, with a
+// value that was not reclaimed yet. A nil value is not inserted.
+func (w *WeakSubjectTree[T]) Insert(subject []byte, value *T) bool {
+	if value == nil {
+		return false
+	}
+	w.Sweep()
+	old, updated := w.t.Insert(subject, weak.Make(value))
+	runtime.AddCleanup(value, w.reclaimed, string(subject))
+	return updated && old.Value() != nil
+}
+
+// Find will find the value and return it, or false if it was not found or has been reclaimed.
+func (w *WeakSubjectTree[T]) Find(subject []byte) (*T, bool) {
+	w.Sweep()
+	wp, ok := w.t.Find(subject)
+	if !ok {
+		return nil, false
+	}
+	v := wp.Value()
+	return v, v != nil
+}
+
+// Delete will delete the item and return its value, or not found if it did not exist or has been reclaimed.
+func (w *WeakSubjectTree[T]) Delete(subject []byte) (*T, bool) {
+	w.Sweep()
+	wp, ok := w.t.Delete(subject)
+	if !ok {
+		return nil, false
+	}
+	v := wp.Value()
+	return v, v != nil
+}
+
+// Match will match against a subject that can have wildcards and invoke the callback func for each matched
+// value that has not been reclaimed. The subject is only valid for the duration of the callback.
+func (w *WeakSubjectTree[T]) Match(filter []byte, cb func(subject []byte, val *T)) {
+	if cb == nil {
+		return
+	}
+	w.Sweep()
+	w.t.Match(filter, func(subject []byte, wp *weak.Pointer[T]) {
+		if v := wp.Value(); v != nil {
+			cb(subject, v)
+		}
+	})
+}
+
+// Sweep evicts the entries whose values the garbage collector has reclaimed so far, and returns how many.
+func (w *WeakSubjectTree[T]) Sweep() int {
+	w.mu.Lock()
+	pending := w.pending
+	w.pending = nil
+	w.mu.Unlock()
+	var n int
+	for _, subject := range pending {
+		// The subject may have been given a new value since, which has to stay.
+		if wp, ok := w.t.Find([]byte(subject)); ok && wp.Value() == nil {
+			w.t.Delete([]byte(subject))
+			n++
+		}
+	}
+	return n
+}
+
+// reclaimed queues the subject of a value the garbage collector has reclaimed. It runs on a goroutine of
+// the runtime.
+func (w *WeakSubjectTree[T]) reclaimed(subject string) {
+	w.mu.Lock()
+	w.pending = append(w.pending, subject)
+	w.mu.Unlock()
+}